@@ -2,8 +2,8 @@ package annbench
 
 import (
 	"context"
+	"errors"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	cl "lsh-search-service/client"
 	cm "lsh-search-service/common"
 	"lsh-search-service/db"
@@ -73,7 +73,68 @@ func (benchClient *BenchClient) Validate(thrshs []float64) ([]float64, error) {
 	return metrics, nil
 }
 
-// Populate put vectors into search index
+// LatencyStats holds the query latency distribution
+type LatencyStats struct {
+	Mean time.Duration
+	P50  time.Duration
+	P99  time.Duration
+}
+
+// MeasureLatency queries the service with every test vector and returns latency stats
+func (benchClient *BenchClient) MeasureLatency() (LatencyStats, error) {
+	results, err := db.GetDbRecords(benchClient.TestCollection, db.FindQuery{Proj: bson.M{"featureVec": 1}})
+	if err != nil {
+		return LatencyStats{}, err
+	}
+	if len(results) == 0 {
+		return LatencyStats{}, nil
+	}
+	latencies := make([]time.Duration, len(results))
+	var total time.Duration
+	for i, result := range results {
+		start := time.Now()
+		_, err := benchClient.Client.GetNeighbors(result.FeatureVec)
+		if err != nil {
+			return LatencyStats{}, err
+		}
+		latencies[i] = time.Since(start)
+		total += latencies[i]
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return LatencyStats{
+		Mean: total / time.Duration(len(latencies)),
+		P50:  latencies[len(latencies)/2],
+		P99:  latencies[len(latencies)*99/100],
+	}, nil
+}
+
+// GetIndexStorageSize returns disk size of the active hash collection with its indexes,
+// posting lists collection is included if the inverted layout is used
+func (benchClient *BenchClient) GetIndexStorageSize() (int64, error) {
+	helperRecord, err := benchClient.Mongo.GetHelperRecord(false)
+	if err != nil {
+		return 0, err
+	}
+	size, err := benchClient.Mongo.GetStorageSize(helperRecord.HashCollName)
+	if err != nil {
+		return 0, err
+	}
+	postingsCollName := db.GetPostingsCollName(helperRecord.HashCollName)
+	postingsExist, err := benchClient.Mongo.CheckCollection(postingsCollName)
+	if err != nil || !postingsExist {
+		return size, err
+	}
+	postingsSize, err := benchClient.Mongo.GetStorageSize(postingsCollName)
+	if err != nil {
+		return 0, err
+	}
+	return size + postingsSize, nil
+}
+
+// PopulateDataset builds the index with the dataset stats and puts the vectors into it;
+// the build runs in background, so the vectors are put only once it's done, every vector exactly once
 func (benchClient *BenchClient) PopulateDataset(batchSize int, dataCollName string) error {
 	dataColl := benchClient.Mongo.GetCollection(dataCollName)
 	convMean, convStd, err := db.GetAggregatedStats(dataColl)
@@ -81,39 +142,67 @@ func (benchClient *BenchClient) PopulateDataset(batchSize int, dataCollName stri
 		return err
 	}
 
-	benchClient.Logger.Info.Println(convMean) // DEBUG - check for not being [0]
-	benchClient.Logger.Info.Println(convStd)  // DEBUG - check for not being [0]
-
-	benchClient.Client.BuildHasher(convMean, convStd)
+	err = benchClient.Client.BuildHasher(convMean, convStd)
+	if err != nil {
+		return err
+	}
+	err = benchClient.waitBuild()
+	if err != nil {
+		return err
+	}
 
 	cursor, err := dataColl.GetCursor(db.FindQuery{})
-	for cursor.Next(context.Background()) {
-		err = benchClient.putBatch(cursor, batchSize)
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return err
 	}
-	return nil
-}
-
-// putBatch accumulates db documents in a batch of desired length and calculates hashes
-func (benchClient *BenchClient) putBatch(cursor *mongo.Cursor, batchSize int) error {
-	batch := make([]cm.RequestData, batchSize)
-	batchID := 0
+	defer cursor.Close(context.Background())
+	batch := make([]cm.RequestData, 0, batchSize)
 	for cursor.Next(context.Background()) {
 		var record db.VectorRecord
 		if err := cursor.Decode(&record); err != nil {
 			continue
 		}
-		batch[batchID] = cm.RequestData{
+		batch = append(batch, cm.RequestData{
 			SecondaryID: record.SecondaryID,
 			Vec:         record.FeatureVec,
+		})
+		if len(batch) < batchSize {
+			continue
 		}
-		batchID++
+		err = benchClient.Client.PutHashes(batch)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
 	}
-	err := benchClient.Client.PutHashes(batch[:batchID])
-	if err != nil {
-		return err
+	if len(batch) == 0 {
+		return nil
+	}
+	return benchClient.Client.PutHashes(batch)
+}
+
+// NOTE: the build of the large dataset takes a while, but the benchmark must not hang forever
+const buildWaitTimeout = 2 * time.Hour
+
+// waitBuild polls the build status until the build is done; the failed or cancelled build
+// is reported as the unknown status with the message
+func (benchClient *BenchClient) waitBuild() error {
+	deadline := time.Now().Add(buildWaitTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := benchClient.Client.CheckBuildStatus()
+		if err != nil {
+			return err
+		}
+		status, _ := resp.Results.(float64)
+		switch int(status) {
+		case cm.BuildStatusDone:
+			return nil
+		case cm.BuildStatusUnknown:
+			if len(resp.Message) != 0 {
+				return errors.New("Populating dataset: " + resp.Message)
+			}
+		}
+		time.Sleep(time.Second)
 	}
-	return nil
+	return errors.New("Populating dataset: build has not been done in " + buildWaitTimeout.String())
 }
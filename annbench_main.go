@@ -18,14 +18,19 @@ var (
 	batchSize, _       = strconv.Atoi(os.Getenv("BATCH_SIZE"))
 	dataCollectionName = os.Getenv("DATA_COLLECTION_NAME")
 	testCollectionName = os.Getenv("TEST_COLLECTION_NAME")
+	helperCollName     = os.Getenv("HELPER_COLLECTION_NAME")
+	hashLayout         = os.Getenv("HASH_LAYOUT")
+	indexType          = os.Getenv("INDEX_TYPE")
 )
 
 func main() {
 	logger := cm.GetNewLogger()
 	mongodb, err := db.New(
 		db.Config{
-			DbLocation: dbLocation,
-			DbName:     dbName,
+			DbLocation:           dbLocation,
+			DbName:               dbName,
+			HelperCollectionName: helperCollName,
+			HashLayout:           hashLayout,
 		},
 	)
 	if err != nil {
@@ -68,4 +73,16 @@ func main() {
 		logger.Err.Fatal(err)
 	}
 	logger.Info.Println(result)
+
+	// NOTE: run the bench against the services with different INDEX_TYPE or HASH_LAYOUT to compare them
+	latency, err := benchClient.MeasureLatency()
+	if err != nil {
+		logger.Err.Fatal(err)
+	}
+	storageSize, err := benchClient.GetIndexStorageSize()
+	if err != nil {
+		logger.Err.Fatal(err)
+	}
+	logger.Info.Printf("Index type: %v; Layout: %v; Latency mean: %v; p50: %v; p99: %v; Index storage size: %v bytes",
+		indexType, hashLayout, latency.Mean, latency.P50, latency.P99, storageSize)
 }
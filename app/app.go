@@ -1,7 +1,9 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	cm "lsh-search-service/common"
@@ -12,7 +14,13 @@ import (
 )
 
 var (
-	helloMessage = getHelloMessage()
+	helloMessage       = getHelloMessage()
+	errBuildInProgress = errors.New("Building index: aborting - previous build is not done yet")
+	errBuildLeaseLost  = errors.New("Building index: aborting - build lease has been taken over")
+	// NOTE: storage computes distances only over the full precision vectors
+	errDbDistanceQuantized = errors.New("Get NN: db distance mode can't be used with the quantized vectors")
+	errIndexNotReady       = errors.New("Get NN: there is no index yet and the source collection is too large for the exact scan")
+	errGraphReadOnly       = errors.New("HNSW index is written only by the replica with GRAPH_WRITER=1")
 )
 
 // HealthCheck just checks that server is up and running;
@@ -41,24 +49,40 @@ func (annServer *ANNServer) BuildHasherHandler(w http.ResponseWriter, r *http.Re
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if annServer.isBuildLeaseHeld() {
+			annServer.Logger.Err.Println("Build hasher: " + errBuildInProgress.Error())
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		ctx, err := annServer.startBuild()
 		if err != nil {
 			annServer.Logger.Err.Println("Build hasher: " + err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusConflict)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 
 		go func() {
-			err := annServer.BuildIndex(input)
-			if err != nil {
-				annServer.UpdateBuildStatus(
-					db.HelperRecord{
-						IsBuildDone:   false,
-						BuildError:    err.Error(),
-						LastBuildTime: time.Now().UnixNano(),
-					},
-				)
+			defer annServer.finishBuild()
+			err := annServer.BuildIndex(ctx, input)
+			if err == nil {
+				return
+			}
+			if errors.Is(err, context.Canceled) {
+				annServer.Logger.Info.Println("Build hasher: build has been cancelled")
+				return
+			}
+			annServer.Logger.Err.Println("Build hasher: " + err.Error())
+			if err == errBuildInProgress || err == errBuildLeaseLost {
+				return
 			}
+			annServer.Store.UpdateBuildStatus(
+				db.HelperRecord{
+					IsBuildDone:   false,
+					BuildError:    err.Error(),
+					LastBuildTime: time.Now().UnixNano(),
+				},
+			)
 		}()
 	default:
 		w.WriteHeader(http.StatusNotImplemented)
@@ -70,17 +94,24 @@ func (annServer *ANNServer) BuildHasherHandler(w http.ResponseWriter, r *http.Re
 func (annServer *ANNServer) CheckBuildHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	resp := cm.ResponseData{Results: cm.BuildStatusUnknown}
-	helperRecord, err := annServer.GetHelperRecord(false)
+	helperRecord, err := annServer.Store.GetHelperRecord(false)
 	if err != nil {
 		annServer.Logger.Err.Println("Checking build status: " + err.Error())
 		resp.Results = cm.BuildStatusError
 		resp.Message = err.Error()
 		w.WriteHeader(http.StatusInternalServerError)
 	} else {
-		if !helperRecord.IsBuildDone && len(helperRecord.BuildError) == 0 {
+		progress := helperRecord.BuildProgress
+		resp.Progress = &progress
+		if helperRecord.BuildProgress.Phase == cm.BuildPhaseCancelled && !helperRecord.IsBuildDone && len(helperRecord.BuildError) == 0 {
+			resp.Message = "Build has been cancelled"
+		} else if !helperRecord.IsBuildDone && len(helperRecord.BuildError) == 0 {
 			resp.Results = cm.BuildStatusInProgress
 		} else if helperRecord.IsBuildDone && len(helperRecord.BuildError) == 0 {
 			resp.Results = cm.BuildStatusDone
+			if helperRecord.BuildProgress.Phase == cm.BuildPhaseCancelled {
+				resp.Message = "Latest build has been cancelled, previous index is active"
+			}
 		} else if len(helperRecord.BuildError) > 0 {
 			resp.Message = fmt.Sprintf("Build error: %s", helperRecord.BuildError)
 		}
@@ -90,6 +121,139 @@ func (annServer *ANNServer) CheckBuildHandler(w http.ResponseWriter, r *http.Req
 	w.Write(jsonResp)
 }
 
+// ComputeStatsHandler computes the dataset stats on the server side
+// curl -v -X POST -H "Content-Type: application/json" -d '{"source":"collection","mode":"exact"}' http://localhost:8080/compute-stats
+func (annServer *ANNServer) ComputeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			annServer.Logger.Err.Println("Compute stats: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input cm.StatsOptions
+		if len(body) > 0 {
+			err = json.Unmarshal(body, &input)
+			if err != nil {
+				annServer.Logger.Err.Println("Compute stats: " + err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		stats, err := annServer.ComputeDatasetStats(r.Context(), input, nil)
+		if err != nil {
+			annServer.Logger.Err.Println("Compute stats: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: stats})
+		if err != nil {
+			annServer.Logger.Err.Println("Compute stats: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// CheckDriftHandler returns the drift report, pass `imbalance=1` to also compute the bucket imbalance
+// curl -v http://localhost:8080/check-drift?imbalance=1
+func (annServer *ANNServer) CheckDriftHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		withImbalance := r.URL.Query().Get("imbalance") == "1"
+		report, err := annServer.GetDriftReport(withImbalance)
+		if err != nil {
+			annServer.Logger.Err.Println("Check drift: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: report})
+		if err != nil {
+			annServer.Logger.Err.Println("Check drift: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// BucketsStatsHandler returns buckets occupancy stats of the every hash table
+// curl -v http://localhost:8080/buckets-stats?top=10
+func (annServer *ANNServer) BucketsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		topN := 10
+		if top := r.URL.Query().Get("top"); len(top) != 0 {
+			val, err := strconv.Atoi(top)
+			if err != nil || val <= 0 {
+				annServer.Logger.Err.Println("Buckets stats: top must be a positive integer")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			topN = val
+		}
+		stats, err := annServer.GetBucketsStats(topN)
+		if err != nil {
+			annServer.Logger.Err.Println("Buckets stats: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: stats})
+		if err != nil {
+			annServer.Logger.Err.Println("Buckets stats: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// CancelBuildHandler stops the build started by this instance; the previous index stays active.
+// The build of another instance is cancelled through its build lease, which is reported by 202,
+// since the owner sees the request only with its next renew
+func (annServer *ANNServer) CancelBuildHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET", "POST":
+		if annServer.CancelBuild() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		isRequested, err := annServer.requestBuildCancel()
+		if err != nil {
+			annServer.Logger.Err.Println("Cancel build: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !isRequested {
+			annServer.Logger.Warn.Println("Cancel build: no running build found")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
 // GetHashCollSizeHandler checks the hashCollection size, returns `0` if it doesnt exist
 func (annServer *ANNServer) GetHashCollSizeHandler(w http.ResponseWriter, r *http.Request) {
 	size, err := annServer.GetHashCollSize()
@@ -104,6 +268,53 @@ func (annServer *ANNServer) GetHashCollSizeHandler(w http.ResponseWriter, r *htt
 	w.WriteHeader(http.StatusOK)
 }
 
+// MetricsHandler returns the counters of the service instance, like hit rates of the query caches
+// curl -v http://localhost:8080/metrics
+func (annServer *ANNServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: annServer.GetMetrics()})
+		if err != nil {
+			annServer.Logger.Err.Println("Metrics: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// ShardsHealthHandler returns the health of every shard of the index, unhealthy shards make the status 503
+func (annServer *ANNServer) ShardsHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		health := annServer.GetShardsHealth()
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: health})
+		if err != nil {
+			annServer.Logger.Err.Println("Shards health: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		status := http.StatusOK
+		for _, shard := range health {
+			if !shard.Healthy {
+				annServer.Logger.Warn.Printf("Shards health: %s: %s", shard.Shard, shard.Error)
+				status = http.StatusServiceUnavailable
+			}
+		}
+		w.WriteHeader(status)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
 // PopHashRecordHandler drops vector from the search index
 // curl -v http://localhost:8080/check?id=kd8f9wfhsdfs9df
 func (annServer *ANNServer) PopHashRecordHandler(w http.ResponseWriter, r *http.Request) {
@@ -124,6 +335,11 @@ func (annServer *ANNServer) PopHashRecordHandler(w http.ResponseWriter, r *http.
 			return
 		}
 		err = annServer.popHashRecord(id)
+		if err == errGraphReadOnly {
+			annServer.Logger.Err.Println("Pop hash record: " + err.Error())
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 		if err != nil {
 			annServer.Logger.Err.Println("Pop hash record: " + err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
@@ -156,6 +372,11 @@ func (annServer *ANNServer) PutHashRecordHandler(w http.ResponseWriter, r *http.
 			return
 		}
 		err = annServer.putHashRecord(input)
+		if err == errGraphReadOnly {
+			annServer.Logger.Err.Println("Put hash record: " + err.Error())
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 		if err != nil {
 			annServer.Logger.Err.Println("Put hash record: " + err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
@@ -168,7 +389,8 @@ func (annServer *ANNServer) PutHashRecordHandler(w http.ResponseWriter, r *http.
 	}
 }
 
-// GetNeighborsHandler makes query to the db and returns all neighbors
+// GetNeighborsHandler makes query to the db and returns all neighbors;
+// neighbors are streamed as NDJSON if the client accepts it
 func (annServer *ANNServer) GetNeighborsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	switch r.Method {
@@ -186,11 +408,22 @@ func (annServer *ANNServer) GetNeighborsHandler(w http.ResponseWriter, r *http.R
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if input.DistanceMode != "" && input.DistanceMode != cm.DistanceModeLocal && input.DistanceMode != cm.DistanceModeDb {
+			annServer.Logger.Err.Println("Get NN: unknown distance mode " + input.DistanceMode)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := annServer.getQueryContext(r.Context(), input)
+		defer cancel()
+		if isStreamRequested(r) {
+			annServer.streamNeighbors(ctx, w, input)
+			return
+		}
 
-		result, err := annServer.getNeighbors(input)
+		result, err := annServer.getNeighbors(ctx, input)
 		if err != nil {
 			annServer.Logger.Err.Println("Get NN: " + err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(getQueryErrorStatus(err))
 			return
 		}
 
@@ -208,3 +441,68 @@ func (annServer *ANNServer) GetNeighborsHandler(w http.ResponseWriter, r *http.R
 		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
 	}
 }
+
+// GetRangeHandler returns the page of all the neighbors within the radius of the request,
+// or streams all of them as NDJSON if the client accepts it
+func (annServer *ANNServer) GetRangeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			annServer.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input cm.RequestData
+		err = json.Unmarshal(body, &input)
+		if err != nil {
+			annServer.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if input.Radius <= 0 {
+			annServer.Logger.Err.Println("Get range: radius must be positive")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(input.Token) != 0 {
+			if _, err = decodeRangeToken(input.Token); err != nil {
+				annServer.Logger.Err.Println("Get range: wrong token: " + err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		ctx, cancel := annServer.getQueryContext(r.Context(), input)
+		defer cancel()
+		if isStreamRequested(r) {
+			annServer.streamRange(ctx, w, input)
+			return
+		}
+
+		result, err := annServer.getRangeNeighbors(ctx, input)
+		if err == errRangeTokenExpired {
+			annServer.Logger.Err.Println(err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			annServer.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(getQueryErrorStatus(err))
+			return
+		}
+
+		jsonResp, err := json.Marshal(result)
+		if err != nil {
+			annServer.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
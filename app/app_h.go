@@ -1,31 +1,216 @@
 package app
 
 import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
 	cm "lsh-search-service/common"
 	"lsh-search-service/db"
+	"lsh-search-service/hnsw"
 	hashing "lsh-search-service/lsh"
 )
 
 // Config holds general constants
 type Config struct {
-	BatchSize      int
-	MaxHashesQuery int
-	MaxNN          int
+	BatchSize          int
+	MaxHashesQuery     int
+	MaxNN              int
+	MaxCandidates      int
+	RerankSize         int
+	PQSubspaces        int
+	SampleSize         int
+	AutoRebuild        int
+	DriftCheckInterval int
+	DriftMinInserts    int
+	DriftThrsh         float64
+	ImbalanceThrsh     float64
+	Quantization       string
+	IndexType          string
+	IVFLists           int
+	IVFNProbe          int
+	ForestSearchK      int
+	FlatWorkers        int
+	FlatThreshold      int
+	RangePageSize      int
+	CursorTTL          int
+	MaxCursors         int
+	QueryTimeout       int
+	QueryTimeBudget    int
+	GoodEnoughDist     float64
+	QueryCacheTTL      int
+	QueryCacheSize     int
+	BucketCacheSize    int
+	HelperPollInterval int
+	BuildLeaseTTL      int
+	BuildTakeover      int
+	GraphWriter        int
 }
 
 // ServiceConfig holds all needed variables to run the app
 type ServiceConfig struct {
 	Hasher hashing.Config
+	Graph  hnsw.Config
+	Forest hashing.ForestConfig
 	Db     db.Config
 	App    Config
 }
 
-// ANNServer holds Hasher itself and the mongo Client
+// ANNServer holds the active index and the storage backend
 type ANNServer struct {
+	Store        db.VectorStore
+	Logger       *cm.Logger
+	Config       ServiceConfig
+	index        *ActiveIndex
+	indexMutex   sync.RWMutex
+	cursors      *cursorCache
+	resultsCache *lruCache
+	bucketsCache *lruCache
+	buildState   buildState
+	instanceID   string
+	buildMutex   sync.Mutex
+	cancelBuild  context.CancelFunc
+}
+
+// ActiveIndex holds the models of the build served by the instance: Hasher itself, and the graph,
+// inverted file or trees forest, which are used instead of the hash tables if the index is HNSW, IVF or forest.
+// Fields aren't reassigned once the index is loaded (the graph locks itself on inserts), the newer build
+// replaces the whole struct, so the request which has taken the index keeps using the same build
+type ActiveIndex struct {
 	Hasher        *hashing.Hasher
-	Mongo         db.MongoDatastore
-	Logger        *cm.Logger
-	Config        ServiceConfig
+	Graph         *hnsw.Graph
+	InvertedFile  *cm.InvertedFile
+	Forest        *hashing.Forest
+	IndexType     string
+	Quantizer     cm.Quantizer
 	LastBuildTime int64
 	HashCollName  string
 }
+
+// buildState keeps the helper record in memory while it's watched, so the requests don't read it
+// from the storage; the record is out of sync after the failed refresh, until the next one
+type buildState struct {
+	sync.RWMutex
+	refreshMutex sync.Mutex
+	record       db.HelperRecord
+	isWatched    bool
+	isSynced     bool
+}
+
+// buildLeaseKeeper holds the build lease of this instance and renews it in the background;
+// the build is cancelled once the lease is lost
+type buildLeaseKeeper struct {
+	sync.Mutex
+	store  db.VectorStore
+	logger *cm.Logger
+	lease  db.BuildLease
+	ttl    time.Duration
+	cancel context.CancelFunc
+	isLost bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// rankedCandidate holds the number of hash tables where the candidate collides with the query
+// and the Hamming distance between the candidate and query sketches
+type rankedCandidate struct {
+	SecondaryID uint64
+	Collisions  int
+	Hamming     int
+}
+
+// neighborsHeap pops the farthest neighbor first, so it keeps the top nearest ones
+type neighborsHeap []cm.NeighborsRecord
+
+// queryState holds the limits of the single nearest neighbors query: the request context carries
+// the deadline of the whole query, the budget context expires once the time budget is spent, so
+// the candidates scan stops and the neighbors found so far are returned; the reason of the early stop
+// marks the response as partial. Stats of the stages are collected into explain, if it's set
+type queryState struct {
+	index        *ActiveIndex
+	ctx          context.Context
+	budgetCtx    context.Context
+	cancelBudget context.CancelFunc
+	goodEnough   float64
+	// NOTE: only the candidates budget set by the request makes the truncated query partial
+	maxCandidates       int
+	hasCandidatesBudget bool
+	explain             *cm.QueryExplain
+	stopReason          string
+	// NOTE: the streamed query passes every neighbor to emit as soon as it's found
+	emit func(cm.NeighborsRecord) error
+}
+
+// scanStats counts vectors of the exact scan and tells if it's stopped by the good enough neighbors
+type scanStats struct {
+	Scanned      int64
+	Passed       int64
+	IsGoodEnough bool
+}
+
+// rangeToken is the position of the last returned neighbor of the range search page,
+// bound to the build which the page has been found in, and the cursor holding the rest of neighbors
+type rangeToken struct {
+	Cursor      string  `json:"c,omitempty"`
+	BuildTime   int64   `json:"t"`
+	Dist        float64 `json:"d"`
+	SecondaryID uint64  `json:"id"`
+}
+
+// rangeCursor holds all the sorted neighbors of the range search,
+// so the next pages are served without repeating the search
+type rangeCursor struct {
+	neighbors []cm.NeighborsRecord
+	strategy  string
+	buildTime int64
+	expires   time.Time
+}
+
+// cursorCache keeps the range search cursors of the service instance for CursorTTL
+type cursorCache struct {
+	sync.Mutex
+	cursors map[string]*rangeCursor
+	ttl     time.Duration
+	maxSize int
+}
+
+// indexModels holds everything needed to convert vectors to the index documents:
+// hasher computes hashes and sketches, inverted file replaces hashes with the IVF list
+// and forest replaces them with the leaves of its trees
+type indexModels struct {
+	Hasher       *hashing.Hasher
+	InvertedFile *cm.InvertedFile
+	Forest       *hashing.Forest
+	Quantizer    cm.Quantizer
+	KeepVec32    bool
+}
+
+// lruCache keeps at most maxSize entries for ttl, the least recently used entry gives way to the new one;
+// every invalidation starts the new generation, and the entries computed within the previous one are not kept,
+// so the query which has started before the index update doesn't cache the outdated results
+type lruCache struct {
+	sync.Mutex
+	entries       map[string]*list.Element
+	order         *list.List
+	ttl           time.Duration
+	maxSize       int
+	generation    uint64
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+}
+
+// lruEntry is the cached value with its key, to drop it from the map once it's evicted from the list
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// cachedResults holds the neighbors of the query and the strategy which has found them
+type cachedResults struct {
+	neighbors []cm.NeighborsRecord
+	strategy  string
+}
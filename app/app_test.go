@@ -0,0 +1,1336 @@
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"lsh-search-service/app"
+	"lsh-search-service/app/apptest"
+	"lsh-search-service/client"
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+	"lsh-search-service/hnsw"
+	hashing "lsh-search-service/lsh"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testVecs = apptest.GetVecs()
+)
+
+func getTestServer(t *testing.T) *app.ANNServer {
+	return getTestServerWithConfig(t, apptest.GetConfig())
+}
+
+func getTestServerWithConfig(t *testing.T, config *app.ServiceConfig) *app.ANNServer {
+	annServer, err := app.NewANNServer(apptest.GetLogger(), config)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	return annServer
+}
+
+func buildTestIndex(t *testing.T, annServer *app.ANNServer) {
+	err := annServer.BuildIndex(context.Background(), apptest.GetStats())
+	if err != nil {
+		t.Fatalf("Could not build index: %v", err)
+	}
+}
+
+func putTestVecs(t *testing.T, annServer *app.ANNServer) {
+	body, _ := json.Marshal(testVecs)
+	req := httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	annServer.PutHashRecordHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Put hash returned status %v", rec.Code)
+	}
+}
+
+func getTestNeighbors(t *testing.T, annServer *app.ANNServer, vec []float64) []uint64 {
+	return getTestNeighborsWithMode(t, annServer, vec, "")
+}
+
+func getTestNeighborsWithMode(t *testing.T, annServer *app.ANNServer, vec []float64, distanceMode string) []uint64 {
+	return getTestNeighborsWithParams(t, annServer, cm.RequestData{Vec: vec, DistanceMode: distanceMode})
+}
+
+func getTestNeighborsWithParams(t *testing.T, annServer *app.ANNServer, request cm.RequestData) []uint64 {
+	neighbors, _ := getTestNeighborsWithStrategy(t, annServer, request)
+	return neighbors
+}
+
+func getTestNeighborsWithStrategy(t *testing.T, annServer *app.ANNServer, request cm.RequestData) ([]uint64, string) {
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest("POST", "/get-nn", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	annServer.GetNeighborsHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Get NN returned status %v", rec.Code)
+	}
+	var resp struct {
+		Results  []uint64 `json:"neighbors"`
+		Strategy string   `json:"strategy"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("Could not decode Get NN response: %v", err)
+	}
+	return resp.Results, resp.Strategy
+}
+
+func TestParseEnv(t *testing.T) {
+	env := map[string]string{
+		"STORAGE_BACKEND":        db.BackendMemory,
+		"DB_NAME":                "test",
+		"COLLECTION_NAME":        "source",
+		"HELPER_COLLECTION_NAME": "helper",
+		"MAX_NN":                 "7",
+	}
+	for key, val := range env {
+		os.Setenv(key, val)
+		defer os.Unsetenv(key)
+	}
+	config, err := app.ParseEnv()
+	if err != nil {
+		t.Fatalf("Variables which aren't set must keep the defaults: %v", err)
+	}
+	if config.App.MaxNN != 7 || config.App.BatchSize != 1000 || config.App.FlatThreshold != 1000 {
+		t.Fatalf("Variables must be parsed over the defaults: %+v", config.App)
+	}
+	os.Setenv("BATCH_SIZE", "many")
+	defer os.Unsetenv("BATCH_SIZE")
+	if _, err = app.ParseEnv(); err == nil {
+		t.Fatal("Malformed variable must fail the parsing")
+	}
+}
+
+func TestGetNeighbors(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+}
+
+func TestSketchPreRanking(t *testing.T) {
+	config := apptest.GetConfig()
+	config.Hasher.SketchBits = 256
+	// NOTE: only the single candidate gets the distance computed, so it must be ranked by sketch
+	config.App.MaxCandidates = 1
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) != 1 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The indexed point must be pre-ranked first by its sketch: %v", neighbors)
+		}
+	}
+}
+
+func TestDbDistanceMode(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	for _, vec := range testVecs {
+		local := getTestNeighborsWithMode(t, annServer, vec.Vec, cm.DistanceModeLocal)
+		remote := getTestNeighborsWithMode(t, annServer, vec.Vec, cm.DistanceModeDb)
+		if len(local) != len(remote) || len(remote) == 0 || remote[0] != vec.SecondaryID {
+			t.Fatalf("Distances computed by the storage must give the same neighbors: %v vs %v", local, remote)
+		}
+	}
+	body, _ := json.Marshal(cm.RequestData{Vec: testVecs[0].Vec, DistanceMode: "unknown"})
+	rec := httptest.NewRecorder()
+	annServer.GetNeighborsHandler(rec, httptest.NewRequest("POST", "/get-nn", bytes.NewBuffer(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("Unknown distance mode must be rejected")
+	}
+}
+
+func TestQuantization(t *testing.T) {
+	for _, quantType := range []string{cm.QuantizationInt8, cm.QuantizationUint8} {
+		config := apptest.GetConfig()
+		config.App.Quantization = quantType
+		config.App.RerankSize = 2
+		annServer := getTestServerWithConfig(t, config)
+		buildTestIndex(t, annServer)
+		putTestVecs(t, annServer)
+		// NOTE: rebuild must restore vectors from the stored copies
+		buildTestIndex(t, annServer)
+		scalarQuantizer, ok := annServer.GetIndex().Quantizer.(*cm.ScalarQuantizer)
+		if !ok || scalarQuantizer.Type != quantType {
+			t.Fatal("Quantizer must be learned during the build")
+		}
+		for _, vec := range testVecs {
+			neighbors := getTestNeighborsWithMode(t, annServer, vec.Vec, cm.DistanceModeLocal)
+			if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+				t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+			}
+		}
+		_, code := getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, DistanceMode: cm.DistanceModeDb})
+		if code != http.StatusBadRequest {
+			t.Fatal("Db distance mode must be rejected for the quantized vectors")
+		}
+	}
+}
+
+func TestQuantizationRebuild(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.Quantization = cm.QuantizationInt8
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	quantizer := annServer.GetIndex().Quantizer
+	codes := quantizer.Encode(testVecs[0].Vec)
+	// NOTE: the index keeps only the codes, so the rebuild with the other stats keeps the quantizer
+	err := annServer.BuildIndex(context.Background(), cm.DatasetStats{
+		Mean: []float64{1.0, 1.0, 1.0},
+		Std:  []float64{2.0, 2.0, 2.0},
+	})
+	if err != nil {
+		t.Fatalf("Could not rebuild index: %v", err)
+	}
+	if !bytes.Equal(annServer.GetIndex().Quantizer.Encode(testVecs[0].Vec), codes) {
+		t.Fatal("Quantizer of the index without the exact vectors must be kept by the rebuild")
+	}
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+}
+
+func TestProductQuantization(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.PQSubspaces = 3
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: product quantizer is trained over the vectors of the current index
+	annServer.Config.App.Quantization = cm.QuantizationPQ
+	for _, rerankSize := range []int{0, 2} {
+		annServer.Config.App.RerankSize = rerankSize
+		buildTestIndex(t, annServer)
+		if _, ok := annServer.GetIndex().Quantizer.(*cm.ProductQuantizer); !ok {
+			t.Fatal("Product quantizer must be trained during the build")
+		}
+		for _, vec := range testVecs {
+			neighbors := getTestNeighbors(t, annServer, vec.Vec)
+			if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+				t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+			}
+		}
+	}
+	size, _ := annServer.GetHashCollSize()
+	if size != int64(len(testVecs)) {
+		t.Fatal("Rebuild must restore all the vectors from the codes")
+	}
+}
+
+func TestProductQuantizationSource(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.Quantization = cm.QuantizationPQ
+	config.App.PQSubspaces = 3
+	annServer := getTestServerWithConfig(t, config)
+	err := annServer.BuildIndex(context.Background(), cm.DatasetStats{
+		Mean: []float64{0.0, 0.0, 0.0},
+		Std:  []float64{1.0, 1.0, 1.0},
+	})
+	if err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("Build without any vectors must fail with the clear error: %v", err)
+	}
+	annServer.Store.UpdateBuildStatus(db.HelperRecord{IsBuildDone: false, BuildError: err.Error()})
+
+	// NOTE: the first build trains the product quantizer over the source collection
+	source := make([]db.HashesRecord, len(testVecs))
+	for i, vec := range testVecs {
+		source[i] = db.HashesRecord{SecondaryID: vec.SecondaryID, FeatureVec: vec.Vec}
+	}
+	annServer.Store.CreateHashCollection(config.Db.SourceCollectionName, nil)
+	annServer.Store.SetHashRecords(config.Db.SourceCollectionName, source)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+}
+
+func TestBoltBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := apptest.GetConfig()
+	config.Db = db.Config{
+		Backend:  db.BackendBolt,
+		BoltPath: filepath.Join(dir, "test.db"),
+	}
+	annServer := getTestServerWithConfig(t, config)
+	defer annServer.Store.Disconnect()
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	buildTestIndex(t, annServer)
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+}
+
+func TestHNSWIndex(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.IndexType = cm.IndexTypeHNSW
+	config.Graph = hnsw.Config{M: 2, EfConstruction: 4, Ef: 4}
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) != len(testVecs) || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+	annServer.PopHashRecordHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/pop-hash?id=1", nil))
+	for _, id := range getTestNeighbors(t, annServer, testVecs[0].Vec) {
+		if id == testVecs[0].SecondaryID {
+			t.Fatal("Popped point must not be returned as neighbor")
+		}
+	}
+
+	// NOTE: the other instance restores the graph from the storage
+	readerConfig := config
+	readerConfig.App.GraphWriter = 0
+	other, err := app.NewANNServerWithStore(apptest.GetLogger(), readerConfig, annServer.Store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	for _, vec := range testVecs[1:] {
+		neighbors := getTestNeighbors(t, other, vec.Vec)
+		if len(neighbors) != len(testVecs)-1 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("Restored graph must give the same neighbors: %v", neighbors)
+		}
+	}
+	body, _ := json.Marshal(testVecs[:1])
+	rec := httptest.NewRecorder()
+	other.PutHashRecordHandler(rec, httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Replica which isn't the graph writer must reject the put: %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	other.PopHashRecordHandler(rec, httptest.NewRequest("GET", "/pop-hash?id=2", nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Replica which isn't the graph writer must reject the pop: %v", rec.Code)
+	}
+
+	buildTestIndex(t, annServer)
+	record, _ := annServer.Store.GetHelperRecord(false)
+	size, _ := annServer.GetHashCollSize()
+	if record.IndexType != cm.IndexTypeHNSW || size != int64(len(testVecs)-1) {
+		t.Fatal("Rebuild must keep the graph type and drop the deleted nodes")
+	}
+	neighbors := getTestNeighbors(t, annServer, testVecs[1].Vec)
+	if len(neighbors) == 0 || neighbors[0] != testVecs[1].SecondaryID {
+		t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+	}
+}
+
+func TestIVFIndex(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.IVFLists = 2
+	config.App.IVFNProbe = 1
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: centroids are trained over the vectors of the current index
+	annServer.Config.App.IndexType = cm.IndexTypeIVF
+	buildTestIndex(t, annServer)
+	if annServer.GetIndex().InvertedFile == nil || len(annServer.GetIndex().InvertedFile.Centroids) != 2 {
+		t.Fatal("Inverted file must be trained during the build")
+	}
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+	neighbors := getTestNeighborsWithParams(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, NProbe: 2})
+	if len(neighbors) != len(testVecs) {
+		t.Fatalf("All the lists must be scanned: %v", neighbors)
+	}
+	stats, err := annServer.GetBucketsStats(1)
+	if err != nil || len(stats) != 1 || stats[0].Documents != int64(len(testVecs)) {
+		t.Fatal("Lists stats must be reported as the single hash table")
+	}
+}
+
+func TestForestIndex(t *testing.T) {
+	config := apptest.GetConfig()
+	config.Forest = hashing.ForestConfig{NTrees: 2, LeafSize: 1}
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: trees are grown over the vectors of the current index
+	annServer.Config.App.IndexType = cm.IndexTypeForest
+	buildTestIndex(t, annServer)
+	if annServer.GetIndex().Forest == nil || len(annServer.GetIndex().Forest.Trees) != 2 {
+		t.Fatal("Forest must be grown during the build")
+	}
+	for _, vec := range testVecs {
+		neighbors := getTestNeighbors(t, annServer, vec.Vec)
+		if len(neighbors) != len(testVecs) || neighbors[0] != vec.SecondaryID {
+			t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+		}
+	}
+	// NOTE: each leaf holds the single vector, so the first round of one leaf per tree exceeds the budget;
+	// the query is moved off the split planes, which pass through the symmetric test vectors
+	neighbors := getTestNeighborsWithParams(t, annServer, cm.RequestData{Vec: []float64{1.0, 0.1, 0.05}, SearchK: 1})
+	if len(neighbors) == 0 || len(neighbors) > len(annServer.GetIndex().Forest.Trees) {
+		t.Fatalf("Search must stop when searchK candidates are collected: %v", neighbors)
+	}
+	stats, err := annServer.GetBucketsStats(1)
+	if err != nil || len(stats) != 2 {
+		t.Fatal("Every tree must be reported as the hash table")
+	}
+
+	restarted, err := app.NewANNServerWithStore(apptest.GetLogger(), config, annServer.Store)
+	if err != nil || restarted.GetIndex().IndexType != cm.IndexTypeForest {
+		t.Fatalf("Forest must be restored from the helper record: %v", err)
+	}
+	neighbors = getTestNeighbors(t, restarted, testVecs[1].Vec)
+	if len(neighbors) == 0 || neighbors[0] != testVecs[1].SecondaryID {
+		t.Fatalf("Restored forest must give the same results: %v", neighbors)
+	}
+}
+
+func TestForestLeafSize(t *testing.T) {
+	config := apptest.GetConfig()
+	config.Forest = hashing.ForestConfig{NTrees: 2, LeafSize: 4}
+	config.App.SampleSize = 2
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: the sample holds half of the vectors, so the leaves of the sample are half the size
+	annServer.Config.App.IndexType = cm.IndexTypeForest
+	buildTestIndex(t, annServer)
+	if leafSize := annServer.GetIndex().Forest.Config.LeafSize; leafSize != 2 {
+		t.Fatalf("Leaf size must be scaled by the share of the sample: %v", leafSize)
+	}
+}
+
+func TestFlatIndex(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.FlatThreshold = 10
+	config.App.FlatWorkers = 3
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: distances to the rest of vectors are equal, so they are ordered by ids
+	expected := []uint64{1, 2, 3, 4}
+	neighbors, strategy := getTestNeighborsWithStrategy(t, annServer, cm.RequestData{Vec: testVecs[0].Vec})
+	if strategy != cm.IndexTypeFlat || len(neighbors) != len(expected) {
+		t.Fatalf("Index smaller than the threshold must be scanned: %v %v", strategy, neighbors)
+	}
+	for i := range expected {
+		if neighbors[i] != expected[i] {
+			t.Fatalf("Exact scan must return all the neighbors sorted by distance: %v", neighbors)
+		}
+	}
+	annServer.Config.App.FlatThreshold = 0
+	_, strategy = getTestNeighborsWithStrategy(t, annServer, cm.RequestData{Vec: testVecs[0].Vec})
+	if strategy != cm.IndexTypeLSH {
+		t.Fatalf("Index must answer if it's ready: %v", strategy)
+	}
+	_, strategy = getTestNeighborsWithStrategy(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Exact: true})
+	if strategy != cm.IndexTypeFlat {
+		t.Fatalf("Exact search must scan the vectors: %v", strategy)
+	}
+
+	err := annServer.Store.UpdateBuildStatus(db.HelperRecord{IsBuildDone: false, BuildError: "failed"})
+	if err != nil {
+		t.Fatalf("Could not update build status: %v", err)
+	}
+	neighbors, strategy = getTestNeighborsWithStrategy(t, annServer, cm.RequestData{Vec: testVecs[1].Vec})
+	if strategy != cm.IndexTypeLSH || len(neighbors) == 0 || neighbors[0] != testVecs[1].SecondaryID {
+		t.Fatalf("Previously loaded index must keep serving if the build has failed: %v %v", strategy, neighbors)
+	}
+
+	// NOTE: without any index only the source collection smaller than the threshold is scanned
+	source := make([]db.HashesRecord, len(testVecs))
+	for i, vec := range testVecs {
+		source[i] = db.HashesRecord{SecondaryID: vec.SecondaryID, FeatureVec: vec.Vec}
+	}
+	fresh := getTestServerWithConfig(t, config)
+	fresh.Store.CreateHashCollection(config.Db.SourceCollectionName, nil)
+	fresh.Store.SetHashRecords(config.Db.SourceCollectionName, source)
+	fresh.Config.App.FlatThreshold = len(source)
+	if _, code := getTestResponse(t, fresh, cm.RequestData{Vec: testVecs[1].Vec}); code != http.StatusServiceUnavailable {
+		t.Fatalf("Source collection larger than the threshold must not be scanned: %v", code)
+	}
+	fresh.Config.App.FlatThreshold = len(source) + 1
+	neighbors, strategy = getTestNeighborsWithStrategy(t, fresh, cm.RequestData{Vec: testVecs[1].Vec})
+	if strategy != cm.IndexTypeFlat || len(neighbors) == 0 || neighbors[0] != testVecs[1].SecondaryID {
+		t.Fatalf("Small source collection must be scanned if there is no index: %v %v", strategy, neighbors)
+	}
+
+	annServer.Config.App.IndexType = cm.IndexTypeFlat
+	buildTestIndex(t, annServer)
+	neighbors, strategy = getTestNeighborsWithStrategy(t, annServer, cm.RequestData{Vec: testVecs[2].Vec})
+	if strategy != cm.IndexTypeFlat || len(neighbors) != len(testVecs) || neighbors[0] != testVecs[2].SecondaryID {
+		t.Fatalf("Flat index must be scanned: %v %v", strategy, neighbors)
+	}
+	if _, err := annServer.GetBucketsStats(1); err == nil {
+		t.Fatal("Flat index has no buckets")
+	}
+}
+
+type testNeighborsResponse struct {
+	Results    []uint64         `json:"neighbors"`
+	Explain    *cm.QueryExplain `json:"explain"`
+	Partial    bool             `json:"partial"`
+	StopReason string           `json:"stopReason"`
+}
+
+func getTestResponse(t *testing.T, annServer *app.ANNServer, request cm.RequestData) (testNeighborsResponse, int) {
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest("POST", "/get-nn", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	annServer.GetNeighborsHandler(rec, req)
+	var resp testNeighborsResponse
+	if rec.Code != http.StatusOK {
+		return resp, rec.Code
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("Could not decode Get NN response: %v", err)
+	}
+	return resp, rec.Code
+}
+
+func getTestExplain(t *testing.T, annServer *app.ANNServer, request cm.RequestData) *cm.QueryExplain {
+	resp, code := getTestResponse(t, annServer, request)
+	if code != http.StatusOK {
+		t.Fatalf("Get NN returned status %v", code)
+	}
+	return resp.Explain
+}
+
+func TestExplain(t *testing.T) {
+	config := apptest.GetConfig()
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	if getTestExplain(t, annServer, cm.RequestData{Vec: testVecs[0].Vec}) != nil {
+		t.Fatal("Explain must be returned only on request")
+	}
+	explain := getTestExplain(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Explain: true})
+	if explain == nil {
+		t.Fatal("Explain must be returned on request")
+	}
+	if len(explain.Hashes) != config.Hasher.NPermutes || len(explain.TableCandidates) == 0 {
+		t.Fatalf("Explain must hold the hashes and the candidates of every table: %+v", explain)
+	}
+	if explain.Fetched < explain.Unique || explain.Unique == 0 || explain.DedupeRatio <= 0 || explain.DedupeRatio > 1 {
+		t.Fatalf("Wrong number of candidates: %+v", explain)
+	}
+	if explain.Ranked > explain.Unique || explain.PassedThrsh == 0 || explain.PassedThrsh > explain.Ranked {
+		t.Fatalf("Wrong number of ranked candidates: %+v", explain)
+	}
+	if explain.Truncated || explain.Timing.Total <= 0 || explain.Timing.Total < explain.Timing.Fetch {
+		t.Fatalf("Wrong timing: %+v", explain)
+	}
+
+	annServer.Config.App.MaxNN = 1
+	explain = getTestExplain(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Explain: true})
+	if explain.PassedThrsh <= 1 {
+		t.Fatalf("Candidates within the threshold must be counted before the MaxNN cut: %+v", explain)
+	}
+	annServer.Config.App.MaxNN = config.App.MaxNN
+
+	annServer.Config.App.MaxHashesQuery = 1
+	explain = getTestExplain(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Explain: true})
+	if !explain.Truncated {
+		t.Fatalf("Fetch limited by MaxHashesQuery must be reported: %+v", explain)
+	}
+
+	annServer.Config.App.MaxHashesQuery = 100
+	explain = getTestExplain(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Explain: true, Exact: true})
+	if explain.Fetched != len(testVecs) || explain.PassedThrsh != len(testVecs) {
+		t.Fatalf("Exact scan must go through all the vectors: %+v", explain)
+	}
+}
+
+// slowStore holds the candidates scan until the delay passes or the context is done,
+// then the scan is interrupted after the first candidate
+type slowStore struct {
+	db.VectorStore
+	delay time.Duration
+}
+
+func (store *slowStore) GetCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]db.HashesRecord, error) {
+	candidates, err := store.VectorStore.GetCandidateHashes(ctx, collName, hashes, limit)
+	if err != nil || len(candidates) == 0 || store.delay == 0 {
+		return candidates, err
+	}
+	select {
+	case <-time.After(store.delay):
+		return candidates, nil
+	case <-ctx.Done():
+		return candidates[:1], ctx.Err()
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	config := apptest.GetConfig()
+	store := &slowStore{VectorStore: db.NewMemoryStore(config.Db)}
+	annServer, err := app.NewANNServerWithStore(apptest.GetLogger(), config, store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	resp, _ := getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, TimeBudget: 10})
+	if resp.Partial || len(resp.Results) == 0 {
+		t.Fatalf("Query within the budget must be complete: %+v", resp)
+	}
+
+	store.delay = time.Minute
+	resp, code := getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, TimeBudget: 10})
+	if code != http.StatusOK || !resp.Partial || resp.StopReason != cm.StopReasonTimeBudget || len(resp.Results) != 1 {
+		t.Fatalf("Query which has spent its budget must return the neighbors found so far: %v %+v", code, resp)
+	}
+	if _, code = getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Timeout: 10}); code != http.StatusGatewayTimeout {
+		t.Fatalf("Query which has hit its deadline must fail: %v", code)
+	}
+	store.delay = 0
+
+	annServer.Config.App.MaxHashesQuery = 1
+	resp, _ = getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec})
+	if resp.Partial {
+		t.Fatalf("Query which has hit the configured candidates limit must not be partial: %+v", resp)
+	}
+	annServer.Config.App.MaxHashesQuery = 100
+	resp, _ = getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, CandidatesBudget: 1})
+	if !resp.Partial || resp.StopReason != cm.StopReasonCandidates {
+		t.Fatalf("Query which has hit its candidates budget must be partial: %+v", resp)
+	}
+
+	// NOTE: the single worker gets the vectors one by one, so the scan stops before the last vector
+	annServer.Config.App.MaxNN = 1
+	annServer.Config.App.BatchSize = 1
+	annServer.Config.App.FlatWorkers = 1
+	resp, _ = getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Exact: true, GoodEnough: 100})
+	if !resp.Partial || resp.StopReason != cm.StopReasonGoodEnough || len(resp.Results) != 1 {
+		t.Fatalf("Scan must stop once enough good neighbors are found: %+v", resp)
+	}
+	resp, _ = getTestResponse(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Exact: true})
+	if resp.Partial || len(resp.Results) != 1 || resp.Results[0] != 1 {
+		t.Fatalf("Scan without limits must be complete: %+v", resp)
+	}
+}
+
+func getTestMetrics(t *testing.T, annServer *app.ANNServer) cm.ServiceMetrics {
+	rec := httptest.NewRecorder()
+	annServer.MetricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var resp struct {
+		Results cm.ServiceMetrics `json:"neighbors"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("Could not get metrics: %v %v", rec.Code, err)
+	}
+	return resp.Results
+}
+
+func hasNeighbor(neighbors []uint64, secondaryID uint64) bool {
+	for _, neighbor := range neighbors {
+		if neighbor == secondaryID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestQueryCache(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.QueryCacheTTL = 60
+	config.App.QueryCacheSize = 10
+	config.App.BucketCacheSize = 10
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	first := getTestNeighbors(t, annServer, testVecs[0].Vec)
+	second := getTestNeighbors(t, annServer, testVecs[0].Vec)
+	metrics := getTestMetrics(t, annServer)
+	if metrics.ResultsCache.Hits != 1 || metrics.ResultsCache.Misses != 1 || len(first) != len(second) || first[0] != second[0] {
+		t.Fatalf("Repeated query must be answered from the cache: %+v", metrics.ResultsCache)
+	}
+	// NOTE: beam size doesn't change the hash index results, but it's the other query with the same buckets
+	getTestNeighborsWithParams(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Ef: 1})
+	metrics = getTestMetrics(t, annServer)
+	if metrics.ResultsCache.Misses != 2 || metrics.BucketsCache.Hits != int64(config.Hasher.NPermutes) {
+		t.Fatalf("Query with the same buckets must get candidates from the cache: %+v", metrics.BucketsCache)
+	}
+	if explain := getTestExplain(t, annServer, cm.RequestData{Vec: testVecs[0].Vec, Explain: true}); explain == nil {
+		t.Fatal("Explained query must bypass the results cache")
+	}
+
+	body, _ := json.Marshal([]cm.RequestData{{SecondaryID: 5, Vec: testVecs[0].Vec}})
+	rec := httptest.NewRecorder()
+	annServer.PutHashRecordHandler(rec, httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Put hash returned status %v", rec.Code)
+	}
+	if !hasNeighbor(getTestNeighbors(t, annServer, testVecs[0].Vec), 5) {
+		t.Fatal("Put must invalidate the cached results and buckets")
+	}
+	annServer.PopHashRecordHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/pop-hash?id=5", nil))
+	if hasNeighbor(getTestNeighbors(t, annServer, testVecs[0].Vec), 5) {
+		t.Fatal("Pop must invalidate the cached results and buckets")
+	}
+
+	// NOTE: the opposite vector falls into the other buckets, so the query buckets are changed only by the old hashes
+	annServer.PutHashRecordHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body)))
+	getTestNeighbors(t, annServer, testVecs[0].Vec)
+	body, _ = json.Marshal([]cm.RequestData{{SecondaryID: 5, Vec: []float64{-1.0, 0.0, 0.0}}})
+	annServer.PutHashRecordHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body)))
+	hits := getTestMetrics(t, annServer).BucketsCache.Hits
+	getTestNeighbors(t, annServer, testVecs[0].Vec)
+	if getTestMetrics(t, annServer).BucketsCache.Hits != hits {
+		t.Fatal("Replace must invalidate the cached buckets of the old hashes")
+	}
+
+	buildTestIndex(t, annServer)
+	metrics = getTestMetrics(t, annServer)
+	if metrics.ResultsCache.Size != 0 || metrics.BucketsCache.Size != 0 || metrics.ResultsCache.HitRate <= 0 {
+		t.Fatalf("Reload of the hasher must drop the cache: %+v", metrics)
+	}
+}
+
+func getTestRange(t *testing.T, annServer *app.ANNServer, request cm.RequestData) ([]cm.NeighborsRecord, string, int) {
+	body, _ := json.Marshal(request)
+	rec := httptest.NewRecorder()
+	annServer.GetRangeHandler(rec, httptest.NewRequest("POST", "/get-range", bytes.NewBuffer(body)))
+	if rec.Code != http.StatusOK {
+		return nil, "", rec.Code
+	}
+	var resp struct {
+		Results []cm.NeighborsRecord `json:"neighbors"`
+		Token   string               `json:"token"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("Could not decode Get range response: %v", err)
+	}
+	return resp.Results, resp.Token, rec.Code
+}
+
+func TestRangeSearch(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.MaxNN = 1
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: the rest of vectors are at the same distance, so they are ordered by ids
+	request := cm.RequestData{Vec: testVecs[0].Vec, Radius: 1.5, PageSize: 3, Exact: true}
+	neighbors, token, _ := getTestRange(t, annServer, request)
+	if len(neighbors) != 3 || len(token) == 0 || neighbors[0].SecondaryID != 1 || neighbors[2].SecondaryID != 3 {
+		t.Fatalf("Page of the range search must not be capped by MaxNN: %v", neighbors)
+	}
+	request.Token = token
+	neighbors, token, _ = getTestRange(t, annServer, request)
+	if len(neighbors) != 1 || len(token) != 0 || neighbors[0].SecondaryID != 4 {
+		t.Fatalf("The last page must hold the rest of neighbors: %v", neighbors)
+	}
+
+	request = cm.RequestData{Vec: testVecs[0].Vec, Radius: 0.5}
+	neighbors, _, _ = getTestRange(t, annServer, request)
+	if len(neighbors) != 1 || neighbors[0].SecondaryID != 1 {
+		t.Fatalf("Neighbors out of the radius must not be returned: %v", neighbors)
+	}
+	request.Radius = 1.5
+	neighbors, _, _ = getTestRange(t, annServer, request)
+	if len(neighbors) < 2 || neighbors[0].SecondaryID != 1 {
+		t.Fatalf("Index must be probed further than the buckets of the query: %v", neighbors)
+	}
+
+	request.PageSize = 1
+	_, token, _ = getTestRange(t, annServer, request)
+	buildTestIndex(t, annServer)
+	request.Token = token
+	if _, _, code := getTestRange(t, annServer, request); code != http.StatusBadRequest {
+		t.Fatal("Token of the previous build must be rejected")
+	}
+	request.Token = "-"
+	if _, _, code := getTestRange(t, annServer, request); code != http.StatusBadRequest {
+		t.Fatal("Malformed token must be rejected")
+	}
+	if _, _, code := getTestRange(t, annServer, cm.RequestData{Vec: testVecs[0].Vec}); code != http.StatusBadRequest {
+		t.Fatal("Range search without the radius must be rejected")
+	}
+}
+
+func TestRangeCursor(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.CursorTTL = 60
+	config.App.MaxCursors = 1
+	annServer := getTestServerWithConfig(t, config)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	request := cm.RequestData{Vec: testVecs[0].Vec, Radius: 1.5, PageSize: 2, Exact: true}
+	neighbors, token, _ := getTestRange(t, annServer, request)
+	if len(neighbors) != 2 || len(token) == 0 {
+		t.Fatalf("The first page must be returned with the token: %v", neighbors)
+	}
+	// NOTE: the cursor keeps the results of the search, so the pages stay the same after the rebuild
+	buildTestIndex(t, annServer)
+	request.Token = token
+	neighbors, token, code := getTestRange(t, annServer, request)
+	if code != http.StatusOK || len(neighbors) != 2 || len(token) != 0 || neighbors[0].SecondaryID != 3 {
+		t.Fatalf("The next page must be served from the cursor: %v %v", code, neighbors)
+	}
+
+	// NOTE: another instance has no cursor, so it has to repeat the search in the rebuilt index
+	request.Token = ""
+	_, token, _ = getTestRange(t, annServer, request)
+	buildTestIndex(t, annServer)
+	otherServer, err := app.NewANNServerWithStore(apptest.GetLogger(), config, annServer.Store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	request.Token = token
+	if _, _, code := getTestRange(t, otherServer, request); code != http.StatusBadRequest {
+		t.Fatal("Token without the cursor must be rejected after the rebuild")
+	}
+}
+
+func TestClientIterators(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get-nn", annServer.GetNeighborsHandler)
+	mux.HandleFunc("/get-range", annServer.GetRangeHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	annClient := client.New(client.Config{ServerAddress: server.URL, Timeout: int(time.Second)})
+
+	var ids []uint64
+	it := annClient.IterateRange(cm.RequestData{Vec: testVecs[0].Vec, Radius: 1.5, PageSize: 1, Exact: true})
+	for it.Next() {
+		ids = append(ids, it.Neighbor().SecondaryID)
+	}
+	if it.Err() != nil || len(ids) != len(testVecs) || ids[0] != 1 || ids[3] != 4 || it.Strategy() != cm.IndexTypeFlat {
+		t.Fatalf("Iterator must go through all the pages: %v %v", ids, it.Err())
+	}
+
+	// NOTE: the time budget makes the candidates consumed in batches, so the neighbors are streamed by the batch
+	stream, err := annClient.StreamNeighbors(cm.RequestData{Vec: testVecs[1].Vec, TimeBudget: 1000})
+	if err != nil {
+		t.Fatalf("Could not stream neighbors: %v", err)
+	}
+	found := make(map[uint64]bool)
+	for stream.Next() {
+		found[stream.Neighbor().SecondaryID] = true
+	}
+	neighbors := getTestNeighbors(t, annServer, testVecs[1].Vec)
+	if stream.Err() != nil || len(found) < len(neighbors) || stream.Strategy() != cm.IndexTypeLSH {
+		t.Fatalf("Streamed neighbors must hold the neighbors of the search: %v %v", found, stream.Err())
+	}
+	for _, id := range neighbors {
+		if !found[id] {
+			t.Fatalf("Streamed neighbors must hold the neighbors of the search: %v %v", found, neighbors)
+		}
+	}
+
+	stream, err = annClient.StreamRange(cm.RequestData{Vec: testVecs[0].Vec, Radius: 1.5, Exact: true})
+	if err != nil {
+		t.Fatalf("Could not stream range: %v", err)
+	}
+	found = make(map[uint64]bool)
+	for stream.Next() {
+		found[stream.Neighbor().SecondaryID] = true
+	}
+	if stream.Err() != nil || len(found) != len(testVecs) {
+		t.Fatalf("All the neighbors within the radius must be streamed: %v %v", found, stream.Err())
+	}
+	if _, err = annClient.StreamRange(cm.RequestData{Vec: testVecs[0].Vec}); err == nil {
+		t.Fatal("Stream of the wrong request must not be started")
+	}
+}
+
+// fetchCountingStore counts the fetches of the candidate vectors
+type fetchCountingStore struct {
+	db.VectorStore
+	fetches int64
+}
+
+func (store *fetchCountingStore) GetVectors(ctx context.Context, collName string, secondaryIDs []uint64, exact bool) ([]db.HashesRecord, error) {
+	atomic.AddInt64(&store.fetches, 1)
+	return store.VectorStore.GetVectors(ctx, collName, secondaryIDs, exact)
+}
+
+// firstWriteRecorder records the number of fetches made before the first line of the response
+type firstWriteRecorder struct {
+	*httptest.ResponseRecorder
+	store         *fetchCountingStore
+	fetchesBefore int64
+}
+
+func (rec *firstWriteRecorder) Write(b []byte) (int, error) {
+	if rec.fetchesBefore == 0 {
+		rec.fetchesBefore = atomic.LoadInt64(&rec.store.fetches)
+	}
+	return rec.ResponseRecorder.Write(b)
+}
+
+func TestStreamNeighbors(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.BatchSize = 1
+	store := &fetchCountingStore{VectorStore: db.NewMemoryStore(config.Db)}
+	annServer, err := app.NewANNServerWithStore(apptest.GetLogger(), config, store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+
+	// NOTE: the time budget makes the candidates consumed in batches of a single vector
+	body, _ := json.Marshal(cm.RequestData{Vec: testVecs[0].Vec, TimeBudget: 1000})
+	req := httptest.NewRequest("POST", "/get-nn", bytes.NewBuffer(body))
+	req.Header.Set("Accept", cm.ContentTypeNDJSON)
+	atomic.StoreInt64(&store.fetches, 0)
+	rec := &firstWriteRecorder{ResponseRecorder: httptest.NewRecorder(), store: store}
+	annServer.GetNeighborsHandler(rec, req)
+	if rec.Code != http.StatusOK || rec.fetchesBefore == 0 || rec.fetchesBefore >= atomic.LoadInt64(&store.fetches) {
+		t.Fatalf("Neighbors must be streamed as the candidate batches are consumed: %v %v of %v fetches",
+			rec.Code, rec.fetchesBefore, atomic.LoadInt64(&store.fetches))
+	}
+}
+
+func TestPopHash(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	req := httptest.NewRequest("GET", "/pop-hash?id=1", nil)
+	rec := httptest.NewRecorder()
+	annServer.PopHashRecordHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Pop hash returned status %v", rec.Code)
+	}
+	size, err := annServer.GetHashCollSize()
+	if err != nil {
+		t.Fatalf("Could not get index size: %v", err)
+	}
+	if size != int64(len(testVecs)-1) {
+		t.Fatal("Popped point must be removed from the index")
+	}
+	report, err := annServer.GetDriftReport(false)
+	if err != nil {
+		t.Fatalf("Could not get drift report: %v", err)
+	}
+	if report.Inserted != int64(len(testVecs)-1) {
+		t.Fatal("Popped point must be subtracted from the insert stats")
+	}
+	for _, id := range getTestNeighbors(t, annServer, testVecs[0].Vec) {
+		if id == testVecs[0].SecondaryID {
+			t.Fatal("Popped point must not be returned as neighbor")
+		}
+	}
+	putTestVecs(t, annServer)
+	if report, _ = annServer.GetDriftReport(false); report.Inserted != int64(len(testVecs)) {
+		t.Fatalf("Replaced points must be subtracted from the insert stats: %v", report.Inserted)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	oldRecord, _ := annServer.Store.GetHelperRecord(false)
+
+	buildTestIndex(t, annServer)
+	newRecord, _ := annServer.Store.GetHelperRecord(false)
+	if !newRecord.IsBuildDone || newRecord.HashCollName == oldRecord.HashCollName {
+		t.Fatal("Rebuild must switch the index to the new hash collection")
+	}
+	size, err := annServer.GetHashCollSize()
+	if err != nil {
+		t.Fatalf("Could not get index size: %v", err)
+	}
+	if size != int64(len(testVecs)) {
+		t.Fatal("Rebuild must rehash all the points of the previous index")
+	}
+	if newRecord.BuildProgress.Processed != int64(len(testVecs)) {
+		t.Fatal("Build progress must count all the rehashed points")
+	}
+}
+
+// countingStore counts the helper record reads, optionally as the storage which can't watch the helper record
+type countingStore struct {
+	db.VectorStore
+	reads    int64
+	canWatch bool
+}
+
+func (store *countingStore) GetHelperRecord(getHasherObject bool) (db.HelperRecord, error) {
+	record, err := store.VectorStore.GetHelperRecord(getHasherObject)
+	atomic.AddInt64(&store.reads, 1)
+	return record, err
+}
+
+func (store *countingStore) WatchHelperRecord(ctx context.Context, onChange func(), onInvalidate func(db.CacheInvalidation)) error {
+	if !store.canWatch {
+		return db.ErrWatchNotSupported
+	}
+	return store.VectorStore.WatchHelperRecord(ctx, onChange, onInvalidate)
+}
+
+// waitTestBuild waits till the server loads the build done by another server
+func waitTestBuild(t *testing.T, annServer *app.ANNServer, lastBuildTime int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := annServer.TryUpdateLocalHasher(); err == nil && annServer.GetIndex().LastBuildTime == lastBuildTime {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Server must load the build done by another server")
+}
+
+func TestWatchBuildState(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.QueryCacheTTL = 60
+	config.App.QueryCacheSize = 10
+	config.App.BucketCacheSize = 10
+	memoryStore := db.NewMemoryStore(config.Db)
+	builder, err := app.NewANNServerWithStore(apptest.GetLogger(), config, memoryStore)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	streamStore := &countingStore{VectorStore: memoryStore, canWatch: true}
+	pollStore := &countingStore{VectorStore: memoryStore}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var replicas []*app.ANNServer
+	for _, store := range []*countingStore{streamStore, pollStore} {
+		replica, err := app.NewANNServerWithStore(apptest.GetLogger(), config, store)
+		if err != nil {
+			t.Fatalf("Could not create server: %v", err)
+		}
+		go replica.WatchBuildState(ctx, 10*time.Millisecond)
+		replicas = append(replicas, replica)
+	}
+
+	buildTestIndex(t, builder)
+	putTestVecs(t, builder)
+	for _, replica := range replicas {
+		waitTestBuild(t, replica, builder.GetIndex().LastBuildTime)
+	}
+	atomic.StoreInt64(&streamStore.reads, 0)
+	neighbors := getTestNeighbors(t, replicas[0], testVecs[0].Vec)
+	if len(neighbors) == 0 || neighbors[0] != testVecs[0].SecondaryID {
+		t.Fatalf("Replica must answer with the loaded build: %v", neighbors)
+	}
+	if reads := atomic.LoadInt64(&streamStore.reads); reads != 0 {
+		t.Fatalf("Queries must not read the watched helper record: %v reads", reads)
+	}
+	putTestVecs(t, replicas[0])
+
+	getTestNeighbors(t, replicas[0], testVecs[0].Vec)
+	body, _ := json.Marshal([]cm.RequestData{{SecondaryID: 5, Vec: testVecs[0].Vec}})
+	builder.PutHashRecordHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body)))
+	if !hasNeighbor(getTestNeighbors(t, replicas[0], testVecs[0].Vec), 5) {
+		t.Fatal("Put must invalidate the cache of the replica watching the stream")
+	}
+
+	// NOTE: the lagging replica doesn't see the next build till the next poll, so it keeps writing into
+	// the old hash collection for the poll interval, which the builder waits out before the rehash
+	lagStore := &countingStore{VectorStore: memoryStore}
+	lagging, err := app.NewANNServerWithStore(apptest.GetLogger(), config, lagStore)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	go lagging.WatchBuildState(ctx, time.Hour)
+	waitTestBuild(t, lagging, builder.GetIndex().LastBuildTime)
+	// NOTE: the first poll of the state must read the current build, the synced state isn't read from the storage
+	for reads := int64(-1); reads != atomic.LoadInt64(&lagStore.reads); {
+		reads = atomic.LoadInt64(&lagStore.reads)
+		lagging.TryUpdateLocalHasher()
+	}
+	builder.Config.App.HelperPollInterval = 1
+	built := make(chan error, 1)
+	go func() {
+		built <- builder.BuildIndex(context.Background(), apptest.GetStats())
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for record, _ := memoryStore.GetHelperRecord(false); record.IsBuildDone; record, _ = memoryStore.GetHelperRecord(false) {
+		if time.Now().After(deadline) {
+			t.Fatal("Build must wait for the lagging replicas before the rehash")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	body, _ = json.Marshal([]cm.RequestData{{SecondaryID: 6, Vec: testVecs[0].Vec}})
+	rec := httptest.NewRecorder()
+	lagging.PutHashRecordHandler(rec, httptest.NewRequest("POST", "/put-hash", bytes.NewBuffer(body)))
+	if err = <-built; err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Could not build index: %v %v", err, rec.Code)
+	}
+	records, _ := memoryStore.GetRecordsHashes(context.Background(), builder.GetIndex().HashCollName, []uint64{6})
+	if len(records) != 1 {
+		t.Fatal("Put through the lagging replica must be rehashed into the new build")
+	}
+	for _, replica := range replicas {
+		waitTestBuild(t, replica, builder.GetIndex().LastBuildTime)
+		if replica.GetIndex().HashCollName != builder.GetIndex().HashCollName {
+			t.Fatal("Replica must switch to the hash collection of the new build")
+		}
+	}
+}
+
+func TestBuildLease(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.BuildLeaseTTL = 60
+	store := db.NewMemoryStore(config.Db)
+	annServer, err := app.NewANNServerWithStore(apptest.GetLogger(), config, store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	stats := cm.DatasetStats{Mean: []float64{0.0, 0.0, 0.0}, Std: []float64{1.0, 1.0, 1.0}}
+	now := time.Now().UnixNano()
+	store.AcquireBuildLease(db.BuildLease{Owner: "live", Heartbeat: now, Expires: now + int64(time.Minute)})
+	if err = annServer.BuildIndex(context.Background(), stats); err == nil {
+		t.Fatal("Build must not run while the lease is held by another instance")
+	}
+	body, _ := json.Marshal(stats)
+	rec := httptest.NewRecorder()
+	annServer.BuildHasherHandler(rec, httptest.NewRequest("POST", "/build-index", bytes.NewBuffer(body)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Build request must be rejected while the lease is held: %v", rec.Code)
+	}
+	store.ReleaseBuildLease("live")
+
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	if lease, _ := store.GetBuildLease(); len(lease.Owner) != 0 {
+		t.Fatal("Lease must be released once the build is done")
+	}
+	record, _ := store.GetHelperRecord(false)
+
+	// NOTE: the dead instance has marked the build in progress and has started filling its hash collection
+	store.AcquireBuildLease(db.BuildLease{
+		Owner:        "dead",
+		Heartbeat:    1,
+		Expires:      2,
+		HashCollName: "dead",
+		PrevStatus:   db.HelperRecord{IsBuildDone: true, LastBuildTime: record.LastBuildTime},
+		Input:        &stats,
+	})
+	store.UpdateBuildStatus(db.HelperRecord{IsBuildDone: false})
+	store.CreateHashCollection("dead", nil)
+	store.SetHashRecords("dead", []db.HashesRecord{{SecondaryID: 1, FeatureVec: testVecs[0].Vec}})
+
+	buildTestIndex(t, annServer)
+	if size, _ := store.GetCollSize("dead"); size != 0 {
+		t.Fatal("Hash collection of the dead build must be dropped")
+	}
+	newRecord, _ := store.GetHelperRecord(false)
+	if !newRecord.IsBuildDone || newRecord.HashCollName == record.HashCollName || newRecord.HashCollName == "dead" {
+		t.Fatal("Build must take over the lease of the dead instance")
+	}
+	if size, _ := annServer.GetHashCollSize(); size != int64(len(testVecs)) {
+		t.Fatal("Build taken over must rehash all the points of the previous index")
+	}
+	if lease, _ := store.GetBuildLease(); len(lease.Owner) != 0 {
+		t.Fatal("Lease taken over must be released once the build is done")
+	}
+}
+
+func TestShardedIndex(t *testing.T) {
+	for _, mode := range []string{db.ShardModeCollections, db.ShardModeStores} {
+		config := apptest.GetConfig()
+		config.Db.Shards = 2
+		config.Db.ShardMode = mode
+		annServer := getTestServerWithConfig(t, config)
+		buildTestIndex(t, annServer)
+		putTestVecs(t, annServer)
+		for _, vec := range testVecs {
+			neighbors := getTestNeighbors(t, annServer, vec.Vec)
+			if len(neighbors) == 0 || neighbors[0] != vec.SecondaryID {
+				t.Fatalf("Neighbors of all the shards must be merged by distance: %v", neighbors)
+			}
+			neighbors = getTestNeighborsWithParams(t, annServer, cm.RequestData{Vec: vec.Vec, Exact: true})
+			if len(neighbors) != len(testVecs) || neighbors[0] != vec.SecondaryID {
+				t.Fatalf("Exact scan must cover all the shards: %v", neighbors)
+			}
+		}
+
+		buildTestIndex(t, annServer)
+		rec := httptest.NewRecorder()
+		annServer.ShardsHealthHandler(rec, httptest.NewRequest("GET", "/shards-health", nil))
+		var resp struct {
+			Results []cm.ShardHealth `json:"neighbors"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || len(resp.Results) != 2 || !resp.Results[0].Healthy || !resp.Results[1].Healthy {
+			t.Fatalf("Every shard must report its health: %v %+v", rec.Code, resp.Results)
+		}
+		if resp.Results[0].Size+resp.Results[1].Size != int64(len(testVecs)) {
+			t.Fatalf("Rebuild must keep all the points of the shards: %+v", resp.Results)
+		}
+	}
+}
+
+func TestCancelBuild(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	oldRecord, _ := annServer.Store.GetHelperRecord(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := annServer.BuildIndex(ctx, cm.DatasetStats{
+		Mean: []float64{0.0, 0.0, 0.0},
+		Std:  []float64{1.0, 1.0, 1.0},
+	})
+	if err == nil {
+		t.Fatal("Cancelled build must return error")
+	}
+	record, _ := annServer.Store.GetHelperRecord(false)
+	if !record.IsBuildDone || record.HashCollName != oldRecord.HashCollName {
+		t.Fatal("Previous index must stay active after the build cancellation")
+	}
+	if record.BuildProgress.Phase != cm.BuildPhaseCancelled {
+		t.Fatal("Build progress must show the cancellation")
+	}
+	if len(getTestNeighbors(t, annServer, testVecs[0].Vec)) == 0 {
+		t.Fatal("Previous index must still be searchable")
+	}
+}
+
+func TestCancelBuildOfAnotherInstance(t *testing.T) {
+	config := apptest.GetConfig()
+	config.App.BuildLeaseTTL = 1
+	store := db.NewMemoryStore(config.Db)
+	owner, err := app.NewANNServerWithStore(apptest.GetLogger(), config, store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	other, err := app.NewANNServerWithStore(apptest.GetLogger(), config, store)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	buildTestIndex(t, owner)
+	putTestVecs(t, owner)
+	oldRecord, _ := store.GetHelperRecord(false)
+
+	rec := httptest.NewRecorder()
+	other.CancelBuildHandler(rec, httptest.NewRequest("POST", "/cancel-build", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Cancel must not be accepted without the running build: %v", rec.Code)
+	}
+
+	// NOTE: the build waits out the writes fence, so it's cancelled before the rehash
+	owner.Config.App.HelperPollInterval = 3
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- owner.BuildIndex(context.Background(), apptest.GetStats())
+	}()
+	for {
+		lease, _ := store.GetBuildLease()
+		if len(lease.HashCollName) != 0 {
+			break
+		}
+		select {
+		case err = <-done:
+			t.Fatalf("Build must wait out the writes fence: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	rec = httptest.NewRecorder()
+	other.CancelBuildHandler(rec, httptest.NewRequest("POST", "/cancel-build", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Cancel of the build of another instance must be accepted: %v", rec.Code)
+	}
+	if err = <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Build must be cancelled by another instance: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 3*time.Second {
+		t.Fatalf("Build must be cancelled with the next renew of the lease: %v", elapsed)
+	}
+	record, _ := store.GetHelperRecord(false)
+	if !record.IsBuildDone || record.HashCollName != oldRecord.HashCollName || record.BuildProgress.Phase != cm.BuildPhaseCancelled {
+		t.Fatalf("Previous index must stay active after the build cancellation: %+v", record.BuildProgress)
+	}
+	if lease, _ := store.GetBuildLease(); len(lease.Owner) != 0 {
+		t.Fatal("Lease must be released once the build is cancelled")
+	}
+}
+
+func TestComputeDatasetStats(t *testing.T) {
+	annServer := getTestServer(t)
+	buildTestIndex(t, annServer)
+	putTestVecs(t, annServer)
+	stats, err := annServer.ComputeDatasetStats(
+		context.Background(),
+		cm.StatsOptions{Source: cm.StatsSourceIndex, Mode: cm.StatsModeExact},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Could not compute stats: %v", err)
+	}
+	if stats.Count != int64(len(testVecs)) || stats.Mean[0] != 0.5 {
+		t.Fatal("Stats computed over the index are wrong")
+	}
+
+	var processed, total int64
+	_, err = annServer.ComputeDatasetStats(
+		context.Background(),
+		cm.StatsOptions{Source: cm.StatsSourceIndex, Mode: cm.StatsModeSample, SampleSize: 100},
+		func(p, n int64) { processed, total = p, n },
+	)
+	if err != nil || processed != total || total != int64(len(testVecs)) {
+		t.Fatalf("Sample progress must reach the collection size: %v/%v %v", processed, total, err)
+	}
+
+	err = annServer.BuildIndex(context.Background(), cm.DatasetStats{
+		Options: &cm.StatsOptions{Source: cm.StatsSourceIndex},
+	})
+	if err != nil {
+		t.Fatalf("Could not build index with server-side stats: %v", err)
+	}
+	record, _ := annServer.Store.GetHelperRecord(false)
+	if record.BuildStats.Mean[0] != 0.5 {
+		t.Fatal("Build must use stats computed on the server side")
+	}
+}
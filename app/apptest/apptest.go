@@ -0,0 +1,65 @@
+// Package apptest provides the fixtures shared by the tests of the ANN server and the router:
+// the config of the server over the in-memory store, the silent logger, the stats and the vectors of the test index
+package apptest
+
+import (
+	"io/ioutil"
+
+	"lsh-search-service/app"
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+	hashing "lsh-search-service/lsh"
+)
+
+// GetConfig returns the config of the server with the small hasher over the in-memory store
+func GetConfig() *app.ServiceConfig {
+	return &app.ServiceConfig{
+		Hasher: hashing.Config{
+			IsAngularDistance: 0,
+			NPermutes:         2,
+			NPlanes:           2,
+			BiasMultiplier:    1.0,
+			DistanceThrsh:     10.0,
+		},
+		Db: db.Config{
+			Backend:              db.BackendMemory,
+			HelperCollectionName: "helper",
+			SourceCollectionName: "source",
+		},
+		App: app.Config{
+			BatchSize:      2,
+			MaxHashesQuery: 100,
+			MaxNN:          10,
+			MaxCandidates:  10,
+			SampleSize:     100,
+			GraphWriter:    1,
+		},
+	}
+}
+
+// GetLogger returns the logger which discards everything
+func GetLogger() *cm.Logger {
+	logger := cm.GetNewLogger()
+	logger.Info.SetOutput(ioutil.Discard)
+	logger.Warn.SetOutput(ioutil.Discard)
+	logger.Err.SetOutput(ioutil.Discard)
+	return logger
+}
+
+// GetStats returns the dataset stats the test index is built with
+func GetStats() cm.DatasetStats {
+	return cm.DatasetStats{
+		Mean: []float64{0.0, 0.0, 0.0},
+		Std:  []float64{1.0, 1.0, 1.0},
+	}
+}
+
+// GetVecs returns the new copy of the test vectors: the unit vectors of the axes and their sum
+func GetVecs() []cm.RequestData {
+	return []cm.RequestData{
+		{SecondaryID: 1, Vec: []float64{1.0, 0.0, 0.0}},
+		{SecondaryID: 2, Vec: []float64{0.0, 1.0, 0.0}},
+		{SecondaryID: 3, Vec: []float64{0.0, 0.0, 1.0}},
+		{SecondaryID: 4, Vec: []float64{1.0, 1.0, 1.0}},
+	}
+}
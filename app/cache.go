@@ -0,0 +1,299 @@
+package app
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+)
+
+// newLRUCache returns the cache which keeps at most maxSize entries for ttl; zero ttl or size disables it
+func newLRUCache(ttl time.Duration, maxSize int) *lruCache {
+	return &lruCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		ttl:     ttl,
+		maxSize: maxSize,
+	}
+}
+
+// isEnabled checks if the cache keeps anything
+func (cache *lruCache) isEnabled() bool {
+	return cache != nil && cache.ttl > 0 && cache.maxSize > 0
+}
+
+// getGeneration returns the current generation, to be passed to put along with the value computed after this call
+func (cache *lruCache) getGeneration() uint64 {
+	if !cache.isEnabled() {
+		return 0
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.generation
+}
+
+// get returns the value if it's cached and hasn't expired, making it the most recently used one
+func (cache *lruCache) get(key string) (interface{}, bool) {
+	if !cache.isEnabled() {
+		return nil, false
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	elem, ok := cache.entries[key]
+	if ok && time.Now().After(elem.Value.(*lruEntry).expires) {
+		cache.removeElement(elem)
+		ok = false
+	}
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// put saves the value computed within the specified generation, the value of the outdated generation is ignored
+func (cache *lruCache) put(key string, value interface{}, generation uint64) {
+	if !cache.isEnabled() {
+		return
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if generation != cache.generation {
+		return
+	}
+	expires := time.Now().Add(cache.ttl)
+	if elem, ok := cache.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		cache.order.MoveToFront(elem)
+		return
+	}
+	for cache.order.Len() >= cache.maxSize {
+		cache.removeElement(cache.order.Back())
+		cache.evictions++
+	}
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+}
+
+// remove drops the entries with the specified keys and starts the new generation
+func (cache *lruCache) remove(keys []string) {
+	if !cache.isEnabled() {
+		return
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	cache.generation++
+	for _, key := range keys {
+		if elem, ok := cache.entries[key]; ok {
+			cache.removeElement(elem)
+			cache.invalidations++
+		}
+	}
+}
+
+// purge drops all the entries and starts the new generation
+func (cache *lruCache) purge() {
+	if !cache.isEnabled() {
+		return
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	cache.generation++
+	cache.invalidations += int64(cache.order.Len())
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
+}
+
+// removeElement drops the entry from the list and the map, the cache must be locked
+func (cache *lruCache) removeElement(elem *list.Element) {
+	cache.order.Remove(elem)
+	delete(cache.entries, elem.Value.(*lruEntry).key)
+}
+
+// getStats returns the counters of the cache
+func (cache *lruCache) getStats() cm.CacheStats {
+	if cache == nil {
+		return cm.CacheStats{}
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	stats := cm.CacheStats{
+		Size:          cache.order.Len(),
+		MaxSize:       cache.maxSize,
+		Hits:          cache.hits,
+		Misses:        cache.misses,
+		Evictions:     cache.evictions,
+		Invalidations: cache.invalidations,
+	}
+	if lookups := cache.hits + cache.misses; lookups > 0 {
+		stats.HitRate = float64(cache.hits) / float64(lookups)
+	}
+	return stats
+}
+
+// getResultsKey returns the key of the query results: the search parameters which change the neighbors
+// followed by the exact bits of the query vector
+func getResultsKey(input cm.RequestData) string {
+	prefix := fmt.Sprintf("%s|%d|%d|%d|%v|%v|%d|", getDistanceMode(input), input.Ef, input.NProbe, input.SearchK, input.Exact, input.GoodEnough, input.CandidatesBudget)
+	key := make([]byte, len(prefix)+8*len(input.Vec))
+	copy(key, prefix)
+	for i, v := range input.Vec {
+		binary.LittleEndian.PutUint64(key[len(prefix)+8*i:], math.Float64bits(v))
+	}
+	return string(key)
+}
+
+// getBucketKey returns the key of the candidates of the bucket
+func getBucketKey(collName string, table int, hash uint64) string {
+	return fmt.Sprintf("%s|%d|%d", collName, table, hash)
+}
+
+// getCandidates returns the candidates of the query buckets: cached buckets are taken from the buckets cache,
+// the rest are fetched at once and split into buckets, which are cached unless the fetch has been truncated
+// by the limit or interrupted by the context; in the latter case the candidates are returned along with the error
+func (annServer *ANNServer) getCandidates(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]db.HashesRecord, error) {
+	cache := annServer.bucketsCache
+	if !cache.isEnabled() {
+		return annServer.Store.GetCandidateHashes(ctx, collName, hashes, limit)
+	}
+	generation := cache.getGeneration()
+	var buckets [][]db.HashesRecord
+	missed := make(map[int]uint64)
+	for table, hash := range hashes {
+		if cached, ok := cache.get(getBucketKey(collName, table, hash)); ok {
+			buckets = append(buckets, cached.([]db.HashesRecord))
+		} else {
+			missed[table] = hash
+		}
+	}
+	var err error
+	if len(missed) > 0 {
+		var fetched []db.HashesRecord
+		fetched, err = annServer.Store.GetCandidateHashes(ctx, collName, missed, limit)
+		if err != nil && fetched == nil {
+			return nil, err
+		}
+		if err == nil && !isTruncated(len(fetched), limit) {
+			for table, hash := range missed {
+				bucket := []db.HashesRecord{}
+				for _, candidate := range fetched {
+					if candidateHash, ok := candidate.Hashes[table]; ok && candidateHash == hash {
+						bucket = append(bucket, candidate)
+					}
+				}
+				cache.put(getBucketKey(collName, table, hash), bucket, generation)
+			}
+		}
+		buckets = append(buckets, fetched)
+	}
+	return mergeCandidates(buckets, limit), err
+}
+
+// mergeCandidates joins the candidates of the buckets, the candidate found in several buckets gets
+// the hashes of all of them; cached records are shared, so they are copied before the merge
+func mergeCandidates(buckets [][]db.HashesRecord, limit int) []db.HashesRecord {
+	if len(buckets) == 1 && (limit <= 0 || len(buckets[0]) <= limit) {
+		return buckets[0]
+	}
+	var candidates []db.HashesRecord
+	positions := make(map[uint64]int)
+	for _, bucket := range buckets {
+		for _, candidate := range bucket {
+			pos, ok := positions[candidate.SecondaryID]
+			if !ok {
+				if limit > 0 && len(candidates) >= limit {
+					continue
+				}
+				positions[candidate.SecondaryID] = len(candidates)
+				candidates = append(candidates, candidate)
+				continue
+			}
+			merged := make(map[int]uint64, len(candidates[pos].Hashes)+len(candidate.Hashes))
+			for table, hash := range candidates[pos].Hashes {
+				merged[table] = hash
+			}
+			for table, hash := range candidate.Hashes {
+				merged[table] = hash
+			}
+			candidates[pos].Hashes = merged
+		}
+	}
+	return candidates
+}
+
+// invalidateCache drops the cached results and the cached buckets, since they have changed;
+// all the buckets are dropped if the changed ones are unknown
+func (annServer *ANNServer) invalidateCache(collName string, buckets []db.Bucket) {
+	annServer.resultsCache.purge()
+	if buckets == nil {
+		annServer.bucketsCache.purge()
+		return
+	}
+	keys := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		keys[i] = getBucketKey(collName, bucket.Table, bucket.Hash)
+	}
+	annServer.bucketsCache.remove(keys)
+}
+
+// NOTE: the write of more buckets is published as the change of all the buckets,
+// to keep the invalidation document small
+const maxInvalidationBuckets = 10000
+
+// getRecordsBuckets returns the buckets of the records; nil records change all the buckets
+func getRecordsBuckets(records []db.HashesRecord) []db.Bucket {
+	if records == nil {
+		return nil
+	}
+	buckets := make([]db.Bucket, 0, len(records))
+	for _, record := range records {
+		for table, hash := range record.Hashes {
+			buckets = append(buckets, db.Bucket{Table: table, Hash: hash})
+		}
+	}
+	return buckets
+}
+
+// invalidateChanged drops the cached buckets of the records changed by the write of this instance
+// and publishes them to the other instances through the store; all the buckets are dropped if the records are unknown
+func (annServer *ANNServer) invalidateChanged(collName string, records []db.HashesRecord) {
+	buckets := getRecordsBuckets(records)
+	annServer.invalidateCache(collName, buckets)
+	invalidation := db.CacheInvalidation{Origin: annServer.instanceID, HashCollName: collName, Buckets: buckets}
+	if buckets == nil || len(buckets) > maxInvalidationBuckets {
+		invalidation.Buckets, invalidation.All = nil, true
+	}
+	err := annServer.Store.PublishInvalidation(invalidation)
+	if err != nil {
+		annServer.Logger.Warn.Println("Publishing cache invalidation: " + err.Error())
+	}
+}
+
+// applyInvalidation drops the cached buckets changed by the write of another instance
+func (annServer *ANNServer) applyInvalidation(invalidation db.CacheInvalidation) {
+	if invalidation.Origin == annServer.instanceID {
+		return
+	}
+	buckets := invalidation.Buckets
+	if invalidation.All {
+		buckets = nil
+	} else if buckets == nil {
+		buckets = []db.Bucket{}
+	}
+	annServer.invalidateCache(invalidation.HashCollName, buckets)
+}
+
+// GetMetrics returns the counters of the service instance
+func (annServer *ANNServer) GetMetrics() cm.ServiceMetrics {
+	return cm.ServiceMetrics{
+		ResultsCache: annServer.resultsCache.getStats(),
+		BucketsCache: annServer.bucketsCache.getStats(),
+	}
+}
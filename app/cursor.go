@@ -0,0 +1,65 @@
+package app
+
+import (
+	"time"
+
+	cm "lsh-search-service/common"
+)
+
+// newCursorCache returns the cache which keeps at most maxSize cursors for ttl; zero ttl or size disables it
+func newCursorCache(ttl time.Duration, maxSize int) *cursorCache {
+	return &cursorCache{
+		cursors: make(map[string]*rangeCursor),
+		ttl:     ttl,
+		maxSize: maxSize,
+	}
+}
+
+// put saves the cursor and returns its id, empty if the cache is disabled; expired cursors are dropped,
+// and if the cache is still full, the cursor which expires first gives way to the new one
+func (cache *cursorCache) put(cursor *rangeCursor) (string, error) {
+	if cache == nil || cache.ttl <= 0 || cache.maxSize <= 0 {
+		return "", nil
+	}
+	id, err := cm.GetRandomID()
+	if err != nil {
+		return "", err
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	now := time.Now()
+	var oldestID string
+	for cursorID, cached := range cache.cursors {
+		if now.After(cached.expires) {
+			delete(cache.cursors, cursorID)
+			continue
+		}
+		if len(oldestID) == 0 || cached.expires.Before(cache.cursors[oldestID].expires) {
+			oldestID = cursorID
+		}
+	}
+	if len(cache.cursors) >= cache.maxSize {
+		delete(cache.cursors, oldestID)
+	}
+	cursor.expires = now.Add(cache.ttl)
+	cache.cursors[id] = cursor
+	return id, nil
+}
+
+// get returns the cursor if it's still alive, nil otherwise
+func (cache *cursorCache) get(id string) *rangeCursor {
+	if cache == nil || len(id) == 0 {
+		return nil
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	cursor, ok := cache.cursors[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(cursor.expires) {
+		delete(cache.cursors, id)
+		return nil
+	}
+	return cursor
+}
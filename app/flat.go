@@ -0,0 +1,238 @@
+package app
+
+import (
+	"container/heap"
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+)
+
+func (h neighborsHeap) Len() int            { return len(h) }
+func (h neighborsHeap) Less(i, j int) bool  { return isFarther(h[i], h[j]) }
+func (h neighborsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *neighborsHeap) Push(x interface{}) { *h = append(*h, x.(cm.NeighborsRecord)) }
+func (h *neighborsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
+
+// isFarther compares neighbors by the distance, ties are broken by the secondary id,
+// so the result doesn't depend on the way vectors are split between the workers
+func isFarther(lv, rv cm.NeighborsRecord) bool {
+	if lv.Dist != rv.Dist {
+		return lv.Dist > rv.Dist
+	}
+	return lv.SecondaryID > rv.SecondaryID
+}
+
+// pushTop keeps the neighbor if there are less than k neighbors or it's nearer than the farthest kept one;
+// returns true if the neighbor is kept
+func (h *neighborsHeap) pushTop(neighbor cm.NeighborsRecord, k int) bool {
+	if h.Len() < k {
+		heap.Push(h, neighbor)
+		return true
+	}
+	if k > 0 && isFarther((*h)[0], neighbor) {
+		(*h)[0] = neighbor
+		heap.Fix(h, 0)
+		return true
+	}
+	return false
+}
+
+// selectExactScan decides whether the query is answered by the exact scan instead of the index:
+// if it's requested, or the index is flat or smaller than FlatThreshold. If the newer build can't be loaded
+// (it's in progress or has failed), the previously loaded index keeps serving the queries; if there is
+// no index yet, the source collection is scanned only if it's smaller than FlatThreshold.
+// Returns the index to serve the query and the collection to scan
+func (annServer *ANNServer) selectExactScan(input cm.RequestData) (*ActiveIndex, string, bool, error) {
+	updateErr := annServer.TryUpdateLocalHasher()
+	index := annServer.GetIndex()
+	collName := index.HashCollName
+	if len(collName) == 0 {
+		collName = annServer.Config.Db.SourceCollectionName
+		isSmall, err := annServer.isSmallColl(collName)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if !isSmall {
+			if updateErr != nil {
+				annServer.Logger.Warn.Println("Get NN: " + updateErr.Error())
+			}
+			return nil, "", false, errIndexNotReady
+		}
+		annServer.Logger.Warn.Printf("Get NN: there is no index yet, falling back to the exact scan of %s", collName)
+		return index, collName, true, nil
+	}
+	if updateErr != nil {
+		annServer.Logger.Warn.Printf("Get NN: serving the index of %s: %v", collName, updateErr)
+	}
+	if input.Exact || index.IndexType == cm.IndexTypeFlat {
+		return index, collName, true, nil
+	}
+	isSmall, err := annServer.isSmallColl(collName)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return index, collName, isSmall, nil
+}
+
+// isSmallColl checks if the collection holds less than FlatThreshold documents
+func (annServer *ANNServer) isSmallColl(collName string) (bool, error) {
+	if annServer.Config.App.FlatThreshold <= 0 {
+		return false, nil
+	}
+	size, err := annServer.Store.GetCollSize(collName)
+	if err != nil {
+		return false, err
+	}
+	return size < int64(annServer.Config.App.FlatThreshold), nil
+}
+
+// getExactDistFunc returns function which computes the distance from the query to the stored vector
+// and checks it against the threshold; unlike the hasher it takes no locks, so the workers share it
+func getExactDistFunc(index *ActiveIndex, query []float64, thrsh float64) func(record db.HashesRecord) (float64, bool) {
+	isAngular := index.Hasher.Config.IsAngularDistance == 1
+	quantizer := index.Quantizer
+	queryVec := cm.NewVec(query)
+	return func(record db.HashesRecord) (float64, bool) {
+		vec := restoreVector(record, quantizer)
+		if len(vec) != len(query) {
+			return 0, false
+		}
+		var dist float64
+		if isAngular {
+			if cm.IsZeroVector(queryVec) || cm.IsZeroVector(cm.NewVec(vec)) {
+				return 1.0, false // NOTE: zero vectors are wrong with angular metric
+			}
+			dist = cm.CosineSim(queryVec, cm.NewVec(vec))
+		} else {
+			dist = cm.L2(queryVec, cm.NewVec(vec))
+		}
+		return dist, dist <= thrsh
+	}
+}
+
+// getFlatNeighbors scans all the vectors of the collection for the top MaxNN neighbors within the distance threshold,
+// until the time budget of the query is spent or MaxNN neighbors are found within the good enough distance
+func (annServer *ANNServer) getFlatNeighbors(query *queryState, collName string, input cm.RequestData) ([]cm.NeighborsRecord, error) {
+	start := time.Now()
+	neighbors, stats, err := annServer.scanNeighbors(query.budgetCtx, query.index, collName, input.Vec, annServer.Config.App.MaxNN, query.index.Hasher.Config.DistanceThrsh, query.goodEnough)
+	if err = query.checkScanErr(err); err != nil {
+		return nil, err
+	}
+	if stats.IsGoodEnough {
+		query.stop(cm.StopReasonGoodEnough)
+	}
+	elapsed := time.Since(start)
+	if explain := query.explain; explain != nil {
+		// NOTE: vectors are fetched and compared at the same time, so the whole scan is counted as distances
+		explain.Fetched, explain.Unique, explain.Ranked = int(stats.Scanned), int(stats.Scanned), int(stats.Scanned)
+		explain.DedupeRatio = 1
+		explain.PassedThrsh = int(stats.Passed)
+		explain.Timing.Distances = int64(elapsed)
+	}
+	annServer.Logger.Info.Printf("Query timing: exact scan %v (%v scanned, %v passed, %v found)", elapsed, stats.Scanned, stats.Passed, len(neighbors))
+	return neighbors, nil
+}
+
+// scanNeighbors scans all the vectors of the collection: batches of vectors are spread over
+// the pool of FlatWorkers workers (number of CPUs by default), each keeping the heap of its top k
+// neighbors within the threshold, and then the heaps are merged; returns sorted neighbors
+// and the numbers of scanned vectors and of the ones within the threshold. If goodEnough is set,
+// the scan stops once k neighbors are found within it. If the context is done, the neighbors
+// scanned so far are returned along with the context error
+func (annServer *ANNServer) scanNeighbors(ctx context.Context, index *ActiveIndex, collName string, vec []float64, k int, thrsh, goodEnough float64) ([]cm.NeighborsRecord, scanStats, error) {
+	workers := annServer.Config.App.FlatWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	batchSize := annServer.Config.App.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	getDist := getExactDistFunc(index, vec, thrsh)
+
+	stats := scanStats{}
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+	var goodNeighbors int64
+	batches := make(chan []db.HashesRecord, workers)
+	heaps := make([]neighborsHeap, workers)
+	passed := make([]int64, workers)
+	wg := sync.WaitGroup{}
+	for i := range heaps {
+		wg.Add(1)
+		go func(h *neighborsHeap, passed *int64) {
+			defer wg.Done()
+			for batch := range batches {
+				for _, record := range batch {
+					dist, ok := getDist(record)
+					if !ok {
+						continue
+					}
+					*passed++
+					h.pushTop(cm.NeighborsRecord{SecondaryID: record.SecondaryID, Dist: dist}, k)
+					if goodEnough > 0 && dist <= goodEnough && atomic.AddInt64(&goodNeighbors, 1) == int64(k) {
+						cancelScan()
+					}
+				}
+			}
+		}(&heaps[i], &passed[i])
+	}
+	batch := make([]db.HashesRecord, 0, batchSize)
+	err := annServer.Store.IterateVectors(scanCtx, collName, 0, func(record db.HashesRecord) error {
+		if err := scanCtx.Err(); err != nil {
+			return err
+		}
+		if record.Deleted {
+			return nil
+		}
+		stats.Scanned++
+		batch = append(batch, record)
+		if len(batch) == batchSize {
+			batches <- batch
+			batch = make([]db.HashesRecord, 0, batchSize)
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	if err != nil && ctx.Err() == nil && atomic.LoadInt64(&goodNeighbors) >= int64(k) {
+		// NOTE: the scan has been stopped by the workers, not by the caller
+		stats.IsGoodEnough = true
+		err = nil
+	}
+	if err != nil && ctx.Err() == nil {
+		return nil, stats, err
+	}
+
+	merged := neighborsHeap{}
+	for i, h := range heaps {
+		stats.Passed += passed[i]
+		for _, neighbor := range h {
+			merged.pushTop(neighbor, k)
+		}
+	}
+	sortNeighbors(merged)
+	return merged, stats, err
+}
+
+// sortNeighbors sorts neighbors by the distance in ascending order, ties are ordered by the secondary id
+func sortNeighbors(neighbors []cm.NeighborsRecord) {
+	sort.Slice(neighbors, func(i, j int) bool {
+		return isFarther(neighbors[j], neighbors[i])
+	})
+}
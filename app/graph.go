@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+	"lsh-search-service/hnsw"
+)
+
+// graphRecords converts the graph nodes to the storage documents, vectors are stored
+// in the same form as the hash collection documents
+func graphRecords(nodes []hnsw.Node, models indexModels) ([]db.HashesRecord, error) {
+	vecs := make([]cm.RequestData, len(nodes))
+	for i, node := range nodes {
+		vecs[i] = cm.RequestData{SecondaryID: node.ID, Vec: node.Vec}
+	}
+	records, err := hashBatch(models, vecs)
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range nodes {
+		records[i].Level = node.Level
+		records[i].Links = node.Links
+		records[i].Deleted = node.Deleted
+	}
+	return records, nil
+}
+
+// loadGraph restores the graph from its serialized config and the nodes of the hash collection.
+// NOTE: the graph keeps every vector in memory as float64, the quantized ones are decoded,
+// so the instance serving HNSW index needs 8 * dims bytes per vector plus the links, whatever the quantization
+func (annServer *ANNServer) loadGraph(graphSerialized []byte, collName string, quantizer cm.Quantizer) (*hnsw.Graph, error) {
+	graph := hnsw.NewGraph(annServer.Config.Graph)
+	err := graph.Load(graphSerialized)
+	if err != nil {
+		return nil, err
+	}
+	err = annServer.Store.IterateVectors(context.Background(), collName, 0, func(record db.HashesRecord) error {
+		vec := restoreVector(record, quantizer)
+		if len(vec) == 0 {
+			return nil
+		}
+		graph.AddNode(hnsw.Node{
+			ID:      record.SecondaryID,
+			Vec:     vec,
+			Level:   record.Level,
+			Links:   record.Links,
+			Deleted: record.Deleted,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+// saveGraphNodes writes the specified graph nodes to the hash collection
+func (annServer *ANNServer) saveGraphNodes(graph *hnsw.Graph, models indexModels, collName string, ids []uint64) error {
+	records, err := graphRecords(graph.GetNodes(ids), models)
+	if err != nil {
+		return err
+	}
+	return annServer.Store.SetHashRecords(collName, records)
+}
+
+// buildGraph inserts alive vectors of the old hash collection into the new graph
+// and saves its nodes to the new collection; returns the serialized graph config
+func (annServer *ANNServer) buildGraph(ctx context.Context, models indexModels, oldQuantizer cm.Quantizer, dims int, oldCollName, newCollName string, progress *cm.BuildProgress, start int64) ([]byte, error) {
+	graphConfig := annServer.Config.Graph
+	graphConfig.Dims = dims
+	graphConfig.IsAngularDistance = annServer.Config.Hasher.IsAngularDistance
+	graph := hnsw.NewGraph(graphConfig)
+
+	if len(oldCollName) != 0 {
+		total, err := annServer.Store.GetCollSize(oldCollName)
+		if err != nil {
+			return nil, err
+		}
+		progress.Total = total
+		insertStart := time.Now()
+		err = annServer.Store.IterateVectors(ctx, oldCollName, 0, func(record db.HashesRecord) error {
+			vec := restoreVector(record, oldQuantizer)
+			if len(vec) != dims || record.Deleted {
+				return nil
+			}
+			_, err := graph.Insert(record.SecondaryID, vec)
+			if err != nil {
+				return err
+			}
+			progress.Processed++
+			if progress.Processed%int64(annServer.Config.App.BatchSize) == 0 {
+				elapsed := time.Since(insertStart).Seconds()
+				progress.Throughput = float64(progress.Processed) / elapsed
+				if progress.Total > progress.Processed {
+					progress.ETA = int64(float64(progress.Total-progress.Processed) / progress.Throughput * float64(time.Second))
+				}
+				annServer.updateBuildProgress(*progress, start)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// NOTE: links of the node keep changing until the last insert, so nodes are saved only at the end
+	ids := graph.GetIDs()
+	batchSize := annServer.Config.App.BatchSize
+	for i := 0; i < len(ids); i += batchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err := annServer.saveGraphNodes(graph, models, newCollName, ids[i:end])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return graph.Dump()
+}
+
+// putGraphRecords inserts vectors into the graph and saves all the nodes whose links have changed.
+// NOTE: the links are computed over the graph of this instance and saved as a whole, so the writes
+// of another replica would overwrite its back-links; the graph is written only by the GRAPH_WRITER replica
+func (annServer *ANNServer) putGraphRecords(index *ActiveIndex, collName string, vecs []cm.RequestData) error {
+	changed := make(map[uint64]struct{})
+	for _, vec := range vecs {
+		ids, err := index.Graph.Insert(vec.SecondaryID, vec.Vec)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			changed[id] = struct{}{}
+		}
+	}
+	ids := make([]uint64, 0, len(changed))
+	for id := range changed {
+		ids = append(ids, id)
+	}
+	return annServer.saveGraphNodes(index.Graph, annServer.getIndexModels(index), collName, ids)
+}
+
+// deleteGraphRecord marks the graph node as deleted and saves the tombstone,
+// so the node keeps serving as a path to its neighbors until the next build
+func (annServer *ANNServer) deleteGraphRecord(index *ActiveIndex, collName string, id uint64) error {
+	if !index.Graph.Delete(id) {
+		return nil
+	}
+	return annServer.saveGraphNodes(index.Graph, annServer.getIndexModels(index), collName, []uint64{id})
+}
+
+// getGraphNeighbors searches the graph and returns the neighbors within the distance threshold;
+// `ef` of the request overrides the configured one
+func (annServer *ANNServer) getGraphNeighbors(index *ActiveIndex, input cm.RequestData, explain *cm.QueryExplain) ([]cm.NeighborsRecord, error) {
+	graph := index.Graph
+	if len(input.Vec) != graph.Config.Dims {
+		return nil, errors.New("vector size does not match the graph dimensions")
+	}
+	ef := input.Ef
+	if ef <= 0 {
+		ef = graph.Config.Ef
+	}
+	start := time.Now()
+	found := graph.Search(input.Vec, annServer.Config.App.MaxNN, ef)
+	within := 0
+	for within < len(found) && found[within].Dist <= index.Hasher.Config.DistanceThrsh {
+		within++
+	}
+	elapsed := time.Since(start)
+	if explain != nil {
+		// NOTE: graph is searched in memory, so the whole search is counted as distances
+		explain.Fetched, explain.Unique, explain.Ranked = len(found), len(found), len(found)
+		explain.DedupeRatio = 1
+		explain.PassedThrsh = within
+		explain.Timing.Distances = int64(elapsed)
+	}
+	annServer.Logger.Info.Printf("Query timing: graph search %v (%v found, ef %v)", elapsed, within, ef)
+	return found[:within], nil
+}
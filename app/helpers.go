@@ -10,10 +10,12 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 
-	"go.mongodb.org/mongo-driver/bson"
+	"gonum.org/v1/gonum/blas/blas64"
 	cm "lsh-search-service/common"
 	"lsh-search-service/db"
+	"lsh-search-service/hnsw"
 	hashing "lsh-search-service/lsh"
 )
 
@@ -24,12 +26,19 @@ func getHelloMessage() []byte {
 		"methods": {
 			"GET/POST": {
 				"/build-index": "starts building search index from scratch",
-				"/check-build": "returns current build status",
+				"/check-build": "returns current build status and progress",
+				"/cancel-build": "stops the running build, keeping the previous index active",
+				"/compute-stats": "computes mean, std and covariance of the source collection or the current index",
+				"/check-drift": "compares stats of the inserted points with the build-time stats",
+				"/buckets-stats": "returns buckets occupancy histograms and the largest buckets per hash table",
 				"/pop-hash": "removes the point from the search index",
-				"/put-hash": "adds the point to the search index"
+				"/put-hash": "adds the point to the search index",
+				"/metrics": "returns hit rates of the query caches of the instance",
+				"/shards-health": "returns health and size of every shard of the index"
 			},
 			"POST": {
-				"/get-nn": "returns db ids and distances of the nearest data points"
+				"/get-nn": "returns db ids and distances of the nearest data points",
+				"/get-range": "returns pages of all the data points within the radius, with their distances"
 			}
 	    }
 	}`}
@@ -44,28 +53,103 @@ func getHelloMessage() []byte {
 // ParseEnv forms app config by parsing the environment variables
 func ParseEnv() (*ServiceConfig, error) {
 	intVars := map[string]int{
-		"BATCH_SIZE":       1000,
-		"MAX_HASHES_QUERY": 10000,
-		"MAX_NN":           100,
-		"ANGULAR_METRIC":   0,
-		"N_PLANES":         30,
-		"N_PERMUTS":        5,
-		"BIAS_MULTIPLIER":  1,
+		"BATCH_SIZE":           1000,
+		"MAX_HASHES_QUERY":     10000,
+		"MAX_NN":               100,
+		"MAX_CANDIDATES":       1000,
+		"RERANK_SIZE":          0,
+		"PQ_SUBSPACES":         8,
+		"ANGULAR_METRIC":       0,
+		"N_PLANES":             30,
+		"N_PERMUTS":            5,
+		"HNSW_M":               16,
+		"HNSW_EF_CONSTRUCTION": 200,
+		"HNSW_EF":              64,
+		"GRAPH_WRITER":         1,
+		"IVF_LISTS":            256,
+		"IVF_NPROBE":           8,
+		"FOREST_TREES":         10,
+		"FOREST_LEAF_SIZE":     64,
+		"FOREST_SEARCH_K":      0,
+		"FLAT_WORKERS":         0,
+		"FLAT_THRESHOLD":       1000,
+		"RANGE_PAGE_SIZE":      1000,
+		"CURSOR_TTL":           300,
+		"MAX_CURSORS":          1000,
+		"QUERY_TIMEOUT":        0,
+		"QUERY_TIME_BUDGET":    0,
+		"QUERY_CACHE_TTL":      60,
+		"QUERY_CACHE_SIZE":     0,
+		"BUCKET_CACHE_SIZE":    0,
+		"HELPER_POLL_INTERVAL": 5,
+		"BUILD_LEASE_TTL":      30,
+		"BUILD_TAKEOVER":       1,
+		"SHARDS":               1,
+		"SKETCH_BITS":          0,
+		"BIAS_MULTIPLIER":      1,
+		"SAMPLE_SIZE":          30000,
+		"AUTO_REBUILD":         0,
+		"DRIFT_CHECK_INTERVAL": 600,
+		"DRIFT_MIN_INSERTS":    1000,
 	}
+	// NOTE: the variables which aren't set keep the defaults, so the older env files still work
 	for key := range intVars {
-		val, err := strconv.Atoi(os.Getenv(key))
+		env := os.Getenv(key)
+		if len(env) == 0 {
+			continue
+		}
+		val, err := strconv.Atoi(env)
 		if err != nil {
 			return nil, err
 		}
 		intVars[key] = val
 	}
-	distanceThrsh, err := strconv.ParseFloat(os.Getenv("DISTANCE_THRSH"), 32)
-	if err != nil {
-		return nil, err
+	floatVars := map[string]float64{
+		"DISTANCE_THRSH":   0.1,
+		"GOOD_ENOUGH_DIST": 0,
+		"DRIFT_THRSH":      0.5,
+		"IMBALANCE_THRSH":  0,
+	}
+	for key := range floatVars {
+		env := os.Getenv(key)
+		if len(env) == 0 {
+			continue
+		}
+		val, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return nil, err
+		}
+		floatVars[key] = val
 	}
 	stringVars := map[string]string{
-		"MONGO_ADDR": "", "DB_NAME": "",
-		"COLLECTION_NAME": "", "HELPER_COLLECTION_NAME": "",
+		"DB_NAME": "", "COLLECTION_NAME": "", "HELPER_COLLECTION_NAME": "",
+	}
+	// NOTE: the variables added after the mongo-only release are optional, so the older env files still work
+	defaultStringVars := map[string]string{
+		"STORAGE_BACKEND": db.BackendMongo,
+		"HASH_LAYOUT":     db.HashLayoutDocument,
+		"QUANTIZATION":    cm.QuantizationNone,
+		"INDEX_TYPE":      cm.IndexTypeLSH,
+	}
+	for key := range defaultStringVars {
+		if env := os.Getenv(key); len(env) != 0 {
+			defaultStringVars[key] = env
+		}
+	}
+	backend := defaultStringVars["STORAGE_BACKEND"]
+	// NOTE: mongo address is needed only if mongo is used as a storage, the same for the bolt file
+	switch backend {
+	case db.BackendMongo:
+		stringVars["MONGO_ADDR"] = ""
+	case db.BackendBolt:
+		stringVars["BOLT_PATH"] = ""
+	}
+	// NOTE: separate stores need their own locations, except the memory ones
+	if intVars["SHARDS"] > 1 {
+		stringVars["SHARD_MODE"] = ""
+		if os.Getenv("SHARD_MODE") == db.ShardModeStores && backend != db.BackendMemory {
+			stringVars["SHARD_LOCATIONS"] = ""
+		}
 	}
 	for key := range stringVars {
 		val := os.Getenv(key)
@@ -75,146 +159,271 @@ func ParseEnv() (*ServiceConfig, error) {
 		stringVars[key] = val
 	}
 
+	var shardLocations []string
+	if len(stringVars["SHARD_LOCATIONS"]) != 0 {
+		shardLocations = strings.Split(stringVars["SHARD_LOCATIONS"], ",")
+	}
 	config := &ServiceConfig{
 		Db: db.Config{
+			Backend:              backend,
+			HashLayout:           defaultStringVars["HASH_LAYOUT"],
 			DbLocation:           stringVars["MONGO_ADDR"],
+			BoltPath:             stringVars["BOLT_PATH"],
 			DbName:               stringVars["DB_NAME"],
 			HelperCollectionName: stringVars["HELPER_COLLECTION_NAME"],
+			SourceCollectionName: stringVars["COLLECTION_NAME"],
+			Shards:               intVars["SHARDS"],
+			ShardMode:            stringVars["SHARD_MODE"],
+			ShardLocations:       shardLocations,
 		},
 		App: Config{
-			BatchSize:      intVars["BATCH_SIZE"],
-			MaxHashesQuery: intVars["MAX_HASHES_QUERY"],
-			MaxNN:          intVars["MAX_NN"],
+			BatchSize:          intVars["BATCH_SIZE"],
+			MaxHashesQuery:     intVars["MAX_HASHES_QUERY"],
+			MaxNN:              intVars["MAX_NN"],
+			MaxCandidates:      intVars["MAX_CANDIDATES"],
+			RerankSize:         intVars["RERANK_SIZE"],
+			PQSubspaces:        intVars["PQ_SUBSPACES"],
+			Quantization:       defaultStringVars["QUANTIZATION"],
+			IndexType:          defaultStringVars["INDEX_TYPE"],
+			IVFLists:           intVars["IVF_LISTS"],
+			IVFNProbe:          intVars["IVF_NPROBE"],
+			ForestSearchK:      intVars["FOREST_SEARCH_K"],
+			FlatWorkers:        intVars["FLAT_WORKERS"],
+			FlatThreshold:      intVars["FLAT_THRESHOLD"],
+			RangePageSize:      intVars["RANGE_PAGE_SIZE"],
+			CursorTTL:          intVars["CURSOR_TTL"],
+			MaxCursors:         intVars["MAX_CURSORS"],
+			QueryTimeout:       intVars["QUERY_TIMEOUT"],
+			QueryTimeBudget:    intVars["QUERY_TIME_BUDGET"],
+			GoodEnoughDist:     floatVars["GOOD_ENOUGH_DIST"],
+			QueryCacheTTL:      intVars["QUERY_CACHE_TTL"],
+			QueryCacheSize:     intVars["QUERY_CACHE_SIZE"],
+			BucketCacheSize:    intVars["BUCKET_CACHE_SIZE"],
+			HelperPollInterval: intVars["HELPER_POLL_INTERVAL"],
+			BuildLeaseTTL:      intVars["BUILD_LEASE_TTL"],
+			BuildTakeover:      intVars["BUILD_TAKEOVER"],
+			GraphWriter:        intVars["GRAPH_WRITER"],
+			SampleSize:         intVars["SAMPLE_SIZE"],
+			AutoRebuild:        intVars["AUTO_REBUILD"],
+			DriftCheckInterval: intVars["DRIFT_CHECK_INTERVAL"],
+			DriftMinInserts:    intVars["DRIFT_MIN_INSERTS"],
+			DriftThrsh:         floatVars["DRIFT_THRSH"],
+			ImbalanceThrsh:     floatVars["IMBALANCE_THRSH"],
 		},
 		Hasher: hashing.Config{
 			IsAngularDistance: intVars["ANGULAR_METRIC"],
 			NPlanes:           intVars["N_PLANES"],
 			NPermutes:         intVars["N_PERMUTS"],
+			SketchBits:        intVars["SKETCH_BITS"],
 			BiasMultiplier:    float64(intVars["BIAS_MULTIPLIER"]),
-			DistanceThrsh:     distanceThrsh,
+			DistanceThrsh:     floatVars["DISTANCE_THRSH"],
+		},
+		Graph: hnsw.Config{
+			IsAngularDistance: intVars["ANGULAR_METRIC"],
+			M:                 intVars["HNSW_M"],
+			EfConstruction:    intVars["HNSW_EF_CONSTRUCTION"],
+			Ef:                intVars["HNSW_EF"],
+		},
+		Forest: hashing.ForestConfig{
+			IsAngularDistance: intVars["ANGULAR_METRIC"],
+			NTrees:            intVars["FOREST_TREES"],
+			LeafSize:          intVars["FOREST_LEAF_SIZE"],
 		},
 	}
 
 	return config, nil
 }
 
-// NewANNServer returns empty index object with initialized mongo client
-func NewANNServer(logger *cm.Logger, config *ServiceConfig) (ANNServer, error) {
-	mongodb, err := db.New(config.Db)
+// NewANNServer returns empty index object with initialized storage backend
+func NewANNServer(logger *cm.Logger, config *ServiceConfig) (*ANNServer, error) {
+	store, err := db.NewStore(config.Db)
+	if err != nil {
+		logger.Err.Println("Creating storage: " + err.Error())
+		return nil, err
+	}
+	annServer, err := NewANNServerWithStore(logger, config, store)
 	if err != nil {
-		logger.Err.Println("Creating db client: " + err.Error())
-		return ANNServer{}, err
+		store.Disconnect()
+		return nil, err
 	}
+	return annServer, nil
+}
 
-	annServer := ANNServer{
-		Config: *config,
-		Mongo:  *mongodb,
-		Logger: logger,
-		Hasher: hashing.NewLSHIndex(config.Hasher),
+// NewANNServerWithStore returns empty index object which uses the provided storage
+func NewANNServerWithStore(logger *cm.Logger, config *ServiceConfig, store db.VectorStore) (*ANNServer, error) {
+	annServer := &ANNServer{
+		Config:     *config,
+		Store:      store,
+		Logger:     logger,
+		instanceID: newInstanceID(),
+		index: &ActiveIndex{
+			Hasher: hashing.NewLSHIndex(config.Hasher),
+			Graph:  hnsw.NewGraph(config.Graph),
+		},
+		cursors: newCursorCache(
+			time.Duration(config.App.CursorTTL)*time.Second,
+			config.App.MaxCursors,
+		),
+		resultsCache: newLRUCache(time.Duration(config.App.QueryCacheTTL)*time.Second, config.App.QueryCacheSize),
+		bucketsCache: newLRUCache(time.Duration(config.App.QueryCacheTTL)*time.Second, config.App.BucketCacheSize),
 	}
-	err = annServer.LoadHasher()
+	err := annServer.LoadHasher()
 	if err != nil {
 		logger.Err.Println("Loading Hasher object: " + err.Error())
-		return ANNServer{}, err
-	}
-	helperExists, err := annServer.Mongo.CheckCollection(config.Db.HelperCollectionName)
-	if err != nil {
-		logger.Err.Println("Checking helper collection: " + err.Error())
-		return ANNServer{}, err
-	}
-	if !helperExists {
-		_, err = annServer.Mongo.CreateCollection(config.Db.HelperCollectionName)
-		if err != nil {
-			logger.Err.Println("Creating helper collection: " + err.Error())
-			return ANNServer{}, err
-		}
+		return nil, err
 	}
 	return annServer, nil
 }
 
-// UpdateBuildStatus updates helper record with the new biuld status and error
-func (annServer *ANNServer) UpdateBuildStatus(status db.HelperRecord) error {
-	helperColl := annServer.Mongo.GetCollection(annServer.Mongo.Config.HelperCollectionName)
-	err := helperColl.UpdateField(
-		bson.D{
-			{"Hasher", bson.D{
-				{"$exists", true},
-			}}},
-		bson.D{
-			{"$set", bson.D{
-				{"isBuildDone", status.IsBuildDone},
-				{"buildError", status.BuildError},
-				{"lastBuildTime", status.LastBuildTime},
-				{"buildElapsedTime", status.BuildElapsedTime},
-			}}})
-
+// LoadHasher load Hasher from the db if it exists
+func (annServer *ANNServer) LoadHasher() error {
+	helperRecord, err := annServer.Store.GetHelperRecord(true)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-// GetHelperRecord gets supplementary data from the specified collection
-func (annServer *ANNServer) GetHelperRecord(getHasherObject bool) (db.HelperRecord, error) {
-	proj := bson.M{}
-	if !getHasherObject {
-		proj = bson.M{"Hasher": 0}
+	if len(helperRecord.Hasher) == 0 || !helperRecord.IsBuildDone {
+		return nil
 	}
-	helperColl := annServer.Mongo.GetCollection(annServer.Mongo.Config.HelperCollectionName)
-	cursor, err := helperColl.GetCursor(
-		db.FindQuery{
-			Limit: 1,
-			Query: bson.D{
-				{"Hasher", bson.D{{"$exists", true}}},
-			},
-			Proj: proj,
-		},
-	)
-	if err != nil {
-		return db.HelperRecord{}, err
+	index := &ActiveIndex{
+		Hasher:        hashing.NewLSHIndex(annServer.Config.Hasher),
+		IndexType:     cm.IndexTypeLSH,
+		Quantizer:     helperRecord.GetQuantizer(),
+		LastBuildTime: helperRecord.LastBuildTime,
+		HashCollName:  helperRecord.HashCollName,
 	}
-
-	var results []db.HelperRecord
-	err = cursor.All(context.Background(), &results)
-	if err != nil || len(results) != 1 {
-		return db.HelperRecord{}, err
-	}
-	return results[0], nil
-}
-
-// LoadHasher load Hasher from the db if it exists
-func (annServer *ANNServer) LoadHasher() error {
-	HasherRecord, err := annServer.GetHelperRecord(true)
+	err = index.Hasher.Load(helperRecord.Hasher)
 	if err != nil {
 		return err
 	}
-	if len(HasherRecord.Hasher) > 0 && HasherRecord.IsBuildDone {
-		annServer.Hasher.Load(HasherRecord.Hasher)
-		annServer.HashCollName = HasherRecord.HashCollName
+	switch helperRecord.IndexType {
+	case cm.IndexTypeHNSW:
+		index.Graph, err = annServer.loadGraph(helperRecord.Graph, helperRecord.HashCollName, index.Quantizer)
+		if err != nil {
+			return err
+		}
+		index.IndexType = helperRecord.IndexType
+	case cm.IndexTypeIVF:
+		index.InvertedFile = helperRecord.InvertedFile
+		index.IndexType = helperRecord.IndexType
+	case cm.IndexTypeFlat:
+		index.IndexType = helperRecord.IndexType
+	case cm.IndexTypeForest:
+		index.Forest = hashing.NewForest(annServer.Config.Forest)
+		err = index.Forest.Load(helperRecord.Forest)
+		if err != nil {
+			return err
+		}
+		index.IndexType = helperRecord.IndexType
+	}
+	annServer.indexMutex.Lock()
+	// NOTE: the concurrent load of the older build must not replace the newer one
+	if annServer.index == nil || annServer.index.LastBuildTime <= index.LastBuildTime {
+		annServer.index = index
 	}
+	annServer.indexMutex.Unlock()
+	// NOTE: the hasher is reloaded by TryUpdateLocalHasher once the build is done by any instance
+	annServer.invalidateCache(helperRecord.HashCollName, nil)
 	return nil
 }
 
-// hashBatch accumulates db documents in a batch of desired length and calculates hashes
-func (annServer *ANNServer) hashBatch(vecs []cm.RequestData) ([]interface{}, error) {
-	batch := make([]interface{}, len(vecs))
+// GetIndex returns the active index; it's never changed, so it's safe to use it till the end of the request
+func (annServer *ANNServer) GetIndex() *ActiveIndex {
+	annServer.indexMutex.RLock()
+	defer annServer.indexMutex.RUnlock()
+	return annServer.index
+}
+
+// hashBatch accumulates db documents in a batch of desired length and calculates hashes,
+// if the hasher is set; with the inverted file the only hash is the IVF list of the vector,
+// with the forest hashes are the leaves of the vector in the trees
+func hashBatch(models indexModels, vecs []cm.RequestData) ([]db.HashesRecord, error) {
+	hasher, quantizer := models.Hasher, models.Quantizer
+	batch := make([]db.HashesRecord, len(vecs))
 	for idx, vec := range vecs {
-		batch[idx] = db.HashesRecord{
-			SecondaryID: vec.SecondaryID,
-			FeatureVec:  vec.Vec,
-			Hashes:      annServer.Hasher.GetHashes(cm.NewVec(vec.Vec)),
+		batch[idx] = db.HashesRecord{SecondaryID: vec.SecondaryID}
+		if models.InvertedFile != nil {
+			if len(vec.Vec) != models.InvertedFile.Dims() {
+				return nil, errors.New("vector size does not match the inverted file dimensions")
+			}
+			batch[idx].Hashes = map[int]uint64{0: uint64(models.InvertedFile.Assign(vec.Vec))}
+		} else if models.Forest != nil {
+			if len(vec.Vec) != models.Forest.Config.Dims {
+				return nil, errors.New("vector size does not match the forest dimensions")
+			}
+			batch[idx].Hashes = models.Forest.GetHashes(cm.NewVec(vec.Vec))
+		} else if hasher != nil {
+			batch[idx].Hashes = hasher.GetHashes(cm.NewVec(vec.Vec))
+		}
+		if hasher != nil {
+			batch[idx].Sketch = hasher.GetSketch(cm.NewVec(vec.Vec))
+		}
+		if quantizer == nil {
+			batch[idx].FeatureVec = vec.Vec
+			continue
+		}
+		if len(vec.Vec) != quantizer.Dims() {
+			return nil, errors.New("vector size does not match the quantizer dimensions")
+		}
+		batch[idx].Codes = quantizer.Encode(vec.Vec)
+		if models.KeepVec32 {
+			batch[idx].Vec32 = cm.EncodeFloat32(vec.Vec)
 		}
 	}
 	return batch, nil
 }
 
+// restoreVector returns the stored vector: the original one, its float32 copy or the decoded codes
+func restoreVector(record db.HashesRecord, quantizer cm.Quantizer) []float64 {
+	switch {
+	case len(record.FeatureVec) > 0:
+		return record.FeatureVec
+	case len(record.Vec32) > 0:
+		return cm.DecodeFloat32(record.Vec32)
+	case len(record.Codes) > 0 && quantizer != nil:
+		return quantizer.Decode(record.Codes)
+	}
+	return nil
+}
+
+// getIndexModels returns models of the index
+func (annServer *ANNServer) getIndexModels(index *ActiveIndex) indexModels {
+	models := indexModels{
+		Hasher:    index.Hasher,
+		Quantizer: index.Quantizer,
+		KeepVec32: annServer.Config.App.RerankSize > 0,
+	}
+	switch index.IndexType {
+	case cm.IndexTypeHNSW, cm.IndexTypeFlat:
+		models.Hasher = nil
+	case cm.IndexTypeIVF:
+		models.InvertedFile = index.InvertedFile
+	case cm.IndexTypeForest:
+		models.Forest = index.Forest
+	}
+	return models
+}
+
+// getHashTables returns names of the hash fields of the index documents
+func getHashTables(indexType string, models indexModels) []string {
+	switch indexType {
+	case cm.IndexTypeHNSW, cm.IndexTypeFlat:
+		// NOTE: graph nodes and flat vectors are fetched only by secondary id, so there are no hash fields to index
+		return nil
+	case cm.IndexTypeIVF:
+		return []string{"0"}
+	case cm.IndexTypeForest:
+		return models.Forest.HashFieldsNames
+	}
+	return models.Hasher.HashFieldsNames
+}
+
 // TryUpdateLocalHasher checks if there is a fresher build in db, and if it is - updates the local hasher
 func (annServer *ANNServer) TryUpdateLocalHasher() error {
-	helperRecord, err := annServer.GetHelperRecord(false)
+	helperRecord, err := annServer.getBuildRecord()
 	if err != nil {
 		return err
 	}
-	dt := helperRecord.LastBuildTime - annServer.LastBuildTime
+	dt := helperRecord.LastBuildTime - annServer.GetIndex().LastBuildTime
 	isBuildValid := helperRecord.IsBuildDone && len(helperRecord.BuildError) == 0
 	if isBuildValid && dt > 0 {
 		err = annServer.LoadHasher()
@@ -227,101 +436,610 @@ func (annServer *ANNServer) TryUpdateLocalHasher() error {
 	return nil
 }
 
-// BuildIndex gets data stats from the db and creates the new Hasher (or hasher) object
-// and submits status to the helper collection
-func (annServer *ANNServer) BuildIndex(input cm.DatasetStats) error {
+// BuildIndex creates the new Hasher object from the dataset stats, rehashes documents
+// of the current hash collection into the new one and submits the status and progress
+// to the helper collection, so the points put into the index survive the rebuild; the source
+// collection is read only by the stats and the training. If ctx gets cancelled, the new
+// collection is dropped and the previous index stays active
+func (annServer *ANNServer) BuildIndex(ctx context.Context, input cm.DatasetStats) (err error) {
 	start := time.Now().UnixNano()
+	// NOTE: the status written by the build is seen by this instance without waiting for the poll
+	defer annServer.refreshBuildState()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaseInput := input
+	lease, err := annServer.acquireBuildLease(&leaseInput, cancel)
+	if err != nil {
+		return err
+	}
+	defer lease.release()
 	// NOTE: check if the previous build has been done
-	helperRecord, err := annServer.GetHelperRecord(false)
+	prevHelperRecord, err := annServer.Store.GetHelperRecord(false)
 	if err != nil {
-		annServer.Logger.Warn.Println("Building index: seems like helper record does not exist yet")
+		return err
 	}
-	if !helperRecord.IsBuildDone || len(helperRecord.BuildError) != 0 {
-		return errors.New("Building index: aborting - previous build is not done yet")
+	isBuildRunning := !prevHelperRecord.ID.IsZero() && !prevHelperRecord.IsBuildDone &&
+		len(prevHelperRecord.BuildError) == 0 && prevHelperRecord.BuildProgress.Phase != cm.BuildPhaseCancelled
+	if isBuildRunning {
+		return errBuildInProgress
+	}
+	// NOTE: vectors of the old hash collection are decoded with the quantizer of the loaded index
+	prevIndex := annServer.GetIndex()
+	err = lease.renew(func(buildLease *db.BuildLease) {
+		buildLease.PrevStatus = db.HelperRecord{
+			IsBuildDone:      prevHelperRecord.IsBuildDone,
+			BuildError:       prevHelperRecord.BuildError,
+			LastBuildTime:    prevHelperRecord.LastBuildTime,
+			BuildElapsedTime: prevHelperRecord.BuildElapsedTime,
+		}
+	})
+	if err != nil {
+		return err
 	}
 
-	err = annServer.UpdateBuildStatus(
+	err = annServer.Store.UpdateBuildStatus(
 		db.HelperRecord{
 			IsBuildDone: false,
+			BuildOwner:  annServer.instanceID,
 		},
 	)
 	if err != nil {
 		return err
 	}
+	writesFence := time.Now().Add(time.Duration(annServer.Config.App.HelperPollInterval) * time.Second)
+	// NOTE: the stats phase is reported only if the stats are computed by the build
+	progress := cm.BuildProgress{Phase: cm.BuildPhasePlanes}
+	if len(input.Mean) == 0 {
+		progress.Phase = cm.BuildPhaseStats
+	}
+	annServer.updateBuildProgress(progress, start)
 
-	err = annServer.Hasher.Generate(cm.NewVec(input.Mean), cm.NewVec(input.Std))
-	if err != nil {
+	var newHashCollName string
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err == errBuildLeaseLost || lease.isLeaseLost() {
+			// NOTE: the build has been rolled back by the instance which has taken the lease over;
+			// the collection is dropped once more, since the batches written after the rollback recreate it
+			err = errBuildLeaseLost
+			if len(newHashCollName) != 0 {
+				annServer.Store.DropCollection(newHashCollName)
+			}
+			return
+		}
+		if len(newHashCollName) != 0 {
+			annServer.Store.DropCollection(newHashCollName)
+		}
+		if ctx.Err() != nil {
+			// NOTE: restore the previous state, so the old index stays active
+			annServer.Store.UpdateBuildStatus(prevHelperRecord)
+			progress.Phase = cm.BuildPhaseCancelled
+			annServer.updateBuildProgress(progress, start)
+		}
+	}()
+
+	if len(input.Mean) == 0 {
+		opts := cm.StatsOptions{}
+		if input.Options != nil {
+			opts = *input.Options
+		}
+		input, err = annServer.ComputeDatasetStats(ctx, opts, func(processed, total int64) {
+			progress.Processed = processed
+			progress.Total = total
+			annServer.updateBuildProgress(progress, start)
+		})
+		if err != nil {
+			return err
+		}
+		progress.Processed, progress.Total = 0, 0
+	}
+	if len(input.Mean) != len(input.Std) {
+		return errors.New("Building index: mean and std vectors must be of the same size")
+	}
+	if err = ctx.Err(); err != nil {
 		return err
 	}
-	annServer.Logger.Info.Println(annServer.Hasher.Instances[0]) // DEBUG - check for not being [0]
+	indexType := annServer.Config.App.IndexType
+	switch indexType {
+	case "":
+		indexType = cm.IndexTypeLSH
+	case cm.IndexTypeLSH, cm.IndexTypeHNSW, cm.IndexTypeIVF, cm.IndexTypeForest, cm.IndexTypeFlat:
+	default:
+		return fmt.Errorf("Building index: unknown index type: %s", indexType)
+	}
 
-	lshSerialized, err := annServer.Hasher.Dump()
+	progress.Phase = cm.BuildPhasePlanes
+	annServer.updateBuildProgress(progress, start)
+	hasherConfig := annServer.Config.Hasher
+	hasherConfig.Dims = len(input.Mean)
+	hasher := hashing.NewLSHIndex(hasherConfig)
+	err = hasher.Generate(cm.NewVec(input.Mean), cm.NewVec(input.Std))
 	if err != nil {
 		return err
 	}
-
-	// NOTE: Getting old hash collection name
-	oldHelperRecord, err := annServer.GetHelperRecord(false)
+	lshSerialized, err := hasher.Dump()
+	if err != nil {
+		return err
+	}
+	quantizer, err := annServer.trainQuantizer(ctx, input, prevIndex, prevHelperRecord.HashCollName, &progress, start)
 	if err != nil {
 		return err
 	}
+	var invertedFile *cm.InvertedFile
+	if indexType == cm.IndexTypeIVF {
+		invertedFile, err = annServer.trainInvertedFile(ctx, input, prevIndex.Quantizer, prevHelperRecord.HashCollName, &progress, start)
+		if err != nil {
+			return err
+		}
+	}
+	var forest *hashing.Forest
+	var forestSerialized []byte
+	if indexType == cm.IndexTypeForest {
+		forest, err = annServer.trainForest(ctx, input, prevIndex.Quantizer, prevHelperRecord.HashCollName, &progress, start)
+		if err != nil {
+			return err
+		}
+		forestSerialized, err = forest.Dump()
+		if err != nil {
+			return err
+		}
+	}
+	models := indexModels{
+		Hasher:       hasher,
+		InvertedFile: invertedFile,
+		Forest:       forest,
+		Quantizer:    quantizer,
+		KeepVec32:    annServer.Config.App.RerankSize > 0,
+	}
 
-	// NOTE: Generating and saving new hash collection, keeping the old one
-	newHashCollName, err := cm.GetRandomID()
+	// NOTE: Generating and saving new hash collection with indexes for the all hash fields, keeping the old one
+	progress.Phase = cm.BuildPhaseIndexing
+	annServer.updateBuildProgress(progress, start)
+	newHashCollName, err = cm.GetRandomID()
+	if err != nil {
+		return err
+	}
+	err = lease.renew(func(buildLease *db.BuildLease) {
+		buildLease.HashCollName = newHashCollName
+	})
 	if err != nil {
+		newHashCollName = ""
 		return err
 	}
-	_, err = annServer.Mongo.CreateCollection(newHashCollName)
+	err = annServer.Store.CreateHashCollection(newHashCollName, getHashTables(indexType, models))
 	if err != nil {
+		newHashCollName = ""
 		return err
 	}
 
-	// NOTE: create indexes for the all new fields
-	hashesColl := annServer.Mongo.GetCollection(newHashCollName)
-	err = hashesColl.CreateIndexesByFields(annServer.Hasher.HashFieldsNames, false)
+	progress.Phase = cm.BuildPhaseHashing
+	annServer.updateBuildProgress(progress, start)
+	// NOTE: the instances keep writing into the old hash collection till they see the build in progress,
+	// so it's rehashed only once the lagging build state of any instance has been refreshed
+	err = waitUntil(ctx, writesFence)
 	if err != nil {
 		return err
 	}
-	// NOTE: drop old collection with hashes
-	if len(oldHelperRecord.HashCollName) != 0 {
-		err = annServer.Mongo.DropCollection(oldHelperRecord.HashCollName)
+	var graphSerialized []byte
+	if indexType == cm.IndexTypeHNSW {
+		models.Hasher = nil
+		graphSerialized, err = annServer.buildGraph(ctx, models, prevIndex.Quantizer, len(input.Mean), prevHelperRecord.HashCollName, newHashCollName, &progress, start)
+		if err != nil {
+			return err
+		}
+	} else if len(prevHelperRecord.HashCollName) != 0 {
+		if indexType == cm.IndexTypeFlat {
+			// NOTE: flat index keeps only vectors
+			models.Hasher = nil
+		}
+		err = annServer.rehashCollection(ctx, models, prevIndex.Quantizer, prevHelperRecord.HashCollName, newHashCollName, &progress, start)
 		if err != nil {
 			return err
 		}
 	}
 
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
 	// NOTE: update helper with the new Hasher object and info
-	helperColl := annServer.Mongo.GetCollection(annServer.Config.Db.HelperCollectionName)
+	progress.Phase = cm.BuildPhaseSwap
+	annServer.updateBuildProgress(progress, start)
 	end := time.Now().UnixNano()
-	annServer.LastBuildTime = end
-	err = helperColl.UpdateField(
-		bson.D{
-			{"hasher", bson.D{
-				{"$exists", true},
-			}}},
-		bson.D{
-			{"$set", bson.D{
-				{"isBuildDone", true},
-				{"buildError", ""},
-				{"hasher", lshSerialized},
-				{"hashCollName", newHashCollName},
-				{"lastBuildTime", end},
-				{"buildElapsedTime", end - start},
-			}}})
-
+	progress.ETA = 0
+	progress.Elapsed = end - start
+	buildRecord := db.HelperRecord{
+		IsBuildDone:      true,
+		BuildOwner:       annServer.instanceID,
+		Hasher:           lshSerialized,
+		HashCollName:     newHashCollName,
+		LastBuildTime:    end,
+		BuildElapsedTime: end - start,
+		BuildProgress:    progress,
+		BuildStats:       cm.DatasetStats{Mean: input.Mean, Std: input.Std, Count: input.Count},
+		IndexType:        indexType,
+		Graph:            graphSerialized,
+		InvertedFile:     invertedFile,
+		Forest:           forestSerialized,
+	}
+	buildRecord.SetQuantizer(quantizer)
+	// NOTE: the build is saved only by the lease owner; the lease may be lost right after the renew,
+	// so the save is fenced by the owner which has marked the build in progress
+	err = lease.renew(nil)
 	if err != nil {
 		return err
 	}
+	err = annServer.Store.SaveBuild(buildRecord)
+	if err == db.ErrLeaseLost {
+		err = errBuildLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+
+	// NOTE: drop old collection with hashes only when the new one is already in use
+	if len(prevHelperRecord.HashCollName) != 0 {
+		err = annServer.Store.DropCollection(prevHelperRecord.HashCollName)
+		if err != nil {
+			annServer.Logger.Warn.Println("Building index: dropping old hash collection: " + err.Error())
+		}
+	}
+	return annServer.LoadHasher()
+}
+
+// waitUntil blocks till the deadline, or till ctx is done
+func waitUntil(ctx context.Context, deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// trainQuantizer creates the quantizer selected in config: scalar quantizer is learned from
+// the dataset stats, product quantizer is trained over the sample of the exact vectors,
+// see sampleVectors
+func (annServer *ANNServer) trainQuantizer(ctx context.Context, input cm.DatasetStats, prevIndex *ActiveIndex, prevCollName string, progress *cm.BuildProgress, start int64) (cm.Quantizer, error) {
+	if quantizer := annServer.getRetainedQuantizer(prevIndex, len(input.Mean)); quantizer != nil {
+		return quantizer, nil
+	}
+	switch quantType := annServer.Config.App.Quantization; quantType {
+	case cm.QuantizationNone, "":
+		return nil, nil
+	case cm.QuantizationInt8, cm.QuantizationUint8:
+		return cm.NewScalarQuantizer(quantType, input)
+	case cm.QuantizationPQ:
+	default:
+		return nil, fmt.Errorf("Building index: unknown quantization type: %s", quantType)
+	}
+
+	progress.Phase = cm.BuildPhaseTraining
+	annServer.updateBuildProgress(*progress, start)
+	vecs, _, err := annServer.sampleVectors(ctx, len(input.Mean), prevIndex.Quantizer, prevCollName)
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) == 0 {
+		return nil, errors.New("Building index: there are no vectors to train the product quantizer, both the index and the source collection are empty")
+	}
+	return cm.TrainProductQuantizer(vecs, annServer.Config.App.PQSubspaces)
+}
+
+// getRetainedQuantizer returns the quantizer of the current index if the index keeps only the codes
+// of the vectors and the quantizer matches the config, nil otherwise; the codes decoded during
+// the rehash are then encoded back into the same codes, so the rebuilds don't add the quantization error
+func (annServer *ANNServer) getRetainedQuantizer(prevIndex *ActiveIndex, dims int) cm.Quantizer {
+	models := annServer.getIndexModels(prevIndex)
+	if models.Quantizer == nil || models.KeepVec32 || models.Quantizer.Dims() != dims {
+		return nil
+	}
+	switch quantizer := models.Quantizer.(type) {
+	case *cm.ScalarQuantizer:
+		if quantizer.Type == annServer.Config.App.Quantization {
+			return quantizer
+		}
+	case *cm.ProductQuantizer:
+		if annServer.Config.App.Quantization == cm.QuantizationPQ && len(quantizer.Bounds)-1 == annServer.Config.App.PQSubspaces {
+			return quantizer
+		}
+	}
 	return nil
 }
 
+// trainInvertedFile clusters the training sample into the IVF lists, see sampleVectors
+func (annServer *ANNServer) trainInvertedFile(ctx context.Context, input cm.DatasetStats, prevQuantizer cm.Quantizer, prevCollName string, progress *cm.BuildProgress, start int64) (*cm.InvertedFile, error) {
+	progress.Phase = cm.BuildPhaseTraining
+	annServer.updateBuildProgress(*progress, start)
+	vecs, _, err := annServer.sampleVectors(ctx, len(input.Mean), prevQuantizer, prevCollName)
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) == 0 {
+		return nil, errors.New("Building index: there are no vectors to train the inverted file")
+	}
+	return cm.TrainInvertedFile(vecs, annServer.Config.App.IVFLists, annServer.Config.Hasher.IsAngularDistance == 1)
+}
+
+// trainForest grows the random projection trees over the training sample, see sampleVectors;
+// the leaf size is scaled down by the share of the sample in the sampled collection, so the leaves
+// hold about LeafSize vectors of the whole collection
+func (annServer *ANNServer) trainForest(ctx context.Context, input cm.DatasetStats, prevQuantizer cm.Quantizer, prevCollName string, progress *cm.BuildProgress, start int64) (*hashing.Forest, error) {
+	progress.Phase = cm.BuildPhaseTraining
+	annServer.updateBuildProgress(*progress, start)
+	vecs, total, err := annServer.sampleVectors(ctx, len(input.Mean), prevQuantizer, prevCollName)
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) == 0 {
+		return nil, errors.New("Building index: there are no vectors to grow the forest")
+	}
+	forestConfig := annServer.Config.Forest
+	if total > int64(len(vecs)) {
+		forestConfig.LeafSize = int(int64(forestConfig.LeafSize) * int64(len(vecs)) / total)
+		if forestConfig.LeafSize < 1 {
+			forestConfig.LeafSize = 1
+		}
+	}
+	forest := hashing.NewForest(forestConfig)
+	err = forest.Build(vecs)
+	if err != nil {
+		return nil, err
+	}
+	return forest, nil
+}
+
+// sampleVectors returns the training sample of the build: up to SampleSize exact vectors of the current index,
+// the original ones or their float32 copies. If the index has none, the source collection is sampled,
+// and the decoded codes of the index are used only if the source is empty as well.
+// Returns the number of documents of the sampled collection along with the sample
+func (annServer *ANNServer) sampleVectors(ctx context.Context, dims int, prevQuantizer cm.Quantizer, prevCollName string) ([][]float64, int64, error) {
+	var vecs, decoded [][]float64
+	if len(prevCollName) != 0 {
+		err := annServer.Store.IterateVectors(ctx, prevCollName, annServer.Config.App.SampleSize, func(record db.HashesRecord) error {
+			vec := restoreVector(record, prevQuantizer)
+			if len(vec) != dims || record.Deleted {
+				return nil
+			}
+			if len(record.FeatureVec) == 0 && len(record.Vec32) == 0 {
+				decoded = append(decoded, vec)
+				return nil
+			}
+			vecs = append(vecs, vec)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(vecs) != 0 {
+		total, err := annServer.Store.GetCollSize(prevCollName)
+		return vecs, total, err
+	}
+	err := annServer.Store.IterateVectors(ctx, annServer.Config.Db.SourceCollectionName, annServer.Config.App.SampleSize, func(record db.HashesRecord) error {
+		if len(record.FeatureVec) == dims {
+			vecs = append(vecs, record.FeatureVec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(vecs) != 0 {
+		total, err := annServer.Store.GetCollSize(annServer.Config.Db.SourceCollectionName)
+		return vecs, total, err
+	}
+	if len(decoded) == 0 {
+		return nil, 0, nil
+	}
+	total, err := annServer.Store.GetCollSize(prevCollName)
+	return decoded, total, err
+}
+
+// rehashCollection copies documents from the old hash collection to the new one,
+// calculating hashes with the newly built models and reporting the build progress
+func (annServer *ANNServer) rehashCollection(ctx context.Context, models indexModels, oldQuantizer cm.Quantizer, oldCollName, newCollName string, progress *cm.BuildProgress, start int64) error {
+	total, err := annServer.Store.GetCollSize(oldCollName)
+	if err != nil {
+		return err
+	}
+	progress.Total = total
+
+	hashingStart := time.Now()
+	batch := make([]cm.RequestData, 0, annServer.Config.App.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		records, err := hashBatch(models, batch)
+		if err != nil {
+			return err
+		}
+		err = annServer.Store.SetHashRecords(newCollName, records)
+		if err != nil {
+			return err
+		}
+		progress.Processed += int64(len(batch))
+		if progress.Processed > progress.Total {
+			progress.Total = progress.Processed
+		}
+		elapsed := time.Since(hashingStart).Seconds()
+		if elapsed > 0 {
+			progress.Throughput = float64(progress.Processed) / elapsed
+			progress.ETA = int64(float64(progress.Total-progress.Processed) / progress.Throughput * float64(time.Second))
+		}
+		annServer.updateBuildProgress(*progress, start)
+		batch = batch[:0]
+		return nil
+	}
+
+	err = annServer.Store.IterateVectors(ctx, oldCollName, 0, func(record db.HashesRecord) error {
+		vec := restoreVector(record, oldQuantizer)
+		if len(vec) == 0 || record.Deleted {
+			return nil
+		}
+		batch = append(batch, cm.RequestData{
+			SecondaryID: record.SecondaryID,
+			Vec:         vec,
+		})
+		if len(batch) >= annServer.Config.App.BatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// ComputeDatasetStats streams feature vectors from the source collection or from the current index
+// and calculates mean, std and (optionally) covariance matrix using the Welford's algorithm;
+// in sample mode only the random subset of documents is used
+func (annServer *ANNServer) ComputeDatasetStats(ctx context.Context, opts cm.StatsOptions, onProgress func(processed, total int64)) (cm.DatasetStats, error) {
+	var collName string
+	switch opts.Source {
+	case cm.StatsSourceCollection, "":
+		opts.Source = cm.StatsSourceCollection
+		collName = annServer.Config.Db.SourceCollectionName
+	case cm.StatsSourceIndex:
+		helperRecord, err := annServer.Store.GetHelperRecord(false)
+		if err != nil {
+			return cm.DatasetStats{}, err
+		}
+		collName = helperRecord.HashCollName
+	default:
+		return cm.DatasetStats{}, fmt.Errorf("Computing stats: unknown source: %s", opts.Source)
+	}
+	if len(collName) == 0 {
+		return cm.DatasetStats{}, errors.New("Computing stats: there is no collection to compute stats from")
+	}
+
+	switch opts.Mode {
+	case cm.StatsModeSample, "":
+		opts.Mode = cm.StatsModeSample
+		if opts.SampleSize <= 0 {
+			opts.SampleSize = annServer.Config.App.SampleSize
+		}
+	case cm.StatsModeExact:
+		opts.SampleSize = 0
+	default:
+		return cm.DatasetStats{}, fmt.Errorf("Computing stats: unknown mode: %s", opts.Mode)
+	}
+	total, err := annServer.Store.GetCollSize(collName)
+	if err != nil {
+		return cm.DatasetStats{}, err
+	}
+	// NOTE: the sample can't be larger than the collection
+	if opts.SampleSize > 0 && int64(opts.SampleSize) < total {
+		total = int64(opts.SampleSize)
+	}
+
+	quantizer := annServer.GetIndex().Quantizer
+	var stats *cm.RunningStats
+	err = annServer.Store.IterateVectors(ctx, collName, opts.SampleSize, func(record db.HashesRecord) error {
+		vec := restoreVector(record, quantizer)
+		if len(vec) == 0 || record.Deleted {
+			return nil
+		}
+		if stats == nil {
+			stats = cm.NewRunningStats(len(vec), opts.Covariance)
+		}
+		err := stats.Update(vec)
+		if err != nil {
+			return err
+		}
+		if onProgress != nil && stats.N%int64(annServer.Config.App.BatchSize) == 0 {
+			onProgress(stats.N, total)
+		}
+		return nil
+	})
+	if err != nil {
+		return cm.DatasetStats{}, err
+	}
+	if stats == nil || stats.N < 2 {
+		return cm.DatasetStats{}, errors.New("Computing stats: at least two vectors are needed")
+	}
+	result := stats.Result()
+	result.Options = &opts
+	return result, nil
+}
+
+// updateBuildProgress saves the current build progress to the helper record;
+// errors are only logged since progress is informational
+func (annServer *ANNServer) updateBuildProgress(progress cm.BuildProgress, start int64) {
+	progress.Elapsed = time.Now().UnixNano() - start
+	err := annServer.Store.UpdateBuildProgress(progress)
+	if err != nil {
+		annServer.Logger.Warn.Println("Updating build progress: " + err.Error())
+	}
+}
+
+// startBuild registers the cancel function of the new build job,
+// returns error if the build is already running on this instance
+func (annServer *ANNServer) startBuild() (context.Context, error) {
+	annServer.buildMutex.Lock()
+	defer annServer.buildMutex.Unlock()
+	if annServer.cancelBuild != nil {
+		return nil, errBuildInProgress
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	annServer.cancelBuild = cancel
+	return ctx, nil
+}
+
+// finishBuild releases the resources of the finished build job
+func (annServer *ANNServer) finishBuild() {
+	annServer.buildMutex.Lock()
+	defer annServer.buildMutex.Unlock()
+	if annServer.cancelBuild != nil {
+		annServer.cancelBuild()
+		annServer.cancelBuild = nil
+	}
+	annServer.refreshBuildState()
+}
+
+// CancelBuild stops the build running on this instance, returns false if there is nothing to cancel
+func (annServer *ANNServer) CancelBuild() bool {
+	annServer.buildMutex.Lock()
+	defer annServer.buildMutex.Unlock()
+	if annServer.cancelBuild == nil {
+		return false
+	}
+	annServer.cancelBuild()
+	return true
+}
+
+// GetShardsHealth checks every shard of the index and counts its documents;
+// the store which isn't sharded is the single shard
+func (annServer *ANNServer) GetShardsHealth() []cm.ShardHealth {
+	collName := annServer.GetIndex().HashCollName
+	if store, ok := annServer.Store.(*db.ShardedStore); ok {
+		return store.GetShardsHealth(collName)
+	}
+	health := cm.ShardHealth{Shard: "shard0"}
+	err := annServer.Store.CheckHealth()
+	if err == nil && len(collName) != 0 {
+		health.Size, err = annServer.Store.GetCollSize(collName)
+	}
+	if err != nil {
+		health.Error = err.Error()
+	} else {
+		health.Healthy = true
+	}
+	return []cm.ShardHealth{health}
+}
+
 // GetHashCollSize returns number of documents in hash collection
 func (annServer *ANNServer) GetHashCollSize() (int64, error) {
 	err := annServer.TryUpdateLocalHasher()
 	if err != nil {
 		return 0, err
 	}
-	size, err := annServer.Mongo.GetCollSize(annServer.HashCollName)
+	size, err := annServer.Store.GetCollSize(annServer.GetIndex().HashCollName)
 	if err != nil {
 		return 0, err
 	}
@@ -334,15 +1052,36 @@ func (annServer *ANNServer) popHashRecord(id uint64) error {
 	if err != nil {
 		return err
 	}
-	helperRecord, err := annServer.GetHelperRecord(false)
+	helperRecord, err := annServer.getBuildRecord()
 	if err != nil {
 		return err
 	}
-	hashesColl := annServer.Mongo.GetCollection(helperRecord.HashCollName)
-	err = hashesColl.DeleteRecords(bson.D{{"secondaryId", id}})
+	index := annServer.GetIndex()
+	if index.IndexType == cm.IndexTypeHNSW && annServer.Config.App.GraphWriter != 1 {
+		return errGraphReadOnly
+	}
+	// NOTE: the vector is read before the delete to subtract it from the insert stats
+	removed, err := annServer.Store.GetVectors(context.Background(), helperRecord.HashCollName, []uint64{id}, annServer.getIndexModels(index).KeepVec32)
 	if err != nil {
 		return err
 	}
+	if index.IndexType == cm.IndexTypeHNSW {
+		err = annServer.deleteGraphRecord(index, helperRecord.HashCollName, id)
+		annServer.invalidateChanged(helperRecord.HashCollName, nil)
+	} else {
+		err = annServer.deleteHashRecord(helperRecord.HashCollName, id)
+	}
+	if err != nil {
+		return err
+	}
+	vecs := make([][]float64, 0, len(removed))
+	for _, record := range removed {
+		vecs = append(vecs, restoreVector(record, index.Quantizer))
+	}
+	err = annServer.updateInsertStats(index, vecs, true)
+	if err != nil {
+		annServer.Logger.Warn.Println("Updating insert stats: " + err.Error())
+	}
 	return nil
 }
 
@@ -352,78 +1091,738 @@ func (annServer *ANNServer) putHashRecord(vecs []cm.RequestData) error {
 	if err != nil {
 		return err
 	}
-	helperRecord, err := annServer.GetHelperRecord(false)
+	helperRecord, err := annServer.getBuildRecord()
 	if err != nil {
 		return err
 	}
-	hashesColl := annServer.Mongo.GetCollection(helperRecord.HashCollName)
-	records, err := annServer.hashBatch(vecs)
+	index := annServer.GetIndex()
+	if index.IndexType == cm.IndexTypeHNSW && annServer.Config.App.GraphWriter != 1 {
+		return errGraphReadOnly
+	}
+	var replaced []db.HashesRecord
+	if index.IndexType == cm.IndexTypeHNSW {
+		replaced, err = annServer.Store.GetVectors(context.Background(), helperRecord.HashCollName, getRequestIDs(vecs), annServer.getIndexModels(index).KeepVec32)
+		if err == nil {
+			err = annServer.putGraphRecords(index, helperRecord.HashCollName, vecs)
+			annServer.invalidateChanged(helperRecord.HashCollName, nil)
+		}
+	} else {
+		replaced, err = annServer.setHashRecords(index, helperRecord.HashCollName, vecs)
+	}
 	if err != nil {
 		return err
 	}
-	err = hashesColl.SetRecords(records)
+	batch := make([][]float64, len(vecs))
+	for i := range vecs {
+		batch[i] = vecs[i].Vec
+	}
+	err = annServer.updateInsertStats(index, batch, false)
+	if err == nil && len(replaced) > 0 {
+		// NOTE: the replaced vectors are subtracted, so the upserts aren't counted twice
+		old := make([][]float64, len(replaced))
+		for i, record := range replaced {
+			old[i] = restoreVector(record, index.Quantizer)
+		}
+		err = annServer.updateInsertStats(index, old, true)
+	}
 	if err != nil {
-		return err
+		annServer.Logger.Warn.Println("Updating insert stats: " + err.Error())
 	}
 	return nil
 }
 
-// getNeighbors returns filtered nearest neighbors sorted by distance in ascending order
-func (annServer *ANNServer) getNeighbors(input cm.RequestData) (*cm.ResponseData, error) {
-	err := annServer.TryUpdateLocalHasher()
+// getRequestIDs returns the secondary ids of the request vectors
+func getRequestIDs(vecs []cm.RequestData) []uint64 {
+	secondaryIDs := make([]uint64, len(vecs))
+	for i := range vecs {
+		secondaryIDs[i] = vecs[i].SecondaryID
+	}
+	return secondaryIDs
+}
+
+// deleteHashRecord drops the record from the hash collection and invalidates the cached buckets of its hashes,
+// which are read before the delete
+func (annServer *ANNServer) deleteHashRecord(collName string, id uint64) error {
+	changed, err := annServer.Store.GetRecordsHashes(context.Background(), collName, []uint64{id})
+	if err != nil {
+		return err
+	}
+	err = annServer.Store.DeleteHashRecords(collName, id)
+	if len(changed) > 0 {
+		annServer.invalidateChanged(collName, changed)
+	}
+	return err
+}
+
+// setHashRecords hashes and upserts the vectors, invalidating the cached buckets of both the new hashes
+// and the old hashes of the replaced records, which are read before the upsert. Returns the vectors
+// of the replaced records; they are read only if there are any, so the plain inserts don't pay for it
+func (annServer *ANNServer) setHashRecords(index *ActiveIndex, collName string, vecs []cm.RequestData) ([]db.HashesRecord, error) {
+	models := annServer.getIndexModels(index)
+	records, err := hashBatch(models, vecs)
 	if err != nil {
 		return nil, err
 	}
-	helperRecord, err := annServer.GetHelperRecord(false)
+	changed, err := annServer.Store.GetRecordsHashes(context.Background(), collName, getRequestIDs(vecs))
 	if err != nil {
 		return nil, err
 	}
-	hashesColl := annServer.Mongo.GetCollection(helperRecord.HashCollName)
-	inputVec := cm.NewVec(input.Vec)
-	hashes := annServer.Hasher.GetHashes(inputVec)
-	hashesQuery := bson.D{}
-	for k, v := range hashes {
-		hashesQuery = append(hashesQuery, bson.E{strconv.Itoa(k), v})
-	}
-	hashesCursor, err := hashesColl.GetCursor(
-		db.FindQuery{
-			Limit: annServer.Config.App.MaxHashesQuery,
-			Query: hashesQuery,
-			Proj:  bson.M{"_id": 1, "featureVec": 1},
-		},
-	)
+	var replaced []db.HashesRecord
+	if len(changed) > 0 {
+		replacedIDs := make([]uint64, len(changed))
+		for i, record := range changed {
+			replacedIDs[i] = record.SecondaryID
+		}
+		replaced, err = annServer.Store.GetVectors(context.Background(), collName, replacedIDs, models.KeepVec32)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = annServer.Store.SetHashRecords(collName, records)
+	annServer.invalidateChanged(collName, append(changed, records...))
+	return replaced, err
+}
+
+// updateInsertStats merges the Welford's stats of the batch into the running stats in the helper record;
+// removed vectors are merged with the negative count, so they are subtracted from the stats
+func (annServer *ANNServer) updateInsertStats(index *ActiveIndex, vecs [][]float64, removed bool) error {
+	dims := index.Hasher.Config.Dims
+	if dims == 0 {
+		return nil
+	}
+	batch := cm.NewRunningStats(dims, false)
+	for _, vec := range vecs {
+		if len(vec) != dims {
+			continue
+		}
+		batch.Update(vec)
+	}
+	if batch.N == 0 {
+		return nil
+	}
+	if removed {
+		batch.N = -batch.N
+	}
+	return annServer.Store.UpdateInsertStats(db.InsertStats{
+		Count: batch.N,
+		Mean:  batch.Mean,
+		M2:    batch.M2,
+	})
+}
+
+// GetDriftReport compares stats of the vectors inserted after the latest build with the build-time stats;
+// bucket imbalance is computed only if requested, since it needs the full hash collection scan
+func (annServer *ANNServer) GetDriftReport(withImbalance bool) (*cm.DriftReport, error) {
+	helperRecord, err := annServer.Store.GetHelperRecord(false)
 	if err != nil {
 		return nil, err
 	}
+	if len(helperRecord.BuildStats.Mean) == 0 {
+		return nil, errors.New("Checking drift: there are no build-time stats yet")
+	}
+	insertStats := helperRecord.InsertStats
+	current := insertStats.Result()
+	report := &cm.DriftReport{Inserted: insertStats.Count}
+	if insertStats.Count >= int64(annServer.Config.App.DriftMinInserts) {
+		report.MeanShift, report.StdShift, err = cm.GetDrift(helperRecord.BuildStats, current)
+		if err != nil {
+			return nil, err
+		}
+		report.Score = report.MeanShift + report.StdShift
+	}
+	if withImbalance && len(helperRecord.HashCollName) != 0 {
+		index := annServer.GetIndex()
+		for _, name := range getHashTables(index.IndexType, annServer.getIndexModels(index)) {
+			bucketsStats, err := annServer.Store.GetBucketsStats(helperRecord.HashCollName, name, 0, annServer.Config.App.MaxHashesQuery)
+			if err != nil {
+				return nil, err
+			}
+			if bucketsStats.AvgSize == 0 {
+				continue
+			}
+			imbalance := float64(bucketsStats.MaxSize) / bucketsStats.AvgSize
+			if imbalance > report.BucketImbalance {
+				report.BucketImbalance = imbalance
+			}
+		}
+	}
+	report.RebuildRecommended = report.Score > annServer.Config.App.DriftThrsh ||
+		(annServer.Config.App.ImbalanceThrsh > 0 && report.BucketImbalance > annServer.Config.App.ImbalanceThrsh)
+	return report, nil
+}
 
-	var neighbors []cm.NeighborsRecord
-	var idx int = 0
-	var candidate db.HashesRecord
-	for hashesCursor.Next(context.Background()) {
-		if err := hashesCursor.Decode(&candidate); err != nil {
+// GetBucketsStats returns buckets occupancy stats for every hash table of the active index
+func (annServer *ANNServer) GetBucketsStats(topN int) ([]cm.BucketsStats, error) {
+	err := annServer.TryUpdateLocalHasher()
+	if err != nil {
+		return nil, err
+	}
+	index := annServer.GetIndex()
+	switch index.IndexType {
+	case cm.IndexTypeHNSW:
+		return nil, errors.New("Buckets stats: graph index has no buckets")
+	case cm.IndexTypeFlat:
+		return nil, errors.New("Buckets stats: flat index has no buckets")
+	}
+	tables := getHashTables(index.IndexType, annServer.getIndexModels(index))
+	results := make([]cm.BucketsStats, len(tables))
+	for i, name := range tables {
+		results[i], err = annServer.Store.GetBucketsStats(index.HashCollName, name, topN, annServer.Config.App.MaxHashesQuery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// MonitorDrift periodically checks the drift report and starts the rebuild
+// with stats computed over the current index, when it's recommended
+func (annServer *ANNServer) MonitorDrift(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := annServer.GetDriftReport(annServer.Config.App.ImbalanceThrsh > 0)
+		if err != nil {
+			annServer.Logger.Warn.Println("Monitoring drift: " + err.Error())
+			continue
+		}
+		if !report.RebuildRecommended {
+			continue
+		}
+		annServer.Logger.Info.Printf("Monitoring drift: starting rebuild; score: %v, bucket imbalance: %v", report.Score, report.BucketImbalance)
+		ctx, err := annServer.startBuild()
+		if err != nil {
+			continue
+		}
+		err = annServer.BuildIndex(ctx, cm.DatasetStats{
+			Options: &cm.StatsOptions{Source: cm.StatsSourceIndex},
+		})
+		annServer.finishBuild()
+		if err != nil {
+			annServer.Logger.Err.Println("Monitoring drift: rebuild failed: " + err.Error())
+		}
+	}
+}
+
+// getDistanceMode returns the place where the exact distances are computed for the query
+func getDistanceMode(input cm.RequestData) string {
+	if input.DistanceMode == cm.DistanceModeDb {
+		return cm.DistanceModeDb
+	}
+	return cm.DistanceModeLocal
+}
+
+// rankCandidates dedupes candidates and sorts them by the Hamming distance between the sketches,
+// if the query sketch is set, and then by the number of tables where they collide with the query,
+// keeping the top ones; candidates without the sketch go after the sketched ones
+func rankCandidates(candidates []db.HashesRecord, hashes map[int]uint64, querySketch []byte, topN int) []uint64 {
+	positions := make(map[uint64]int)
+	ranked := make([]rankedCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		count := 0
+		for table, hash := range hashes {
+			if candidateHash, ok := candidate.Hashes[table]; ok && candidateHash == hash {
+				count++
+			}
+		}
+		hamming := getSketchDistance(querySketch, candidate.Sketch)
+		pos, ok := positions[candidate.SecondaryID]
+		if !ok {
+			positions[candidate.SecondaryID] = len(ranked)
+			ranked = append(ranked, rankedCandidate{SecondaryID: candidate.SecondaryID, Collisions: count, Hamming: hamming})
+			continue
+		}
+		if count > ranked[pos].Collisions {
+			ranked[pos].Collisions = count
+		}
+		if hamming < ranked[pos].Hamming {
+			ranked[pos].Hamming = hamming
+		}
+	}
+	return selectRankedCandidates(ranked, topN)
+}
+
+// rankListCandidates sorts candidates of the probed IVF lists by the Hamming distance between
+// the sketches, if the query sketch is set, and then by the rank of their list, keeping the top ones
+func rankListCandidates(candidates []db.HashesRecord, lists []int, querySketch []byte, topN int) []uint64 {
+	listRanks := make(map[uint64]int, len(lists))
+	for rank, list := range lists {
+		listRanks[uint64(list)] = rank
+	}
+	ranked := make([]rankedCandidate, len(candidates))
+	for i, candidate := range candidates {
+		ranked[i] = rankedCandidate{
+			SecondaryID: candidate.SecondaryID,
+			// NOTE: the nearer list is, the more collisions
+			Collisions: len(lists) - listRanks[candidate.Hashes[0]],
+			Hamming:    getSketchDistance(querySketch, candidate.Sketch),
+		}
+	}
+	return selectRankedCandidates(ranked, topN)
+}
+
+// getSketchDistance returns the Hamming distance between the sketches, zero if the query sketch isn't set;
+// candidate without the sketch is farther than any sketched one
+func getSketchDistance(querySketch, sketch []byte) int {
+	if len(querySketch) == 0 {
+		return 0
+	}
+	if len(sketch) != len(querySketch) {
+		return len(querySketch)*8 + 1
+	}
+	return cm.HammingDistance(querySketch, sketch)
+}
+
+// selectRankedCandidates sorts candidates by the Hamming distance, then by the number of collisions,
+// and returns ids of the top ones
+func selectRankedCandidates(ranked []rankedCandidate, topN int) []uint64 {
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hamming != ranked[j].Hamming {
+			return ranked[i].Hamming < ranked[j].Hamming
+		}
+		if ranked[i].Collisions != ranked[j].Collisions {
+			return ranked[i].Collisions > ranked[j].Collisions
+		}
+		return ranked[i].SecondaryID < ranked[j].SecondaryID
+	})
+	if topN > 0 && len(ranked) > topN {
+		ranked = ranked[:topN]
+	}
+	secondaryIDs := make([]uint64, len(ranked))
+	for i := range ranked {
+		secondaryIDs[i] = ranked[i].SecondaryID
+	}
+	return secondaryIDs
+}
+
+// getListsCandidates probes the IVF lists nearest to the query and fetches ids, lists and sketches
+// of their documents, until the time budget of the query is spent; `nprobe` of the request overrides the configured one
+func (annServer *ANNServer) getListsCandidates(query *queryState, collName string, input cm.RequestData, stats *cm.QueryExplain) ([]int, []db.HashesRecord, error) {
+	invertedFile := query.index.InvertedFile
+	if len(input.Vec) != invertedFile.Dims() {
+		return nil, nil, errors.New("vector size does not match the inverted file dimensions")
+	}
+	nprobe := input.NProbe
+	if nprobe <= 0 {
+		nprobe = annServer.Config.App.IVFNProbe
+	}
+	start := time.Now()
+	lists := invertedFile.Probe(input.Vec, nprobe)
+	stats.Timing.Hashing = int64(time.Since(start))
+	start = time.Now()
+	var candidates []db.HashesRecord
+	for i, list := range lists {
+		if query.isBudgetSpent() {
+			// NOTE: lists which haven't been probed must not be counted by the ranking
+			lists = lists[:i]
+			break
+		}
+		listCandidates, err := annServer.getCandidates(query.budgetCtx, collName, map[int]uint64{0: uint64(list)}, query.maxCandidates)
+		if err = query.checkScanErr(err); err != nil {
+			return nil, nil, err
+		}
+		stats.Truncated = stats.Truncated || isTruncated(len(listCandidates), query.maxCandidates)
+		candidates = append(candidates, listCandidates...)
+	}
+	stats.Timing.Fetch = int64(time.Since(start))
+	return lists, candidates, nil
+}
+
+// getForestCandidates visits leaves of the forest trees, nearest to the query first, until `searchK`
+// distinct candidates are collected, fetching ids, hashes and sketches of their documents; returns
+// the leaves of the query itself to rank the candidates by the number of collisions with them; the search also
+// stops once the time budget of the query is spent. `searchK` of the request overrides the configured one,
+// which defaults to the number of trees times MaxNN
+func (annServer *ANNServer) getForestCandidates(query *queryState, collName string, input cm.RequestData, stats *cm.QueryExplain) (map[int]uint64, []db.HashesRecord, error) {
+	forest := query.index.Forest
+	if len(input.Vec) != forest.Config.Dims {
+		return nil, nil, errors.New("vector size does not match the forest dimensions")
+	}
+	searchK := input.SearchK
+	if searchK <= 0 {
+		searchK = annServer.Config.App.ForestSearchK
+	}
+	if searchK <= 0 {
+		searchK = len(forest.Trees) * annServer.Config.App.MaxNN
+	}
+
+	// NOTE: storage matches the single hash per table, so leaves are fetched in rounds of one leaf per tree
+	var candidates []db.HashesRecord
+	var err error
+	seen := make(map[uint64]struct{})
+	round := make(map[int]uint64)
+	// NOTE: the tree traversal is interleaved with the fetches, so the fetches are timed one by one
+	start := time.Now()
+	var fetchElapsed time.Duration
+	fetchRound := func() bool {
+		var roundCandidates []db.HashesRecord
+		fetchStart := time.Now()
+		roundCandidates, err = annServer.getCandidates(query.budgetCtx, collName, round, query.maxCandidates)
+		fetchElapsed += time.Since(fetchStart)
+		round = make(map[int]uint64)
+		if err = query.checkScanErr(err); err != nil {
+			return false
+		}
+		stats.Truncated = stats.Truncated || isTruncated(len(roundCandidates), query.maxCandidates)
+		for _, candidate := range roundCandidates {
+			seen[candidate.SecondaryID] = struct{}{}
+		}
+		candidates = append(candidates, roundCandidates...)
+		return len(seen) < searchK && !query.isBudgetSpent()
+	}
+	inputVec := cm.NewVec(input.Vec)
+	forest.Search(inputVec, func(table int, hash uint64) bool {
+		if _, ok := round[table]; ok && !fetchRound() {
+			return false
+		}
+		round[table] = hash
+		return true
+	})
+	if err == nil && len(round) > 0 && !query.isBudgetSpent() {
+		fetchRound()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := forest.GetHashes(inputVec)
+	stats.Timing.Fetch = int64(fetchElapsed)
+	stats.Timing.Hashing = int64(time.Since(start) - fetchElapsed)
+	return hashes, candidates, nil
+}
+
+// getCandidateDistFunc returns function which computes distance from the query to the candidate,
+// directly on the codes if the candidate is quantized, and checks it against the distance threshold
+func getCandidateDistFunc(index *ActiveIndex, inputVec blas64.Vector) func(candidate db.HashesRecord) (float64, bool) {
+	quantizer := index.Quantizer
+	var codesDist func(codes []byte) (float64, bool)
+	if quantizer != nil {
+		codesDist = quantizer.GetDistanceFunc(inputVec.Data, index.Hasher.Config.IsAngularDistance == 1)
+	}
+	return func(candidate db.HashesRecord) (float64, bool) {
+		if len(candidate.Codes) == 0 || codesDist == nil {
+			return index.Hasher.GetDist(inputVec, cm.NewVec(candidate.FeatureVec))
+		}
+		dist, ok := codesDist(candidate.Codes)
+		return dist, ok && dist <= index.Hasher.Config.DistanceThrsh
+	}
+}
+
+// rerankNeighbors recomputes exact distances for the top neighbors found on the quantized codes,
+// using the float32 copies of the vectors; the window covers at least MaxNN neighbors and only
+// the reranked ones are returned, so the exact and approximate distances aren't mixed
+func (annServer *ANNServer) rerankNeighbors(ctx context.Context, index *ActiveIndex, collName string, inputVec blas64.Vector, neighbors []cm.NeighborsRecord) ([]cm.NeighborsRecord, error) {
+	rerankSize := annServer.Config.App.RerankSize
+	if rerankSize < annServer.Config.App.MaxNN {
+		rerankSize = annServer.Config.App.MaxNN
+	}
+	if len(neighbors) < rerankSize {
+		rerankSize = len(neighbors)
+	}
+	secondaryIDs := make([]uint64, rerankSize)
+	for i := range secondaryIDs {
+		secondaryIDs[i] = neighbors[i].SecondaryID
+	}
+	vectors, err := annServer.Store.GetVectors(ctx, collName, secondaryIDs, true)
+	if err != nil {
+		return nil, err
+	}
+	reranked := make([]cm.NeighborsRecord, 0, rerankSize)
+	for _, vector := range vectors {
+		vec := restoreVector(vector, index.Quantizer)
+		if len(vec) == 0 {
 			continue
 		}
-		dist, ok := annServer.Hasher.GetDist(inputVec, cm.NewVec(candidate.FeatureVec))
+		dist, ok := index.Hasher.GetDist(inputVec, cm.NewVec(vec))
 		if ok {
-			neighbors = append(neighbors, cm.NeighborsRecord{
-				SecondaryID: candidate.SecondaryID,
+			reranked = append(reranked, cm.NeighborsRecord{
+				SecondaryID: vector.SecondaryID,
 				Dist:        dist,
 			})
-			idx++
 		}
 	}
-	sort.Slice(neighbors, func(i, j int) bool {
-		return neighbors[i].Dist < neighbors[j].Dist
+	sort.Slice(reranked, func(i, j int) bool {
+		return reranked[i].Dist < reranked[j].Dist
 	})
-	answerSize := annServer.Config.App.MaxNN
-	if len(neighbors) < answerSize {
-		answerSize = len(neighbors)
+	return reranked, nil
+}
+
+// getNeighbors returns filtered nearest neighbors sorted by distance in ascending order, searching
+// the active index, or scanning all the vectors if the exact search is requested, the index is flat,
+// small or isn't ready; the response tells which strategy has answered and whether the search has stopped early
+func (annServer *ANNServer) getNeighbors(ctx context.Context, input cm.RequestData) (*cm.ResponseData, error) {
+	var explain *cm.QueryExplain
+	if input.Explain {
+		explain = &cm.QueryExplain{}
+	}
+	query := annServer.newQueryState(ctx, input, explain)
+	defer query.close()
+	neighbors, strategy, err := annServer.searchNeighbors(query, input)
+	if err != nil {
+		return nil, err
 	}
-	neighborsIDs := make([]uint64, answerSize)
-	for i := 0; i < answerSize; i++ {
-		neighborsIDs[i] = neighbors[i].SecondaryID
+	neighborsIDs := make([]uint64, len(neighbors))
+	for i, neighbor := range neighbors {
+		neighborsIDs[i] = neighbor.SecondaryID
 	}
 	return &cm.ResponseData{
-		Results: neighborsIDs,
+		Results:    neighborsIDs,
+		Strategy:   strategy,
+		Explain:    explain,
+		Partial:    len(query.stopReason) > 0,
+		StopReason: query.stopReason,
 	}, nil
 }
+
+// searchNeighbors returns the top MaxNN neighbors with their distances and the strategy which has found them,
+// within the limits of the query; complete results are cached, and the cached ones are returned unless
+// the query must be explained
+func (annServer *ANNServer) searchNeighbors(query *queryState, input cm.RequestData) ([]cm.NeighborsRecord, string, error) {
+	start := time.Now()
+	index, collName, isExact, err := annServer.selectExactScan(input)
+	if err != nil {
+		return nil, "", err
+	}
+	query.index = index
+	if query.explain != nil {
+		query.explain.Timing.HelperRead = int64(time.Since(start))
+	}
+	// NOTE: the cache is checked after the hasher is updated, so the reload drops the outdated results first
+	resultsKey := getResultsKey(input)
+	generation := annServer.resultsCache.getGeneration()
+	if query.explain == nil {
+		if cached, ok := annServer.resultsCache.get(resultsKey); ok {
+			results := cached.(*cachedResults)
+			return results.neighbors, results.strategy, query.emitAll(results.neighbors)
+		}
+	}
+	var neighbors []cm.NeighborsRecord
+	strategy := index.IndexType
+	isEmitted := false
+	switch {
+	case isExact:
+		strategy = cm.IndexTypeFlat
+		neighbors, err = annServer.getFlatNeighbors(query, collName, input)
+	case index.IndexType == cm.IndexTypeHNSW:
+		// NOTE: graph is searched in memory, so only the deadline of the query is checked
+		if err = query.ctx.Err(); err == nil {
+			neighbors, err = annServer.getGraphNeighbors(index, input, query.explain)
+		}
+	default:
+		neighbors, err = annServer.getHashNeighbors(query, collName, input)
+		isEmitted = true
+	}
+	// NOTE: the exact scan and the graph find the neighbors at once, so they are emitted after the search
+	if err == nil && !isEmitted {
+		err = query.emitAll(neighbors)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if query.explain != nil {
+		query.explain.Timing.Total = int64(time.Since(start))
+	}
+	if len(query.stopReason) == 0 {
+		annServer.resultsCache.put(resultsKey, &cachedResults{neighbors: neighbors, strategy: strategy}, generation)
+	}
+	return neighbors, strategy, nil
+}
+
+// getHashNeighbors searches the index of hash tables, IVF lists or forest leaves;
+// candidates are fetched in two phases: ids, hashes and sketches first, to rank them by the Hamming
+// distance and the number of collisions (or the rank of the IVF list), and then vectors only for the top ranked ones;
+// with the forest, collisions are counted with the leaves of the query. If the query is limited, vectors
+// are fetched in batches, from the top ranked candidates, until the time budget is spent or enough
+// good neighbors are found. Stats of the stages are collected into explain, if it's set
+func (annServer *ANNServer) getHashNeighbors(query *queryState, collName string, input cm.RequestData) ([]cm.NeighborsRecord, error) {
+	// NOTE: timings are collected anyway for the log, while the per-table stats only on request
+	stats := query.explain
+	if stats == nil {
+		stats = &cm.QueryExplain{}
+	}
+	index := query.index
+	start := time.Now()
+	var err error
+	inputVec := cm.NewVec(input.Vec)
+	var hashes map[int]uint64
+	var lists []int
+	var candidates []db.HashesRecord
+	switch index.IndexType {
+	case cm.IndexTypeIVF:
+		lists, candidates, err = annServer.getListsCandidates(query, collName, input, stats)
+	case cm.IndexTypeForest:
+		hashes, candidates, err = annServer.getForestCandidates(query, collName, input, stats)
+	default:
+		start = time.Now()
+		hashes = index.Hasher.GetHashes(inputVec)
+		stats.Timing.Hashing = int64(time.Since(start))
+		start = time.Now()
+		candidates, err = annServer.getCandidates(query.budgetCtx, collName, hashes, query.maxCandidates)
+		err = query.checkScanErr(err)
+		stats.Timing.Fetch = int64(time.Since(start))
+		stats.Truncated = isTruncated(len(candidates), query.maxCandidates)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stats.Truncated && query.hasCandidatesBudget {
+		query.stop(cm.StopReasonCandidates)
+	}
+	if query.explain != nil {
+		explainCandidates(query.explain, hashes, lists, candidates)
+	}
+
+	start = time.Now()
+	var candidateIDs []uint64
+	querySketch := index.Hasher.GetSketch(inputVec)
+	if index.IndexType == cm.IndexTypeIVF {
+		candidateIDs = rankListCandidates(candidates, lists, querySketch, annServer.Config.App.MaxCandidates)
+	} else {
+		candidateIDs = rankCandidates(candidates, hashes, querySketch, annServer.Config.App.MaxCandidates)
+	}
+	stats.Timing.Ranking = int64(time.Since(start))
+	stats.Ranked = len(candidateIDs)
+
+	var neighbors []cm.NeighborsRecord
+	var emit func(cm.NeighborsRecord) error
+	var rerankElapsed time.Duration
+	distanceMode := getDistanceMode(input)
+	if distanceMode == cm.DistanceModeDb && index.Quantizer != nil {
+		return nil, errDbDistanceQuantized
+	}
+	switch distanceMode {
+	case cm.DistanceModeDb:
+		// NOTE: storage fetches, filters and sorts the vectors at once, so it's all counted as distances
+		start = time.Now()
+		neighbors, err = annServer.Store.GetNearestVectors(query.ctx, collName, candidateIDs, db.DistanceQuery{
+			Vec:       input.Vec,
+			IsAngular: index.Hasher.Config.IsAngularDistance == 1,
+			Thrsh:     index.Hasher.Config.DistanceThrsh,
+			Limit:     annServer.Config.App.MaxNN,
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats.Timing.Distances = int64(time.Since(start))
+		stats.PassedThrsh = len(neighbors)
+	default:
+		// NOTE: distances are final unless the neighbors are re-ranked, so the neighbor is emitted as soon as
+		// its batch is consumed, if it's among the nearest MaxNN found so far
+		if index.Quantizer == nil || annServer.Config.App.RerankSize <= 0 {
+			emit = query.emit
+		}
+		top := neighborsHeap{}
+		batchSize := len(candidateIDs)
+		if query.isLimited() && annServer.Config.App.BatchSize > 0 {
+			batchSize = annServer.Config.App.BatchSize
+		}
+		getDist := getCandidateDistFunc(index, inputVec)
+		goodNeighbors := 0
+		for i := 0; i < len(candidateIDs); i += batchSize {
+			// NOTE: the first batch is fetched anyway, so the query which has spent its budget still gets some neighbors
+			if i > 0 && query.isBudgetSpent() {
+				break
+			}
+			if query.goodEnough > 0 && goodNeighbors >= annServer.Config.App.MaxNN {
+				query.stop(cm.StopReasonGoodEnough)
+				break
+			}
+			batchEnd := i + batchSize
+			if batchEnd > len(candidateIDs) {
+				batchEnd = len(candidateIDs)
+			}
+			start = time.Now()
+			vectors, err := annServer.Store.GetVectors(query.ctx, collName, candidateIDs[i:batchEnd], false)
+			if err != nil {
+				return nil, err
+			}
+			stats.Timing.Fetch += int64(time.Since(start))
+
+			start = time.Now()
+			for _, candidate := range vectors {
+				dist, ok := getDist(candidate)
+				if !ok {
+					continue
+				}
+				neighbor := cm.NeighborsRecord{SecondaryID: candidate.SecondaryID, Dist: dist}
+				neighbors = append(neighbors, neighbor)
+				if dist <= query.goodEnough {
+					goodNeighbors++
+				}
+				if emit != nil && top.pushTop(neighbor, annServer.Config.App.MaxNN) {
+					if err = emit(neighbor); err != nil {
+						return nil, err
+					}
+				}
+			}
+			stats.Timing.Distances += int64(time.Since(start))
+		}
+		// NOTE: the candidates are counted before the sort and the MaxNN cut, distances of the candidates
+		// which are out of DistanceThrsh aren't returned by getDist
+		stats.PassedThrsh = len(neighbors)
+
+		start = time.Now()
+		sort.Slice(neighbors, func(i, j int) bool {
+			return neighbors[i].Dist < neighbors[j].Dist
+		})
+		stats.Timing.Sort = int64(time.Since(start))
+
+		if index.Quantizer != nil && annServer.Config.App.RerankSize > 0 {
+			start = time.Now()
+			neighbors, err = annServer.rerankNeighbors(query.ctx, index, collName, inputVec, neighbors)
+			if err != nil {
+				return nil, err
+			}
+			rerankElapsed = time.Since(start)
+		}
+	}
+	annServer.Logger.Info.Printf(
+		"Query timing: helper %v; hashes %v; fetch %v (%v fetched, truncated %v); ranking %v (%v kept); distances %v (%v found, %v mode); sort %v; re-rank %v; stop reason %q",
+		time.Duration(stats.Timing.HelperRead), time.Duration(stats.Timing.Hashing), time.Duration(stats.Timing.Fetch), len(candidates), stats.Truncated,
+		time.Duration(stats.Timing.Ranking), len(candidateIDs), time.Duration(stats.Timing.Distances), len(neighbors), distanceMode,
+		time.Duration(stats.Timing.Sort), rerankElapsed, query.stopReason,
+	)
+
+	if len(neighbors) > annServer.Config.App.MaxNN {
+		neighbors = neighbors[:annServer.Config.App.MaxNN]
+	}
+	if emit != nil {
+		return neighbors, nil
+	}
+	return neighbors, query.emitAll(neighbors)
+}
+
+// isTruncated checks if the fetch of candidates has hit the limit, so some of them may be missed
+func isTruncated(fetched, limit int) bool {
+	return limit > 0 && fetched >= limit
+}
+
+// explainCandidates counts candidates colliding with the query per table, and the share of unique candidates;
+// for the IVF index tables are the probed lists in the order of probing
+func explainCandidates(explain *cm.QueryExplain, hashes map[int]uint64, lists []int, candidates []db.HashesRecord) {
+	if lists != nil {
+		hashes = make(map[int]uint64, len(lists))
+		for rank, list := range lists {
+			hashes[rank] = uint64(list)
+		}
+	}
+	explain.Hashes = hashes
+	explain.TableCandidates = make(map[int]int, len(hashes))
+	unique := make(map[uint64]struct{}, len(candidates))
+	for _, candidate := range candidates {
+		unique[candidate.SecondaryID] = struct{}{}
+		for table, hash := range hashes {
+			candidateTable := table
+			if lists != nil {
+				candidateTable = 0
+			}
+			if candidateHash, ok := candidate.Hashes[candidateTable]; ok && candidateHash == hash {
+				explain.TableCandidates[table]++
+			}
+		}
+	}
+	explain.Fetched = len(candidates)
+	explain.Unique = len(unique)
+	if len(candidates) > 0 {
+		explain.DedupeRatio = float64(len(unique)) / float64(len(candidates))
+	}
+}
@@ -0,0 +1,246 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+)
+
+// newInstanceID returns the id of the service instance, used as the owner of the build lease
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "ann"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// getBuildLeaseTTL returns the time after which the lease of the dead owner expires, zero disables the lease
+func (annServer *ANNServer) getBuildLeaseTTL() time.Duration {
+	return time.Duration(annServer.Config.App.BuildLeaseTTL) * time.Second
+}
+
+// acquireBuildLease takes the build lease for this instance and starts renewing it, the lost lease
+// and the cancel requested by another instance cancel the build. The lease expired after its owner has died is taken over once the build of the dead owner
+// is rolled back. Returns errBuildInProgress if the lease is held by the live owner, and the nil keeper
+// if the lease is disabled
+func (annServer *ANNServer) acquireBuildLease(input *cm.DatasetStats, cancel context.CancelFunc) (*buildLeaseKeeper, error) {
+	ttl := annServer.getBuildLeaseTTL()
+	if ttl <= 0 {
+		return nil, nil
+	}
+	now := time.Now().UnixNano()
+	lease := db.BuildLease{
+		Owner:     annServer.instanceID,
+		Heartbeat: now,
+		Expires:   now + int64(ttl),
+		Input:     input,
+	}
+	prev, err := annServer.Store.AcquireBuildLease(lease)
+	if err == db.ErrLeaseHeld {
+		return nil, errBuildInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	keeper := &buildLeaseKeeper{
+		store:  annServer.Store,
+		logger: annServer.Logger,
+		lease:  lease,
+		ttl:    ttl,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go keeper.keep()
+	if len(prev.Owner) != 0 && prev.Owner != lease.Owner {
+		annServer.Logger.Warn.Printf("Build lease: %s has died, rolling back its build", prev.Owner)
+		err = annServer.rollbackBuild(prev)
+		if err != nil {
+			keeper.release()
+			return nil, err
+		}
+	}
+	return keeper, nil
+}
+
+// rollbackBuild undoes the build of the dead lease owner: its hash collection is dropped and the build
+// status preceding the build is restored. The build which has been saved already is kept
+func (annServer *ANNServer) rollbackBuild(dead db.BuildLease) error {
+	helperRecord, err := annServer.Store.GetHelperRecord(false)
+	if err != nil {
+		return err
+	}
+	if len(dead.HashCollName) != 0 && helperRecord.HashCollName == dead.HashCollName {
+		return nil
+	}
+	if len(dead.HashCollName) != 0 {
+		err = annServer.Store.DropCollection(dead.HashCollName)
+		if err != nil {
+			annServer.Logger.Warn.Println("Build lease: dropping hash collection of the dead build: " + err.Error())
+		}
+	}
+	// NOTE: the status is saved in the lease before the build marks itself in progress
+	isBuildRunning := !helperRecord.ID.IsZero() && !helperRecord.IsBuildDone && len(helperRecord.BuildError) == 0
+	if !isBuildRunning {
+		return nil
+	}
+	err = annServer.Store.UpdateBuildStatus(dead.PrevStatus)
+	if err != nil {
+		return err
+	}
+	return annServer.Store.UpdateBuildProgress(cm.BuildProgress{Phase: cm.BuildPhaseCancelled})
+}
+
+// isBuildLeaseHeld checks if the build lease is held by another live instance
+func (annServer *ANNServer) isBuildLeaseHeld() bool {
+	if annServer.getBuildLeaseTTL() <= 0 {
+		return false
+	}
+	lease, err := annServer.Store.GetBuildLease()
+	if err != nil {
+		annServer.Logger.Warn.Println("Build lease: " + err.Error())
+		return false
+	}
+	return len(lease.Owner) != 0 && lease.Owner != annServer.instanceID && lease.Expires >= time.Now().UnixNano()
+}
+
+// requestBuildCancel asks another instance to cancel its build by marking its lease, the owner cancels
+// the build with the next renew. Returns false if there is no build of the live owner
+func (annServer *ANNServer) requestBuildCancel() (bool, error) {
+	if annServer.getBuildLeaseTTL() <= 0 {
+		return false, nil
+	}
+	lease, err := annServer.Store.GetBuildLease()
+	if err != nil {
+		return false, err
+	}
+	if len(lease.Owner) == 0 || lease.Owner == annServer.instanceID || lease.Expires < time.Now().UnixNano() {
+		return false, nil
+	}
+	err = annServer.Store.RequestBuildCancel(lease.Owner)
+	if err == db.ErrLeaseLost {
+		// NOTE: the build has been finished or released meanwhile
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MonitorBuildLease periodically checks the build lease and takes over the build of the dead owner:
+// the build is rerun with the same input, or only rolled back if the takeover is disabled
+func (annServer *ANNServer) MonitorBuildLease(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		lease, err := annServer.Store.GetBuildLease()
+		if err != nil {
+			annServer.Logger.Warn.Println("Monitoring build lease: " + err.Error())
+			continue
+		}
+		if len(lease.Owner) == 0 || lease.Owner == annServer.instanceID || lease.Expires >= time.Now().UnixNano() {
+			continue
+		}
+		ctx, err := annServer.startBuild()
+		if err != nil {
+			continue
+		}
+		if annServer.Config.App.BuildTakeover == 1 && lease.Input != nil {
+			annServer.Logger.Info.Printf("Monitoring build lease: taking over the build of %s", lease.Owner)
+			err = annServer.BuildIndex(ctx, *lease.Input)
+		} else {
+			var keeper *buildLeaseKeeper
+			keeper, err = annServer.acquireBuildLease(nil, func() {})
+			keeper.release()
+		}
+		annServer.finishBuild()
+		if err != nil {
+			annServer.Logger.Err.Println("Monitoring build lease: " + err.Error())
+		}
+	}
+}
+
+// keep renews the lease every third of its TTL until the keeper is released
+func (keeper *buildLeaseKeeper) keep() {
+	defer close(keeper.done)
+	ticker := time.NewTicker(keeper.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-keeper.stop:
+			return
+		case <-ticker.C:
+			err := keeper.renew(nil)
+			if err == errBuildLeaseLost {
+				keeper.cancel()
+				return
+			}
+			if err == context.Canceled {
+				return
+			}
+			if err != nil {
+				keeper.logger.Warn.Println("Build lease: renewing: " + err.Error())
+			}
+		}
+	}
+}
+
+// renew applies the update to the lease and prolongs it; returns errBuildLeaseLost if the lease
+// has been taken over by another instance, and cancels the build if another instance has requested it
+func (keeper *buildLeaseKeeper) renew(update func(lease *db.BuildLease)) error {
+	if keeper == nil {
+		return nil
+	}
+	keeper.Lock()
+	defer keeper.Unlock()
+	if keeper.isLost {
+		return errBuildLeaseLost
+	}
+	if update != nil {
+		update(&keeper.lease)
+	}
+	now := time.Now().UnixNano()
+	keeper.lease.Heartbeat, keeper.lease.Expires = now, now+int64(keeper.ttl)
+	err := keeper.store.RenewBuildLease(keeper.lease)
+	if err == db.ErrLeaseLost {
+		keeper.isLost = true
+		return errBuildLeaseLost
+	}
+	if err == db.ErrCancelRequested {
+		keeper.cancel()
+		return context.Canceled
+	}
+	return err
+}
+
+// isLeaseLost checks if the lease has been taken over by another instance
+func (keeper *buildLeaseKeeper) isLeaseLost() bool {
+	if keeper == nil {
+		return false
+	}
+	keeper.Lock()
+	defer keeper.Unlock()
+	return keeper.isLost
+}
+
+// release stops renewing the lease and drops it, unless it has been taken over
+func (keeper *buildLeaseKeeper) release() {
+	if keeper == nil {
+		return
+	}
+	close(keeper.stop)
+	<-keeper.done
+	if keeper.isLeaseLost() {
+		return
+	}
+	err := keeper.store.ReleaseBuildLease(keeper.lease.Owner)
+	if err != nil {
+		keeper.logger.Warn.Println("Build lease: releasing: " + err.Error())
+	}
+}
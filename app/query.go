@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	cm "lsh-search-service/common"
+)
+
+// getQueryContext returns the context of the request bound by the query deadline;
+// `timeout` of the request overrides the configured one, zero means no deadline
+func (annServer *ANNServer) getQueryContext(parent context.Context, input cm.RequestData) (context.Context, context.CancelFunc) {
+	timeout := input.Timeout
+	if timeout <= 0 {
+		timeout = annServer.Config.App.QueryTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
+}
+
+// newQueryState sets the limits of the query; `timeBudget`, `goodEnough` and `candidatesBudget` of the request
+// override the configured ones, zero disables them. The state must be closed to release the budget timer
+func (annServer *ANNServer) newQueryState(ctx context.Context, input cm.RequestData, explain *cm.QueryExplain) *queryState {
+	query := &queryState{
+		ctx:          ctx,
+		budgetCtx:    ctx,
+		cancelBudget: func() {},
+		goodEnough:   input.GoodEnough,
+		explain:      explain,
+	}
+	query.maxCandidates, query.hasCandidatesBudget = input.CandidatesBudget, input.CandidatesBudget > 0
+	if !query.hasCandidatesBudget {
+		query.maxCandidates = annServer.Config.App.MaxHashesQuery
+	}
+	if query.goodEnough <= 0 {
+		query.goodEnough = annServer.Config.App.GoodEnoughDist
+	}
+	budget := input.TimeBudget
+	if budget <= 0 {
+		budget = annServer.Config.App.QueryTimeBudget
+	}
+	if budget > 0 {
+		query.budgetCtx, query.cancelBudget = context.WithTimeout(ctx, time.Duration(budget)*time.Millisecond)
+	}
+	return query
+}
+
+// emitAll passes the neighbors found at once to emit of the streamed query
+func (query *queryState) emitAll(neighbors []cm.NeighborsRecord) error {
+	if query.emit == nil {
+		return nil
+	}
+	for _, neighbor := range neighbors {
+		if err := query.emit(neighbor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close releases the budget timer of the query
+func (query *queryState) close() {
+	query.cancelBudget()
+}
+
+// isLimited checks if the query may stop before all the candidates are checked
+func (query *queryState) isLimited() bool {
+	return query.budgetCtx != query.ctx || query.goodEnough > 0
+}
+
+// stop keeps the first reason of the early stop
+func (query *queryState) stop(reason string) {
+	if len(query.stopReason) == 0 {
+		query.stopReason = reason
+	}
+}
+
+// isBudgetSpent checks if the time budget of the query is spent, while its deadline isn't hit yet,
+// so the search must go on with the candidates found so far
+func (query *queryState) isBudgetSpent() bool {
+	if query.ctx.Err() != nil || query.budgetCtx.Err() == nil {
+		return false
+	}
+	query.stop(cm.StopReasonTimeBudget)
+	return true
+}
+
+// checkScanErr separates the error of the scan stopped by the time budget from the real errors:
+// the former is dropped, so the scanned candidates are used
+func (query *queryState) checkScanErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && query.isBudgetSpent() {
+		return nil
+	}
+	return err
+}
+
+// getQueryErrorStatus returns the response status of the failed query: the query which has hit
+// its deadline and the query which can't be run with the active index are told apart from the other errors
+func getQueryErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if err == errDbDistanceQuantized {
+		return http.StatusBadRequest
+	}
+	if err == errIndexNotReady {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
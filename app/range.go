@@ -0,0 +1,279 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+)
+
+// NOTE: range search keeps probing while the probes find new neighbors within the radius,
+// and stops after this number of consecutive probes without them
+const rangeEmptyRounds = 2
+
+var errRangeTokenExpired = errors.New("Range search: index has been rebuilt since the token was issued, the search must be restarted")
+
+// encodeRangeToken serializes the position of the last neighbor of the page
+func encodeRangeToken(token rangeToken) (string, error) {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeRangeToken restores the position of the last neighbor of the previous page
+func decodeRangeToken(token string) (rangeToken, error) {
+	decoded := rangeToken{}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return decoded, err
+	}
+	err = json.Unmarshal(b, &decoded)
+	return decoded, err
+}
+
+// getRangeNeighbors returns the page of the neighbors within the radius of the request, sorted
+// by the distance, with the token of the next page if there are more neighbors. There is no MaxNN cap,
+// and the index is probed further until the probes stop finding new neighbors. All the neighbors are
+// kept in the cursor of the service instance, so the next pages don't repeat the search; if the cursor
+// has expired or the page is requested from another instance, the search is repeated and the page
+// is found by the position of the last neighbor, as long as the index hasn't been rebuilt
+func (annServer *ANNServer) getRangeNeighbors(ctx context.Context, input cm.RequestData) (*cm.ResponseData, error) {
+	var token *rangeToken
+	if len(input.Token) != 0 {
+		decoded, err := decodeRangeToken(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		token = &decoded
+	}
+	var cursor *rangeCursor
+	var cursorID string
+	if token != nil {
+		cursorID = token.Cursor
+		cursor = annServer.cursors.get(cursorID)
+	}
+	if cursor == nil {
+		var err error
+		cursor, err = annServer.searchRange(ctx, input, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != nil && token.BuildTime != cursor.buildTime {
+			return nil, errRangeTokenExpired
+		}
+		sortNeighbors(cursor.neighbors)
+		cursorID = ""
+	}
+
+	neighbors := cursor.neighbors
+	if token != nil {
+		last := cm.NeighborsRecord{SecondaryID: token.SecondaryID, Dist: token.Dist}
+		neighbors = neighbors[sort.Search(len(neighbors), func(i int) bool {
+			return isFarther(neighbors[i], last)
+		}):]
+	}
+	pageSize := input.PageSize
+	if pageSize <= 0 {
+		pageSize = annServer.Config.App.RangePageSize
+	}
+	result := &cm.ResponseData{Strategy: cursor.strategy}
+	if pageSize > 0 && len(neighbors) > pageSize {
+		neighbors = neighbors[:pageSize]
+		var err error
+		if len(cursorID) == 0 {
+			cursorID, err = annServer.cursors.put(cursor)
+			if err != nil {
+				return nil, err
+			}
+		}
+		last := neighbors[len(neighbors)-1]
+		result.Token, err = encodeRangeToken(rangeToken{
+			Cursor:      cursorID,
+			BuildTime:   cursor.buildTime,
+			Dist:        last.Dist,
+			SecondaryID: last.SecondaryID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Results = neighbors
+	return result, nil
+}
+
+// searchRange finds all the neighbors within the radius of the request and returns them in the cursor,
+// with the strategy which has found them and the build time of the searched index; if emit is set, it gets every neighbor as soon as it's found,
+// so neighbors found by the probes of the hash index are emitted unsorted. Range search has no budget,
+// it fails once the deadline of the context is hit
+func (annServer *ANNServer) searchRange(ctx context.Context, input cm.RequestData, emit func(cm.NeighborsRecord) error) (*rangeCursor, error) {
+	index, collName, isExact, err := annServer.selectExactScan(input)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var neighbors []cm.NeighborsRecord
+	strategy := index.IndexType
+	switch {
+	case isExact:
+		strategy = cm.IndexTypeFlat
+		neighbors, _, err = annServer.scanNeighbors(ctx, index, collName, input.Vec, math.MaxInt32, input.Radius, 0)
+	case index.IndexType == cm.IndexTypeHNSW:
+		if err = ctx.Err(); err == nil {
+			neighbors, err = annServer.getGraphRange(index, input)
+		}
+	default:
+		neighbors, err = annServer.getHashRange(ctx, index, collName, input, emit)
+		emit = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if emit != nil {
+		for _, neighbor := range neighbors {
+			if err = emit(neighbor); err != nil {
+				return nil, err
+			}
+		}
+	}
+	annServer.Logger.Info.Printf("Query timing: range search %v (%v found, %v strategy)", time.Since(start), len(neighbors), strategy)
+	return &rangeCursor{neighbors: neighbors, strategy: strategy, buildTime: index.LastBuildTime}, nil
+}
+
+// getGraphRange searches the graph with the doubling beam, until the farthest found node
+// is out of the radius or the graph has no more nodes
+func (annServer *ANNServer) getGraphRange(index *ActiveIndex, input cm.RequestData) ([]cm.NeighborsRecord, error) {
+	graph := index.Graph
+	if len(input.Vec) != graph.Config.Dims {
+		return nil, errors.New("vector size does not match the graph dimensions")
+	}
+	k := input.Ef
+	if k <= 0 {
+		k = graph.Config.Ef
+	}
+	if k <= 0 {
+		k = annServer.Config.App.MaxNN
+	}
+	for {
+		found := graph.Search(input.Vec, k, k)
+		within := 0
+		for within < len(found) && found[within].Dist <= input.Radius {
+			within++
+		}
+		if within < len(found) || len(found) < k {
+			return found[:within], nil
+		}
+		k *= 2
+	}
+}
+
+// getRangeProbes returns the rounds of probes of the hash index, from the most to the least likely
+// to hold the neighbors of the query, and the number of rounds which are probed anyway:
+// LSH buckets of the query and then the buckets which differ in a single plane, IVF lists
+// from the nearest one, forest leaves in the order of the forest search
+func (annServer *ANNServer) getRangeProbes(index *ActiveIndex, vec []float64) ([]map[int]uint64, int, error) {
+	switch index.IndexType {
+	case cm.IndexTypeIVF:
+		if len(vec) != index.InvertedFile.Dims() {
+			return nil, 0, errors.New("vector size does not match the inverted file dimensions")
+		}
+		lists := index.InvertedFile.Probe(vec, 0)
+		rounds := make([]map[int]uint64, len(lists))
+		for i, list := range lists {
+			rounds[i] = map[int]uint64{0: uint64(list)}
+		}
+		return rounds, annServer.Config.App.IVFNProbe, nil
+	case cm.IndexTypeForest:
+		if len(vec) != index.Forest.Config.Dims {
+			return nil, 0, errors.New("vector size does not match the forest dimensions")
+		}
+		var rounds []map[int]uint64
+		round := make(map[int]uint64)
+		index.Forest.Search(cm.NewVec(vec), func(table int, hash uint64) bool {
+			if _, ok := round[table]; ok {
+				rounds = append(rounds, round)
+				round = make(map[int]uint64)
+			}
+			round[table] = hash
+			return true
+		})
+		if len(round) > 0 {
+			rounds = append(rounds, round)
+		}
+		return rounds, 1, nil
+	}
+	hashes := index.Hasher.GetHashes(cm.NewVec(vec))
+	rounds := []map[int]uint64{hashes}
+	for plane := 0; plane < index.Hasher.Config.NPlanes; plane++ {
+		round := make(map[int]uint64, len(hashes))
+		for table, hash := range hashes {
+			round[table] = hash ^ (1 << plane)
+		}
+		rounds = append(rounds, round)
+	}
+	return rounds, 1, nil
+}
+
+// getHashRange probes the hash index round by round, computing the exact distances to the new candidates
+// and emitting the neighbors found by the round, if emit is set
+func (annServer *ANNServer) getHashRange(ctx context.Context, index *ActiveIndex, collName string, input cm.RequestData, emit func(cm.NeighborsRecord) error) ([]cm.NeighborsRecord, error) {
+	rounds, minRounds, err := annServer.getRangeProbes(index, input.Vec)
+	if err != nil {
+		return nil, err
+	}
+	getDist := getExactDistFunc(index, input.Vec, input.Radius)
+	seen := make(map[uint64]struct{})
+	var neighbors []cm.NeighborsRecord
+	emptyRounds := 0
+	for i, round := range rounds {
+		if i >= minRounds && emptyRounds >= rangeEmptyRounds {
+			break
+		}
+		candidates, err := annServer.getCandidates(ctx, collName, round, annServer.Config.App.MaxHashesQuery)
+		if err != nil {
+			return nil, err
+		}
+		secondaryIDs := make([]uint64, 0, len(candidates))
+		for _, candidate := range candidates {
+			if _, ok := seen[candidate.SecondaryID]; !ok {
+				seen[candidate.SecondaryID] = struct{}{}
+				secondaryIDs = append(secondaryIDs, candidate.SecondaryID)
+			}
+		}
+		found := 0
+		if len(secondaryIDs) > 0 {
+			var vectors []db.HashesRecord
+			vectors, err = annServer.Store.GetVectors(ctx, collName, secondaryIDs, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, vector := range vectors {
+				dist, ok := getDist(vector)
+				if !ok {
+					continue
+				}
+				neighbor := cm.NeighborsRecord{SecondaryID: vector.SecondaryID, Dist: dist}
+				if emit != nil {
+					if err = emit(neighbor); err != nil {
+						return nil, err
+					}
+				}
+				neighbors = append(neighbors, neighbor)
+				found++
+			}
+		}
+		if found == 0 {
+			emptyRounds++
+		} else {
+			emptyRounds = 0
+		}
+	}
+	return neighbors, nil
+}
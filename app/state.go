@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"lsh-search-service/db"
+)
+
+// WatchBuildState keeps the build state in memory until ctx is done, so the requests don't read
+// the helper record: the state is refreshed on every change of the active build streamed by the storage.
+// If the storage can't stream the changes, the state is polled every pollInterval; if the stream fails,
+// the state is polled until the stream is reopened with the next poll. The stream also carries the cache
+// invalidations published by the writes of other instances
+func (annServer *ANNServer) WatchBuildState(ctx context.Context, pollInterval time.Duration) {
+	state := &annServer.buildState
+	state.Lock()
+	state.isWatched = true
+	state.Unlock()
+	defer func() {
+		state.Lock()
+		state.isWatched, state.isSynced = false, false
+		state.Unlock()
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	canStream := true
+	for {
+		if canStream {
+			err := annServer.Store.WatchHelperRecord(ctx, annServer.refreshBuildState, annServer.applyInvalidation)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, db.ErrWatchNotSupported) {
+				canStream = false
+				annServer.Logger.Info.Printf("Watching build state: polling every %v", pollInterval)
+			} else {
+				annServer.Logger.Warn.Println("Watching build state: polling till the stream is reopened: " + err.Error())
+				// NOTE: invalidations published by other instances while the stream is closed are lost
+				annServer.invalidateCache("", nil)
+			}
+		}
+		annServer.refreshBuildState()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshBuildState reads the helper record into the build state, if the state is watched;
+// refreshes are serialized, so the record read earlier never replaces the later one
+func (annServer *ANNServer) refreshBuildState() {
+	state := &annServer.buildState
+	state.refreshMutex.Lock()
+	defer state.refreshMutex.Unlock()
+	state.RLock()
+	isWatched := state.isWatched
+	state.RUnlock()
+	if !isWatched {
+		return
+	}
+	record, err := annServer.Store.GetHelperRecord(false)
+	if err != nil {
+		annServer.Logger.Warn.Println("Refreshing build state: " + err.Error())
+	}
+	state.Lock()
+	defer state.Unlock()
+	if !state.isWatched {
+		return
+	}
+	state.record, state.isSynced = record, err == nil
+}
+
+// getBuildRecord returns the helper record without the hasher: the one kept in memory,
+// if the build state is in sync, or the one read from the storage otherwise
+func (annServer *ANNServer) getBuildRecord() (db.HelperRecord, error) {
+	state := &annServer.buildState
+	state.RLock()
+	record, isSynced := state.record, state.isSynced
+	state.RUnlock()
+	if isSynced {
+		return record, nil
+	}
+	return annServer.Store.GetHelperRecord(false)
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	cm "lsh-search-service/common"
+)
+
+// streamWriter writes the NDJSON stream records, flushing every line to the client
+type streamWriter struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+// isStreamRequested checks if the client accepts the NDJSON stream
+func isStreamRequested(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), cm.ContentTypeNDJSON)
+}
+
+// newStreamWriter starts the streamed response
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	w.Header().Set("Content-Type", cm.ContentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &streamWriter{enc: json.NewEncoder(w), flusher: flusher}
+}
+
+// write sends the single record
+func (sw *streamWriter) write(record cm.StreamRecord) error {
+	err := sw.enc.Encode(record)
+	if err != nil {
+		return err
+	}
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	return nil
+}
+
+// writeNeighbor sends the neighbor
+func (sw *streamWriter) writeNeighbor(neighbor cm.NeighborsRecord) error {
+	return sw.write(cm.StreamRecord{Neighbor: &neighbor})
+}
+
+// streamNeighbors writes the neighbors as soon as the hash index finds them among the nearest MaxNN
+// of the candidates consumed so far, so they aren't sorted and the neighbors written first may be pushed out
+// of the top MaxNN later; the neighbors of the exact scan, the graph, the db distance mode, the re-ranking
+// and the cache are written once the search is done, sorted by the distance. The trailer tells if the search
+// has stopped early and holds the explain of the query if it's requested; the response status is sent
+// with the first line, so the error which happens later is sent as the last line
+func (annServer *ANNServer) streamNeighbors(ctx context.Context, w http.ResponseWriter, input cm.RequestData) {
+	var explain *cm.QueryExplain
+	if input.Explain {
+		explain = &cm.QueryExplain{}
+	}
+	query := annServer.newQueryState(ctx, input, explain)
+	defer query.close()
+	var sw *streamWriter
+	query.emit = func(neighbor cm.NeighborsRecord) error {
+		if sw == nil {
+			sw = newStreamWriter(w)
+		}
+		return sw.writeNeighbor(neighbor)
+	}
+	_, strategy, err := annServer.searchNeighbors(query, input)
+	if err != nil {
+		annServer.Logger.Err.Println("Get NN: " + err.Error())
+		if sw == nil {
+			w.WriteHeader(getQueryErrorStatus(err))
+			return
+		}
+		sw.write(cm.StreamRecord{Error: err.Error()})
+		return
+	}
+	if sw == nil {
+		sw = newStreamWriter(w)
+	}
+	sw.write(cm.StreamRecord{
+		Strategy:   strategy,
+		Explain:    explain,
+		Partial:    len(query.stopReason) > 0,
+		StopReason: query.stopReason,
+	})
+}
+
+// streamRange streams all the neighbors within the radius as soon as they are found, so they
+// aren't sorted, followed by the trailer; the response status is sent with the first line,
+// so the error which happens later is sent as the last line
+func (annServer *ANNServer) streamRange(ctx context.Context, w http.ResponseWriter, input cm.RequestData) {
+	var sw *streamWriter
+	cursor, err := annServer.searchRange(ctx, input, func(neighbor cm.NeighborsRecord) error {
+		if sw == nil {
+			sw = newStreamWriter(w)
+		}
+		return sw.writeNeighbor(neighbor)
+	})
+	if err != nil {
+		annServer.Logger.Err.Println("Get range: " + err.Error())
+		if sw == nil {
+			w.WriteHeader(getQueryErrorStatus(err))
+			return
+		}
+		sw.write(cm.StreamRecord{Error: err.Error()})
+		return
+	}
+	if sw == nil {
+		sw = newStreamWriter(w)
+	}
+	sw.write(cm.StreamRecord{Strategy: cursor.strategy})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	cl "lsh-search-service/client"
+	cm "lsh-search-service/common"
+)
+
+var (
+	serverAddress = os.Getenv("SERVER_ADDRESS")
+	dbtimeOut, _  = strconv.Atoi(os.Getenv("DB_CLIENT_TIMEOUT"))
+	topN, _       = strconv.Atoi(os.Getenv("TOP_BUCKETS"))
+)
+
+func main() {
+	logger := cm.GetNewLogger()
+	if topN <= 0 {
+		topN = 10
+	}
+	client := cl.New(cl.Config{
+		ServerAddress: serverAddress,
+		Timeout:       dbtimeOut,
+	})
+	stats, err := client.GetBucketsStats(topN)
+	if err != nil {
+		logger.Err.Fatal(err)
+	}
+	for _, table := range stats {
+		fmt.Printf("Table %s: buckets: %v; documents: %v; avg. size: %.2f; max. size: %v\n",
+			table.Table, table.Buckets, table.Documents, table.AvgSize, table.MaxSize)
+		fmt.Printf("  singletons: %v (%.2f%%); over query limit: %v\n",
+			table.Singletons, table.SingletonsFraction*100, table.OverQueryLimit)
+		fmt.Println("  histogram:")
+		for _, bin := range table.Histogram {
+			to := "inf"
+			if bin.To != 0 {
+				to = strconv.FormatInt(bin.To, 10)
+			}
+			fmt.Printf("    [%v, %s): %v %s\n", bin.From, to, bin.Count, strings.Repeat("#", barLength(bin.Count, table.Buckets)))
+		}
+		fmt.Println("  hot buckets:")
+		for _, bucket := range table.HotBuckets {
+			fmt.Printf("    %v: %v\n", bucket.Hash, bucket.Size)
+		}
+	}
+}
+
+// barLength scales the bin count to the 50-chars wide bar
+func barLength(count, total int64) int {
+	if total == 0 {
+		return 0
+	}
+	return int(count * 50 / total)
+}
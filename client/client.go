@@ -20,11 +20,18 @@ func New(config Config) ANNClient {
 		Methods: methods{
 			HealthCheck:     config.ServerAddress + "/",
 			CheckBuild:      config.ServerAddress + "/check-build",
+			CancelBuild:     config.ServerAddress + "/cancel-build",
 			BuildIndex:      config.ServerAddress + "/build-index",
+			ComputeStats:    config.ServerAddress + "/compute-stats",
+			CheckDrift:      config.ServerAddress + "/check-drift?imbalance=",
+			BucketsStats:    config.ServerAddress + "/buckets-stats?top=",
 			GetHashCollSize: config.ServerAddress + "/get-index-size",
 			GetNN:           config.ServerAddress + "/get-nn",
+			GetRange:        config.ServerAddress + "/get-range",
 			PopHash:         config.ServerAddress + "/pop-hash?id=",
 			PutHash:         config.ServerAddress + "/put-hash?id=",
+			Metrics:         config.ServerAddress + "/metrics",
+			ShardsHealth:    config.ServerAddress + "/shards-health",
 		},
 	}
 }
@@ -63,6 +70,15 @@ func (client *ANNClient) CheckBuildStatus() (*cm.ResponseData, error) {
 	return target, nil
 }
 
+// CancelBuild stops the running index build, keeping the previous index active
+func (client *ANNClient) CancelBuild() error {
+	err := client.MakeRequest("POST", client.Methods.CancelBuild, nil, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // GetHashCollSize returns number of documents in the hash collection
 func (client *ANNClient) GetHashCollSize() (int64, error) {
 	target := &cm.ResponseData{}
@@ -95,6 +111,91 @@ func (client *ANNClient) BuildHasher(mean, std []float64) error {
 	return nil
 }
 
+// BuildHasherWithStatsOptions initiates hasher building process on server,
+// letting the server compute the dataset stats by itself
+func (client *ANNClient) BuildHasherWithStatsOptions(opts cm.StatsOptions) error {
+	request := &cm.DatasetStats{
+		Options: &opts,
+	}
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	err = client.MakeRequest("POST", client.Methods.BuildIndex, bytes.NewBuffer(jsonRequest), nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ComputeStats asks server to compute the dataset stats
+func (client *ANNClient) ComputeStats(opts cm.StatsOptions) (*cm.DatasetStats, error) {
+	jsonRequest, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	target := &struct {
+		Results cm.DatasetStats `json:"neighbors"`
+	}{}
+	err = client.MakeRequest("POST", client.Methods.ComputeStats, bytes.NewBuffer(jsonRequest), target)
+	if err != nil {
+		return nil, err
+	}
+	return &target.Results, nil
+}
+
+// CheckDrift returns the difference between the build-time stats and the stats of the inserted points
+func (client *ANNClient) CheckDrift(withImbalance bool) (*cm.DriftReport, error) {
+	imbalance := "0"
+	if withImbalance {
+		imbalance = "1"
+	}
+	target := &struct {
+		Results cm.DriftReport `json:"neighbors"`
+	}{}
+	err := client.MakeRequest("GET", client.Methods.CheckDrift+imbalance, nil, target)
+	if err != nil {
+		return nil, err
+	}
+	return &target.Results, nil
+}
+
+// GetBucketsStats returns buckets occupancy stats of the every hash table
+func (client *ANNClient) GetBucketsStats(topN int) ([]cm.BucketsStats, error) {
+	target := &struct {
+		Results []cm.BucketsStats `json:"neighbors"`
+	}{}
+	err := client.MakeRequest("GET", client.Methods.BucketsStats+strconv.Itoa(topN), nil, target)
+	if err != nil {
+		return nil, err
+	}
+	return target.Results, nil
+}
+
+// GetMetrics returns the counters of the service instance, like hit rates of the query caches
+func (client *ANNClient) GetMetrics() (*cm.ServiceMetrics, error) {
+	target := &struct {
+		Results cm.ServiceMetrics `json:"neighbors"`
+	}{}
+	err := client.MakeRequest("GET", client.Methods.Metrics, nil, target)
+	if err != nil {
+		return nil, err
+	}
+	return &target.Results, nil
+}
+
+// GetShardsHealth returns the health and the size of every shard of the index
+func (client *ANNClient) GetShardsHealth() ([]cm.ShardHealth, error) {
+	target := &struct {
+		Results []cm.ShardHealth `json:"neighbors"`
+	}{}
+	err := client.MakeRequest("GET", client.Methods.ShardsHealth, nil, target)
+	if err != nil {
+		return nil, err
+	}
+	return target.Results, nil
+}
+
 // PopHash drops specified hash from the search index
 func (client *ANNClient) PopHash(id uint64) error {
 	stringID := strconv.FormatUint(id, 10)
@@ -120,21 +221,200 @@ func (client *ANNClient) PutHashes(requestData []cm.RequestData) error {
 
 // GetNeighbors gets the nearest neighbors for the query point (by ID or feature vector)
 func (client *ANNClient) GetNeighbors(vec []float64) ([]uint64, error) {
-	request := &cm.RequestData{
-		Vec: vec,
+	return client.GetNeighborsWithMode(vec, "")
+}
+
+// GetNeighborsWithMode gets the nearest neighbors, computing the exact distances
+// in the selected place: inside the service or by the storage
+func (client *ANNClient) GetNeighborsWithMode(vec []float64, distanceMode string) ([]uint64, error) {
+	return client.GetNeighborsWithParams(cm.RequestData{
+		Vec:          vec,
+		DistanceMode: distanceMode,
+	})
+}
+
+// GetExactNeighbors gets the exact nearest neighbors, scanning all the vectors of the index,
+// e.g. to get the ground truth for the recall evaluation
+func (client *ANNClient) GetExactNeighbors(vec []float64) ([]uint64, error) {
+	return client.GetNeighborsWithParams(cm.RequestData{
+		Vec:   vec,
+		Exact: true,
+	})
+}
+
+// GetNeighborsWithParams gets the nearest neighbors with the search parameters set in the request,
+// e.g. `ef` of the HNSW index
+func (client *ANNClient) GetNeighborsWithParams(request cm.RequestData) ([]uint64, error) {
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
 	}
+	target := &struct {
+		Results []uint64 `json:"neighbors"`
+	}{}
+	err = client.MakeRequest("POST", client.Methods.GetNN, bytes.NewBuffer(jsonRequest), target)
+	if err != nil {
+		return nil, err
+	}
+	return target.Results, nil
+}
+
+// GetRangeNeighbors gets the page of the neighbors within the radius of the request, sorted by the distance,
+// and the token of the next page, empty if it's the last one; pass the token with the same request to get the next page
+func (client *ANNClient) GetRangeNeighbors(request cm.RequestData) ([]cm.NeighborsRecord, string, error) {
+	page, err := client.getRangePage(request)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Results, page.Token, nil
+}
+
+// getRangePage gets the page of the range search results
+func (client *ANNClient) getRangePage(request cm.RequestData) (*rangePage, error) {
 	jsonRequest, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
-	target := &cm.ResponseData{}
-	err = client.MakeRequest("POST", client.Methods.CheckBuild, bytes.NewBuffer(jsonRequest), target)
+	target := &rangePage{}
+	err = client.MakeRequest("POST", client.Methods.GetRange, bytes.NewBuffer(jsonRequest), target)
 	if err != nil {
 		return nil, err
 	}
-	neighbors, ok := target.Results.([]uint64)
-	if !ok {
-		return nil, errors.New("GetNeighbors: can't cast result to the []uint64 type")
+	return target, nil
+}
+
+// IterateRange returns the iterator over all the neighbors within the radius of the request, sorted
+// by the distance; pages of `pageSize` neighbors are fetched as the iterator advances
+func (client *ANNClient) IterateRange(request cm.RequestData) *NeighborsIterator {
+	it := &NeighborsIterator{}
+	isLastPage := false
+	it.fetch = func() ([]cm.NeighborsRecord, error) {
+		if isLastPage {
+			return nil, io.EOF
+		}
+		page, err := client.getRangePage(request)
+		if err != nil {
+			return nil, err
+		}
+		request.Token = page.Token
+		isLastPage = len(page.Token) == 0
+		it.strategy = page.Strategy
+		return page.Results, nil
+	}
+	return it
+}
+
+// StreamNeighbors returns the iterator over the nearest neighbors written by the service as the NDJSON stream
+// as soon as they are found, so they aren't sorted and may be more than the MAX_NN of the service
+func (client *ANNClient) StreamNeighbors(request cm.RequestData) (*NeighborsIterator, error) {
+	return client.stream(client.Methods.GetNN, request)
+}
+
+// StreamRange returns the iterator over all the neighbors within the radius, streamed by the service
+// as soon as they are found, so they aren't sorted
+func (client *ANNClient) StreamRange(request cm.RequestData) (*NeighborsIterator, error) {
+	return client.stream(client.Methods.GetRange, request)
+}
+
+// stream requests the NDJSON stream of the neighbors; the iterator must be closed
+// if it isn't read to the end
+func (client *ANNClient) stream(url string, request cm.RequestData) (*NeighborsIterator, error) {
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-type", "application/json")
+	httpRequest.Header.Set("Accept", cm.ContentTypeNDJSON)
+	resp, err := client.Client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("Response error")
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	it := &NeighborsIterator{body: resp.Body}
+	it.fetch = func() ([]cm.NeighborsRecord, error) {
+		var record cm.StreamRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			// NOTE: the stream always ends with the trailer
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record.Error) != 0 {
+			return nil, errors.New(record.Error)
+		}
+		if record.Neighbor == nil {
+			it.strategy, it.partial = record.Strategy, record.Partial
+			return nil, io.EOF
+		}
+		return []cm.NeighborsRecord{*record.Neighbor}, nil
+	}
+	return it, nil
+}
+
+// Next advances the iterator to the next neighbor, returns false if there are no more neighbors
+// or the error has happened
+func (it *NeighborsIterator) Next() bool {
+	for it.pos >= len(it.chunk) {
+		if it.done || it.err != nil {
+			return false
+		}
+		chunk, err := it.fetch()
+		if err == io.EOF {
+			it.done = true
+			it.Close()
+			return false
+		}
+		if err != nil {
+			it.err = err
+			it.Close()
+			return false
+		}
+		it.chunk, it.pos = chunk, 0
+	}
+	it.current = it.chunk[it.pos]
+	it.pos++
+	return true
+}
+
+// Neighbor returns the current neighbor
+func (it *NeighborsIterator) Neighbor() cm.NeighborsRecord {
+	return it.current
+}
+
+// Strategy returns the strategy which has answered, it's known after the first page
+// or at the end of the stream
+func (it *NeighborsIterator) Strategy() string {
+	return it.strategy
+}
+
+// Partial tells if the streamed search has stopped before all the candidates were checked,
+// it's known at the end of the stream
+func (it *NeighborsIterator) Partial() bool {
+	return it.partial
+}
+
+// Err returns the error which has stopped the iteration
+func (it *NeighborsIterator) Err() error {
+	return it.err
+}
+
+// Close releases the stream, it's safe to call it more than once
+func (it *NeighborsIterator) Close() error {
+	if it.body == nil {
+		return nil
 	}
-	return neighbors, nil
+	body := it.body
+	it.body = nil
+	return body.Close()
 }
@@ -1,7 +1,10 @@
 package client
 
 import (
+	"io"
 	"net/http"
+
+	cm "lsh-search-service/common"
 )
 
 // Config holds necessary constants for initiating the ANNClient
@@ -13,11 +16,18 @@ type Config struct {
 type methods struct {
 	HealthCheck     string
 	CheckBuild      string
+	CancelBuild     string
 	BuildIndex      string
+	ComputeStats    string
+	CheckDrift      string
+	BucketsStats    string
 	GetHashCollSize string
 	GetNN           string
+	GetRange        string
 	PopHash         string
 	PutHash         string
+	Metrics         string
+	ShardsHealth    string
 }
 
 // ANNClient holds data needed to perform custom http requests
@@ -26,3 +36,23 @@ type ANNClient struct {
 	Client        http.Client
 	Methods       methods
 }
+
+// rangePage is the single page of the range search results
+type rangePage struct {
+	Results  []cm.NeighborsRecord `json:"neighbors"`
+	Token    string               `json:"token"`
+	Strategy string               `json:"strategy"`
+}
+
+// NeighborsIterator iterates over the neighbors fetched page by page or read from the stream
+type NeighborsIterator struct {
+	fetch    func() ([]cm.NeighborsRecord, error)
+	body     io.ReadCloser
+	chunk    []cm.NeighborsRecord
+	pos      int
+	current  cm.NeighborsRecord
+	strategy string
+	partial  bool
+	done     bool
+	err      error
+}
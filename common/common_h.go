@@ -12,6 +12,17 @@ const (
 	BuildStatusDone
 )
 
+// Used to represent the current phase of the index build
+const (
+	BuildPhaseStats     = "stats"
+	BuildPhasePlanes    = "planes"
+	BuildPhaseTraining  = "training"
+	BuildPhaseHashing   = "hashing"
+	BuildPhaseIndexing  = "indexing"
+	BuildPhaseSwap      = "swap"
+	BuildPhaseCancelled = "cancelled"
+)
+
 // Logger holds several logger instances with different prefixes
 type Logger struct {
 	Warn *log.Logger
@@ -27,21 +38,252 @@ type NeighborsRecord struct {
 	Dist        float64 `json:"dist,omitempty"`
 }
 
+// BuildProgress holds the state of the running (or the latest) index build;
+// ETA and elapsed time are in nanoseconds, throughput is in documents per second
+type BuildProgress struct {
+	Phase      string  `json:"phase,omitempty" bson:"phase,omitempty"`
+	Processed  int64   `json:"processed" bson:"processed"`
+	Total      int64   `json:"total" bson:"total"`
+	Throughput float64 `json:"throughput" bson:"throughput"`
+	ETA        int64   `json:"eta" bson:"eta"`
+	Elapsed    int64   `json:"elapsed" bson:"elapsed"`
+}
+
 // ResponseData holds the response data of any hanlder
 type ResponseData struct {
-	Results interface{} `json:"neighbors,omitempty"`
-	Message string      `json:"message,omitempty"`
+	Results    interface{}    `json:"neighbors,omitempty"`
+	Message    string         `json:"message,omitempty"`
+	Progress   *BuildProgress `json:"progress,omitempty"`
+	Strategy   string         `json:"strategy,omitempty"` // index type which answered the query, flat for the exact scan
+	Token      string         `json:"token,omitempty"`    // continuation token of the next page
+	Explain    *QueryExplain  `json:"explain,omitempty"`
+	Partial    bool           `json:"partial,omitempty"` // search has stopped before all the candidates were checked
+	StopReason string         `json:"stopReason,omitempty"`
+}
+
+// Used to tell why the search has stopped early, so the neighbors are partial;
+// the router also reports the shards which haven't answered
+const (
+	StopReasonTimeBudget       = "timeBudget"
+	StopReasonCandidates       = "candidatesBudget"
+	StopReasonGoodEnough       = "goodEnough"
+	StopReasonShardUnavailable = "shardUnavailable"
+)
+
+// QueryExplain describes how the `/get-nn` query has been processed, to find the reasons of the bad recall:
+// hashes of the query and the number of candidates colliding with it per table (for the IVF index tables
+// are the probed lists in the order of probing), the number of fetched candidates and the share of unique
+// ones among them, the number of candidates kept by the ranking and the ones within DistanceThrsh
+type QueryExplain struct {
+	Hashes          map[int]uint64 `json:"hashes,omitempty"`
+	TableCandidates map[int]int    `json:"tableCandidates,omitempty"`
+	Fetched         int            `json:"fetched"`
+	Unique          int            `json:"unique"`
+	DedupeRatio     float64        `json:"dedupeRatio"`
+	Ranked          int            `json:"ranked"`
+	PassedThrsh     int            `json:"passedThrsh"`
+	Truncated       bool           `json:"truncated"` // some fetch has hit MAX_HASHES_QUERY
+	Timing          QueryTiming    `json:"timing"`
 }
 
+// QueryTiming holds durations of the query stages in nanoseconds
+type QueryTiming struct {
+	HelperRead int64 `json:"helperRead"`
+	Hashing    int64 `json:"hashing"`
+	Fetch      int64 `json:"fetch"`
+	Ranking    int64 `json:"ranking"`
+	Distances  int64 `json:"distances"`
+	Sort       int64 `json:"sort"`
+	Total      int64 `json:"total"`
+}
+
+// ContentTypeNDJSON is requested in the Accept header to get the neighbors streamed line by line
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// StreamRecord is the single line of the streamed response: the neighbor, or the trailer
+// with the strategy which has answered, or the error which has interrupted the stream
+type StreamRecord struct {
+	Neighbor   *NeighborsRecord `json:"neighbor,omitempty"`
+	Strategy   string           `json:"strategy,omitempty"`
+	Explain    *QueryExplain    `json:"explain,omitempty"`
+	Partial    bool             `json:"partial,omitempty"`
+	StopReason string           `json:"stopReason,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// Used to select where the exact distances to the candidates are computed:
+// inside the service process, or by the storage, so only the final neighbors leave the db
+const (
+	DistanceModeLocal = "local"
+	DistanceModeDb    = "db"
+)
+
+// Used to select the type of the search index:
+// hash tables of the local sensitive hashing, the hierarchical navigable small world graph,
+// the inverted file of k-means clusters, the forest of random projection trees,
+// or the flat index which is scanned exhaustively
+const (
+	IndexTypeLSH    = "lsh"
+	IndexTypeHNSW   = "hnsw"
+	IndexTypeIVF    = "ivf"
+	IndexTypeForest = "forest"
+	IndexTypeFlat   = "flat"
+)
+
 // RequestData used for unpacking the request payload for Pop/Put vectors
 type RequestData struct {
-	ID          string    `json:"id,omitempty"`
-	SecondaryID uint64    `json:"secondaryId,omitempty"`
-	Vec         []float64 `json:"vec,omitempty"`
+	ID               string    `json:"id,omitempty"`
+	SecondaryID      uint64    `json:"secondaryId,omitempty"`
+	Vec              []float64 `json:"vec,omitempty"`
+	DistanceMode     string    `json:"distanceMode,omitempty"`
+	Ef               int       `json:"ef,omitempty"`      // HNSW search beam size, the service default is used if not set
+	NProbe           int       `json:"nprobe,omitempty"`  // number of IVF lists to scan, the service default is used if not set
+	SearchK          int       `json:"searchK,omitempty"` // number of forest candidates to collect, the service default is used if not set
+	Exact            bool      `json:"exact,omitempty"`   // scan all the vectors instead of the index, e.g. to get the ground truth
+	Radius           float64   `json:"radius,omitempty"`  // distance limit of the range search
+	PageSize         int       `json:"pageSize,omitempty"`
+	Token            string    `json:"token,omitempty"`            // continuation token returned with the previous page
+	Explain          bool      `json:"explain,omitempty"`          // return the query processing details along with the neighbors
+	Timeout          int       `json:"timeout,omitempty"`          // deadline of the query in milliseconds, the service default is used if not set
+	TimeBudget       int       `json:"timeBudget,omitempty"`       // time in milliseconds after which the search returns the neighbors found so far
+	GoodEnough       float64   `json:"goodEnough,omitempty"`       // search stops once MaxNN neighbors are found within this distance
+	CandidatesBudget int       `json:"candidatesBudget,omitempty"` // max candidates of the single fetch, the query which hits it is partial
 }
 
-// DatasetStats holds basic feature vector stats like mean and standart deviation
+// Used to represent the source and the way of the dataset stats computation
+const (
+	StatsSourceCollection = "collection"
+	StatsSourceIndex      = "index"
+	StatsModeExact        = "exact"
+	StatsModeSample       = "sample"
+)
+
+// StatsOptions defines how the server computes the dataset stats
+type StatsOptions struct {
+	Source     string `json:"source,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+	SampleSize int    `json:"sampleSize,omitempty"`
+	Covariance bool   `json:"covariance,omitempty"`
+}
+
+// DatasetStats holds basic feature vector stats like mean and standart deviation;
+// if mean and std are omitted in the build request, server computes them by the specified options
 type DatasetStats struct {
-	Mean []float64 `json:"mean"`
-	Std  []float64 `json:"std"`
+	Mean    []float64     `json:"mean"`
+	Std     []float64     `json:"std"`
+	Cov     [][]float64   `json:"cov,omitempty"`
+	Count   int64         `json:"count,omitempty"`
+	Options *StatsOptions `json:"options,omitempty"`
+}
+
+// DriftReport holds the difference between the build-time stats and the stats of inserted vectors;
+// mean shift is measured in build-time std units
+type DriftReport struct {
+	Score              float64 `json:"score"`
+	MeanShift          float64 `json:"meanShift"`
+	StdShift           float64 `json:"stdShift"`
+	Inserted           int64   `json:"inserted"`
+	BucketImbalance    float64 `json:"bucketImbalance,omitempty"`
+	RebuildRecommended bool    `json:"rebuildRecommended"`
+}
+
+// CacheStats holds the counters of the in-process cache since the service start; hit rate is the share
+// of hits among all the lookups, invalidations count the entries dropped by the index updates
+type CacheStats struct {
+	Size          int     `json:"size"`
+	MaxSize       int     `json:"maxSize"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hitRate"`
+	Evictions     int64   `json:"evictions"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+// ServiceMetrics holds the counters of the service instance
+type ServiceMetrics struct {
+	ResultsCache CacheStats `json:"resultsCache"`
+	BucketsCache CacheStats `json:"bucketsCache"`
+}
+
+// HistogramBin holds number of buckets with size in range [From, To); To is zero for the last open bin
+type HistogramBin struct {
+	From  int64 `json:"from"`
+	To    int64 `json:"to,omitempty"`
+	Count int64 `json:"count"`
+}
+
+// ShardHealth holds the state of the single shard of the index
+type ShardHealth struct {
+	Shard   string `json:"shard"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// HotBucket holds the hash value and the size of the large bucket
+type HotBucket struct {
+	Hash uint64 `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// BucketsStats holds the occupancy stats of the single hash table
+type BucketsStats struct {
+	Table              string         `json:"table"`
+	Buckets            int64          `json:"buckets"`
+	Documents          int64          `json:"documents"`
+	MaxSize            int64          `json:"maxSize"`
+	AvgSize            float64        `json:"avgSize"`
+	Singletons         int64          `json:"singletons"`
+	SingletonsFraction float64        `json:"singletonsFraction"`
+	OverQueryLimit     int64          `json:"overQueryLimit"`
+	Histogram          []HistogramBin `json:"histogram"`
+	HotBuckets         []HotBucket    `json:"hotBuckets"`
+}
+
+// RunningStats accumulates mean, variance and (optionally) covariance in a single pass
+type RunningStats struct {
+	N    int64
+	Mean []float64
+	M2   []float64
+	C    [][]float64
+}
+
+// Used to select the way the vectors are stored in the index
+const (
+	QuantizationNone  = "none"
+	QuantizationInt8  = "int8"
+	QuantizationUint8 = "uint8"
+	QuantizationPQ    = "pq"
+)
+
+// Quantizer compresses vectors into the byte codes and computes distances directly on the codes
+type Quantizer interface {
+	Dims() int
+	Encode(vec []float64) []byte
+	Decode(codes []byte) []float64
+	// GetDistanceFunc prepares everything needed to compare the query with the codes;
+	// the function returns false if the distance can't be computed
+	GetDistanceFunc(query []float64, isAngular bool) func(codes []byte) (float64, bool)
+}
+
+// ScalarQuantizer maps every dimension of the vector to the single byte code:
+// value = offset + scale * code, where code is signed for int8 and unsigned for uint8
+type ScalarQuantizer struct {
+	Type   string    `json:"type" bson:"type"`
+	Scale  []float64 `json:"scale" bson:"scale"`
+	Offset []float64 `json:"offset" bson:"offset"`
+}
+
+// ProductQuantizer splits the vector into subspaces and keeps the index of the nearest
+// k-means centroid of every subspace as the single byte code
+type ProductQuantizer struct {
+	Bounds    []int         `json:"bounds" bson:"bounds"` // subspace i covers dims [Bounds[i], Bounds[i+1])
+	Centroids [][][]float64 `json:"centroids" bson:"centroids"`
+}
+
+// InvertedFile holds k-means centroids of the IVF index: every vector belongs to the list
+// of its nearest centroid; with angular metric centroids are trained over the normalized vectors
+type InvertedFile struct {
+	Centroids [][]float64 `json:"centroids" bson:"centroids"`
+	IsAngular bool        `json:"isAngular" bson:"isAngular"`
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"gonum.org/v1/gonum/blas/blas64"
 	cm "lsh-search-service/common"
+	"math"
 	"os"
 	"testing"
 )
@@ -27,6 +28,9 @@ func TestL2(t *testing.T) {
 	if l2 != 5.0 {
 		t.Fatal("L2 distance is wrong")
 	}
+	if v2.Data[0] != -4.0 || v2.Data[1] != 3.0 {
+		t.Fatal("L2 distance must not modify the input vectors")
+	}
 }
 
 func TestCosineSim(t *testing.T) {
@@ -59,6 +63,17 @@ func TestIsZeroVec(t *testing.T) {
 	}
 }
 
+func TestHammingDistance(t *testing.T) {
+	a := []byte{0xFF, 0x00}
+	b := []byte{0x0F, 0x01}
+	if cm.HammingDistance(a, b) != 5 {
+		t.Fatal("Hamming distance must be equal to 5")
+	}
+	if cm.HammingDistance(a, a) != 0 {
+		t.Fatal("Hamming distance to itself must be zero")
+	}
+}
+
 func TestNewLogger(t *testing.T) {
 	var buf bytes.Buffer
 	logger := cm.GetNewLogger()
@@ -84,3 +99,214 @@ func TestRandomID(t *testing.T) {
 		t.Fatalf("Cannot generate random id %v", err)
 	}
 }
+
+func TestRunningStats(t *testing.T) {
+	stats := cm.NewRunningStats(2, true)
+	vecs := [][]float64{{1.0, 2.0}, {3.0, 6.0}, {5.0, 10.0}}
+	for _, vec := range vecs {
+		err := stats.Update(vec)
+		if err != nil {
+			t.Fatalf("Could not update stats: %v", err)
+		}
+	}
+	result := stats.Result()
+	if result.Count != 3 {
+		t.Fatal("Stats must count all the added vectors")
+	}
+	if result.Mean[0] != 3.0 || result.Mean[1] != 6.0 {
+		t.Fatal("Running mean is wrong")
+	}
+	if result.Std[0] != 2.0 || result.Std[1] != 4.0 {
+		t.Fatal("Running sample std is wrong")
+	}
+	if result.Cov[0][1] != 8.0 || result.Cov[1][0] != 8.0 {
+		t.Fatal("Running sample covariance is wrong")
+	}
+	err := stats.Update([]float64{1.0})
+	if err == nil {
+		t.Fatal("Stats must not accept vectors of the wrong size")
+	}
+}
+
+func TestMergeRunningStats(t *testing.T) {
+	vecs := [][]float64{{1e9 + 1.0, 2.0}, {1e9 + 3.0, 6.0}, {1e9 + 5.0, 10.0}, {1e9 + 7.0, 14.0}}
+	stats := cm.NewRunningStats(2, false)
+	stats.Update(vecs[0])
+	batch := cm.NewRunningStats(2, false)
+	for _, vec := range vecs[1:] {
+		batch.Update(vec)
+	}
+	err := stats.Merge(batch)
+	if err != nil {
+		t.Fatalf("Could not merge stats: %v", err)
+	}
+	if stats.N != 4 || stats.Mean[0] != 1e9+4.0 || stats.Mean[1] != 8.0 {
+		t.Fatal("Merged mean is wrong")
+	}
+	std := stats.Std()
+	if math.Abs(std[0]-math.Sqrt(20.0/3.0)) > 1e-9 || math.Abs(std[1]-math.Sqrt(80.0/3.0)) > 1e-9 {
+		t.Fatal("Merged sample std is wrong")
+	}
+	removed := cm.NewRunningStats(2, false)
+	removed.Update(vecs[3])
+	removed.N = -removed.N
+	stats.Merge(removed)
+	std = stats.Std()
+	if stats.N != 3 || stats.Mean[0] != 1e9+3.0 || math.Abs(std[0]-2.0) > 1e-9 || math.Abs(std[1]-4.0) > 1e-9 {
+		t.Fatal("Removed vector must be subtracted from the stats")
+	}
+	removed = cm.NewRunningStats(2, false)
+	removed.Update(vecs[1])
+	removed.Update(vecs[2])
+	removed.N = -removed.N
+	stats.Merge(removed)
+	if stats.N != 1 || stats.Mean[0] != 1e9+1.0 || stats.M2[0] > 1e-6 || stats.M2[1] > 1e-6 {
+		t.Fatalf("Removed batch must be subtracted from the stats: %+v", stats)
+	}
+
+	// NOTE: removing {5,7} from {1,3,5,7} leaves {1,3} with M2 = 2
+	stats = cm.NewRunningStats(1, false)
+	removed = cm.NewRunningStats(1, false)
+	for _, x := range []float64{1.0, 3.0, 5.0, 7.0} {
+		stats.Update([]float64{x})
+		if x > 4.0 {
+			removed.Update([]float64{x})
+		}
+	}
+	removed.N = -removed.N
+	stats.Merge(removed)
+	if stats.N != 2 || stats.Mean[0] != 2.0 || math.Abs(stats.M2[0]-2.0) > 1e-9 {
+		t.Fatalf("Removed batch must be subtracted from the variance: %+v", stats)
+	}
+	err = stats.Merge(cm.NewRunningStats(2, false))
+	if err == nil {
+		t.Fatal("Stats of different dimensions must not be merged")
+	}
+}
+
+func TestGetDrift(t *testing.T) {
+	reference := cm.DatasetStats{Mean: []float64{3.0, 1.0}, Std: []float64{2.0, 1.0}}
+	meanShift, stdShift, err := cm.GetDrift(reference, reference)
+	if err != nil {
+		t.Fatalf("Could not compute drift: %v", err)
+	}
+	if meanShift != 0.0 || stdShift != 0.0 {
+		t.Fatal("Drift must be zero for the same stats")
+	}
+	shifted := cm.DatasetStats{
+		Mean: []float64{reference.Mean[0] + 2*reference.Std[0], reference.Mean[1] + 2*reference.Std[1]},
+		Std:  reference.Std,
+	}
+	meanShift, stdShift, _ = cm.GetDrift(reference, shifted)
+	if math.Abs(meanShift-2.0) > 1e-9 || stdShift != 0.0 {
+		t.Fatal("Mean shift must be measured in std units")
+	}
+	_, _, err = cm.GetDrift(reference, cm.DatasetStats{Mean: []float64{0.0}, Std: []float64{1.0}})
+	if err == nil {
+		t.Fatal("Drift must not be computed for stats of different dimensions")
+	}
+}
+
+func TestScalarQuantizer(t *testing.T) {
+	stats := cm.DatasetStats{Mean: []float64{0.0, 10.0}, Std: []float64{1.0, 0.0}}
+	vec := []float64{0.5, 10.0}
+	for _, quantType := range []string{cm.QuantizationInt8, cm.QuantizationUint8} {
+		quantizer, err := cm.NewScalarQuantizer(quantType, stats)
+		if err != nil {
+			t.Fatalf("Could not create quantizer: %v", err)
+		}
+		codes := quantizer.Encode(vec)
+		decoded := quantizer.Decode(codes)
+		for i := range vec {
+			if math.Abs(decoded[i]-vec[i]) > quantizer.Scale[i] {
+				t.Fatalf("Decoded value is too far from the original one: %v vs %v", decoded, vec)
+			}
+		}
+		dist, ok := quantizer.Distance(vec, codes, false)
+		if !ok || math.Abs(dist-cm.L2(cm.NewVec(vec), cm.NewVec(decoded))) > 1e-9 {
+			t.Fatal("Distance on codes must be equal to the distance to the decoded vector")
+		}
+		clipped := quantizer.Decode(quantizer.Encode([]float64{100.0, 10.0}))
+		if clipped[0] > 3.01 {
+			t.Fatal("Values out of the range must be clipped")
+		}
+	}
+	if _, err := cm.NewScalarQuantizer("int4", stats); err == nil {
+		t.Fatal("Unknown quantization type must be rejected")
+	}
+	packed := cm.DecodeFloat32(cm.EncodeFloat32(vec))
+	if packed[0] != 0.5 || packed[1] != 10.0 {
+		t.Fatal("Float32 copy must keep the values")
+	}
+}
+
+func TestInvertedFile(t *testing.T) {
+	vecs := [][]float64{
+		{1.0, 0.0}, {1.1, 0.1}, {0.9, -0.1},
+		{-5.0, 5.0}, {-5.1, 5.1}, {-4.9, 4.9},
+	}
+	ivf, err := cm.TrainInvertedFile(vecs, 2, false)
+	if err != nil {
+		t.Fatalf("Could not train inverted file: %v", err)
+	}
+	if ivf.Dims() != 2 || len(ivf.Centroids) != 2 {
+		t.Fatal("Inverted file must hold the requested number of lists")
+	}
+	for i := range vecs {
+		sameCluster := ivf.Assign(vecs[i]) == ivf.Assign(vecs[i/3*3])
+		if !sameCluster {
+			t.Fatal("Close vectors must be assigned to the same list")
+		}
+		lists := ivf.Probe(vecs[i], 1)
+		if len(lists) != 1 || lists[0] != ivf.Assign(vecs[i]) {
+			t.Fatal("List of the vector must be probed first")
+		}
+	}
+	if ivf.Assign(vecs[0]) == ivf.Assign(vecs[3]) {
+		t.Fatal("Far vectors must be assigned to the different lists")
+	}
+	if len(ivf.Probe(vecs[0], 0)) != 2 {
+		t.Fatal("All the lists must be probed if nprobe isn't set")
+	}
+	ivf, _ = cm.TrainInvertedFile(vecs[:1], 2, true)
+	if len(ivf.Centroids) != 1 || ivf.Assign([]float64{10.0, 0.0}) != 0 {
+		t.Fatal("Number of lists must be limited by the number of training vectors")
+	}
+}
+
+func TestProductQuantizer(t *testing.T) {
+	vecs := [][]float64{
+		{1.0, 0.0, 0.0, 2.0},
+		{0.0, 1.0, 0.0, 2.0},
+		{0.0, 0.0, 1.0, 2.0},
+	}
+	quantizer, err := cm.TrainProductQuantizer(vecs, 2)
+	if err != nil {
+		t.Fatalf("Could not train quantizer: %v", err)
+	}
+	if quantizer.Dims() != 4 || len(quantizer.Centroids) != 2 || len(quantizer.Centroids[0]) != len(vecs) {
+		t.Fatal("Codebook of every subspace must hold up to one centroid per training vector")
+	}
+	for _, isAngular := range []bool{false, true} {
+		getDist := quantizer.GetDistanceFunc(vecs[0], isAngular)
+		for i, vec := range vecs {
+			codes := quantizer.Encode(vec)
+			if len(codes) != 2 {
+				t.Fatal("Every subspace must be encoded with the single byte")
+			}
+			decoded := quantizer.Decode(codes)
+			for j := range vec {
+				if math.Abs(decoded[j]-vec[j]) > 1e-9 {
+					t.Fatalf("Training vectors must be restored exactly: %v vs %v", decoded, vec)
+				}
+			}
+			dist, ok := getDist(codes)
+			if !ok || (i == 0 && math.Abs(dist) > 1e-9) || (i != 0 && dist < 1e-3) {
+				t.Fatalf("Asymmetric distance is wrong: %v", dist)
+			}
+		}
+	}
+	if _, err := cm.TrainProductQuantizer(vecs, 5); err == nil {
+		t.Fatal("Number of subspaces larger than dims must be rejected")
+	}
+}
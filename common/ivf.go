@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+const ivfIterations = 25
+
+// normalizeVec returns the copy of the vector with the unit length, zero vector is returned as is
+func normalizeVec(vec []float64) []float64 {
+	var norm float64
+	for _, v := range vec {
+		norm += v * v
+	}
+	normalized := make([]float64, len(vec))
+	if norm == 0 {
+		return normalized
+	}
+	norm = math.Sqrt(norm)
+	for i, v := range vec {
+		normalized[i] = v / norm
+	}
+	return normalized
+}
+
+// TrainInvertedFile clusters the training vectors into the specified number of lists
+func TrainInvertedFile(vecs [][]float64, lists int, isAngular bool) (*InvertedFile, error) {
+	if len(vecs) == 0 {
+		return nil, errors.New("inverted file needs at least one training vector")
+	}
+	if lists <= 0 {
+		return nil, errors.New("number of lists must be a positive integer")
+	}
+	dims := len(vecs[0])
+	points := make([][]float64, len(vecs))
+	for i, vec := range vecs {
+		if len(vec) != dims {
+			return nil, errors.New("training vectors must be of the same size")
+		}
+		points[i] = vec
+		if isAngular {
+			points[i] = normalizeVec(vec)
+		}
+	}
+	if len(points) < lists {
+		lists = len(points)
+	}
+	return &InvertedFile{
+		Centroids: kMeans(points, lists, ivfIterations),
+		IsAngular: isAngular,
+	}, nil
+}
+
+// Dims returns the size of the vectors
+func (ivf *InvertedFile) Dims() int {
+	return len(ivf.Centroids[0])
+}
+
+// Assign returns the list of the vector
+func (ivf *InvertedFile) Assign(vec []float64) int {
+	if ivf.IsAngular {
+		vec = normalizeVec(vec)
+	}
+	return nearestCentroid(ivf.Centroids, vec)
+}
+
+// Probe returns nprobe lists with the nearest centroids, the nearest list goes first
+func (ivf *InvertedFile) Probe(vec []float64, nprobe int) []int {
+	if ivf.IsAngular {
+		vec = normalizeVec(vec)
+	}
+	dists := make([]float64, len(ivf.Centroids))
+	lists := make([]int, len(ivf.Centroids))
+	for c, centroid := range ivf.Centroids {
+		dists[c] = squaredL2(centroid, vec)
+		lists[c] = c
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		return dists[lists[i]] < dists[lists[j]]
+	})
+	if nprobe > 0 && nprobe < len(lists) {
+		lists = lists[:nprobe]
+	}
+	return lists
+}
@@ -0,0 +1,191 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+)
+
+const (
+	// NOTE: codes are single bytes, so every subspace has at most 256 centroids
+	pqMaxCentroids = 256
+	pqIterations   = 25
+)
+
+// TrainProductQuantizer learns k-means codebooks for every subspace over the training vectors
+func TrainProductQuantizer(vecs [][]float64, subspaces int) (*ProductQuantizer, error) {
+	if len(vecs) == 0 {
+		return nil, errors.New("product quantizer needs at least one training vector")
+	}
+	dims := len(vecs[0])
+	if subspaces <= 0 || subspaces > dims {
+		return nil, errors.New("number of subspaces must be in range [1, dims]")
+	}
+	for _, vec := range vecs {
+		if len(vec) != dims {
+			return nil, errors.New("training vectors must be of the same size")
+		}
+	}
+	quantizer := &ProductQuantizer{
+		Bounds:    make([]int, subspaces+1),
+		Centroids: make([][][]float64, subspaces),
+	}
+	for m := range quantizer.Bounds {
+		quantizer.Bounds[m] = m * dims / subspaces
+	}
+	k := pqMaxCentroids
+	if len(vecs) < k {
+		k = len(vecs)
+	}
+	points := make([][]float64, len(vecs))
+	for m := 0; m < subspaces; m++ {
+		for i, vec := range vecs {
+			points[i] = vec[quantizer.Bounds[m]:quantizer.Bounds[m+1]]
+		}
+		quantizer.Centroids[m] = kMeans(points, k, pqIterations)
+	}
+	return quantizer, nil
+}
+
+// kMeans clusters points with the Lloyd's algorithm, starting from the random points
+func kMeans(points [][]float64, k, iterations int) [][]float64 {
+	centroids := make([][]float64, k)
+	for i, idx := range rand.Perm(len(points))[:k] {
+		centroids[i] = append([]float64(nil), points[idx]...)
+	}
+	assignment := make([]int, len(points))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for iter := 0; iter < iterations; iter++ {
+		changed := false
+		for i, point := range points {
+			nearest := nearestCentroid(centroids, point)
+			if nearest != assignment[i] {
+				assignment[i] = nearest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		sums := make([][]float64, k)
+		counts := make([]int, k)
+		for i, point := range points {
+			c := assignment[i]
+			if sums[c] == nil {
+				sums[c] = make([]float64, len(point))
+			}
+			for j, v := range point {
+				sums[c][j] += v
+			}
+			counts[c]++
+		}
+		// NOTE: empty clusters keep their previous centroids
+		for c := range centroids {
+			if counts[c] == 0 {
+				continue
+			}
+			for j := range centroids[c] {
+				centroids[c][j] = sums[c][j] / float64(counts[c])
+			}
+		}
+	}
+	return centroids
+}
+
+// squaredL2 returns the squared euclidean distance between two slices of the same size
+func squaredL2(a, b []float64) float64 {
+	var dist float64
+	for i := range a {
+		dist += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return dist
+}
+
+// nearestCentroid returns index of the centroid nearest to the point
+func nearestCentroid(centroids [][]float64, point []float64) int {
+	nearest, minDist := 0, math.Inf(1)
+	for c, centroid := range centroids {
+		dist := squaredL2(centroid, point)
+		if dist < minDist {
+			nearest, minDist = c, dist
+		}
+	}
+	return nearest
+}
+
+// Dims returns size of the vectors the quantizer is trained for
+func (quantizer *ProductQuantizer) Dims() int {
+	return quantizer.Bounds[len(quantizer.Bounds)-1]
+}
+
+// Encode returns index of the nearest centroid for every subspace of the vector
+func (quantizer *ProductQuantizer) Encode(vec []float64) []byte {
+	codes := make([]byte, len(quantizer.Centroids))
+	for m, centroids := range quantizer.Centroids {
+		codes[m] = byte(nearestCentroid(centroids, vec[quantizer.Bounds[m]:quantizer.Bounds[m+1]]))
+	}
+	return codes
+}
+
+// Decode restores the approximate vector by concatenating the centroids
+func (quantizer *ProductQuantizer) Decode(codes []byte) []float64 {
+	vec := make([]float64, 0, quantizer.Dims())
+	for m, code := range codes {
+		vec = append(vec, quantizer.Centroids[m][code]...)
+	}
+	return vec
+}
+
+// GetDistanceFunc computes lookup tables of the distances between the query subvectors
+// and every centroid, so the distance to the codes is just the sum of the table values
+// (asymmetric distance computation)
+func (quantizer *ProductQuantizer) GetDistanceFunc(query []float64, isAngular bool) func(codes []byte) (float64, bool) {
+	if len(query) != quantizer.Dims() {
+		return func(codes []byte) (float64, bool) { return 0, false }
+	}
+	// NOTE: for angular metric tables hold dot products and squared centroid norms
+	values := make([][]float64, len(quantizer.Centroids))
+	norms := make([][]float64, len(quantizer.Centroids))
+	var queryNorm float64
+	for m, centroids := range quantizer.Centroids {
+		sub := query[quantizer.Bounds[m]:quantizer.Bounds[m+1]]
+		values[m] = make([]float64, len(centroids))
+		norms[m] = make([]float64, len(centroids))
+		for c, centroid := range centroids {
+			if !isAngular {
+				values[m][c] = squaredL2(sub, centroid)
+				continue
+			}
+			for j := range centroid {
+				values[m][c] += sub[j] * centroid[j]
+				norms[m][c] += centroid[j] * centroid[j]
+			}
+		}
+		for _, v := range sub {
+			queryNorm += v * v
+		}
+	}
+
+	return func(codes []byte) (float64, bool) {
+		if len(codes) != len(values) {
+			return 0, false
+		}
+		var sum, norm float64
+		for m, code := range codes {
+			if int(code) >= len(values[m]) {
+				return 0, false
+			}
+			sum += values[m][code]
+			norm += norms[m][code]
+		}
+		if !isAngular {
+			return math.Sqrt(sum), true
+		}
+		if norm == 0 || queryNorm == 0 {
+			return 1.0, false
+		}
+		return 1.0 - sum/math.Sqrt(norm*queryNorm), true
+	}
+}
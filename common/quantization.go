@@ -0,0 +1,131 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// NOTE: values farther than that number of std from the mean are clipped
+const quantizationStdRange = 3.0
+
+// NewScalarQuantizer learns per-dimension scale and offset from the dataset stats:
+// int8 codes are centered at the mean, uint8 codes cover the range starting at mean - 3 std
+func NewScalarQuantizer(quantType string, stats DatasetStats) (*ScalarQuantizer, error) {
+	if len(stats.Mean) == 0 || len(stats.Mean) != len(stats.Std) {
+		return nil, errors.New("quantizer needs mean and std of the same size")
+	}
+	quantizer := &ScalarQuantizer{
+		Type:   quantType,
+		Scale:  make([]float64, len(stats.Mean)),
+		Offset: make([]float64, len(stats.Mean)),
+	}
+	for i := range stats.Mean {
+		valueRange := quantizationStdRange * stats.Std[i]
+		switch quantType {
+		case QuantizationInt8:
+			quantizer.Offset[i] = stats.Mean[i]
+			quantizer.Scale[i] = valueRange / math.MaxInt8
+		case QuantizationUint8:
+			quantizer.Offset[i] = stats.Mean[i] - valueRange
+			quantizer.Scale[i] = 2 * valueRange / math.MaxUint8
+		default:
+			return nil, fmt.Errorf("unknown quantization type: %s", quantType)
+		}
+	}
+	return quantizer, nil
+}
+
+// Dims returns size of the vectors the quantizer is learned for
+func (quantizer *ScalarQuantizer) Dims() int {
+	return len(quantizer.Scale)
+}
+
+// Encode returns the byte code of every dimension of the vector
+func (quantizer *ScalarQuantizer) Encode(vec []float64) []byte {
+	codes := make([]byte, len(vec))
+	for i, v := range vec {
+		var code float64
+		if quantizer.Scale[i] > 0 {
+			code = math.Round((v - quantizer.Offset[i]) / quantizer.Scale[i])
+		}
+		if quantizer.Type == QuantizationInt8 {
+			code = math.Max(math.Min(code, math.MaxInt8), -math.MaxInt8)
+			codes[i] = byte(int8(code))
+		} else {
+			code = math.Max(math.Min(code, math.MaxUint8), 0)
+			codes[i] = byte(code)
+		}
+	}
+	return codes
+}
+
+// decodeValue restores the single dimension value from its code
+func (quantizer *ScalarQuantizer) decodeValue(i int, code byte) float64 {
+	if quantizer.Type == QuantizationInt8 {
+		return quantizer.Offset[i] + quantizer.Scale[i]*float64(int8(code))
+	}
+	return quantizer.Offset[i] + quantizer.Scale[i]*float64(code)
+}
+
+// Decode restores the approximate vector from the codes
+func (quantizer *ScalarQuantizer) Decode(codes []byte) []float64 {
+	vec := make([]float64, len(codes))
+	for i, code := range codes {
+		vec[i] = quantizer.decodeValue(i, code)
+	}
+	return vec
+}
+
+// Distance computes the distance between the query and the quantized vector directly
+// on the codes, without allocating the decoded vector; returns false if the distance
+// can't be computed (zero vectors with angular metric)
+func (quantizer *ScalarQuantizer) Distance(query []float64, codes []byte, isAngular bool) (float64, bool) {
+	if len(query) != len(codes) {
+		return 0, false
+	}
+	var dot, norm, queryNorm, sqDist float64
+	for i, code := range codes {
+		v := quantizer.decodeValue(i, code)
+		if isAngular {
+			dot += query[i] * v
+			norm += v * v
+			queryNorm += query[i] * query[i]
+		} else {
+			sqDist += (query[i] - v) * (query[i] - v)
+		}
+	}
+	if !isAngular {
+		return math.Sqrt(sqDist), true
+	}
+	if norm == 0 || queryNorm == 0 {
+		return 1.0, false
+	}
+	return 1.0 - dot/math.Sqrt(norm*queryNorm), true
+}
+
+// GetDistanceFunc returns function which computes distances from the query to the codes
+func (quantizer *ScalarQuantizer) GetDistanceFunc(query []float64, isAngular bool) func(codes []byte) (float64, bool) {
+	return func(codes []byte) (float64, bool) {
+		return quantizer.Distance(query, codes, isAngular)
+	}
+}
+
+// EncodeFloat32 packs the vector as little-endian float32 values
+func EncodeFloat32(vec []float64) []byte {
+	data := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(v)))
+	}
+	return data
+}
+
+// DecodeFloat32 unpacks the vector packed by EncodeFloat32
+func DecodeFloat32(data []byte) []float64 {
+	vec := make([]float64, len(data)/4)
+	for i := range vec {
+		vec[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+	}
+	return vec
+}
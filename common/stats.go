@@ -0,0 +1,144 @@
+package common
+
+import (
+	"errors"
+	"math"
+)
+
+// NewRunningStats creates the accumulator for the vectors of specified size;
+// co-moments matrix is only allocated when the covariance is requested
+func NewRunningStats(dims int, withCov bool) *RunningStats {
+	stats := &RunningStats{
+		Mean: make([]float64, dims),
+		M2:   make([]float64, dims),
+	}
+	if withCov {
+		stats.C = make([][]float64, dims)
+		for i := range stats.C {
+			stats.C[i] = make([]float64, dims)
+		}
+	}
+	return stats
+}
+
+// Update adds the new vector to the running stats using the Welford's online algorithm
+func (stats *RunningStats) Update(vec []float64) error {
+	if len(vec) != len(stats.Mean) {
+		return errors.New("vector size does not match the stats dimensions")
+	}
+	stats.N++
+	n := float64(stats.N)
+	delta := make([]float64, len(vec))
+	for i, v := range vec {
+		delta[i] = v - stats.Mean[i]
+		stats.Mean[i] += delta[i] / n
+		stats.M2[i] += delta[i] * (v - stats.Mean[i])
+	}
+	for i := range stats.C {
+		for j := range stats.C[i] {
+			stats.C[i][j] += delta[i] * (vec[j] - stats.Mean[j])
+		}
+	}
+	return nil
+}
+
+// Std returns the sample standart deviation of every dimension
+func (stats *RunningStats) Std() []float64 {
+	std := make([]float64, len(stats.M2))
+	if stats.N < 2 {
+		return std
+	}
+	for i := range std {
+		std[i] = math.Sqrt(stats.M2[i] / float64(stats.N-1))
+	}
+	return std
+}
+
+// Covariance returns the sample covariance matrix, nil if it hasn't been requested
+func (stats *RunningStats) Covariance() [][]float64 {
+	if stats.C == nil {
+		return nil
+	}
+	cov := make([][]float64, len(stats.C))
+	for i := range stats.C {
+		cov[i] = make([]float64, len(stats.C[i]))
+		if stats.N < 2 {
+			continue
+		}
+		for j := range stats.C[i] {
+			cov[i][j] = stats.C[i][j] / float64(stats.N-1)
+		}
+	}
+	return cov
+}
+
+// Result returns the accumulated stats in form of DatasetStats
+func (stats *RunningStats) Result() DatasetStats {
+	mean := make([]float64, len(stats.Mean))
+	copy(mean, stats.Mean)
+	return DatasetStats{
+		Mean:  mean,
+		Std:   stats.Std(),
+		Cov:   stats.Covariance(),
+		Count: stats.N,
+	}
+}
+
+// Merge combines the running stats of the other batch into the current ones by the parallel
+// form of the Welford's algorithm; the batch with the negative count removes its vectors.
+// Co-moments aren't merged
+func (stats *RunningStats) Merge(other *RunningStats) error {
+	if len(other.Mean) != len(stats.Mean) || len(other.M2) != len(stats.M2) {
+		return errors.New("stats dimensions do not match")
+	}
+	n := stats.N + other.N
+	if n <= 0 {
+		stats.N = 0
+		for i := range stats.Mean {
+			stats.Mean[i], stats.M2[i] = 0, 0
+		}
+		return nil
+	}
+	weight := float64(other.N) / float64(n)
+	for i := range stats.Mean {
+		delta := other.Mean[i] - stats.Mean[i]
+		stats.Mean[i] += delta * weight
+		// NOTE: the removed batch takes its own squared deviations away along with the shift of the mean
+		otherM2 := other.M2[i]
+		if other.N < 0 {
+			otherM2 = -otherM2
+		}
+		stats.M2[i] += otherM2 + delta*delta*float64(stats.N)*weight
+		// NOTE: removal of the points may leave tiny negative rounding error
+		if stats.M2[i] < 0 {
+			stats.M2[i] = 0
+		}
+	}
+	stats.N = n
+	return nil
+}
+
+// GetDrift compares current stats with the reference ones and returns
+// RMS of the mean shift measured in reference std units and
+// RMS of the log-ratio of std values
+func GetDrift(reference, current DatasetStats) (float64, float64, error) {
+	if len(reference.Mean) != len(current.Mean) || len(reference.Std) != len(current.Std) {
+		return 0, 0, errors.New("stats dimensions do not match")
+	}
+	var meanShift, stdShift float64
+	var dims float64
+	for i := range reference.Mean {
+		if reference.Std[i] <= 0 || current.Std[i] <= 0 {
+			continue
+		}
+		z := (current.Mean[i] - reference.Mean[i]) / reference.Std[i]
+		meanShift += z * z
+		logRatio := math.Log(current.Std[i] / reference.Std[i])
+		stdShift += logRatio * logRatio
+		dims++
+	}
+	if dims == 0 {
+		return 0, 0, nil
+	}
+	return math.Sqrt(meanShift / dims), math.Sqrt(stdShift / dims), nil
+}
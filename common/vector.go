@@ -1,6 +1,8 @@
 package common
 
 import (
+	"math/bits"
+
 	"gonum.org/v1/gonum/blas/blas64"
 )
 
@@ -18,7 +20,8 @@ func NewVec(data []float64) blas64.Vector {
 
 // L2 calculates l2-distance between two vectors
 func L2(a, b blas64.Vector) float64 {
-	res := NewVec(b.Data)
+	res := NewVec(make([]float64, b.N))
+	blas64.Copy(b, res)
 	blas64.Axpy(-1.0, a, res)
 	return blas64.Nrm2(res)
 }
@@ -33,3 +36,12 @@ func CosineSim(a, b blas64.Vector) float64 {
 func IsZeroVector(v blas64.Vector) bool {
 	return blas64.Asum(v) == 0.0
 }
+
+// HammingDistance returns number of different bits of the two sketches of the same size
+func HammingDistance(a, b []byte) int {
+	var dist int
+	for i := range a {
+		dist += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return dist
+}
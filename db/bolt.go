@@ -0,0 +1,732 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	cm "lsh-search-service/common"
+)
+
+var (
+	boltHelperBucket   = []byte("helper")
+	boltHelperKey      = []byte("record")
+	boltLeaseKey       = []byte("lease")
+	boltVectorsBucket  = []byte("vectors")
+	boltPostingsBucket = []byte("postings")
+	boltSizeKey        = []byte("size")
+	// NOTE: number of documents read within the single transaction while iterating
+	boltIterateBatch = 1000
+)
+
+// NewBoltStore opens (or creates) the embedded storage file
+func NewBoltStore(config Config) (*BoltStore, error) {
+	if len(config.BoltPath) == 0 {
+		return nil, errors.New("bolt file path must be specified")
+	}
+	boltDb, err := bolt.Open(config.BoltPath, 0600, &bolt.Options{Timeout: time.Duration(dbtimeOut) * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltHelperBucket)
+		return err
+	})
+	if err != nil {
+		boltDb.Close()
+		return nil, err
+	}
+	return &BoltStore{
+		Config: config,
+		db:     boltDb,
+	}, nil
+}
+
+// getBoltCollName returns name of the bucket which holds the collection
+func getBoltCollName(collName string) []byte {
+	return []byte("coll/" + collName)
+}
+
+// encodeBoltID makes sortable key from the secondary id
+func encodeBoltID(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// getPostingPrefix returns key prefix of the posting list of the (table, hash) pair
+func getPostingPrefix(table int, hash uint64) []byte {
+	prefix := make([]byte, 12)
+	binary.BigEndian.PutUint32(prefix, uint32(table))
+	binary.BigEndian.PutUint64(prefix[4:], hash)
+	return prefix
+}
+
+// getPostingKey returns key of the posting list entry: (table, hash, secondary id)
+func getPostingKey(table int, hash, id uint64) []byte {
+	return append(getPostingPrefix(table, hash), encodeBoltID(id)...)
+}
+
+// encodeBoltValue serializes value with gob
+func encodeBoltValue(value interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBoltValue deserializes gob value
+func decodeBoltValue(data []byte, target interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(target)
+}
+
+// getBoltColl returns collection bucket with its vectors and postings sub-buckets
+func getBoltColl(tx *bolt.Tx, collName string) (*bolt.Bucket, *bolt.Bucket, *bolt.Bucket) {
+	coll := tx.Bucket(getBoltCollName(collName))
+	if coll == nil {
+		return nil, nil, nil
+	}
+	return coll, coll.Bucket(boltVectorsBucket), coll.Bucket(boltPostingsBucket)
+}
+
+// getBoltCollSize reads the documents counter of the collection
+func getBoltCollSize(coll *bolt.Bucket) int64 {
+	size := coll.Get(boltSizeKey)
+	if size == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(size))
+}
+
+// setBoltCollSize writes the documents counter of the collection
+func setBoltCollSize(coll *bolt.Bucket, size int64) error {
+	return coll.Put(boltSizeKey, encodeBoltID(uint64(size)))
+}
+
+// deleteBoltRecord drops the document and its posting list entries, returns false if there was no such document
+func deleteBoltRecord(vectors, postings *bolt.Bucket, id uint64) (bool, error) {
+	data := vectors.Get(encodeBoltID(id))
+	if data == nil {
+		return false, nil
+	}
+	var record HashesRecord
+	err := decodeBoltValue(data, &record)
+	if err != nil {
+		return false, err
+	}
+	for table, hash := range record.Hashes {
+		err = postings.Delete(getPostingKey(table, hash, id))
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, vectors.Delete(encodeBoltID(id))
+}
+
+// CreateHashCollection creates the new collection bucket
+func (store *BoltStore) CreateHashCollection(collName string, tables []string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		coll, err := tx.CreateBucket(getBoltCollName(collName))
+		if err != nil {
+			return err
+		}
+		_, err = coll.CreateBucket(boltVectorsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = coll.CreateBucket(boltPostingsBucket)
+		return err
+	})
+}
+
+// DropCollection drops the collection bucket if it exists
+func (store *BoltStore) DropCollection(collName string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(getBoltCollName(collName))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// GetCollSize returns number of documents in the collection, 0 if it doesn't exist
+func (store *BoltStore) GetCollSize(collName string) (int64, error) {
+	var size int64
+	err := store.db.View(func(tx *bolt.Tx) error {
+		coll, _, _ := getBoltColl(tx, collName)
+		if coll != nil {
+			size = getBoltCollSize(coll)
+		}
+		return nil
+	})
+	return size, err
+}
+
+// GetCandidateHashes returns documents which fall into the same bucket as the query
+// in at least one of the tables; hashes are restored from the posting list keys
+// and sketches from the values, so the vectors aren't decoded
+func (store *BoltStore) GetCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]HashesRecord, error) {
+	var candidates []HashesRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		_, _, postings := getBoltColl(tx, collName)
+		if postings == nil {
+			return nil
+		}
+		positions := make(map[uint64]int)
+		cursor := postings.Cursor()
+		for table, hash := range hashes {
+			prefix := getPostingPrefix(table, hash)
+			for key, sketch := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, sketch = cursor.Next() {
+				secondaryID := binary.BigEndian.Uint64(key[len(prefix):])
+				pos, ok := positions[secondaryID]
+				if !ok {
+					if limit > 0 && len(candidates) >= limit {
+						continue
+					}
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					pos = len(candidates)
+					positions[secondaryID] = pos
+					candidates = append(candidates, HashesRecord{
+						SecondaryID: secondaryID,
+						Hashes:      make(map[int]uint64),
+						Sketch:      append([]byte(nil), sketch...),
+					})
+				}
+				candidates[pos].Hashes[table] = hash
+			}
+		}
+		return nil
+	})
+	return candidates, err
+}
+
+// GetVectors returns feature vectors of the documents with the specified secondary ids;
+// quantized documents are returned with codes, or with the float32 copy if exact vectors are requested
+func (store *BoltStore) GetVectors(ctx context.Context, collName string, secondaryIDs []uint64, exact bool) ([]HashesRecord, error) {
+	records := make([]HashesRecord, 0, len(secondaryIDs))
+	err := store.db.View(func(tx *bolt.Tx) error {
+		_, vectors, _ := getBoltColl(tx, collName)
+		if vectors == nil {
+			return nil
+		}
+		for _, secondaryID := range secondaryIDs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			data := vectors.Get(encodeBoltID(secondaryID))
+			if data == nil {
+				continue
+			}
+			var record HashesRecord
+			err := decodeBoltValue(data, &record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record.vectorFields(exact))
+		}
+		return nil
+	})
+	return records, err
+}
+
+// GetRecordsHashes returns secondary ids and hashes of the stored documents with the specified secondary ids
+func (store *BoltStore) GetRecordsHashes(ctx context.Context, collName string, secondaryIDs []uint64) ([]HashesRecord, error) {
+	records := make([]HashesRecord, 0, len(secondaryIDs))
+	err := store.db.View(func(tx *bolt.Tx) error {
+		_, vectors, _ := getBoltColl(tx, collName)
+		if vectors == nil {
+			return nil
+		}
+		for _, secondaryID := range secondaryIDs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			data := vectors.Get(encodeBoltID(secondaryID))
+			if data == nil {
+				continue
+			}
+			var record HashesRecord
+			err := decodeBoltValue(data, &record)
+			if err != nil {
+				return err
+			}
+			records = append(records, HashesRecord{SecondaryID: secondaryID, Hashes: record.Hashes})
+		}
+		return nil
+	})
+	return records, err
+}
+
+// GetNearestVectors returns the nearest documents with the specified secondary ids,
+// filtered by the distance threshold
+func (store *BoltStore) GetNearestVectors(ctx context.Context, collName string, secondaryIDs []uint64, query DistanceQuery) ([]cm.NeighborsRecord, error) {
+	records, err := store.GetVectors(ctx, collName, secondaryIDs, true)
+	if err != nil {
+		return nil, err
+	}
+	return GetNearestRecords(records, query), nil
+}
+
+// SetHashRecords adds the new documents to the collection, creating it if needed;
+// document with the same secondary id gets replaced
+func (store *BoltStore) SetHashRecords(collName string, records []HashesRecord) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		coll, err := tx.CreateBucketIfNotExists(getBoltCollName(collName))
+		if err != nil {
+			return err
+		}
+		vectors, err := coll.CreateBucketIfNotExists(boltVectorsBucket)
+		if err != nil {
+			return err
+		}
+		postings, err := coll.CreateBucketIfNotExists(boltPostingsBucket)
+		if err != nil {
+			return err
+		}
+		size := getBoltCollSize(coll)
+		for _, record := range records {
+			record.ID = primitive.NilObjectID
+			existed, err := deleteBoltRecord(vectors, postings, record.SecondaryID)
+			if err != nil {
+				return err
+			}
+			if !existed {
+				size++
+			}
+			data, err := encodeBoltValue(record)
+			if err != nil {
+				return err
+			}
+			err = vectors.Put(encodeBoltID(record.SecondaryID), data)
+			if err != nil {
+				return err
+			}
+			for table, hash := range record.Hashes {
+				// NOTE: posting value holds the sketch, so candidates are pre-ranked without decoding the vectors
+				err = postings.Put(getPostingKey(table, hash, record.SecondaryID), record.Sketch)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return setBoltCollSize(coll, size)
+	})
+}
+
+// DeleteHashRecords drops the document with the specified secondary id
+func (store *BoltStore) DeleteHashRecords(collName string, secondaryID uint64) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		coll, vectors, postings := getBoltColl(tx, collName)
+		if coll == nil {
+			return nil
+		}
+		existed, err := deleteBoltRecord(vectors, postings, secondaryID)
+		if err != nil || !existed {
+			return err
+		}
+		return setBoltCollSize(coll, getBoltCollSize(coll)-1)
+	})
+}
+
+// IterateVectors calls fn for every document of the collection, or for the first documents
+// if sample size is specified; documents are read in batches with short transactions,
+// so fn is free to modify the store
+func (store *BoltStore) IterateVectors(ctx context.Context, collName string, sampleSize int, fn func(HashesRecord) error) error {
+	if sampleSize > 0 {
+		return store.iterateSample(ctx, collName, sampleSize, fn)
+	}
+	var lastKey []byte
+	for {
+		var batch []HashesRecord
+		err := store.db.View(func(tx *bolt.Tx) error {
+			_, vectors, _ := getBoltColl(tx, collName)
+			if vectors == nil {
+				return nil
+			}
+			cursor := vectors.Cursor()
+			key, data := cursor.First()
+			if lastKey != nil {
+				key, data = cursor.Seek(lastKey)
+				if key != nil && bytes.Equal(key, lastKey) {
+					key, data = cursor.Next()
+				}
+			}
+			for ; key != nil && len(batch) < boltIterateBatch; key, data = cursor.Next() {
+				var record HashesRecord
+				err := decodeBoltValue(data, &record)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, record.iterateFields())
+				lastKey = append(lastKey[:0], key...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, record := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err = fn(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// iterateSample calls fn for the random sample of the collection records: the keys are sampled
+// by the reservoir, and only the sampled vectors are decoded
+func (store *BoltStore) iterateSample(ctx context.Context, collName string, sampleSize int, fn func(HashesRecord) error) error {
+	var batch []HashesRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		_, vectors, _ := getBoltColl(tx, collName)
+		if vectors == nil {
+			return nil
+		}
+		keys := make([][]byte, 0, sampleSize)
+		cursor := vectors.Cursor()
+		seen := 0
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			slot := getSampleSlot(seen, sampleSize)
+			seen++
+			switch {
+			case slot == len(keys):
+				keys = append(keys, append([]byte(nil), key...))
+			case slot >= 0:
+				keys[slot] = append(keys[slot][:0], key...)
+			}
+		}
+		batch = make([]HashesRecord, len(keys))
+		for i, key := range keys {
+			err := decodeBoltValue(vectors.Get(key), &batch[i])
+			if err != nil {
+				return err
+			}
+			batch[i] = batch[i].iterateFields()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range batch {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBucketsStats returns occupancy stats of the buckets of the specified hash table
+func (store *BoltStore) GetBucketsStats(collName, table string, topN, queryLimit int) (cm.BucketsStats, error) {
+	tableIdx, err := strconv.Atoi(table)
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+	stats := cm.BucketsStats{Table: table}
+	histogram := make(map[int64]int64)
+	var hotBuckets []cm.HotBucket
+	addBucket := func(hash uint64, size int64) {
+		stats.Buckets++
+		stats.Documents += size
+		if size > stats.MaxSize {
+			stats.MaxSize = size
+		}
+		if size == 1 {
+			stats.Singletons++
+		}
+		if size > int64(queryLimit) {
+			stats.OverQueryLimit++
+		}
+		from := int64(1)
+		for from*2 <= size && from < maxHistogramBinSize {
+			from *= 2
+		}
+		histogram[from]++
+		hotBuckets = append(hotBuckets, cm.HotBucket{Hash: hash, Size: size})
+	}
+
+	err = store.db.View(func(tx *bolt.Tx) error {
+		_, _, postings := getBoltColl(tx, collName)
+		if postings == nil {
+			return nil
+		}
+		prefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(prefix, uint32(tableIdx))
+		var hash uint64
+		var size int64
+		cursor := postings.Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			keyHash := binary.BigEndian.Uint64(key[4:12])
+			if size > 0 && keyHash != hash {
+				addBucket(hash, size)
+				size = 0
+			}
+			hash = keyHash
+			size++
+		}
+		if size > 0 {
+			addBucket(hash, size)
+		}
+		return nil
+	})
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+
+	if stats.Buckets > 0 {
+		stats.AvgSize = float64(stats.Documents) / float64(stats.Buckets)
+		stats.SingletonsFraction = float64(stats.Singletons) / float64(stats.Buckets)
+	}
+	for from, count := range histogram {
+		stats.Histogram = append(stats.Histogram, newHistogramBin(from, count))
+	}
+	sort.Slice(stats.Histogram, func(i, j int) bool {
+		return stats.Histogram[i].From < stats.Histogram[j].From
+	})
+	sort.Slice(hotBuckets, func(i, j int) bool {
+		return hotBuckets[i].Size > hotBuckets[j].Size
+	})
+	if len(hotBuckets) > topN {
+		hotBuckets = hotBuckets[:topN]
+	}
+	stats.HotBuckets = hotBuckets
+	return stats, nil
+}
+
+// getBoltHelperRecord reads the helper record within the transaction
+func getBoltHelperRecord(tx *bolt.Tx) (HelperRecord, error) {
+	var record HelperRecord
+	data := tx.Bucket(boltHelperBucket).Get(boltHelperKey)
+	if data == nil {
+		return record, nil
+	}
+	err := decodeBoltValue(data, &record)
+	return record, err
+}
+
+// updateHelperRecord applies update to the helper record within the single write transaction,
+// creating the record if needed
+func (store *BoltStore) updateHelperRecord(update func(record *HelperRecord) error) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		record, err := getBoltHelperRecord(tx)
+		if err != nil {
+			return err
+		}
+		if record.ID.IsZero() {
+			record.ID = primitive.NewObjectID()
+		}
+		err = update(&record)
+		if err != nil {
+			return err
+		}
+		data, err := encodeBoltValue(record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltHelperBucket).Put(boltHelperKey, data)
+	})
+}
+
+// GetHelperRecord returns the helper record
+func (store *BoltStore) GetHelperRecord(getHasherObject bool) (HelperRecord, error) {
+	var record HelperRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getBoltHelperRecord(tx)
+		return err
+	})
+	if !getHasherObject {
+		record.Hasher = nil
+	}
+	return record, err
+}
+
+// WatchHelperRecord isn't supported: the file is locked by the single process, so the build state
+// changes only with the writes of this process and is polled
+func (store *BoltStore) WatchHelperRecord(ctx context.Context, onChange func(), onInvalidate func(CacheInvalidation)) error {
+	return ErrWatchNotSupported
+}
+
+// PublishInvalidation does nothing, since the only instance using the file has already invalidated its cache
+func (store *BoltStore) PublishInvalidation(invalidation CacheInvalidation) error {
+	return nil
+}
+
+// GetBuildLease returns the build lease, the lease without the owner means there is no build running
+func (store *BoltStore) GetBuildLease() (BuildLease, error) {
+	var lease BuildLease
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lease, err = getBoltBuildLease(tx)
+		return err
+	})
+	return lease, err
+}
+
+// AcquireBuildLease takes the lease, if there is no lease, it has expired by the heartbeat of the new one
+// or it's held by the same owner. Returns the replaced lease or ErrLeaseHeld
+func (store *BoltStore) AcquireBuildLease(lease BuildLease) (BuildLease, error) {
+	var prev BuildLease
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		prev, err = getBoltBuildLease(tx)
+		if err != nil {
+			return err
+		}
+		if len(prev.Owner) > 0 && prev.Owner != lease.Owner && prev.Expires >= lease.Heartbeat {
+			return ErrLeaseHeld
+		}
+		return putBoltBuildLease(tx, lease)
+	})
+	if err != nil {
+		return BuildLease{}, err
+	}
+	return prev, nil
+}
+
+// RenewBuildLease updates the lease held by the owner, returns ErrLeaseLost if it has been taken over
+// and ErrCancelRequested if its build has been cancelled
+func (store *BoltStore) RenewBuildLease(lease BuildLease) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		prev, err := getBoltBuildLease(tx)
+		if err != nil {
+			return err
+		}
+		if prev.Owner != lease.Owner {
+			return ErrLeaseLost
+		}
+		if prev.CancelRequested {
+			return ErrCancelRequested
+		}
+		return putBoltBuildLease(tx, lease)
+	})
+}
+
+// RequestBuildCancel marks the build of the lease owner cancelled, returns ErrLeaseLost if the lease
+// isn't held by the owner anymore
+func (store *BoltStore) RequestBuildCancel(owner string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		lease, err := getBoltBuildLease(tx)
+		if err != nil {
+			return err
+		}
+		if len(owner) == 0 || lease.Owner != owner {
+			return ErrLeaseLost
+		}
+		lease.CancelRequested = true
+		return putBoltBuildLease(tx, lease)
+	})
+}
+
+// ReleaseBuildLease drops the lease held by the owner
+func (store *BoltStore) ReleaseBuildLease(owner string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		prev, err := getBoltBuildLease(tx)
+		if err != nil || prev.Owner != owner {
+			return err
+		}
+		return tx.Bucket(boltHelperBucket).Delete(boltLeaseKey)
+	})
+}
+
+// getBoltBuildLease reads the build lease within the transaction
+func getBoltBuildLease(tx *bolt.Tx) (BuildLease, error) {
+	var lease BuildLease
+	data := tx.Bucket(boltHelperBucket).Get(boltLeaseKey)
+	if data == nil {
+		return lease, nil
+	}
+	err := decodeBoltValue(data, &lease)
+	return lease, err
+}
+
+// putBoltBuildLease writes the build lease within the transaction
+func putBoltBuildLease(tx *bolt.Tx, lease BuildLease) error {
+	lease.ID = BuildLeaseID
+	data, err := encodeBoltValue(lease)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltHelperBucket).Put(boltLeaseKey, data)
+}
+
+// CheckHealth checks that the file is still open
+func (store *BoltStore) CheckHealth() error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// UpdateBuildStatus updates helper record with the new build status and error
+func (store *BoltStore) UpdateBuildStatus(status HelperRecord) error {
+	return store.updateHelperRecord(func(record *HelperRecord) error {
+		record.IsBuildDone = status.IsBuildDone
+		record.BuildError = status.BuildError
+		record.BuildOwner = status.BuildOwner
+		record.LastBuildTime = status.LastBuildTime
+		record.BuildElapsedTime = status.BuildElapsedTime
+		return nil
+	})
+}
+
+// UpdateBuildProgress saves the current build progress to the helper record
+func (store *BoltStore) UpdateBuildProgress(progress cm.BuildProgress) error {
+	return store.updateHelperRecord(func(record *HelperRecord) error {
+		record.BuildProgress = progress
+		return nil
+	})
+}
+
+// SaveBuild stores the new hasher and makes the new hash collection active, if the build
+// is still marked in progress by its owner
+func (store *BoltStore) SaveBuild(build HelperRecord) error {
+	return store.updateHelperRecord(func(record *HelperRecord) error {
+		if record.BuildOwner != build.BuildOwner {
+			return ErrLeaseLost
+		}
+		build.ID = record.ID
+		build.InsertStats = NewInsertStats(len(build.BuildStats.Mean))
+		*record = build
+		return nil
+	})
+}
+
+// UpdateInsertStats merges the stats of the batch into the running stats in the helper record
+func (store *BoltStore) UpdateInsertStats(stats InsertStats) error {
+	return store.updateHelperRecord(func(record *HelperRecord) error {
+		insertStats, err := record.InsertStats.Merge(stats)
+		if err != nil {
+			return err
+		}
+		record.InsertStats = insertStats
+		return nil
+	})
+}
+
+// Disconnect closes the storage file
+func (store *BoltStore) Disconnect() {
+	store.db.Close()
+}
@@ -0,0 +1,212 @@
+package db_test
+
+import (
+	"context"
+	"io/ioutil"
+	"lsh-search-service/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func getTestBoltStore(t *testing.T) (*db.BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "bolt-test")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	store, err := db.NewBoltStore(db.Config{Backend: db.BackendBolt, BoltPath: filepath.Join(dir, "test.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not open bolt store: %v", err)
+	}
+	fillTestStore(t, store)
+	return store, func() {
+		store.Disconnect()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStoreCandidates(t *testing.T) {
+	store, cleanup := getTestBoltStore(t)
+	defer cleanup()
+	candidates, err := store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 0)
+	if err != nil {
+		t.Fatalf("Could not get candidates: %v", err)
+	}
+	if len(candidates) != 3 {
+		t.Fatal("Candidates must match hash of any table")
+	}
+	for _, candidate := range candidates {
+		if candidate.SecondaryID == 1 && (len(candidate.Sketch) != 1 || candidate.Sketch[0] != 7) {
+			t.Fatal("Candidates must be returned with sketches")
+		}
+	}
+	candidates, _ = store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 2)
+	if len(candidates) != 2 {
+		t.Fatal("Candidates must be limited")
+	}
+	vectors, err := store.GetVectors(context.Background(), "hashes", []uint64{2, 5}, false)
+	if err != nil {
+		t.Fatalf("Could not get vectors: %v", err)
+	}
+	if len(vectors) != 1 || vectors[0].FeatureVec[0] != 2.0 {
+		t.Fatal("Vectors must be fetched by secondary id")
+	}
+	err = store.SetHashRecords("hashes", []db.HashesRecord{
+		{SecondaryID: 1, FeatureVec: []float64{1.0}, Hashes: map[int]uint64{0: 2, 1: 3}},
+	})
+	if err != nil {
+		t.Fatalf("Could not replace record: %v", err)
+	}
+	candidates, _ = store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 0)
+	if len(candidates) != 2 || hasCandidate(candidates, 1) {
+		t.Fatal("Replaced record must leave its old buckets")
+	}
+	err = store.DeleteHashRecords("hashes", 1)
+	if err != nil {
+		t.Fatalf("Could not delete record: %v", err)
+	}
+	candidates, _ = store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 2, 1: 3}, 0)
+	if len(candidates) != 1 || candidates[0].SecondaryID != 4 {
+		t.Fatal("Deleted record must not be returned as candidate")
+	}
+	size, _ := store.GetCollSize("hashes")
+	if size != 3 {
+		t.Fatal("Deleted record must not be counted")
+	}
+}
+
+func TestBoltStoreBucketsStats(t *testing.T) {
+	store, cleanup := getTestBoltStore(t)
+	defer cleanup()
+	stats, err := store.GetBucketsStats("hashes", "0", 1, 2)
+	if err != nil {
+		t.Fatalf("Could not get buckets stats: %v", err)
+	}
+	if stats.Buckets != 2 || stats.Documents != 4 || stats.MaxSize != 3 || stats.Singletons != 1 {
+		t.Fatal("Buckets stats are wrong")
+	}
+	if len(stats.HotBuckets) != 1 || stats.HotBuckets[0].Hash != 1 {
+		t.Fatal("Hot buckets must be sorted by size and limited")
+	}
+}
+
+func TestBoltStoreIterateVectors(t *testing.T) {
+	store, cleanup := getTestBoltStore(t)
+	defer cleanup()
+	var count int
+	// NOTE: writes are allowed while iterating
+	err := store.IterateVectors(context.Background(), "hashes", 0, func(record db.HashesRecord) error {
+		count++
+		return store.SetHashRecords("other", []db.HashesRecord{record})
+	})
+	if err != nil || count != 4 {
+		t.Fatal("All the records must be iterated")
+	}
+	size, _ := store.GetCollSize("other")
+	if size != 4 {
+		t.Fatal("Records written while iterating must be saved")
+	}
+	count = 0
+	store.IterateVectors(context.Background(), "hashes", 2, func(record db.HashesRecord) error {
+		count++
+		return nil
+	})
+	if count != 2 {
+		t.Fatal("Only the sample of records must be iterated")
+	}
+	sampled := make(map[uint64]struct{})
+	for i := 0; i < 200; i++ {
+		store.IterateVectors(context.Background(), "hashes", 1, func(record db.HashesRecord) error {
+			sampled[record.SecondaryID] = struct{}{}
+			return nil
+		})
+	}
+	if len(sampled) != 4 {
+		t.Fatal("Every record must get into the random sample")
+	}
+}
+
+func TestNewStoreError(t *testing.T) {
+	store, err := db.NewStore(db.Config{Backend: db.BackendBolt})
+	if err == nil || store != nil {
+		t.Fatal("Failed store must be returned as the untyped nil")
+	}
+	store, err = db.NewStore(db.Config{Backend: db.BackendBolt, Shards: 2, ShardMode: db.ShardModeStores})
+	if err == nil || store != nil {
+		t.Fatal("Failed sharded store must be returned as the untyped nil")
+	}
+}
+
+func TestBoltStoreHelperRecord(t *testing.T) {
+	store, cleanup := getTestBoltStore(t)
+	defer cleanup()
+	record, _ := store.GetHelperRecord(false)
+	if !record.ID.IsZero() {
+		t.Fatal("Helper record must not exist before the first update")
+	}
+	store.SaveBuild(db.HelperRecord{IsBuildDone: true, Hasher: []byte{1}, HashCollName: "hashes"})
+	store.UpdateInsertStats(db.InsertStats{Count: 1})
+	record, _ = store.GetHelperRecord(false)
+	if record.ID.IsZero() || !record.IsBuildDone || record.Hasher != nil || record.InsertStats.Count != 1 {
+		t.Fatal("Helper record must be saved, hasher is returned only on demand")
+	}
+	record, _ = store.GetHelperRecord(true)
+	if len(record.Hasher) != 1 {
+		t.Fatal("Hasher must be returned on demand")
+	}
+}
+
+func TestBoltStoreBuildLease(t *testing.T) {
+	store, cleanup := getTestBoltStore(t)
+	defer cleanup()
+	store.SaveBuild(db.HelperRecord{IsBuildDone: true, HashCollName: "hashes"})
+	_, err := store.AcquireBuildLease(db.BuildLease{Owner: "a", Heartbeat: 1, Expires: 10})
+	if err != nil {
+		t.Fatalf("Could not acquire lease: %v", err)
+	}
+	if _, err = store.AcquireBuildLease(db.BuildLease{Owner: "b", Heartbeat: 5, Expires: 15}); err != db.ErrLeaseHeld {
+		t.Fatal("Live lease must not be acquired by another owner")
+	}
+	if err = store.RenewBuildLease(db.BuildLease{Owner: "a", Heartbeat: 10, Expires: 20, HashCollName: "hashes"}); err != nil {
+		t.Fatalf("Could not renew lease: %v", err)
+	}
+	prev, err := store.AcquireBuildLease(db.BuildLease{Owner: "b", Heartbeat: 21, Expires: 30})
+	if err != nil || prev.Owner != "a" || prev.HashCollName != "hashes" {
+		t.Fatalf("Expired lease must be taken over: %v %+v", err, prev)
+	}
+	if err = store.RenewBuildLease(db.BuildLease{Owner: "a", Heartbeat: 22, Expires: 32}); err != db.ErrLeaseLost {
+		t.Fatal("Lease taken over must be lost by the previous owner")
+	}
+	store.UpdateBuildStatus(db.HelperRecord{IsBuildDone: false, BuildOwner: "b"})
+	if err = store.SaveBuild(db.HelperRecord{IsBuildDone: true, BuildOwner: "a", HashCollName: "a"}); err != db.ErrLeaseLost {
+		t.Fatal("Build must not be saved by the owner which has lost the lease")
+	}
+	if err = store.SaveBuild(db.HelperRecord{IsBuildDone: true, BuildOwner: "b", HashCollName: "b"}); err != nil {
+		t.Fatalf("Could not save build: %v", err)
+	}
+	if err = store.RequestBuildCancel("a"); err != db.ErrLeaseLost {
+		t.Fatal("Build must be cancelled only for the lease owner")
+	}
+	if err = store.RequestBuildCancel("b"); err != nil {
+		t.Fatalf("Could not request build cancel: %v", err)
+	}
+	if err = store.RenewBuildLease(db.BuildLease{Owner: "b", Heartbeat: 25, Expires: 35}); err != db.ErrCancelRequested {
+		t.Fatal("Cancel request must be seen by the owner with the renew")
+	}
+	if lease, _ := store.GetBuildLease(); !lease.CancelRequested || lease.Expires != 30 {
+		t.Fatalf("Cancel request must be kept by the renew: %+v", lease)
+	}
+	store.ReleaseBuildLease("a")
+	if lease, _ := store.GetBuildLease(); lease.Owner != "b" {
+		t.Fatal("Lease must be released only by its owner")
+	}
+	store.ReleaseBuildLease("b")
+	if lease, _ := store.GetBuildLease(); len(lease.Owner) != 0 {
+		t.Fatal("Lease must be released by its owner")
+	}
+	record, _ := store.GetHelperRecord(false)
+	if !record.IsBuildDone || record.HashCollName != "b" {
+		t.Fatal("Lease must not change the helper record, the build is saved only by its owner")
+	}
+}
@@ -75,8 +75,15 @@ func (mongodb *MongoDatastore) CreateCollection(collName string) (MongoCollectio
 	return coll, nil
 }
 
-// DropCollection drops collection on the server
+// DropCollection drops collection on the server, together with its posting lists
+// if the inverted hash layout is used
 func (mongodb *MongoDatastore) DropCollection(collectionName string) error {
+	if mongodb.Config.HashLayout == HashLayoutInverted {
+		err := mongodb.db.Collection(GetPostingsCollName(collectionName)).Drop(context.Background())
+		if err != nil {
+			return err
+		}
+	}
 	coll := mongodb.db.Collection(collectionName)
 	// ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
 	// defer cancel()
@@ -87,6 +94,29 @@ func (mongodb *MongoDatastore) DropCollection(collectionName string) error {
 	return nil
 }
 
+// GetStorageSize returns size of the collection data and its indexes on disk
+func (mongodb *MongoDatastore) GetStorageSize(collName string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	var result struct {
+		StorageSize    interface{} `bson:"storageSize"`
+		TotalIndexSize interface{} `bson:"totalIndexSize"`
+	}
+	err := mongodb.db.RunCommand(ctx, bson.D{{"collStats", collName}}).Decode(&result)
+	if err != nil {
+		return 0, err
+	}
+	storageSize, err := ConvertNumber(result.StorageSize)
+	if err != nil {
+		return 0, err
+	}
+	indexSize, err := ConvertNumber(result.TotalIndexSize)
+	if err != nil {
+		return 0, err
+	}
+	return int64(storageSize + indexSize), nil
+}
+
 // GetCollection just wraps the default mongo collection into custom one
 func (mongodb *MongoDatastore) GetCollection(collName string) MongoCollection {
 	return MongoCollection{mongodb.db.Collection(collName)}
@@ -136,6 +166,29 @@ func (coll MongoCollection) CreateIndexesByFields(fields []string, unique bool)
 	return nil
 }
 
+// CreateCompoundIndex creates the single ascending index over all the fields
+func (coll MongoCollection) CreateCompoundIndex(fields []string, unique bool) error {
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{field, 1})
+	}
+	model := mongo.IndexModel{
+		Keys: keys,
+		Options: options.MergeIndexOptions(
+			options.Index().SetBackground(true), // deprecated since mongodb 4.2
+			options.Index().SetUnique(unique),
+		),
+	}
+	opts := options.CreateIndexes().SetMaxTime(time.Duration(createIndexMaxTime) * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := coll.Indexes().CreateOne(ctx, model, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // DropIndexByField sends command to drop the selected index;
 // Input format should be in the following format: ""Some Field_1""
 func (coll MongoCollection) DropIndexByField(indexName string) error {
@@ -150,19 +203,40 @@ func (coll MongoCollection) DropIndexByField(indexName string) error {
 
 // GetAggregation runs prepared aggregation pipeline in mongodb
 func (coll MongoCollection) GetAggregation(groupStage mongo.Pipeline) ([]bson.M, error) {
+	return coll.GetAggregationWithContext(context.TODO(), groupStage)
+}
+
+// GetAggregationWithContext runs prepared aggregation pipeline in mongodb until the context is done
+func (coll MongoCollection) GetAggregationWithContext(ctx context.Context, groupStage mongo.Pipeline) ([]bson.M, error) {
 	opts := options.Aggregate().SetMaxTime(time.Duration(dbtimeOut) * time.Second)
-	cursor, err := coll.Aggregate(context.TODO(), groupStage, opts)
+	cursor, err := coll.Aggregate(ctx, groupStage, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	var results []bson.M
-	if err = cursor.All(context.TODO(), &results); err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		return nil, err
 	}
 	return results, nil
 }
 
+// GetSampleCursor returns cursor over the random sample of documents of the specified size
+func (coll MongoCollection) GetSampleCursor(size int, proj bson.M) (*mongo.Cursor, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{"$sample", bson.D{
+			{"size", size},
+		}}},
+		bson.D{{"$project", proj}},
+	}
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	cursor, err := coll.Aggregate(context.Background(), pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
 // UpdateField updates the selected field of the doc.
 // Example:
 //     filter := bson.D{{"_id", id}}
@@ -194,6 +268,21 @@ func (coll MongoCollection) SetRecords(data []interface{}) error {
 	return nil
 }
 
+// WriteRecords applies the batch of write operations in a single request
+func (coll MongoCollection) WriteRecords(models []mongo.WriteModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	opts := options.BulkWrite().SetOrdered(false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	_, err := coll.BulkWrite(ctx, models, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // DeleteRecords deletes records from specified collection by query
 func (coll MongoCollection) DeleteRecords(query bson.D) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
@@ -210,11 +299,17 @@ func (coll MongoCollection) DeleteRecords(query bson.D) error {
 //     bson.D{{"secondaryId", bson.M{"$in": []int{1, 3}}}}
 // 	   bson.D{{"Hasher", bson.D{{"$exists", true}}}}
 func (coll MongoCollection) GetCursor(query FindQuery) (*mongo.Cursor, error) {
+	return coll.GetCursorWithContext(context.Background(), query)
+}
+
+// GetCursorWithContext returns db cursor for specified collection and query, the query
+// is sent within the context; the context of the cursor reads is passed to the reads themselves
+func (coll MongoCollection) GetCursorWithContext(ctx context.Context, query FindQuery) (*mongo.Cursor, error) {
 	opts := options.MergeFindOptions(
 		options.Find().SetLimit(int64(query.Limit)),
 		options.Find().SetProjection(query.Proj),
 	)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(dbtimeOut)*time.Second)
 	defer cancel()
 	cursor, err := coll.Find(ctx, query.Query, opts)
 	if err != nil {
@@ -1,12 +1,17 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"os"
 	"strconv"
+	"sync"
 
+	bolt "go.etcd.io/bbolt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	cm "lsh-search-service/common"
 )
 
 var (
@@ -43,6 +48,46 @@ var (
 			}},
 		}}},
 	}
+
+	// HelperChangesPipeline passes the cache invalidations and only the changes of the helper document
+	// which switch the active build, so the build progress, the insert stats updates and the build lease aren't streamed
+	HelperChangesPipeline = mongo.Pipeline{
+		bson.D{{"$match", bson.D{{"$or", bson.A{
+			bson.D{{"documentKey._id", CacheInvalidationID}},
+			bson.D{
+				{"documentKey._id", bson.D{{"$nin", bson.A{BuildLeaseID, CacheInvalidationID}}}},
+				{"$or", bson.A{
+					bson.D{{"operationType", bson.D{{"$ne", "update"}}}},
+					bson.D{{"updateDescription.updatedFields.isBuildDone", bson.D{{"$exists", true}}}},
+					bson.D{{"updateDescription.updatedFields.buildError", bson.D{{"$exists", true}}}},
+					bson.D{{"updateDescription.updatedFields.hashCollName", bson.D{{"$exists", true}}}},
+					bson.D{{"updateDescription.updatedFields.lastBuildTime", bson.D{{"$exists", true}}}},
+				}},
+			},
+		}}}}},
+	}
+
+	// helperFilter selects the helper document, skipping the build lease and the cache invalidation
+	// kept in the same collection
+	helperFilter = bson.D{{"_id", bson.D{{"$nin", bson.A{BuildLeaseID, CacheInvalidationID}}}}}
+
+	// ErrWatchNotSupported is returned by the store which can't notify about the helper record changes
+	ErrWatchNotSupported = errors.New("watching helper record changes is not supported")
+	// ErrLeaseHeld is returned when the build lease is held by another live owner
+	ErrLeaseHeld = errors.New("build lease is held by another owner")
+	// ErrLeaseLost is returned when the build lease has been taken over by another owner,
+	// or when the build is saved after another owner has rolled it back or restarted it
+	ErrLeaseLost = errors.New("build lease has been lost")
+	// ErrCancelRequested is returned by the renew of the lease whose build has been cancelled by another instance
+	ErrCancelRequested = errors.New("build has been cancelled by another instance")
+)
+
+const (
+	// BuildLeaseID is the id of the build lease document in the helper collection
+	BuildLeaseID = "buildLease"
+	// CacheInvalidationID is the id of the document in the helper collection which is replaced by every
+	// write of the hash collection, so its change stream tells the instances which buckets to drop from their caches
+	CacheInvalidationID = "cacheInvalidation"
 )
 
 // Objects inside the hdf5:
@@ -69,24 +114,251 @@ type HashesRecord struct {
 	SecondaryID uint64             `bson:"secondaryId,omitempty"`
 	FeatureVec  []float64          `bson:"featureVec,omitempty"`
 	Hashes      map[int]uint64     `bson:"hashes,omitempty"`
+	Codes       []byte             `bson:"codes,omitempty"`   // quantized vector, replaces featureVec
+	Vec32       []byte             `bson:"vec32,omitempty"`   // float32 copy of the quantized vector for the exact re-rank
+	Sketch      []byte             `bson:"sketch,omitempty"`  // SimHash sketch for the candidates pre-ranking
+	Level       int                `bson:"level,omitempty"`   // top level of the HNSW graph node
+	Links       [][]uint64         `bson:"links,omitempty"`   // HNSW graph node links per level
+	Deleted     bool               `bson:"deleted,omitempty"` // tombstone of the HNSW graph node
 }
 
 // HelperRecord holds the Hasher model and supplementary data
 type HelperRecord struct {
-	ID               primitive.ObjectID `bson:"_id,omitempty"`
-	Hasher           []byte             `bson:"hasher,omitempty"`
-	IsBuildDone      bool               `bson:"isBuildDone,omitempty"`
-	BuildError       string             `bson:"buildError,omitempty"`
-	HashCollName     string             `bson:"hashCollName,omitempty"`
-	LastBuildTime    int64              `bson:"lastBuildTime,omitempty"`
-	BuildElapsedTime int64              `bson:"buildElapsedTime,omitempty"`
+	ID               primitive.ObjectID   `bson:"_id,omitempty"`
+	Hasher           []byte               `bson:"hasher,omitempty"`
+	IsBuildDone      bool                 `bson:"isBuildDone,omitempty"`
+	BuildError       string               `bson:"buildError,omitempty"`
+	BuildOwner       string               `bson:"buildOwner,omitempty"` // instance which has marked the build in progress, only it saves the build
+	HashCollName     string               `bson:"hashCollName,omitempty"`
+	LastBuildTime    int64                `bson:"lastBuildTime,omitempty"`
+	BuildElapsedTime int64                `bson:"buildElapsedTime,omitempty"`
+	BuildProgress    cm.BuildProgress     `bson:"buildProgress,omitempty"`
+	BuildStats       cm.DatasetStats      `bson:"buildStats,omitempty"`
+	InsertStats      InsertStats          `bson:"insertStats,omitempty"`
+	ScalarQuantizer  *cm.ScalarQuantizer  `bson:"scalarQuantizer,omitempty"`
+	ProductQuantizer *cm.ProductQuantizer `bson:"productQuantizer,omitempty"`
+	IndexType        string               `bson:"indexType,omitempty"`
+	InvertedFile     *cm.InvertedFile     `bson:"invertedFile,omitempty"`
+	Forest           []byte               `bson:"forest,omitempty"` // random projection trees, dumped in the same way as the hasher
+	Graph            []byte               `bson:"graph,omitempty"`  // HNSW graph config, nodes are kept in the hash collection
+}
+
+// CacheInvalidation holds the buckets of the hash collection changed by the write of the instance;
+// all the buckets are changed if All is set. Time makes every invalidation differ from the previous one,
+// since the storage doesn't stream the writes which change nothing
+type CacheInvalidation struct {
+	ID           string   `bson:"_id,omitempty"`
+	Origin       string   `bson:"origin"`
+	HashCollName string   `bson:"hashCollName"`
+	Buckets      []Bucket `bson:"buckets,omitempty"`
+	All          bool     `bson:"all,omitempty"`
+	Time         int64    `bson:"time"`
+}
+
+// helperChange is the event of the helper collection change stream; the full document comes with the inserts
+// and the replaces, which are the only writes of the cache invalidation, and it's decoded only for them
+type helperChange struct {
+	DocumentKey struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// Bucket is the single bucket of the hash table
+type Bucket struct {
+	Table int    `bson:"table"`
+	Hash  uint64 `bson:"hash"`
+}
+
+// BuildLease is the lock of the index build kept in the helper collection: only the owner runs the build,
+// renewing the lease with heartbeats, so the lease expires if the owner dies. The lease keeps what is needed
+// to roll back or to rerun the build of the dead owner. Times are unix nanoseconds
+type BuildLease struct {
+	ID           string           `bson:"_id,omitempty"`
+	Owner        string           `bson:"owner"`
+	Heartbeat    int64            `bson:"heartbeat"`
+	Expires      int64            `bson:"expires"`
+	HashCollName string           `bson:"hashCollName,omitempty"` // hash collection being built
+	PrevStatus   HelperRecord     `bson:"prevStatus,omitempty"`   // build status preceding the build
+	Input        *cm.DatasetStats `bson:"input,omitempty"`
+	// NOTE: the cancel requested by another instance is kept till the owner sees it with the next renew
+	CancelRequested bool `bson:"cancelRequested,omitempty"`
+}
+
+// PostingRecord is the chunk of the posting list of the single bucket of the hash table,
+// used by the inverted hash layout
+type PostingRecord struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Table   int                `bson:"table"`
+	Hash    uint64             `bson:"hash"`
+	Entries []PostingEntry     `bson:"entries"`
+}
+
+// PostingEntry is the vector listed in the posting list; the sketch is kept in the entry,
+// so candidates are pre-ranked without reading the vectors collection
+type PostingEntry struct {
+	SecondaryID uint64 `bson:"id"`
+	Sketch      []byte `bson:"sketch,omitempty"`
+}
+
+// DistanceQuery describes the exact distance filtering which is done by the storage
+type DistanceQuery struct {
+	Vec       []float64
+	IsAngular bool
+	Thrsh     float64
+	Limit     int
+}
+
+// InsertStats holds the running stats (the Welford's state) of the vectors added after the build;
+// the version is bumped by every update, so several instances can merge their batches concurrently
+type InsertStats struct {
+	Count   int64     `bson:"count"`
+	Mean    []float64 `bson:"mean"`
+	M2      []float64 `bson:"m2"`
+	Version int64     `bson:"version"`
+}
+
+// nearestRecord is used to decode the distance aggregation result
+type nearestRecord struct {
+	SecondaryID uint64  `bson:"secondaryId"`
+	Dist        float64 `bson:"dist"`
+}
+
+// bucketsFacet is used to decode the buckets occupancy aggregation result
+type bucketsFacet struct {
+	Summary []struct {
+		Buckets        int64 `bson:"buckets"`
+		Documents      int64 `bson:"documents"`
+		MaxSize        int64 `bson:"maxSize"`
+		Singletons     int64 `bson:"singletons"`
+		OverQueryLimit int64 `bson:"overQueryLimit"`
+	} `bson:"summary"`
+	Histogram []struct {
+		ID    interface{} `bson:"_id"`
+		Count int64       `bson:"count"`
+	} `bson:"histogram"`
+	HotBuckets []struct {
+		Hash uint64 `bson:"_id"`
+		Size int64  `bson:"size"`
+	} `bson:"hotBuckets"`
 }
 
+// Used to select the storage backend
+const (
+	BackendMongo  = "mongo"
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
+
+// Used to select the layout of the hash collections in mongo:
+// document layout keeps all the hashes within the vector document and indexes every table field,
+// inverted layout keeps one posting list document per (table, bucket) in the separate collection
+const (
+	HashLayoutDocument = "document"
+	HashLayoutInverted = "inverted"
+)
+
+// Used to select the way the hash collections are sharded: collections mode splits them into the suffixed
+// collections of the single store, stores mode splits them between the separate stores
+const (
+	ShardModeCollections = "collections"
+	ShardModeStores      = "stores"
+)
+
 // Config holds db address and entities names
 type Config struct {
+	Backend              string
+	HashLayout           string
+	BoltPath             string
 	DbLocation           string
 	DbName               string
 	HelperCollectionName string
+	SourceCollectionName string
+	Shards               int
+	ShardMode            string
+	ShardLocations       []string // mongo addresses or bolt paths of the shard stores
+}
+
+// VectorStore holds all the operations the search index needs from the storage;
+// collections are named sets of HashesRecord documents, helper record is the single
+// document which holds the hasher and the build state. Reads of the query take the context
+// of the request: once it's done, the documents read so far are returned along with the context error
+type VectorStore interface {
+	CreateHashCollection(collName string, tables []string) error
+	DropCollection(collName string) error
+	GetCollSize(collName string) (int64, error)
+	GetCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]HashesRecord, error)
+	GetVectors(ctx context.Context, collName string, secondaryIDs []uint64, exact bool) ([]HashesRecord, error)
+	GetRecordsHashes(ctx context.Context, collName string, secondaryIDs []uint64) ([]HashesRecord, error)
+	GetNearestVectors(ctx context.Context, collName string, secondaryIDs []uint64, query DistanceQuery) ([]cm.NeighborsRecord, error)
+	SetHashRecords(collName string, records []HashesRecord) error
+	DeleteHashRecords(collName string, secondaryID uint64) error
+	IterateVectors(ctx context.Context, collName string, sampleSize int, fn func(HashesRecord) error) error
+	GetBucketsStats(collName, table string, topN, queryLimit int) (cm.BucketsStats, error)
+	GetHelperRecord(getHasherObject bool) (HelperRecord, error)
+	WatchHelperRecord(ctx context.Context, onChange func(), onInvalidate func(CacheInvalidation)) error
+	PublishInvalidation(invalidation CacheInvalidation) error
+	GetBuildLease() (BuildLease, error)
+	AcquireBuildLease(lease BuildLease) (BuildLease, error)
+	RenewBuildLease(lease BuildLease) error
+	ReleaseBuildLease(owner string) error
+	RequestBuildCancel(owner string) error
+	CheckHealth() error
+	UpdateBuildStatus(status HelperRecord) error
+	UpdateBuildProgress(progress cm.BuildProgress) error
+	SaveBuild(record HelperRecord) error
+	UpdateInsertStats(stats InsertStats) error
+	Disconnect()
+}
+
+// memoryCollection holds documents by secondary id and the buckets index:
+// table -> hash -> set of secondary ids
+type memoryCollection struct {
+	records map[uint64]HashesRecord
+	buckets map[int]map[uint64]map[uint64]struct{}
+}
+
+// ShardedStore splits every hash collection into shards by consistent hashing of the secondary id:
+// shards are either the suffixed collections of the single store or the separate stores. Queries are sent
+// to all the shards concurrently, writes are routed to the shard of the document. The source collection,
+// the helper record and the build lease are kept by the first shard
+type ShardedStore struct {
+	Config   Config
+	shards   []VectorStore
+	names    []string
+	suffixes []string
+	ring     HashRing
+}
+
+// shardCandidateRank is used to merge the candidates of the shards: the number of the query buckets
+// the candidate falls into, and its position in the candidates of its shard
+type shardCandidateRank struct {
+	collisions int
+	pos        int
+}
+
+// HashRing maps the secondary ids to the shards: every shard owns several points of the ring,
+// the id belongs to the shard of the first point following the hash of the id
+type HashRing struct {
+	points []uint64
+	shards []int
+}
+
+// BoltStore keeps all the data in the single embedded key-value file;
+// every collection is a bucket with vectors and posting lists of (table, hash) pairs
+type BoltStore struct {
+	Config Config
+	db     *bolt.DB
+}
+
+// MemoryStore keeps all the data in the process memory, suitable for tests and small deployments
+type MemoryStore struct {
+	sync.RWMutex
+	Config       Config
+	collections  map[string]*memoryCollection
+	helperRecord HelperRecord
+	buildLease   BuildLease
+	watchers     map[chan struct{}]func(CacheInvalidation)
 }
 
 // MongoCollection is just an alias to original mongo Collection,
@@ -3,9 +3,133 @@ package db
 import (
 	"context"
 	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gonum.org/v1/gonum/blas/blas64"
+	cm "lsh-search-service/common"
+)
+
+const (
+	// NOTE: buckets larger than that fall into the last open histogram bin
+	maxHistogramBinSize = int64(1 << 20)
 )
 
+// GetHashFieldName returns the name of the document field which holds the hash of the specified table
+func GetHashFieldName(table string) string {
+	return "hashes." + table
+}
+
+// vectorFields returns the copy of the record with the same fields as GetVectors fetches from mongo
+func (record HashesRecord) vectorFields(exact bool) HashesRecord {
+	vector := HashesRecord{
+		SecondaryID: record.SecondaryID,
+		FeatureVec:  record.FeatureVec,
+	}
+	if exact {
+		vector.Vec32 = record.Vec32
+	} else {
+		vector.Codes = record.Codes
+	}
+	return vector
+}
+
+// iterateFields returns the copy of the record with the same fields as IterateVectors fetches from mongo
+func (record HashesRecord) iterateFields() HashesRecord {
+	return HashesRecord{
+		SecondaryID: record.SecondaryID,
+		FeatureVec:  record.FeatureVec,
+		Codes:       record.Codes,
+		Vec32:       record.Vec32,
+		Level:       record.Level,
+		Links:       record.Links,
+		Deleted:     record.Deleted,
+	}
+}
+
+// GetQuantizer returns the quantizer of the build, nil if vectors are stored as is
+func (record HelperRecord) GetQuantizer() cm.Quantizer {
+	switch {
+	case record.ScalarQuantizer != nil:
+		return record.ScalarQuantizer
+	case record.ProductQuantizer != nil:
+		return record.ProductQuantizer
+	}
+	return nil
+}
+
+// SetQuantizer stores the quantizer of the build into the field of its type
+func (record *HelperRecord) SetQuantizer(quantizer cm.Quantizer) {
+	switch q := quantizer.(type) {
+	case *cm.ScalarQuantizer:
+		record.ScalarQuantizer = q
+	case *cm.ProductQuantizer:
+		record.ProductQuantizer = q
+	}
+}
+
+// NewInsertStats returns the empty insert stats of the vectors of the specified size
+func NewInsertStats(dims int) InsertStats {
+	return InsertStats{
+		Mean: make([]float64, dims),
+		M2:   make([]float64, dims),
+	}
+}
+
+// Merge returns the insert stats combined with the stats of the batch; the batch with
+// the negative count removes its vectors
+func (stats InsertStats) Merge(batch InsertStats) (InsertStats, error) {
+	if stats.Count == 0 && len(stats.Mean) == 0 {
+		stats.Mean, stats.M2 = make([]float64, len(batch.Mean)), make([]float64, len(batch.M2))
+	}
+	running := &cm.RunningStats{
+		N:    stats.Count,
+		Mean: append([]float64(nil), stats.Mean...),
+		M2:   append([]float64(nil), stats.M2...),
+	}
+	err := running.Merge(&cm.RunningStats{N: batch.Count, Mean: batch.Mean, M2: batch.M2})
+	if err != nil {
+		return stats, errors.New("insert stats dimensions do not match")
+	}
+	return InsertStats{
+		Count:   running.N,
+		Mean:    running.Mean,
+		M2:      running.M2,
+		Version: stats.Version + 1,
+	}, nil
+}
+
+// Result returns the mean and sample std of the inserted vectors
+func (stats InsertStats) Result() cm.DatasetStats {
+	running := &cm.RunningStats{N: stats.Count, Mean: stats.Mean, M2: stats.M2}
+	return running.Result()
+}
+
+// getSampleSlot returns the slot of the sample the next of the iterated records goes to, -1 if it's skipped;
+// sampling is done by the reservoir algorithm, so the sample is uniform for any iteration order.
+// Zero sample size keeps all the records
+func getSampleSlot(seen, sampleSize int) int {
+	if sampleSize <= 0 || seen < sampleSize {
+		return seen
+	}
+	slot := rand.Intn(seen + 1)
+	if slot < sampleSize {
+		return slot
+	}
+	return -1
+}
+
+// GetPostingsCollName returns name of the posting lists collection for the hash collection
+func GetPostingsCollName(collName string) string {
+	return collName + "_postings"
+}
+
 // ConvertAggResult makes Vector from the bson from Mongo
 func ConvertAggResult(inp interface{}) ([]float64, error) {
 	val, ok := inp.(primitive.A)
@@ -23,6 +147,19 @@ func ConvertAggResult(inp interface{}) ([]float64, error) {
 	return conv, nil
 }
 
+// ConvertNumber makes float64 from any numeric bson value
+func ConvertNumber(inp interface{}) (float64, error) {
+	switch val := inp.(type) {
+	case int32:
+		return float64(val), nil
+	case int64:
+		return float64(val), nil
+	case float64:
+		return val, nil
+	}
+	return 0, errors.New("type conversion failed")
+}
+
 // GetAggregatedStats returns vectors with Mongo aggregation results (mean and std vectors)
 func GetAggregatedStats(coll MongoCollection) ([]float64, []float64, error) {
 	results, err := coll.GetAggregation(GroupMeanStd)
@@ -40,6 +177,133 @@ func GetAggregatedStats(coll MongoCollection) ([]float64, []float64, error) {
 	return convMean, convStd, nil
 }
 
+// GetBucketsStats returns occupancy stats of the buckets of the specified hash table:
+// histogram of bucket sizes with power-of-two bins and the list of the largest buckets;
+// buckets larger than queryLimit are counted separately
+func GetBucketsStats(coll MongoCollection, table string, topN, queryLimit int) (cm.BucketsStats, error) {
+	bucketsStages := mongo.Pipeline{
+		bson.D{{"$group", bson.D{
+			{"_id", "$" + GetHashFieldName(table)},
+			{"size", bson.D{{"$sum", 1}}},
+		}}},
+	}
+	return getBucketsStats(coll, table, bucketsStages, topN, queryLimit)
+}
+
+// GetPostingsStats returns the same stats as GetBucketsStats, but computed over
+// the posting lists collection of the inverted hash layout, summing the chunks of every list
+func GetPostingsStats(coll MongoCollection, table string, topN, queryLimit int) (cm.BucketsStats, error) {
+	tableIdx, err := strconv.Atoi(table)
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+	bucketsStages := mongo.Pipeline{
+		bson.D{{"$match", bson.D{{"table", tableIdx}}}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$hash"},
+			{"size", bson.D{{"$sum", bson.D{{"$size", "$entries"}}}}},
+		}}},
+		bson.D{{"$match", bson.D{{"size", bson.D{{"$gt", 0}}}}}},
+	}
+	return getBucketsStats(coll, table, bucketsStages, topN, queryLimit)
+}
+
+// getBucketsStats summarizes buckets, produced by bucketsStages as {_id: hash, size: count} documents
+func getBucketsStats(coll MongoCollection, table string, bucketsStages mongo.Pipeline, topN, queryLimit int) (cm.BucketsStats, error) {
+	boundaries := bson.A{}
+	for size := int64(1); size <= maxHistogramBinSize; size *= 2 {
+		boundaries = append(boundaries, size)
+	}
+	pipeline := append(bucketsStages,
+		bson.D{{"$facet", bson.D{
+			{"summary", bson.A{
+				bson.D{{"$group", bson.D{
+					{"_id", nil},
+					{"buckets", bson.D{{"$sum", 1}}},
+					{"documents", bson.D{{"$sum", "$size"}}},
+					{"maxSize", bson.D{{"$max", "$size"}}},
+					{"singletons", bson.D{{"$sum", bson.D{
+						{"$cond", bson.A{bson.D{{"$eq", bson.A{"$size", 1}}}, 1, 0}},
+					}}}},
+					{"overQueryLimit", bson.D{{"$sum", bson.D{
+						{"$cond", bson.A{bson.D{{"$gt", bson.A{"$size", queryLimit}}}, 1, 0}},
+					}}}},
+				}}},
+			}},
+			{"histogram", bson.A{
+				bson.D{{"$bucket", bson.D{
+					{"groupBy", "$size"},
+					{"boundaries", boundaries},
+					{"default", maxHistogramBinSize},
+					{"output", bson.D{{"count", bson.D{{"$sum", 1}}}}},
+				}}},
+			}},
+			{"hotBuckets", bson.A{
+				bson.D{{"$sort", bson.D{{"size", -1}}}},
+				bson.D{{"$limit", topN}},
+			}},
+		}}},
+	)
+	opts := options.Aggregate().SetAllowDiskUse(true).SetMaxTime(time.Duration(createIndexMaxTime) * time.Second)
+	cursor, err := coll.Aggregate(context.Background(), pipeline, opts)
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+	var results []bson.Raw
+	err = cursor.All(context.Background(), &results)
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+	if len(results) == 0 {
+		return cm.BucketsStats{Table: table}, nil
+	}
+	return DecodeBucketsStats(table, results[0])
+}
+
+// DecodeBucketsStats makes BucketsStats from the document produced by the buckets occupancy aggregation
+func DecodeBucketsStats(table string, raw bson.Raw) (cm.BucketsStats, error) {
+	var result bucketsFacet
+	err := bson.Unmarshal(raw, &result)
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+
+	stats := cm.BucketsStats{Table: table}
+	if len(result.Summary) == 0 {
+		return stats, nil
+	}
+	summary := result.Summary[0]
+	stats.Buckets = summary.Buckets
+	stats.Documents = summary.Documents
+	stats.MaxSize = summary.MaxSize
+	stats.Singletons = summary.Singletons
+	stats.OverQueryLimit = summary.OverQueryLimit
+	if stats.Buckets > 0 {
+		stats.AvgSize = float64(stats.Documents) / float64(stats.Buckets)
+		stats.SingletonsFraction = float64(stats.Singletons) / float64(stats.Buckets)
+	}
+	for _, bin := range result.Histogram {
+		from, err := ConvertNumber(bin.ID)
+		if err != nil {
+			return cm.BucketsStats{}, err
+		}
+		stats.Histogram = append(stats.Histogram, newHistogramBin(int64(from), bin.Count))
+	}
+	for _, bucket := range result.HotBuckets {
+		stats.HotBuckets = append(stats.HotBuckets, cm.HotBucket{Hash: bucket.Hash, Size: bucket.Size})
+	}
+	return stats, nil
+}
+
+// newHistogramBin creates power-of-two bin which starts from the specified size
+func newHistogramBin(from, count int64) cm.HistogramBin {
+	bin := cm.HistogramBin{From: from, Count: count}
+	if from < maxHistogramBinSize {
+		bin.To = from * 2
+	}
+	return bin
+}
+
 // GetDbRecords get documents from the db collection by field and query (aka `find`)
 func GetDbRecords(coll MongoCollection, query FindQuery) ([]VectorRecord, error) {
 	cursor, err := coll.GetCursor(query)
@@ -53,3 +317,99 @@ func GetDbRecords(coll MongoCollection, query FindQuery) ([]VectorRecord, error)
 	}
 	return results, nil
 }
+
+// GetDistancePipeline returns aggregation pipeline which computes distances from the query
+// to the documents with the specified secondary ids, filters them by the threshold
+// and returns the nearest ones sorted by distance
+func GetDistancePipeline(secondaryIDs []uint64, query DistanceQuery) mongo.Pipeline {
+	pairs := bson.D{{"$zip", bson.D{{"inputs", bson.A{"$featureVec", query.Vec}}}}}
+	sumOver := func(in interface{}) bson.D {
+		return bson.D{{"$reduce", bson.D{
+			{"input", pairs},
+			{"initialValue", 0.0},
+			{"in", bson.D{{"$add", bson.A{"$$value", in}}}},
+		}}}
+	}
+	left := bson.D{{"$arrayElemAt", bson.A{"$$this", 0}}}
+	right := bson.D{{"$arrayElemAt", bson.A{"$$this", 1}}}
+
+	queryNorm := blas64.Nrm2(cm.NewVec(query.Vec))
+	if query.IsAngular && queryNorm == 0 {
+		// NOTE: zero query is wrong with angular metric, so nothing is matched, the same as for GetNearestRecords
+		secondaryIDs = []uint64{}
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.D{{"secondaryId", bson.D{{"$in", secondaryIDs}}}}}},
+	}
+	if query.IsAngular {
+		pipeline = append(pipeline,
+			bson.D{{"$project", bson.D{
+				{"_id", 0},
+				{"secondaryId", 1},
+				{"dot", sumOver(bson.D{{"$multiply", bson.A{left, right}}})},
+				{"norm", bson.D{{"$sqrt", sumOver(bson.D{{"$multiply", bson.A{left, left}}})}}},
+			}}},
+			// NOTE: zero vectors are wrong with angular metric
+			bson.D{{"$match", bson.D{{"norm", bson.D{{"$gt", 0}}}}}},
+			bson.D{{"$project", bson.D{
+				{"secondaryId", 1},
+				{"dist", bson.D{{"$subtract", bson.A{1.0, bson.D{{"$divide", bson.A{
+					"$dot", bson.D{{"$multiply", bson.A{"$norm", queryNorm}}},
+				}}}}}}},
+			}}},
+		)
+	} else {
+		diff := bson.D{{"$subtract", bson.A{left, right}}}
+		pipeline = append(pipeline,
+			bson.D{{"$project", bson.D{
+				{"_id", 0},
+				{"secondaryId", 1},
+				{"dist", bson.D{{"$sqrt", sumOver(bson.D{{"$multiply", bson.A{diff, diff}}})}}},
+			}}},
+		)
+	}
+	pipeline = append(pipeline,
+		bson.D{{"$match", bson.D{{"dist", bson.D{{"$lte", query.Thrsh}}}}}},
+		bson.D{{"$sort", bson.D{{"dist", 1}, {"secondaryId", 1}}}},
+	)
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{"$limit", query.Limit}})
+	}
+	return pipeline
+}
+
+// GetNearestRecords computes distances from the query to the records in process, the same way
+// as the distance aggregation pipeline does; used by the storages without the query language
+func GetNearestRecords(records []HashesRecord, query DistanceQuery) []cm.NeighborsRecord {
+	queryVec := cm.NewVec(query.Vec)
+	var neighbors []cm.NeighborsRecord
+	for _, record := range records {
+		vec := cm.NewVec(record.FeatureVec)
+		var dist float64
+		if query.IsAngular {
+			if cm.IsZeroVector(vec) || cm.IsZeroVector(queryVec) {
+				continue
+			}
+			dist = cm.CosineSim(queryVec, vec)
+		} else {
+			dist = cm.L2(queryVec, vec)
+		}
+		if dist > query.Thrsh {
+			continue
+		}
+		neighbors = append(neighbors, cm.NeighborsRecord{
+			SecondaryID: record.SecondaryID,
+			Dist:        dist,
+		})
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Dist != neighbors[j].Dist {
+			return neighbors[i].Dist < neighbors[j].Dist
+		}
+		return neighbors[i].SecondaryID < neighbors[j].SecondaryID
+	})
+	if query.Limit > 0 && len(neighbors) > query.Limit {
+		neighbors = neighbors[:query.Limit]
+	}
+	return neighbors
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// NOTE: posting list of the bucket is split into the chunk documents of at most that many entries,
+	// so the large buckets don't hit the BSON document size limit
+	maxPostingChunk = 10000
+)
+
+// postingKey identifies the single bucket of the hash table
+type postingKey struct {
+	table int
+	hash  uint64
+}
+
+// createInvertedCollection creates the vectors collection, indexed only by the secondary id,
+// and the posting lists collection with the (table, hash) index over the chunks of the lists
+func (mongodb *MongoDatastore) createInvertedCollection(collName string) error {
+	coll, err := mongodb.CreateCollection(collName)
+	if err != nil {
+		return err
+	}
+	err = coll.CreateIndexesByFields([]string{"secondaryId"}, true)
+	if err != nil {
+		return err
+	}
+	postingsColl, err := mongodb.CreateCollection(GetPostingsCollName(collName))
+	if err != nil {
+		return err
+	}
+	return postingsColl.CreateCompoundIndex([]string{"table", "hash"}, false)
+}
+
+// pullPostings removes the vectors from all the chunks of the posting lists of their buckets,
+// empty chunks are dropped
+func (mongodb *MongoDatastore) pullPostings(collName string, records []HashesRecord) error {
+	removed := make(map[postingKey][]uint64)
+	for _, record := range records {
+		for table, hash := range record.Hashes {
+			key := postingKey{table: table, hash: hash}
+			removed[key] = append(removed[key], record.SecondaryID)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	pullModels := make([]mongo.WriteModel, 0, len(removed))
+	cleanupModels := make([]mongo.WriteModel, 0, len(removed))
+	for key, ids := range removed {
+		filter := bson.D{{"table", key.table}, {"hash", key.hash}}
+		pullModels = append(pullModels, mongo.NewUpdateManyModel().
+			SetFilter(filter).
+			SetUpdate(bson.D{{"$pull", bson.D{{"entries", bson.D{{"id", bson.D{{"$in", ids}}}}}}}}))
+		cleanupModels = append(cleanupModels, mongo.NewDeleteManyModel().
+			SetFilter(append(filter, bson.E{"entries", bson.D{{"$size", 0}}})))
+	}
+	postingsColl := mongodb.GetCollection(GetPostingsCollName(collName))
+	err := postingsColl.WriteRecords(pullModels)
+	if err != nil {
+		return err
+	}
+	return postingsColl.WriteRecords(cleanupModels)
+}
+
+// setInvertedRecords upserts the vectors by secondary id and adds them to the posting lists
+// of their buckets; stale posting list entries of the replaced vectors are removed first
+func (mongodb *MongoDatastore) setInvertedRecords(collName string, records []HashesRecord) error {
+	secondaryIDs := make([]uint64, len(records))
+	for i := range records {
+		secondaryIDs[i] = records[i].SecondaryID
+	}
+	oldRecords, err := mongodb.GetRecordsHashes(context.Background(), collName, secondaryIDs)
+	if err != nil {
+		return err
+	}
+	err = mongodb.pullPostings(collName, oldRecords)
+	if err != nil {
+		return err
+	}
+
+	vectorModels := make([]mongo.WriteModel, len(records))
+	added := make(map[postingKey][]PostingEntry)
+	for i, record := range records {
+		record.ID = primitive.NilObjectID
+		vectorModels[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{"secondaryId", record.SecondaryID}}).
+			SetReplacement(record).
+			SetUpsert(true)
+		for table, hash := range record.Hashes {
+			key := postingKey{table: table, hash: hash}
+			added[key] = append(added[key], PostingEntry{SecondaryID: record.SecondaryID, Sketch: record.Sketch})
+		}
+	}
+	err = mongodb.GetCollection(collName).WriteRecords(vectorModels)
+	if err != nil {
+		return err
+	}
+
+	postingModels := make([]mongo.WriteModel, 0, len(added))
+	for key, entries := range added {
+		for start := 0; start < len(entries); start += maxPostingChunk {
+			end := start + maxPostingChunk
+			if end > len(entries) {
+				end = len(entries)
+			}
+			postingModels = append(postingModels, getPostingChunkModel(key, entries[start:end]))
+		}
+	}
+	return mongodb.GetCollection(GetPostingsCollName(collName)).WriteRecords(postingModels)
+}
+
+// getPostingChunkModel appends entries to the chunk of the posting list which has room for all of them,
+// the new chunk is created if there is no such chunk
+func getPostingChunkModel(key postingKey, entries []PostingEntry) mongo.WriteModel {
+	// NOTE: the chunk has room for the entries if its array has no element at the position of the last free slot
+	lastFree := "entries." + strconv.Itoa(maxPostingChunk-len(entries))
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.D{{"table", key.table}, {"hash", key.hash}, {lastFree, bson.D{{"$exists", false}}}}).
+		SetUpdate(bson.D{{"$push", bson.D{{"entries", bson.D{{"$each", entries}}}}}}).
+		SetUpsert(true)
+}
+
+// deleteInvertedRecords drops the vector and removes it from the posting lists
+func (mongodb *MongoDatastore) deleteInvertedRecords(collName string, secondaryID uint64) error {
+	records, err := mongodb.GetRecordsHashes(context.Background(), collName, []uint64{secondaryID})
+	if err != nil {
+		return err
+	}
+	err = mongodb.pullPostings(collName, records)
+	if err != nil {
+		return err
+	}
+	return mongodb.GetCollection(collName).DeleteRecords(bson.D{{"secondaryId", secondaryID}})
+}
+
+// getInvertedCandidateHashes reads all the chunks of the posting lists of the query buckets and restores
+// the matched hashes and the sketch of every listed id, so the vectors collection isn't touched
+func (mongodb *MongoDatastore) getInvertedCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]HashesRecord, error) {
+	bucketsQuery := bson.A{}
+	for table, hash := range hashes {
+		bucketsQuery = append(bucketsQuery, bson.D{{"table", table}, {"hash", hash}})
+	}
+	cursor, err := mongodb.GetCollection(GetPostingsCollName(collName)).GetCursorWithContext(ctx,
+		FindQuery{
+			Query: bson.D{{"$or", bucketsQuery}},
+			Proj:  bson.M{"table": 1, "hash": 1, "entries": 1},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	// NOTE: posting lists read before the context is done are still turned into candidates
+	var postings []PostingRecord
+	for cursor.Next(ctx) {
+		var posting PostingRecord
+		if err = cursor.Decode(&posting); err != nil {
+			return nil, err
+		}
+		postings = append(postings, posting)
+	}
+	ctxErr := ctx.Err()
+	if ctxErr == nil {
+		if err = cursor.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []HashesRecord
+	positions := make(map[uint64]int)
+	for _, posting := range postings {
+		for _, entry := range posting.Entries {
+			pos, ok := positions[entry.SecondaryID]
+			if !ok {
+				if limit > 0 && len(candidates) >= limit {
+					continue
+				}
+				pos = len(candidates)
+				positions[entry.SecondaryID] = pos
+				candidates = append(candidates, HashesRecord{
+					SecondaryID: entry.SecondaryID,
+					Hashes:      make(map[int]uint64),
+					Sketch:      entry.Sketch,
+				})
+			}
+			candidates[pos].Hashes[posting.Table] = posting.Hash
+		}
+	}
+	return candidates, ctxErr
+}
@@ -0,0 +1,481 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	cm "lsh-search-service/common"
+)
+
+// NewMemoryStore creates empty in-memory storage
+func NewMemoryStore(config Config) *MemoryStore {
+	return &MemoryStore{
+		Config:      config,
+		collections: make(map[string]*memoryCollection),
+		watchers:    make(map[chan struct{}]func(CacheInvalidation)),
+	}
+}
+
+// newMemoryCollection creates empty collection with the buckets index
+func newMemoryCollection() *memoryCollection {
+	return &memoryCollection{
+		records: make(map[uint64]HashesRecord),
+		buckets: make(map[int]map[uint64]map[uint64]struct{}),
+	}
+}
+
+// set adds the document to the collection, replacing the one with the same secondary id
+func (coll *memoryCollection) set(record HashesRecord) {
+	coll.delete(record.SecondaryID)
+	coll.records[record.SecondaryID] = record
+	for table, hash := range record.Hashes {
+		tableBuckets, ok := coll.buckets[table]
+		if !ok {
+			tableBuckets = make(map[uint64]map[uint64]struct{})
+			coll.buckets[table] = tableBuckets
+		}
+		bucket, ok := tableBuckets[hash]
+		if !ok {
+			bucket = make(map[uint64]struct{})
+			tableBuckets[hash] = bucket
+		}
+		bucket[record.SecondaryID] = struct{}{}
+	}
+}
+
+// delete drops the document and its buckets index entries
+func (coll *memoryCollection) delete(secondaryID uint64) {
+	record, ok := coll.records[secondaryID]
+	if !ok {
+		return
+	}
+	for table, hash := range record.Hashes {
+		bucket := coll.buckets[table][hash]
+		delete(bucket, secondaryID)
+		if len(bucket) == 0 {
+			delete(coll.buckets[table], hash)
+		}
+	}
+	delete(coll.records, secondaryID)
+}
+
+// CreateHashCollection creates the new empty collection
+func (store *MemoryStore) CreateHashCollection(collName string, tables []string) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.collections[collName]; ok {
+		return errors.New("collection already exists")
+	}
+	store.collections[collName] = newMemoryCollection()
+	return nil
+}
+
+// DropCollection drops the collection if it exists
+func (store *MemoryStore) DropCollection(collName string) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.collections, collName)
+	return nil
+}
+
+// GetCollSize returns number of documents in the collection, 0 if it doesn't exist
+func (store *MemoryStore) GetCollSize(collName string) (int64, error) {
+	store.RLock()
+	defer store.RUnlock()
+	coll, ok := store.collections[collName]
+	if !ok {
+		return 0, nil
+	}
+	return int64(len(coll.records)), nil
+}
+
+// GetCandidateHashes returns documents which fall into the same bucket as the query
+// in at least one of the tables; only secondary id, hashes and sketch are returned
+func (store *MemoryStore) GetCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]HashesRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+	coll, ok := store.collections[collName]
+	if !ok {
+		return nil, nil
+	}
+	var candidates []HashesRecord
+	seen := make(map[uint64]struct{})
+	for table, hash := range hashes {
+		for secondaryID := range coll.buckets[table][hash] {
+			if _, ok := seen[secondaryID]; ok {
+				continue
+			}
+			if limit > 0 && len(candidates) >= limit {
+				return candidates, nil
+			}
+			if err := ctx.Err(); err != nil {
+				return candidates, err
+			}
+			seen[secondaryID] = struct{}{}
+			candidates = append(candidates, HashesRecord{
+				SecondaryID: secondaryID,
+				Hashes:      coll.records[secondaryID].Hashes,
+				Sketch:      coll.records[secondaryID].Sketch,
+			})
+		}
+	}
+	return candidates, nil
+}
+
+// GetVectors returns feature vectors of the documents with the specified secondary ids;
+// quantized documents are returned with codes, or with the float32 copy if exact vectors are requested
+func (store *MemoryStore) GetVectors(ctx context.Context, collName string, secondaryIDs []uint64, exact bool) ([]HashesRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+	coll, ok := store.collections[collName]
+	if !ok {
+		return nil, nil
+	}
+	records := make([]HashesRecord, 0, len(secondaryIDs))
+	for _, secondaryID := range secondaryIDs {
+		if err := ctx.Err(); err != nil {
+			return records, err
+		}
+		record, ok := coll.records[secondaryID]
+		if !ok {
+			continue
+		}
+		records = append(records, record.vectorFields(exact))
+	}
+	return records, nil
+}
+
+// GetRecordsHashes returns secondary ids and hashes of the stored documents with the specified secondary ids
+func (store *MemoryStore) GetRecordsHashes(ctx context.Context, collName string, secondaryIDs []uint64) ([]HashesRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+	coll, ok := store.collections[collName]
+	if !ok {
+		return nil, nil
+	}
+	records := make([]HashesRecord, 0, len(secondaryIDs))
+	for _, secondaryID := range secondaryIDs {
+		if err := ctx.Err(); err != nil {
+			return records, err
+		}
+		if record, ok := coll.records[secondaryID]; ok {
+			records = append(records, HashesRecord{SecondaryID: secondaryID, Hashes: record.Hashes})
+		}
+	}
+	return records, nil
+}
+
+// GetNearestVectors returns the nearest documents with the specified secondary ids,
+// filtered by the distance threshold
+func (store *MemoryStore) GetNearestVectors(ctx context.Context, collName string, secondaryIDs []uint64, query DistanceQuery) ([]cm.NeighborsRecord, error) {
+	records, err := store.GetVectors(ctx, collName, secondaryIDs, true)
+	if err != nil {
+		return nil, err
+	}
+	return GetNearestRecords(records, query), nil
+}
+
+// SetHashRecords adds the new documents to the collection, creating it if needed
+func (store *MemoryStore) SetHashRecords(collName string, records []HashesRecord) error {
+	store.Lock()
+	defer store.Unlock()
+	coll, ok := store.collections[collName]
+	if !ok {
+		coll = newMemoryCollection()
+		store.collections[collName] = coll
+	}
+	for _, record := range records {
+		coll.set(record)
+	}
+	return nil
+}
+
+// DeleteHashRecords drops the document with the specified secondary id
+func (store *MemoryStore) DeleteHashRecords(collName string, secondaryID uint64) error {
+	store.Lock()
+	defer store.Unlock()
+	coll, ok := store.collections[collName]
+	if !ok {
+		return nil
+	}
+	coll.delete(secondaryID)
+	return nil
+}
+
+// IterateVectors calls fn for every document of the collection, or for the
+// arbitrary subset of the specified size; the snapshot of the documents is used,
+// so fn is free to modify the store
+func (store *MemoryStore) IterateVectors(ctx context.Context, collName string, sampleSize int, fn func(HashesRecord) error) error {
+	store.RLock()
+	coll, ok := store.collections[collName]
+	var records []HashesRecord
+	if ok {
+		records = make([]HashesRecord, 0, len(coll.records))
+		seen := 0
+		for _, record := range coll.records {
+			slot := getSampleSlot(seen, sampleSize)
+			seen++
+			switch {
+			case slot == len(records):
+				records = append(records, record.iterateFields())
+			case slot >= 0:
+				records[slot] = record.iterateFields()
+			}
+		}
+	}
+	store.RUnlock()
+
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBucketsStats returns occupancy stats of the buckets of the specified hash table
+func (store *MemoryStore) GetBucketsStats(collName, table string, topN, queryLimit int) (cm.BucketsStats, error) {
+	tableIdx, err := strconv.Atoi(table)
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+	store.RLock()
+	defer store.RUnlock()
+	stats := cm.BucketsStats{Table: table}
+	coll, ok := store.collections[collName]
+	if !ok {
+		return stats, nil
+	}
+
+	histogram := make(map[int64]int64)
+	hotBuckets := make([]cm.HotBucket, 0, len(coll.buckets[tableIdx]))
+	for hash, bucket := range coll.buckets[tableIdx] {
+		size := int64(len(bucket))
+		stats.Buckets++
+		stats.Documents += size
+		if size > stats.MaxSize {
+			stats.MaxSize = size
+		}
+		if size == 1 {
+			stats.Singletons++
+		}
+		if size > int64(queryLimit) {
+			stats.OverQueryLimit++
+		}
+		from := int64(1)
+		for from*2 <= size && from < maxHistogramBinSize {
+			from *= 2
+		}
+		histogram[from]++
+		hotBuckets = append(hotBuckets, cm.HotBucket{Hash: hash, Size: size})
+	}
+	if stats.Buckets > 0 {
+		stats.AvgSize = float64(stats.Documents) / float64(stats.Buckets)
+		stats.SingletonsFraction = float64(stats.Singletons) / float64(stats.Buckets)
+	}
+	for from, count := range histogram {
+		stats.Histogram = append(stats.Histogram, newHistogramBin(from, count))
+	}
+	sort.Slice(stats.Histogram, func(i, j int) bool {
+		return stats.Histogram[i].From < stats.Histogram[j].From
+	})
+	sort.Slice(hotBuckets, func(i, j int) bool {
+		return hotBuckets[i].Size > hotBuckets[j].Size
+	})
+	if len(hotBuckets) > topN {
+		hotBuckets = hotBuckets[:topN]
+	}
+	stats.HotBuckets = hotBuckets
+	return stats, nil
+}
+
+// GetHelperRecord returns copy of the helper record
+func (store *MemoryStore) GetHelperRecord(getHasherObject bool) (HelperRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+	record := store.helperRecord
+	if !getHasherObject {
+		record.Hasher = nil
+	}
+	return record, nil
+}
+
+// UpdateBuildStatus updates helper record with the new build status and error
+func (store *MemoryStore) UpdateBuildStatus(status HelperRecord) error {
+	store.Lock()
+	defer store.Unlock()
+	store.touchHelperRecord()
+	store.helperRecord.IsBuildDone = status.IsBuildDone
+	store.helperRecord.BuildError = status.BuildError
+	store.helperRecord.BuildOwner = status.BuildOwner
+	store.helperRecord.LastBuildTime = status.LastBuildTime
+	store.helperRecord.BuildElapsedTime = status.BuildElapsedTime
+	store.notifyWatchers()
+	return nil
+}
+
+// UpdateBuildProgress saves the current build progress to the helper record
+func (store *MemoryStore) UpdateBuildProgress(progress cm.BuildProgress) error {
+	store.Lock()
+	defer store.Unlock()
+	store.touchHelperRecord()
+	store.helperRecord.BuildProgress = progress
+	return nil
+}
+
+// SaveBuild stores the new hasher and makes the new hash collection active, if the build
+// is still marked in progress by its owner
+func (store *MemoryStore) SaveBuild(record HelperRecord) error {
+	store.Lock()
+	defer store.Unlock()
+	if store.helperRecord.BuildOwner != record.BuildOwner {
+		return ErrLeaseLost
+	}
+	store.touchHelperRecord()
+	record.ID = store.helperRecord.ID
+	record.InsertStats = NewInsertStats(len(record.BuildStats.Mean))
+	store.helperRecord = record
+	store.notifyWatchers()
+	return nil
+}
+
+// UpdateInsertStats merges the stats of the batch into the running stats in the helper record
+func (store *MemoryStore) UpdateInsertStats(stats InsertStats) error {
+	store.Lock()
+	defer store.Unlock()
+	insertStats, err := store.helperRecord.InsertStats.Merge(stats)
+	if err != nil {
+		return err
+	}
+	store.helperRecord.InsertStats = insertStats
+	return nil
+}
+
+// WatchHelperRecord calls onChange once the watch is set and then after every change of the build status,
+// until ctx is done; notifications which come while onChange runs are collapsed into the single call.
+// onInvalidate is called by PublishInvalidation itself, so no invalidation is collapsed
+func (store *MemoryStore) WatchHelperRecord(ctx context.Context, onChange func(), onInvalidate func(CacheInvalidation)) error {
+	changes := make(chan struct{}, 1)
+	store.Lock()
+	store.watchers[changes] = onInvalidate
+	store.Unlock()
+	defer func() {
+		store.Lock()
+		delete(store.watchers, changes)
+		store.Unlock()
+	}()
+	onChange()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changes:
+			onChange()
+		}
+	}
+}
+
+// PublishInvalidation passes the invalidation to all the watchers of the helper record
+func (store *MemoryStore) PublishInvalidation(invalidation CacheInvalidation) error {
+	store.RLock()
+	onInvalidates := make([]func(CacheInvalidation), 0, len(store.watchers))
+	for _, onInvalidate := range store.watchers {
+		onInvalidates = append(onInvalidates, onInvalidate)
+	}
+	store.RUnlock()
+	for _, onInvalidate := range onInvalidates {
+		onInvalidate(invalidation)
+	}
+	return nil
+}
+
+// notifyWatchers wakes up the watchers of the helper record, the store must be locked
+func (store *MemoryStore) notifyWatchers() {
+	for changes := range store.watchers {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// GetBuildLease returns the build lease, the lease without the owner means there is no build running
+func (store *MemoryStore) GetBuildLease() (BuildLease, error) {
+	store.RLock()
+	defer store.RUnlock()
+	return store.buildLease, nil
+}
+
+// AcquireBuildLease takes the lease, if there is no lease, it has expired by the heartbeat of the new one
+// or it's held by the same owner. Returns the replaced lease or ErrLeaseHeld
+func (store *MemoryStore) AcquireBuildLease(lease BuildLease) (BuildLease, error) {
+	store.Lock()
+	defer store.Unlock()
+	prev := store.buildLease
+	if len(prev.Owner) > 0 && prev.Owner != lease.Owner && prev.Expires >= lease.Heartbeat {
+		return BuildLease{}, ErrLeaseHeld
+	}
+	lease.ID = BuildLeaseID
+	store.buildLease = lease
+	return prev, nil
+}
+
+// RenewBuildLease updates the lease held by the owner, returns ErrLeaseLost if it has been taken over
+// and ErrCancelRequested if its build has been cancelled
+func (store *MemoryStore) RenewBuildLease(lease BuildLease) error {
+	store.Lock()
+	defer store.Unlock()
+	if store.buildLease.Owner != lease.Owner {
+		return ErrLeaseLost
+	}
+	if store.buildLease.CancelRequested {
+		return ErrCancelRequested
+	}
+	lease.ID = BuildLeaseID
+	store.buildLease = lease
+	return nil
+}
+
+// ReleaseBuildLease drops the lease held by the owner
+func (store *MemoryStore) ReleaseBuildLease(owner string) error {
+	store.Lock()
+	defer store.Unlock()
+	if store.buildLease.Owner == owner {
+		store.buildLease = BuildLease{}
+	}
+	return nil
+}
+
+// RequestBuildCancel marks the build of the lease owner cancelled, returns ErrLeaseLost if the lease
+// isn't held by the owner anymore
+func (store *MemoryStore) RequestBuildCancel(owner string) error {
+	store.Lock()
+	defer store.Unlock()
+	if len(owner) == 0 || store.buildLease.Owner != owner {
+		return ErrLeaseLost
+	}
+	store.buildLease.CancelRequested = true
+	return nil
+}
+
+// CheckHealth does nothing, since the memory is always available
+func (store *MemoryStore) CheckHealth() error {
+	return nil
+}
+
+// Disconnect does nothing, since there are no connections to close
+func (store *MemoryStore) Disconnect() {}
+
+// touchHelperRecord marks helper record as existing, the same way as the upsert does
+func (store *MemoryStore) touchHelperRecord() {
+	if store.helperRecord.ID.IsZero() {
+		store.helperRecord.ID = primitive.NewObjectID()
+	}
+}
@@ -0,0 +1,227 @@
+package db_test
+
+import (
+	"context"
+	"lsh-search-service/db"
+	"testing"
+)
+
+func getTestStore(t *testing.T) *db.MemoryStore {
+	store := db.NewMemoryStore(db.Config{Backend: db.BackendMemory})
+	fillTestStore(t, store)
+	return store
+}
+
+func fillTestStore(t *testing.T, store db.VectorStore) {
+	err := store.CreateHashCollection("hashes", []string{"0", "1"})
+	if err != nil {
+		t.Fatalf("Could not create collection: %v", err)
+	}
+	err = store.SetHashRecords("hashes", []db.HashesRecord{
+		{SecondaryID: 1, FeatureVec: []float64{1.0}, Hashes: map[int]uint64{0: 1, 1: 1}, Sketch: []byte{7}},
+		{SecondaryID: 2, FeatureVec: []float64{2.0}, Hashes: map[int]uint64{0: 1, 1: 2}},
+		{SecondaryID: 3, FeatureVec: []float64{3.0}, Hashes: map[int]uint64{0: 1, 1: 1}},
+		{SecondaryID: 4, FeatureVec: []float64{4.0}, Hashes: map[int]uint64{0: 2, 1: 3}},
+	})
+	if err != nil {
+		t.Fatalf("Could not set records: %v", err)
+	}
+}
+
+func hasCandidate(candidates []db.HashesRecord, secondaryID uint64) bool {
+	for _, candidate := range candidates {
+		if candidate.SecondaryID == secondaryID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMemoryStoreCandidates(t *testing.T) {
+	store := getTestStore(t)
+	candidates, err := store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 0)
+	if err != nil {
+		t.Fatalf("Could not get candidates: %v", err)
+	}
+	if len(candidates) != 3 {
+		t.Fatal("Candidates must match hash of any table")
+	}
+	for _, candidate := range candidates {
+		if candidate.SecondaryID == 1 && (len(candidate.Sketch) != 1 || candidate.Sketch[0] != 7) {
+			t.Fatal("Candidates must be returned with sketches")
+		}
+	}
+	candidates, _ = store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 2)
+	if len(candidates) != 2 {
+		t.Fatal("Candidates must be limited")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	candidates, err = store.GetCandidateHashes(ctx, "hashes", map[int]uint64{0: 1, 1: 1}, 0)
+	if err != context.Canceled || len(candidates) != 0 {
+		t.Fatal("Candidates scan must stop once the context is done")
+	}
+	vectors, err := store.GetVectors(context.Background(), "hashes", []uint64{2, 5}, false)
+	if err != nil {
+		t.Fatalf("Could not get vectors: %v", err)
+	}
+	if len(vectors) != 1 || vectors[0].FeatureVec[0] != 2.0 {
+		t.Fatal("Vectors must be fetched by secondary id")
+	}
+	err = store.DeleteHashRecords("hashes", 1)
+	if err != nil {
+		t.Fatalf("Could not delete record: %v", err)
+	}
+	candidates, _ = store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 0)
+	if len(candidates) != 2 || hasCandidate(candidates, 1) {
+		t.Fatal("Deleted record must not be returned as candidate")
+	}
+	size, _ := store.GetCollSize("hashes")
+	if size != 3 {
+		t.Fatal("Deleted record must not be counted")
+	}
+}
+
+func TestMemoryStoreBucketsStats(t *testing.T) {
+	store := getTestStore(t)
+	stats, err := store.GetBucketsStats("hashes", "0", 1, 2)
+	if err != nil {
+		t.Fatalf("Could not get buckets stats: %v", err)
+	}
+	if stats.Buckets != 2 || stats.Documents != 4 || stats.MaxSize != 3 || stats.Singletons != 1 {
+		t.Fatal("Buckets stats are wrong")
+	}
+	if stats.OverQueryLimit != 1 {
+		t.Fatal("Buckets larger than the query limit must be counted")
+	}
+	if len(stats.HotBuckets) != 1 || stats.HotBuckets[0].Hash != 1 {
+		t.Fatal("Hot buckets must be sorted by size and limited")
+	}
+	if len(stats.Histogram) != 2 || stats.Histogram[1].From != 2 || stats.Histogram[1].To != 4 {
+		t.Fatal("Buckets histogram is wrong")
+	}
+}
+
+func TestMemoryStoreIterateVectors(t *testing.T) {
+	store := getTestStore(t)
+	var count int
+	err := store.IterateVectors(context.Background(), "hashes", 0, func(record db.HashesRecord) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 4 {
+		t.Fatal("All the records must be iterated")
+	}
+	count = 0
+	store.IterateVectors(context.Background(), "hashes", 2, func(record db.HashesRecord) error {
+		count++
+		return nil
+	})
+	if count != 2 {
+		t.Fatal("Only the sample of records must be iterated")
+	}
+	sampled := make(map[uint64]struct{})
+	for i := 0; i < 200; i++ {
+		store.IterateVectors(context.Background(), "hashes", 1, func(record db.HashesRecord) error {
+			sampled[record.SecondaryID] = struct{}{}
+			return nil
+		})
+	}
+	if len(sampled) != 4 {
+		t.Fatal("Every record must get into the random sample")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.IterateVectors(ctx, "hashes", 0, func(record db.HashesRecord) error { return nil })
+	if err == nil {
+		t.Fatal("Iteration must stop when context is cancelled")
+	}
+}
+
+func TestMemoryStoreHelperRecord(t *testing.T) {
+	store := getTestStore(t)
+	record, _ := store.GetHelperRecord(false)
+	if !record.ID.IsZero() {
+		t.Fatal("Helper record must not exist before the first update")
+	}
+	store.SaveBuild(db.HelperRecord{IsBuildDone: true, Hasher: []byte{1}, HashCollName: "hashes"})
+	record, _ = store.GetHelperRecord(false)
+	if record.ID.IsZero() || !record.IsBuildDone || record.Hasher != nil {
+		t.Fatal("Helper record must be saved, hasher is returned only on demand")
+	}
+	record, _ = store.GetHelperRecord(true)
+	if len(record.Hasher) != 1 {
+		t.Fatal("Hasher must be returned on demand")
+	}
+}
+
+func TestMemoryStoreBuildLease(t *testing.T) {
+	store := getTestStore(t)
+	_, err := store.AcquireBuildLease(db.BuildLease{Owner: "a", Heartbeat: 1, Expires: 10})
+	if err != nil {
+		t.Fatalf("Could not acquire lease: %v", err)
+	}
+	if _, err = store.AcquireBuildLease(db.BuildLease{Owner: "b", Heartbeat: 5, Expires: 15}); err != db.ErrLeaseHeld {
+		t.Fatal("Live lease must not be acquired by another owner")
+	}
+	if err = store.RenewBuildLease(db.BuildLease{Owner: "a", Heartbeat: 10, Expires: 20, HashCollName: "hashes"}); err != nil {
+		t.Fatalf("Could not renew lease: %v", err)
+	}
+	prev, err := store.AcquireBuildLease(db.BuildLease{Owner: "b", Heartbeat: 21, Expires: 30})
+	if err != nil || prev.Owner != "a" || prev.HashCollName != "hashes" {
+		t.Fatalf("Expired lease must be taken over: %v %+v", err, prev)
+	}
+	if err = store.RenewBuildLease(db.BuildLease{Owner: "a", Heartbeat: 22, Expires: 32}); err != db.ErrLeaseLost {
+		t.Fatal("Lease taken over must be lost by the previous owner")
+	}
+	store.UpdateBuildStatus(db.HelperRecord{IsBuildDone: false, BuildOwner: "b"})
+	if err = store.SaveBuild(db.HelperRecord{IsBuildDone: true, BuildOwner: "a", HashCollName: "a"}); err != db.ErrLeaseLost {
+		t.Fatal("Build must not be saved by the owner which has lost the lease")
+	}
+	if err = store.SaveBuild(db.HelperRecord{IsBuildDone: true, BuildOwner: "b", HashCollName: "b"}); err != nil {
+		t.Fatalf("Could not save build: %v", err)
+	}
+	if err = store.RequestBuildCancel("a"); err != db.ErrLeaseLost {
+		t.Fatal("Build must be cancelled only for the lease owner")
+	}
+	if err = store.RequestBuildCancel("b"); err != nil {
+		t.Fatalf("Could not request build cancel: %v", err)
+	}
+	if err = store.RenewBuildLease(db.BuildLease{Owner: "b", Heartbeat: 25, Expires: 35}); err != db.ErrCancelRequested {
+		t.Fatal("Cancel request must be seen by the owner with the renew")
+	}
+	if lease, _ := store.GetBuildLease(); !lease.CancelRequested || lease.Expires != 30 {
+		t.Fatalf("Cancel request must be kept by the renew: %+v", lease)
+	}
+	store.ReleaseBuildLease("a")
+	if lease, _ := store.GetBuildLease(); lease.Owner != "b" {
+		t.Fatal("Lease must be released only by its owner")
+	}
+	store.ReleaseBuildLease("b")
+	if lease, _ := store.GetBuildLease(); len(lease.Owner) != 0 {
+		t.Fatal("Lease must be released by its owner")
+	}
+}
+
+func TestMemoryStoreNearestVectors(t *testing.T) {
+	store := getTestStore(t)
+	neighbors, err := store.GetNearestVectors(context.Background(), "hashes", []uint64{1, 2, 3, 4}, db.DistanceQuery{
+		Vec:   []float64{2.1},
+		Thrsh: 1.0,
+		Limit: 2,
+	})
+	if err != nil {
+		t.Fatalf("Could not get nearest vectors: %v", err)
+	}
+	if len(neighbors) != 2 || neighbors[0].SecondaryID != 2 || neighbors[1].SecondaryID != 3 {
+		t.Fatalf("Nearest vectors must be filtered, sorted and limited: %v", neighbors)
+	}
+	neighbors, _ = store.GetNearestVectors(context.Background(), "hashes", []uint64{1, 2}, db.DistanceQuery{
+		Vec:       []float64{0.0},
+		IsAngular: true,
+		Thrsh:     1.0,
+	})
+	if len(neighbors) != 0 {
+		t.Fatal("Zero vectors must be skipped with angular metric")
+	}
+}
@@ -0,0 +1,500 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	cm "lsh-search-service/common"
+)
+
+// ShardRingPoints is the number of the ring points per shard, more points spread the ids more evenly
+const ShardRingPoints = 128
+
+// NewShardedStore creates the shards of the backend selected in config
+func NewShardedStore(config Config) (*ShardedStore, error) {
+	store := &ShardedStore{Config: config}
+	switch config.ShardMode {
+	case ShardModeCollections, "":
+		backend, err := newBackendStore(config)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < config.Shards; i++ {
+			store.shards = append(store.shards, backend)
+			store.names = append(store.names, "shard"+strconv.Itoa(i))
+			store.suffixes = append(store.suffixes, "_shard"+strconv.Itoa(i))
+		}
+	case ShardModeStores:
+		if len(config.ShardLocations) != 0 && len(config.ShardLocations) != config.Shards {
+			return nil, fmt.Errorf("number of shard locations must be equal to the number of shards: %d", config.Shards)
+		}
+		for i := 0; i < config.Shards; i++ {
+			shardConfig := config
+			name := "shard" + strconv.Itoa(i)
+			if len(config.ShardLocations) != 0 {
+				name = config.ShardLocations[i]
+				shardConfig.DbLocation, shardConfig.BoltPath = name, name
+			}
+			backend, err := newBackendStore(shardConfig)
+			if err != nil {
+				store.Disconnect()
+				return nil, err
+			}
+			store.shards = append(store.shards, backend)
+			store.names = append(store.names, name)
+			store.suffixes = append(store.suffixes, "")
+		}
+	default:
+		return nil, fmt.Errorf("unknown shard mode: %s", config.ShardMode)
+	}
+	store.ring = NewHashRing(store.names, ShardRingPoints)
+	return store, nil
+}
+
+// NewHashRing places the points of every shard on the ring by the hash of the shard name,
+// so the ids keep their shards while the shards keep their names
+func NewHashRing(names []string, points int) HashRing {
+	ring := HashRing{}
+	for shard, name := range names {
+		for i := 0; i < points; i++ {
+			ring.points = append(ring.points, getRingHash([]byte(name+"#"+strconv.Itoa(i))))
+			ring.shards = append(ring.shards, shard)
+		}
+	}
+	sort.Sort(ring)
+	return ring
+}
+
+func (ring HashRing) Len() int           { return len(ring.points) }
+func (ring HashRing) Less(i, j int) bool { return ring.points[i] < ring.points[j] }
+func (ring HashRing) Swap(i, j int) {
+	ring.points[i], ring.points[j] = ring.points[j], ring.points[i]
+	ring.shards[i], ring.shards[j] = ring.shards[j], ring.shards[i]
+}
+
+// GetShard returns the shard of the id
+func (ring HashRing) GetShard(secondaryID uint64) int {
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, secondaryID)
+	hash := getRingHash(key)
+	pos := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if pos == len(ring.points) {
+		pos = 0
+	}
+	return ring.shards[pos]
+}
+
+// getRingHash returns the position of the key on the ring
+func getRingHash(key []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(key)
+	return hash.Sum64()
+}
+
+// GetShard returns the index of the shard which keeps the document with the secondary id
+func (store *ShardedStore) GetShard(secondaryID uint64) int {
+	return store.ring.GetShard(secondaryID)
+}
+
+// isSharded checks if the collection is split into shards: only the hash collections are
+func (store *ShardedStore) isSharded(collName string) bool {
+	return collName != store.Config.SourceCollectionName
+}
+
+// getShardCollName returns the name of the collection within the shard
+func (store *ShardedStore) getShardCollName(shard int, collName string) string {
+	return collName + store.suffixes[shard]
+}
+
+// fanOut runs fn for all the shards concurrently, returns the first error
+func (store *ShardedStore) fanOut(fn func(shard int) error) error {
+	errs := make([]error, len(store.shards))
+	var wg sync.WaitGroup
+	for shard := range store.shards {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			errs[shard] = fn(shard)
+		}(shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupByShard splits the ids by their shards
+func (store *ShardedStore) groupByShard(secondaryIDs []uint64) [][]uint64 {
+	groups := make([][]uint64, len(store.shards))
+	for _, id := range secondaryIDs {
+		shard := store.GetShard(id)
+		groups[shard] = append(groups[shard], id)
+	}
+	return groups
+}
+
+// CreateHashCollection creates the collection within every shard
+func (store *ShardedStore) CreateHashCollection(collName string, tables []string) error {
+	return store.fanOut(func(shard int) error {
+		return store.shards[shard].CreateHashCollection(store.getShardCollName(shard, collName), tables)
+	})
+}
+
+// DropCollection drops the collection within every shard
+func (store *ShardedStore) DropCollection(collName string) error {
+	if !store.isSharded(collName) {
+		return store.shards[0].DropCollection(collName)
+	}
+	return store.fanOut(func(shard int) error {
+		return store.shards[shard].DropCollection(store.getShardCollName(shard, collName))
+	})
+}
+
+// GetCollSize returns the total number of documents of all the shards
+func (store *ShardedStore) GetCollSize(collName string) (int64, error) {
+	if !store.isSharded(collName) {
+		return store.shards[0].GetCollSize(collName)
+	}
+	sizes := make([]int64, len(store.shards))
+	err := store.fanOut(func(shard int) error {
+		var err error
+		sizes[shard], err = store.shards[shard].GetCollSize(store.getShardCollName(shard, collName))
+		return err
+	})
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total, err
+}
+
+// GetCandidateHashes gathers the candidates of all the shards, at most limit of them; every shard returns
+// up to limit candidates, so the ones kept are the most colliding with the query of all the shards,
+// and the ties are taken from the shards in turn
+func (store *ShardedStore) GetCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]HashesRecord, error) {
+	if !store.isSharded(collName) {
+		return store.shards[0].GetCandidateHashes(ctx, collName, hashes, limit)
+	}
+	results := make([][]HashesRecord, len(store.shards))
+	err := store.fanOut(func(shard int) error {
+		var err error
+		results[shard], err = store.shards[shard].GetCandidateHashes(ctx, store.getShardCollName(shard, collName), hashes, limit)
+		return err
+	})
+	var candidates []HashesRecord
+	var ranks []shardCandidateRank
+	for _, result := range results {
+		for pos, candidate := range result {
+			ranks = append(ranks, shardCandidateRank{collisions: countCollisions(candidate, hashes), pos: pos})
+			candidates = append(candidates, candidate)
+		}
+	}
+	if limit <= 0 || len(candidates) <= limit {
+		return candidates, err
+	}
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := ranks[order[i]], ranks[order[j]]
+		if a.collisions != b.collisions {
+			return a.collisions > b.collisions
+		}
+		return a.pos < b.pos
+	})
+	merged := make([]HashesRecord, limit)
+	for i := range merged {
+		merged[i] = candidates[order[i]]
+	}
+	return merged, err
+}
+
+// countCollisions returns the number of tables where the candidate falls into the bucket of the query
+func countCollisions(candidate HashesRecord, hashes map[int]uint64) int {
+	count := 0
+	for table, hash := range hashes {
+		if candidateHash, ok := candidate.Hashes[table]; ok && candidateHash == hash {
+			count++
+		}
+	}
+	return count
+}
+
+// GetVectors fetches the documents from their shards
+func (store *ShardedStore) GetVectors(ctx context.Context, collName string, secondaryIDs []uint64, exact bool) ([]HashesRecord, error) {
+	if !store.isSharded(collName) {
+		return store.shards[0].GetVectors(ctx, collName, secondaryIDs, exact)
+	}
+	groups := store.groupByShard(secondaryIDs)
+	results := make([][]HashesRecord, len(store.shards))
+	err := store.fanOut(func(shard int) error {
+		if len(groups[shard]) == 0 {
+			return nil
+		}
+		var err error
+		results[shard], err = store.shards[shard].GetVectors(ctx, store.getShardCollName(shard, collName), groups[shard], exact)
+		return err
+	})
+	var vectors []HashesRecord
+	for _, result := range results {
+		vectors = append(vectors, result...)
+	}
+	return vectors, err
+}
+
+// GetRecordsHashes reads the hashes of the documents from their shards
+func (store *ShardedStore) GetRecordsHashes(ctx context.Context, collName string, secondaryIDs []uint64) ([]HashesRecord, error) {
+	if !store.isSharded(collName) {
+		return store.shards[0].GetRecordsHashes(ctx, collName, secondaryIDs)
+	}
+	groups := store.groupByShard(secondaryIDs)
+	results := make([][]HashesRecord, len(store.shards))
+	err := store.fanOut(func(shard int) error {
+		if len(groups[shard]) == 0 {
+			return nil
+		}
+		var err error
+		results[shard], err = store.shards[shard].GetRecordsHashes(ctx, store.getShardCollName(shard, collName), groups[shard])
+		return err
+	})
+	var records []HashesRecord
+	for _, result := range results {
+		records = append(records, result...)
+	}
+	return records, err
+}
+
+// GetNearestVectors computes the distances within the shards of the documents
+// and merges the top nearest neighbors of the shards
+func (store *ShardedStore) GetNearestVectors(ctx context.Context, collName string, secondaryIDs []uint64, query DistanceQuery) ([]cm.NeighborsRecord, error) {
+	if !store.isSharded(collName) {
+		return store.shards[0].GetNearestVectors(ctx, collName, secondaryIDs, query)
+	}
+	groups := store.groupByShard(secondaryIDs)
+	results := make([][]cm.NeighborsRecord, len(store.shards))
+	err := store.fanOut(func(shard int) error {
+		if len(groups[shard]) == 0 {
+			return nil
+		}
+		var err error
+		results[shard], err = store.shards[shard].GetNearestVectors(ctx, store.getShardCollName(shard, collName), groups[shard], query)
+		return err
+	})
+	var neighbors []cm.NeighborsRecord
+	for _, result := range results {
+		neighbors = append(neighbors, result...)
+	}
+	sort.Slice(neighbors, func(i, j int) bool { return neighbors[i].Dist < neighbors[j].Dist })
+	if query.Limit > 0 && len(neighbors) > query.Limit {
+		neighbors = neighbors[:query.Limit]
+	}
+	return neighbors, err
+}
+
+// SetHashRecords writes the documents to their shards
+func (store *ShardedStore) SetHashRecords(collName string, records []HashesRecord) error {
+	if !store.isSharded(collName) {
+		return store.shards[0].SetHashRecords(collName, records)
+	}
+	groups := make([][]HashesRecord, len(store.shards))
+	for _, record := range records {
+		shard := store.GetShard(record.SecondaryID)
+		groups[shard] = append(groups[shard], record)
+	}
+	return store.fanOut(func(shard int) error {
+		if len(groups[shard]) == 0 {
+			return nil
+		}
+		return store.shards[shard].SetHashRecords(store.getShardCollName(shard, collName), groups[shard])
+	})
+}
+
+// DeleteHashRecords drops the document from its shard
+func (store *ShardedStore) DeleteHashRecords(collName string, secondaryID uint64) error {
+	if !store.isSharded(collName) {
+		return store.shards[0].DeleteHashRecords(collName, secondaryID)
+	}
+	shard := store.GetShard(secondaryID)
+	return store.shards[shard].DeleteHashRecords(store.getShardCollName(shard, collName), secondaryID)
+}
+
+// IterateVectors iterates over the shards one by one, so fn isn't called concurrently;
+// the sample is split evenly between the shards
+func (store *ShardedStore) IterateVectors(ctx context.Context, collName string, sampleSize int, fn func(HashesRecord) error) error {
+	if !store.isSharded(collName) {
+		return store.shards[0].IterateVectors(ctx, collName, sampleSize, fn)
+	}
+	shardSampleSize := sampleSize
+	if sampleSize > 0 {
+		shardSampleSize = (sampleSize + len(store.shards) - 1) / len(store.shards)
+	}
+	for shard := range store.shards {
+		err := store.shards[shard].IterateVectors(ctx, store.getShardCollName(shard, collName), shardSampleSize, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBucketsStats merges the buckets stats of the shards; the bucket split between the shards
+// is counted once per shard, while the sizes of the hot buckets are summed up
+func (store *ShardedStore) GetBucketsStats(collName, table string, topN, queryLimit int) (cm.BucketsStats, error) {
+	results := make([]cm.BucketsStats, len(store.shards))
+	err := store.fanOut(func(shard int) error {
+		var err error
+		results[shard], err = store.shards[shard].GetBucketsStats(store.getShardCollName(shard, collName), table, topN, queryLimit)
+		return err
+	})
+	if err != nil {
+		return cm.BucketsStats{}, err
+	}
+	return mergeBucketsStats(results, table, topN), nil
+}
+
+// mergeBucketsStats sums up the buckets stats of the shards
+func mergeBucketsStats(results []cm.BucketsStats, table string, topN int) cm.BucketsStats {
+	stats := cm.BucketsStats{Table: table}
+	histogram := make(map[int64]int64)
+	hotBuckets := make(map[uint64]int64)
+	for _, result := range results {
+		stats.Buckets += result.Buckets
+		stats.Documents += result.Documents
+		stats.Singletons += result.Singletons
+		stats.OverQueryLimit += result.OverQueryLimit
+		if result.MaxSize > stats.MaxSize {
+			stats.MaxSize = result.MaxSize
+		}
+		for _, bin := range result.Histogram {
+			histogram[bin.From] += bin.Count
+		}
+		for _, bucket := range result.HotBuckets {
+			hotBuckets[bucket.Hash] += bucket.Size
+		}
+	}
+	if stats.Buckets > 0 {
+		stats.AvgSize = float64(stats.Documents) / float64(stats.Buckets)
+		stats.SingletonsFraction = float64(stats.Singletons) / float64(stats.Buckets)
+	}
+	for from, count := range histogram {
+		stats.Histogram = append(stats.Histogram, newHistogramBin(from, count))
+	}
+	sort.Slice(stats.Histogram, func(i, j int) bool { return stats.Histogram[i].From < stats.Histogram[j].From })
+	for hash, size := range hotBuckets {
+		stats.HotBuckets = append(stats.HotBuckets, cm.HotBucket{Hash: hash, Size: size})
+		if size > stats.MaxSize {
+			stats.MaxSize = size
+		}
+	}
+	sort.Slice(stats.HotBuckets, func(i, j int) bool { return stats.HotBuckets[i].Size > stats.HotBuckets[j].Size })
+	if len(stats.HotBuckets) > topN {
+		stats.HotBuckets = stats.HotBuckets[:topN]
+	}
+	return stats
+}
+
+// GetHelperRecord returns the helper record of the first shard
+func (store *ShardedStore) GetHelperRecord(getHasherObject bool) (HelperRecord, error) {
+	return store.shards[0].GetHelperRecord(getHasherObject)
+}
+
+// WatchHelperRecord watches the helper record of the first shard
+func (store *ShardedStore) WatchHelperRecord(ctx context.Context, onChange func(), onInvalidate func(CacheInvalidation)) error {
+	return store.shards[0].WatchHelperRecord(ctx, onChange, onInvalidate)
+}
+
+// PublishInvalidation publishes the invalidation through the helper collection of the first shard
+func (store *ShardedStore) PublishInvalidation(invalidation CacheInvalidation) error {
+	return store.shards[0].PublishInvalidation(invalidation)
+}
+
+// UpdateBuildStatus updates the helper record of the first shard
+func (store *ShardedStore) UpdateBuildStatus(status HelperRecord) error {
+	return store.shards[0].UpdateBuildStatus(status)
+}
+
+// UpdateBuildProgress updates the helper record of the first shard
+func (store *ShardedStore) UpdateBuildProgress(progress cm.BuildProgress) error {
+	return store.shards[0].UpdateBuildProgress(progress)
+}
+
+// SaveBuild updates the helper record of the first shard
+func (store *ShardedStore) SaveBuild(record HelperRecord) error {
+	return store.shards[0].SaveBuild(record)
+}
+
+// UpdateInsertStats updates the helper record of the first shard
+func (store *ShardedStore) UpdateInsertStats(stats InsertStats) error {
+	return store.shards[0].UpdateInsertStats(stats)
+}
+
+// GetBuildLease returns the build lease of the first shard
+func (store *ShardedStore) GetBuildLease() (BuildLease, error) {
+	return store.shards[0].GetBuildLease()
+}
+
+// AcquireBuildLease takes the build lease of the first shard
+func (store *ShardedStore) AcquireBuildLease(lease BuildLease) (BuildLease, error) {
+	return store.shards[0].AcquireBuildLease(lease)
+}
+
+// RenewBuildLease renews the build lease of the first shard
+func (store *ShardedStore) RenewBuildLease(lease BuildLease) error {
+	return store.shards[0].RenewBuildLease(lease)
+}
+
+// ReleaseBuildLease drops the build lease of the first shard
+func (store *ShardedStore) ReleaseBuildLease(owner string) error {
+	return store.shards[0].ReleaseBuildLease(owner)
+}
+
+// RequestBuildCancel marks the build of the lease owner of the first shard cancelled
+func (store *ShardedStore) RequestBuildCancel(owner string) error {
+	return store.shards[0].RequestBuildCancel(owner)
+}
+
+// CheckHealth checks all the shards, returns the first error
+func (store *ShardedStore) CheckHealth() error {
+	return store.fanOut(func(shard int) error {
+		return store.shards[shard].CheckHealth()
+	})
+}
+
+// GetShardsHealth checks every shard and counts its documents of the hash collection
+func (store *ShardedStore) GetShardsHealth(collName string) []cm.ShardHealth {
+	health := make([]cm.ShardHealth, len(store.shards))
+	store.fanOut(func(shard int) error {
+		health[shard].Shard = store.names[shard]
+		err := store.shards[shard].CheckHealth()
+		if err == nil && len(collName) != 0 {
+			health[shard].Size, err = store.shards[shard].GetCollSize(store.getShardCollName(shard, collName))
+		}
+		if err != nil {
+			health[shard].Error = err.Error()
+			return nil
+		}
+		health[shard].Healthy = true
+		return nil
+	})
+	return health
+}
+
+// Disconnect closes all the shard stores
+func (store *ShardedStore) Disconnect() {
+	closed := make(map[VectorStore]bool)
+	for _, shard := range store.shards {
+		if !closed[shard] {
+			shard.Disconnect()
+			closed[shard] = true
+		}
+	}
+}
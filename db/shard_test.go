@@ -0,0 +1,103 @@
+package db_test
+
+import (
+	"context"
+	"lsh-search-service/db"
+	"testing"
+)
+
+func getTestShardedStore(t *testing.T, mode string, shards int) *db.ShardedStore {
+	store, err := db.NewShardedStore(db.Config{Backend: db.BackendMemory, Shards: shards, ShardMode: mode, SourceCollectionName: "source"})
+	if err != nil {
+		t.Fatalf("Could not create sharded store: %v", err)
+	}
+	fillTestStore(t, store)
+	return store
+}
+
+func TestShardedStore(t *testing.T) {
+	for _, mode := range []string{db.ShardModeCollections, db.ShardModeStores} {
+		store := getTestShardedStore(t, mode, 2)
+		candidates, err := store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 0)
+		if err != nil || len(candidates) != 3 {
+			t.Fatalf("Candidates of all the shards must be gathered: %v %v", err, len(candidates))
+		}
+		candidates, _ = store.GetCandidateHashes(context.Background(), "hashes", map[int]uint64{0: 1, 1: 1}, 2)
+		if len(candidates) != 2 {
+			t.Fatal("Candidates must be limited")
+		}
+		neighbors, err := store.GetNearestVectors(context.Background(), "hashes", []uint64{1, 2, 3, 4}, db.DistanceQuery{
+			Vec:   []float64{2.2},
+			Thrsh: 10.0,
+			Limit: 2,
+		})
+		if err != nil || len(neighbors) != 2 || neighbors[0].SecondaryID != 2 || neighbors[1].SecondaryID != 3 {
+			t.Fatalf("Nearest neighbors of the shards must be merged by distance: %v %+v", err, neighbors)
+		}
+		store.DeleteHashRecords("hashes", 1)
+		vectors, _ := store.GetVectors(context.Background(), "hashes", []uint64{1, 2, 3}, false)
+		if len(vectors) != 2 || hasCandidate(vectors, 1) {
+			t.Fatal("Vectors must be fetched from their shards")
+		}
+		if size, _ := store.GetCollSize("hashes"); size != 3 {
+			t.Fatal("Size must be summed over the shards")
+		}
+
+		var records []db.HashesRecord
+		for id := uint64(1); id <= 100; id++ {
+			records = append(records, db.HashesRecord{SecondaryID: id, FeatureVec: []float64{1.0}, Hashes: map[int]uint64{0: 1}})
+		}
+		store.CreateHashCollection("spread", []string{"0"})
+		store.SetHashRecords("spread", records)
+		health := store.GetShardsHealth("spread")
+		if len(health) != 2 || !health[0].Healthy || !health[1].Healthy || health[0].Size == 0 || health[0].Size+health[1].Size != 100 {
+			t.Fatalf("Documents must be spread over the healthy shards: %+v", health)
+		}
+		for _, record := range records {
+			vectors, _ := store.GetVectors(context.Background(), "spread", []uint64{record.SecondaryID}, false)
+			if len(vectors) != 1 {
+				t.Fatal("Document must be fetched from the shard it has been routed to")
+			}
+		}
+
+		// NOTE: candidates of the first shard collide with the single query bucket, and the ones of the second shard with both
+		var merged []db.HashesRecord
+		counts := make([]int, 2)
+		for _, record := range records {
+			shard := store.GetShard(record.SecondaryID)
+			if counts[shard] == 3 {
+				continue
+			}
+			counts[shard]++
+			record.Hashes = map[int]uint64{0: 1, 1: uint64(shard)}
+			merged = append(merged, record)
+		}
+		store.CreateHashCollection("merged", []string{"0", "1"})
+		store.SetHashRecords("merged", merged)
+		candidates, _ = store.GetCandidateHashes(context.Background(), "merged", map[int]uint64{0: 1, 1: 1}, 3)
+		for _, candidate := range candidates {
+			if store.GetShard(candidate.SecondaryID) != 1 {
+				t.Fatalf("Candidates of the shards must be merged by the number of collisions: %+v", candidates)
+			}
+		}
+	}
+}
+
+func TestShardedStoreConsistentHashing(t *testing.T) {
+	twoShards := getTestShardedStore(t, db.ShardModeCollections, 2)
+	threeShards := getTestShardedStore(t, db.ShardModeCollections, 3)
+	moved := 0
+	for id := uint64(1); id <= 1000; id++ {
+		shard := threeShards.GetShard(id)
+		if shard == twoShards.GetShard(id) {
+			continue
+		}
+		if shard != 2 {
+			t.Fatal("Ids must move only to the added shard")
+		}
+		moved++
+	}
+	if moved == 0 || moved > 500 {
+		t.Fatalf("About third of the ids must move to the added shard: %v", moved)
+	}
+}
@@ -0,0 +1,570 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	cm "lsh-search-service/common"
+)
+
+// Error codes of the mongo server: the change stream opened on the standalone server
+// and the duplicate unique key
+const (
+	changeStreamNotSupportedCode = 40573
+	duplicateKeyCode             = 11000
+)
+
+const (
+	// NOTE: the merge is retried only while other instances update the stats at the same time
+	insertStatsRetries = 10
+)
+
+// NewStore creates the storage backend selected in config, sharded if there are several shards
+// NOTE: failed constructors return the untyped nil, so the returned store can be compared with nil
+func NewStore(config Config) (VectorStore, error) {
+	if config.Shards > 1 {
+		store, err := NewShardedStore(config)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return newBackendStore(config)
+}
+
+// newBackendStore creates the single store of the backend selected in config
+func newBackendStore(config Config) (VectorStore, error) {
+	switch config.Backend {
+	case BackendMongo, "":
+		mongodb, err := New(config)
+		if err != nil {
+			return nil, err
+		}
+		err = mongodb.ensureHelperCollection()
+		if err != nil {
+			mongodb.Disconnect()
+			return nil, err
+		}
+		return mongodb, nil
+	case BackendMemory:
+		return NewMemoryStore(config), nil
+	case BackendBolt:
+		store, err := NewBoltStore(config)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", config.Backend)
+}
+
+// ensureHelperCollection creates the helper collection if it doesn't exist yet
+func (mongodb *MongoDatastore) ensureHelperCollection() error {
+	helperExists, err := mongodb.CheckCollection(mongodb.Config.HelperCollectionName)
+	if err != nil {
+		return err
+	}
+	if !helperExists {
+		_, err = mongodb.CreateCollection(mongodb.Config.HelperCollectionName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateHashCollection creates the new collection and indexes for the hash field of every table,
+// or the vectors and posting lists collections for the inverted layout
+func (mongodb *MongoDatastore) CreateHashCollection(collName string, tables []string) error {
+	if mongodb.Config.HashLayout == HashLayoutInverted {
+		return mongodb.createInvertedCollection(collName)
+	}
+	coll, err := mongodb.CreateCollection(collName)
+	if err != nil {
+		return err
+	}
+	// NOTE: secondary id index is needed to fetch vectors of the final candidates
+	hashFields := []string{"secondaryId"}
+	for _, table := range tables {
+		hashFields = append(hashFields, GetHashFieldName(table))
+	}
+	return coll.CreateIndexesByFields(hashFields, false)
+}
+
+// GetCandidateHashes returns documents which fall into the same bucket as the query
+// in at least one of the tables; only secondary id, hashes and sketch are fetched
+func (mongodb *MongoDatastore) GetCandidateHashes(ctx context.Context, collName string, hashes map[int]uint64, limit int) ([]HashesRecord, error) {
+	if mongodb.Config.HashLayout == HashLayoutInverted {
+		return mongodb.getInvertedCandidateHashes(ctx, collName, hashes, limit)
+	}
+	hashesQuery := bson.A{}
+	for k, v := range hashes {
+		hashesQuery = append(hashesQuery, bson.D{{GetHashFieldName(strconv.Itoa(k)), v}})
+	}
+	cursor, err := mongodb.GetCollection(collName).GetCursorWithContext(ctx,
+		FindQuery{
+			Limit: limit,
+			Query: bson.D{{"$or", hashesQuery}},
+			Proj:  bson.M{"_id": 0, "secondaryId": 1, "hashes": 1, "sketch": 1},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHashRecords(ctx, cursor)
+}
+
+// GetVectors returns feature vectors of the documents with the specified secondary ids;
+// quantized documents are returned with codes, or with the float32 copy if exact vectors are requested
+func (mongodb *MongoDatastore) GetVectors(ctx context.Context, collName string, secondaryIDs []uint64, exact bool) ([]HashesRecord, error) {
+	if len(secondaryIDs) == 0 {
+		return nil, nil
+	}
+	proj := bson.M{"_id": 0, "secondaryId": 1, "featureVec": 1, "codes": 1}
+	if exact {
+		proj = bson.M{"_id": 0, "secondaryId": 1, "featureVec": 1, "vec32": 1}
+	}
+	cursor, err := mongodb.GetCollection(collName).GetCursorWithContext(ctx,
+		FindQuery{
+			Query: bson.D{{"secondaryId", bson.D{{"$in", secondaryIDs}}}},
+			Proj:  proj,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHashRecords(ctx, cursor)
+}
+
+// GetRecordsHashes returns secondary ids and hashes of the stored documents with the specified secondary ids
+func (mongodb *MongoDatastore) GetRecordsHashes(ctx context.Context, collName string, secondaryIDs []uint64) ([]HashesRecord, error) {
+	if len(secondaryIDs) == 0 {
+		return nil, nil
+	}
+	cursor, err := mongodb.GetCollection(collName).GetCursorWithContext(ctx,
+		FindQuery{
+			Query: bson.D{{"secondaryId", bson.D{{"$in", secondaryIDs}}}},
+			Proj:  bson.M{"_id": 0, "secondaryId": 1, "hashes": 1},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHashRecords(ctx, cursor)
+}
+
+// GetNearestVectors computes distances to the documents inside the aggregation pipeline,
+// so only the nearest ones leave the database
+func (mongodb *MongoDatastore) GetNearestVectors(ctx context.Context, collName string, secondaryIDs []uint64, query DistanceQuery) ([]cm.NeighborsRecord, error) {
+	if len(secondaryIDs) == 0 {
+		return nil, nil
+	}
+	opts := options.Aggregate().SetMaxTime(time.Duration(dbtimeOut) * time.Second)
+	cursor, err := mongodb.GetCollection(collName).Aggregate(ctx, GetDistancePipeline(secondaryIDs, query), opts)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: ids are decoded into the integer field, since they don't fit float64 above 2^53
+	var results []nearestRecord
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := make([]cm.NeighborsRecord, len(results))
+	for i, result := range results {
+		neighbors[i] = cm.NeighborsRecord{
+			SecondaryID: result.SecondaryID,
+			Dist:        result.Dist,
+		}
+	}
+	return neighbors, nil
+}
+
+// decodeHashRecords reads all the documents from the cursor, skipping the malformed ones;
+// if the context is done before the cursor is exhausted, the documents read so far are returned with the context error
+func decodeHashRecords(ctx context.Context, cursor *mongo.Cursor) ([]HashesRecord, error) {
+	defer cursor.Close(context.Background())
+	var records []HashesRecord
+	for cursor.Next(ctx) {
+		var record HashesRecord
+		if err := cursor.Decode(&record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := ctx.Err(); err != nil {
+		return records, err
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// SetHashRecords adds the new documents to the hash collection;
+// document with the same secondary id gets replaced
+func (mongodb *MongoDatastore) SetHashRecords(collName string, records []HashesRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if mongodb.Config.HashLayout == HashLayoutInverted {
+		return mongodb.setInvertedRecords(collName, records)
+	}
+	// NOTE: documents are upserted by secondary id, since graph nodes get rewritten along with their links
+	models := make([]mongo.WriteModel, len(records))
+	for i, record := range records {
+		record.ID = primitive.NilObjectID
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{"secondaryId", record.SecondaryID}}).
+			SetReplacement(record).
+			SetUpsert(true)
+	}
+	return mongodb.GetCollection(collName).WriteRecords(models)
+}
+
+// DeleteHashRecords drops all the documents with the specified secondary id
+func (mongodb *MongoDatastore) DeleteHashRecords(collName string, secondaryID uint64) error {
+	if mongodb.Config.HashLayout == HashLayoutInverted {
+		return mongodb.deleteInvertedRecords(collName, secondaryID)
+	}
+	return mongodb.GetCollection(collName).DeleteRecords(bson.D{{"secondaryId", secondaryID}})
+}
+
+// IterateVectors calls fn for every document of the collection, or for the random sample
+// of the specified size; only secondary id, feature vector (or its quantized forms) and graph links are fetched
+func (mongodb *MongoDatastore) IterateVectors(ctx context.Context, collName string, sampleSize int, fn func(HashesRecord) error) error {
+	coll := mongodb.GetCollection(collName)
+	proj := bson.M{"secondaryId": 1, "featureVec": 1, "codes": 1, "vec32": 1, "level": 1, "links": 1, "deleted": 1}
+	var cursor *mongo.Cursor
+	var err error
+	if sampleSize > 0 {
+		cursor, err = coll.GetSampleCursor(sampleSize, proj)
+	} else {
+		cursor, err = coll.GetCursor(FindQuery{Proj: proj})
+	}
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var record HashesRecord
+		if err := cursor.Decode(&record); err != nil {
+			continue
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return cursor.Err()
+}
+
+// GetBucketsStats returns occupancy stats of the buckets of the specified hash table
+func (mongodb *MongoDatastore) GetBucketsStats(collName, table string, topN, queryLimit int) (cm.BucketsStats, error) {
+	if mongodb.Config.HashLayout == HashLayoutInverted {
+		return GetPostingsStats(mongodb.GetCollection(GetPostingsCollName(collName)), table, topN, queryLimit)
+	}
+	return GetBucketsStats(mongodb.GetCollection(collName), table, topN, queryLimit)
+}
+
+// GetHelperRecord gets supplementary data from the helper collection
+func (mongodb *MongoDatastore) GetHelperRecord(getHasherObject bool) (HelperRecord, error) {
+	proj := bson.M{}
+	if !getHasherObject {
+		proj = bson.M{"hasher": 0}
+	}
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	cursor, err := helperColl.GetCursor(
+		FindQuery{
+			Limit: 1,
+			Query: helperFilter,
+			Proj:  proj,
+		},
+	)
+	if err != nil {
+		return HelperRecord{}, err
+	}
+
+	var results []HelperRecord
+	err = cursor.All(context.Background(), &results)
+	if err != nil || len(results) != 1 {
+		return HelperRecord{}, err
+	}
+	return results[0], nil
+}
+
+// WatchHelperRecord opens the change stream of the helper collection, calls onChange once the stream is open
+// and then after every change of the active build, until ctx is done or the stream fails.
+// Change streams need the replica set, so the standalone server gets ErrWatchNotSupported
+func (mongodb *MongoDatastore) WatchHelperRecord(ctx context.Context, onChange func(), onInvalidate func(CacheInvalidation)) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	stream, err := helperColl.Watch(ctx, HelperChangesPipeline)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == changeStreamNotSupportedCode {
+			return ErrWatchNotSupported
+		}
+		return err
+	}
+	defer stream.Close(context.Background())
+	onChange()
+	for stream.Next(ctx) {
+		var change helperChange
+		if err = stream.Decode(&change); err != nil {
+			return err
+		}
+		if change.DocumentKey.ID == CacheInvalidationID {
+			var invalidation CacheInvalidation
+			if err = bson.Unmarshal(change.FullDocument, &invalidation); err != nil {
+				return err
+			}
+			onInvalidate(invalidation)
+			continue
+		}
+		onChange()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if stream.Err() != nil {
+		return stream.Err()
+	}
+	return errors.New("helper change stream has been closed")
+}
+
+// PublishInvalidation replaces the cache invalidation document, so its change is streamed to the instances
+func (mongodb *MongoDatastore) PublishInvalidation(invalidation CacheInvalidation) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	invalidation.ID = CacheInvalidationID
+	invalidation.Time = time.Now().UnixNano()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	_, err := helperColl.ReplaceOne(ctx, bson.D{{"_id", CacheInvalidationID}}, invalidation, options.Replace().SetUpsert(true))
+	return err
+}
+
+// UpdateBuildStatus updates helper record with the new build status and error
+func (mongodb *MongoDatastore) UpdateBuildStatus(status HelperRecord) error {
+	return mongodb.updateHelperRecord(bson.D{
+		{"$set", bson.D{
+			{"isBuildDone", status.IsBuildDone},
+			{"buildError", status.BuildError},
+			{"buildOwner", status.BuildOwner},
+			{"lastBuildTime", status.LastBuildTime},
+			{"buildElapsedTime", status.BuildElapsedTime},
+		}}})
+}
+
+// UpdateBuildProgress saves the current build progress to the helper record
+func (mongodb *MongoDatastore) UpdateBuildProgress(progress cm.BuildProgress) error {
+	return mongodb.updateHelperRecord(bson.D{
+		{"$set", bson.D{
+			{"buildProgress", progress},
+		}}})
+}
+
+// SaveBuild stores the new hasher and makes the new hash collection active;
+// insert stats are reset, since they are compared with the new build stats. The build is saved
+// only if it's still marked in progress by its owner, otherwise ErrLeaseLost is returned
+func (mongodb *MongoDatastore) SaveBuild(record HelperRecord) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	filter := append(bson.D{{"buildOwner", record.BuildOwner}}, helperFilter...)
+	res, err := helperColl.UpdateOne(ctx, filter, bson.D{
+		{"$set", bson.D{
+			{"isBuildDone", record.IsBuildDone},
+			{"buildError", record.BuildError},
+			{"buildOwner", record.BuildOwner},
+			{"hasher", record.Hasher},
+			{"hashCollName", record.HashCollName},
+			{"lastBuildTime", record.LastBuildTime},
+			{"buildElapsedTime", record.BuildElapsedTime},
+			{"buildProgress", record.BuildProgress},
+			{"buildStats", record.BuildStats},
+			{"scalarQuantizer", record.ScalarQuantizer},
+			{"productQuantizer", record.ProductQuantizer},
+			{"indexType", record.IndexType},
+			{"invertedFile", record.InvertedFile},
+			{"forest", record.Forest},
+			{"graph", record.Graph},
+			{"insertStats", NewInsertStats(len(record.BuildStats.Mean))},
+		}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// UpdateInsertStats merges the stats of the batch into the running stats in the helper record;
+// the merged stats are written only if the version is the same as the read one, otherwise the merge
+// is retried over the stats updated by the other instance
+func (mongodb *MongoDatastore) UpdateInsertStats(stats InsertStats) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	for i := 0; i < insertStatsRetries; i++ {
+		record, err := mongodb.GetHelperRecord(false)
+		if err != nil {
+			return err
+		}
+		merged, err := record.InsertStats.Merge(stats)
+		if err != nil {
+			return err
+		}
+		// NOTE: the stats saved before the versioning have no version field
+		var version interface{} = record.InsertStats.Version
+		if record.InsertStats.Version == 0 {
+			version = bson.D{{"$in", bson.A{0, nil}}}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+		res, err := helperColl.UpdateOne(
+			ctx,
+			bson.D{{"_id", record.ID}, {"insertStats.version", version}},
+			bson.D{{"$set", bson.D{{"insertStats", merged}}}},
+		)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 1 {
+			return nil
+		}
+	}
+	return errors.New("insert stats are updated concurrently, retries exhausted")
+}
+
+// updateHelperRecord applies update to the single helper document, creating it if needed
+func (mongodb *MongoDatastore) updateHelperRecord(update bson.D) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	return helperColl.UpdateField(helperFilter, update)
+}
+
+// GetBuildLease returns the build lease, the lease without the owner means there is no build running
+func (mongodb *MongoDatastore) GetBuildLease() (BuildLease, error) {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	var lease BuildLease
+	err := helperColl.FindOne(ctx, bson.D{{"_id", BuildLeaseID}}).Decode(&lease)
+	if err == mongo.ErrNoDocuments {
+		return BuildLease{}, nil
+	}
+	return lease, err
+}
+
+// AcquireBuildLease atomically takes the lease, if there is no lease, it has expired by the heartbeat
+// of the new one or it's held by the same owner. Returns the replaced lease, so the build of the dead owner
+// may be rolled back, or ErrLeaseHeld if the lease is held by another owner
+func (mongodb *MongoDatastore) AcquireBuildLease(lease BuildLease) (BuildLease, error) {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	lease.ID = BuildLeaseID
+	filter := bson.D{
+		{"_id", BuildLeaseID},
+		{"$or", bson.A{
+			bson.D{{"owner", lease.Owner}},
+			bson.D{{"expires", bson.D{{"$lt", lease.Heartbeat}}}},
+		}},
+	}
+	// NOTE: the lease held by another owner doesn't match the filter, so the upsert hits the duplicate id
+	opts := options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.Before)
+	var prev BuildLease
+	err := helperColl.FindOneAndReplace(ctx, filter, lease, opts).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return BuildLease{}, nil
+	}
+	if isDuplicateKeyError(err) {
+		return BuildLease{}, ErrLeaseHeld
+	}
+	return prev, err
+}
+
+// RenewBuildLease updates the heartbeat, the expiration and the build info of the lease held by the owner,
+// returns ErrLeaseLost if the lease has been taken over and ErrCancelRequested if its build has been cancelled
+func (mongodb *MongoDatastore) RenewBuildLease(lease BuildLease) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	lease.ID = BuildLeaseID
+	// NOTE: the lease with the cancel request isn't replaced, so the request isn't lost
+	filter := bson.D{{"_id", BuildLeaseID}, {"owner", lease.Owner}, {"cancelRequested", bson.D{{"$ne", true}}}}
+	res, err := helperColl.ReplaceOne(ctx, filter, lease)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 0 {
+		return nil
+	}
+	current, err := mongodb.GetBuildLease()
+	if err != nil {
+		return err
+	}
+	if current.Owner == lease.Owner && current.CancelRequested {
+		return ErrCancelRequested
+	}
+	return ErrLeaseLost
+}
+
+// RequestBuildCancel marks the build of the lease owner cancelled, returns ErrLeaseLost if the lease
+// isn't held by the owner anymore
+func (mongodb *MongoDatastore) RequestBuildCancel(owner string) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	res, err := helperColl.UpdateOne(ctx, bson.D{{"_id", BuildLeaseID}, {"owner", owner}}, bson.D{{"$set", bson.D{{"cancelRequested", true}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// ReleaseBuildLease drops the lease held by the owner
+func (mongodb *MongoDatastore) ReleaseBuildLease(owner string) error {
+	helperColl := mongodb.GetCollection(mongodb.Config.HelperCollectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	_, err := helperColl.DeleteOne(ctx, bson.D{{"_id", BuildLeaseID}, {"owner", owner}})
+	return err
+}
+
+// CheckHealth pings the primary of the mongo deployment
+func (mongodb *MongoDatastore) CheckHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dbtimeOut)*time.Second)
+	defer cancel()
+	return mongodb.Session.Ping(ctx, readpref.Primary())
+}
+
+// isDuplicateKeyError checks if the write has failed because of the duplicate unique key
+func isDuplicateKeyError(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == duplicateKeyCode
+	}
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package db_test
+
+import (
+	"lsh-search-service/db"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDecodeBucketsStats(t *testing.T) {
+	// NOTE: the same buckets as in the memory store test, with the types mongo returns for the aggregation
+	raw, err := bson.Marshal(bson.D{
+		{"summary", bson.A{bson.D{
+			{"_id", nil},
+			{"buckets", int32(2)},
+			{"documents", int32(4)},
+			{"maxSize", int32(3)},
+			{"singletons", int32(1)},
+			{"overQueryLimit", int32(1)},
+		}}},
+		{"histogram", bson.A{
+			bson.D{{"_id", int64(1)}, {"count", int32(1)}},
+			bson.D{{"_id", int64(2)}, {"count", int32(1)}},
+		}},
+		{"hotBuckets", bson.A{
+			bson.D{{"_id", int64(1)}, {"size", int32(3)}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Could not marshal aggregation result: %v", err)
+	}
+	stats, err := db.DecodeBucketsStats("0", raw)
+	if err != nil {
+		t.Fatalf("Could not decode buckets stats: %v", err)
+	}
+	if stats.Table != "0" || stats.Buckets != 2 || stats.Documents != 4 || stats.MaxSize != 3 || stats.Singletons != 1 {
+		t.Fatal("Buckets stats are wrong")
+	}
+	if stats.AvgSize != 2.0 || stats.SingletonsFraction != 0.5 || stats.OverQueryLimit != 1 {
+		t.Fatal("Derived buckets stats are wrong")
+	}
+	if len(stats.HotBuckets) != 1 || stats.HotBuckets[0].Hash != 1 || stats.HotBuckets[0].Size != 3 {
+		t.Fatal("Hot buckets are decoded wrong")
+	}
+	if len(stats.Histogram) != 2 || stats.Histogram[1].From != 2 || stats.Histogram[1].To != 4 {
+		t.Fatal("Buckets histogram is wrong")
+	}
+
+	raw, _ = bson.Marshal(bson.D{{"summary", bson.A{}}, {"histogram", bson.A{}}, {"hotBuckets", bson.A{}}})
+	stats, err = db.DecodeBucketsStats("1", raw)
+	if err != nil || stats.Table != "1" || stats.Buckets != 0 || stats.AvgSize != 0 {
+		t.Fatal("Empty collection must give empty stats")
+	}
+}
+
+func TestDistancePipelineZeroQuery(t *testing.T) {
+	query := db.DistanceQuery{Vec: []float64{0.0, 0.0}, IsAngular: true, Thrsh: 1.0}
+	match := db.GetDistancePipeline([]uint64{1, 2}, query)[0].Map()["$match"].(bson.D).Map()
+	ids := match["secondaryId"].(bson.D).Map()["$in"].([]uint64)
+	if len(ids) != 0 {
+		t.Fatal("Zero query must not match anything with angular metric")
+	}
+	query.IsAngular = false
+	match = db.GetDistancePipeline([]uint64{1, 2}, query)[0].Map()["$match"].(bson.D).Map()
+	ids = match["secondaryId"].(bson.D).Map()["$in"].([]uint64)
+	if len(ids) != 2 {
+		t.Fatal("Zero query must match the documents with L2 metric")
+	}
+}
@@ -3,6 +3,7 @@ module lsh-search-service
 go 1.13
 
 require (
+	go.etcd.io/bbolt v1.3.5
 	go.mongodb.org/mongo-driver v1.4.6
 	gonum.org/v1/gonum v0.8.2
 	gonum.org/v1/hdf5 v0.0.0-20200504100616-496fefe91614
@@ -0,0 +1,391 @@
+package hnsw
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	cm "lsh-search-service/common"
+)
+
+func (h minHeap) Len() int            { return len(h) }
+func (h minHeap) Less(i, j int) bool  { return h[i].dist < h[j].dist }
+func (h minHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *minHeap) Push(x interface{}) { *h = append(*h, x.(item)) }
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (h maxHeap) Len() int            { return len(h) }
+func (h maxHeap) Less(i, j int) bool  { return h[i].dist > h[j].dist }
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(item)) }
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// NewGraph creates the empty graph; M is limited from below by 2,
+// since the levels distribution depends on its logarithm
+func NewGraph(config Config) *Graph {
+	graph := &Graph{}
+	graph.setConfig(config)
+	return graph
+}
+
+// setConfig resets the graph with the new config
+func (graph *Graph) setConfig(config Config) {
+	if config.M < 2 {
+		config.M = 2
+	}
+	if config.EfConstruction < config.M {
+		config.EfConstruction = config.M
+	}
+	graph.Config = config
+	graph.Nodes = make(map[uint64]*Node)
+	graph.EntryPoint = 0
+	graph.MaxLevel = 0
+	graph.levelMult = 1.0 / math.Log(float64(config.M))
+	graph.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// getDist calculates distance between vectors with the configured metric
+func (graph *Graph) getDist(a, b []float64) float64 {
+	if graph.Config.IsAngularDistance == 1 {
+		va, vb := cm.NewVec(a), cm.NewVec(b)
+		if cm.IsZeroVector(va) || cm.IsZeroVector(vb) {
+			return 1.0 // NOTE: zero vectors are wrong with angular metric
+		}
+		return cm.CosineSim(va, vb)
+	}
+	var sum float64
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// maxLinks returns the max number of links of the node on the level;
+// the ground level is twice denser
+func (graph *Graph) maxLinks(level int) int {
+	if level == 0 {
+		return graph.Config.M * 2
+	}
+	return graph.Config.M
+}
+
+// randomLevel draws the top level of the new node from the exponentially decaying distribution
+func (graph *Graph) randomLevel() int {
+	return int(-math.Log(1.0-graph.rnd.Float64()) * graph.levelMult)
+}
+
+// searchLayer performs the greedy beam search on the single level, starting from the entry points;
+// returns up to ef closest nodes sorted by distance in ascending order
+func (graph *Graph) searchLayer(query []float64, entryPoints []item, ef, level int) []item {
+	visited := make(map[uint64]struct{}, ef*4)
+	candidates := &minHeap{}
+	results := &maxHeap{}
+	for _, ep := range entryPoints {
+		visited[ep.id] = struct{}{}
+		heap.Push(candidates, ep)
+		heap.Push(results, ep)
+	}
+	for results.Len() > ef {
+		heap.Pop(results)
+	}
+	for candidates.Len() > 0 {
+		current := heap.Pop(candidates).(item)
+		if results.Len() >= ef && current.dist > (*results)[0].dist {
+			break
+		}
+		node, ok := graph.Nodes[current.id]
+		if !ok || len(node.Links) <= level {
+			continue
+		}
+		for _, id := range node.Links[level] {
+			if _, ok := visited[id]; ok {
+				continue
+			}
+			visited[id] = struct{}{}
+			neighbor, ok := graph.Nodes[id]
+			if !ok {
+				continue
+			}
+			dist := graph.getDist(query, neighbor.Vec)
+			if results.Len() < ef || dist < (*results)[0].dist {
+				heap.Push(candidates, item{id: id, dist: dist})
+				heap.Push(results, item{id: id, dist: dist})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+	found := make([]item, len(*results))
+	copy(found, *results)
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].dist < found[j].dist
+	})
+	return found
+}
+
+// selectNeighbors picks up to m neighbors from the sorted candidates with the heuristic:
+// candidate is preferred if it's closer to the base than to any of the already selected ones,
+// so links lead to the different directions; the rest of slots are filled with the pruned candidates
+func (graph *Graph) selectNeighbors(candidates []item, m int) []item {
+	if len(candidates) <= m {
+		return candidates
+	}
+	selected := make([]item, 0, m)
+	var pruned []item
+	for _, candidate := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		candidateVec := graph.Nodes[candidate.id].Vec
+		isDiverse := true
+		for _, s := range selected {
+			if graph.getDist(candidateVec, graph.Nodes[s.id].Vec) < candidate.dist {
+				isDiverse = false
+				break
+			}
+		}
+		if isDiverse {
+			selected = append(selected, candidate)
+		} else {
+			pruned = append(pruned, candidate)
+		}
+	}
+	for _, candidate := range pruned {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, candidate)
+	}
+	return selected
+}
+
+// pruneLinks shrinks links of the node on the level down to the max allowed number
+func (graph *Graph) pruneLinks(node *Node, level int) {
+	candidates := make([]item, 0, len(node.Links[level]))
+	for _, id := range node.Links[level] {
+		neighbor, ok := graph.Nodes[id]
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, item{id: id, dist: graph.getDist(node.Vec, neighbor.Vec)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].dist < candidates[j].dist
+	})
+	selected := graph.selectNeighbors(candidates, graph.maxLinks(level))
+	node.Links[level] = make([]uint64, len(selected))
+	for i := range selected {
+		node.Links[level][i] = selected[i].id
+	}
+}
+
+// descend greedily moves from the entry point down to the level
+func (graph *Graph) descend(query []float64, level int) []item {
+	entryPoints := []item{{id: graph.EntryPoint, dist: graph.getDist(query, graph.Nodes[graph.EntryPoint].Vec)}}
+	for l := graph.MaxLevel; l > level; l-- {
+		entryPoints = graph.searchLayer(query, entryPoints, 1, l)[:1]
+	}
+	return entryPoints
+}
+
+// Insert adds the vector to the graph and links it with the nearest nodes on every its level;
+// vector with the existing id replaces the old one and gets relinked, keeping its level.
+// Returns ids of all the nodes whose links have been changed
+func (graph *Graph) Insert(id uint64, vec []float64) ([]uint64, error) {
+	if graph.Config.Dims > 0 && len(vec) != graph.Config.Dims {
+		return nil, errors.New("vector size does not match the graph dimensions")
+	}
+	graph.Lock()
+	defer graph.Unlock()
+
+	node, exists := graph.Nodes[id]
+	if exists {
+		node.Vec = vec
+		node.Deleted = false
+	} else {
+		node = &Node{ID: id, Vec: vec, Level: graph.randomLevel()}
+		node.Links = make([][]uint64, node.Level+1)
+		graph.Nodes[id] = node
+		if len(graph.Nodes) == 1 {
+			graph.EntryPoint = id
+			graph.MaxLevel = node.Level
+			return []uint64{id}, nil
+		}
+	}
+
+	changed := map[uint64]struct{}{id: {}}
+	topLevel := node.Level
+	if topLevel > graph.MaxLevel {
+		topLevel = graph.MaxLevel
+	}
+	entryPoints := graph.descend(vec, topLevel)
+	for level := topLevel; level >= 0; level-- {
+		found := graph.searchLayer(vec, entryPoints, graph.Config.EfConstruction, level)
+		candidates := make([]item, 0, len(found))
+		for _, candidate := range found {
+			if candidate.id != id {
+				candidates = append(candidates, candidate)
+			}
+		}
+		neighbors := graph.selectNeighbors(candidates, graph.maxLinks(level))
+		node.Links[level] = make([]uint64, len(neighbors))
+		for i, neighbor := range neighbors {
+			node.Links[level][i] = neighbor.id
+			neighborNode := graph.Nodes[neighbor.id]
+			if len(neighborNode.Links) <= level || hasLink(neighborNode.Links[level], id) {
+				continue
+			}
+			neighborNode.Links[level] = append(neighborNode.Links[level], id)
+			if len(neighborNode.Links[level]) > graph.maxLinks(level) {
+				graph.pruneLinks(neighborNode, level)
+			}
+			changed[neighbor.id] = struct{}{}
+		}
+		if len(found) > 0 {
+			entryPoints = found
+		}
+	}
+	if node.Level > graph.MaxLevel {
+		graph.MaxLevel = node.Level
+		graph.EntryPoint = id
+	}
+
+	changedIDs := make([]uint64, 0, len(changed))
+	for changedID := range changed {
+		changedIDs = append(changedIDs, changedID)
+	}
+	return changedIDs, nil
+}
+
+// hasLink checks if the links list contains the id
+func hasLink(links []uint64, id uint64) bool {
+	for _, link := range links {
+		if link == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete marks the node as deleted, so it's still used to navigate the graph
+// but never returned; returns false if there is no such alive node
+func (graph *Graph) Delete(id uint64) bool {
+	graph.Lock()
+	defer graph.Unlock()
+	node, ok := graph.Nodes[id]
+	if !ok || node.Deleted {
+		return false
+	}
+	node.Deleted = true
+	return true
+}
+
+// Search returns up to k nearest alive nodes, sorted by distance in ascending order;
+// ef is the size of the dynamic candidates list, larger ef gives better recall
+func (graph *Graph) Search(vec []float64, k, ef int) []cm.NeighborsRecord {
+	graph.RLock()
+	defer graph.RUnlock()
+	if len(graph.Nodes) == 0 {
+		return nil
+	}
+	if ef < k {
+		ef = k
+	}
+	found := graph.searchLayer(vec, graph.descend(vec, 0), ef, 0)
+	neighbors := make([]cm.NeighborsRecord, 0, k)
+	for _, candidate := range found {
+		if graph.Nodes[candidate.id].Deleted {
+			continue
+		}
+		neighbors = append(neighbors, cm.NeighborsRecord{SecondaryID: candidate.id, Dist: candidate.dist})
+		if len(neighbors) >= k {
+			break
+		}
+	}
+	return neighbors
+}
+
+// AddNode puts already linked node into the graph, used to restore the graph from the storage;
+// node with the highest level becomes the entry point
+func (graph *Graph) AddNode(node Node) {
+	graph.Lock()
+	defer graph.Unlock()
+	graph.Nodes[node.ID] = &node
+	if len(graph.Nodes) == 1 || node.Level > graph.MaxLevel {
+		graph.EntryPoint = node.ID
+		graph.MaxLevel = node.Level
+	}
+}
+
+// GetNodes returns copies of the nodes with the specified ids
+func (graph *Graph) GetNodes(ids []uint64) []Node {
+	graph.RLock()
+	defer graph.RUnlock()
+	nodes := make([]Node, 0, len(ids))
+	for _, id := range ids {
+		node, ok := graph.Nodes[id]
+		if !ok {
+			continue
+		}
+		nodeCopy := *node
+		nodeCopy.Links = make([][]uint64, len(node.Links))
+		for level := range node.Links {
+			nodeCopy.Links[level] = append([]uint64(nil), node.Links[level]...)
+		}
+		nodes = append(nodes, nodeCopy)
+	}
+	return nodes
+}
+
+// GetIDs returns ids of all the nodes, including the deleted ones
+func (graph *Graph) GetIDs() []uint64 {
+	graph.RLock()
+	defer graph.RUnlock()
+	ids := make([]uint64, 0, len(graph.Nodes))
+	for id := range graph.Nodes {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Dump encodes the graph config as a byte-array; nodes are stored separately
+func (graph *Graph) Dump() ([]byte, error) {
+	graph.RLock()
+	defer graph.RUnlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(graph.Config)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Load decodes the graph config and resets the graph, so nodes must be added again
+func (graph *Graph) Load(inp []byte) error {
+	var config Config
+	err := gob.NewDecoder(bytes.NewReader(inp)).Decode(&config)
+	if err != nil {
+		return err
+	}
+	graph.Lock()
+	defer graph.Unlock()
+	graph.setConfig(config)
+	return nil
+}
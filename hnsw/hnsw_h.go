@@ -0,0 +1,48 @@
+package hnsw
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Config holds the graph construction and search parameters
+type Config struct {
+	IsAngularDistance int
+	M                 int
+	EfConstruction    int
+	Ef                int
+	Dims              int
+}
+
+// Node is the single graph vertex with its links on every level it belongs to;
+// deleted nodes stay in the graph as tombstones, so the graph keeps connected
+type Node struct {
+	ID      uint64
+	Vec     []float64
+	Level   int
+	Links   [][]uint64
+	Deleted bool
+}
+
+// Graph holds the hierarchical navigable small world graph
+type Graph struct {
+	sync.RWMutex
+	Config     Config
+	Nodes      map[uint64]*Node
+	EntryPoint uint64
+	MaxLevel   int
+	levelMult  float64
+	rnd        *rand.Rand
+}
+
+// item is the node with its distance to the query
+type item struct {
+	id   uint64
+	dist float64
+}
+
+// minHeap pops the closest item first
+type minHeap []item
+
+// maxHeap pops the farthest item first
+type maxHeap []item
@@ -0,0 +1,134 @@
+package hnsw_test
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/hnsw"
+)
+
+func getTestGraph(t *testing.T, vecs [][]float64) *hnsw.Graph {
+	graph := hnsw.NewGraph(hnsw.Config{M: 8, EfConstruction: 64, Ef: 32, Dims: len(vecs[0])})
+	for i, vec := range vecs {
+		_, err := graph.Insert(uint64(i+1), vec)
+		if err != nil {
+			t.Fatalf("Could not insert vector: %v", err)
+		}
+	}
+	return graph
+}
+
+func getRandomVecs(n, dims int) [][]float64 {
+	rnd := rand.New(rand.NewSource(42))
+	vecs := make([][]float64, n)
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rnd.NormFloat64()
+		}
+	}
+	return vecs
+}
+
+func getExactNeighbors(vecs [][]float64, query []float64, k int) []uint64 {
+	neighbors := make([]cm.NeighborsRecord, len(vecs))
+	for i, vec := range vecs {
+		neighbors[i] = cm.NeighborsRecord{SecondaryID: uint64(i + 1), Dist: cm.L2(cm.NewVec(vec), cm.NewVec(query))}
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		return neighbors[i].Dist < neighbors[j].Dist
+	})
+	ids := make([]uint64, k)
+	for i := range ids {
+		ids[i] = neighbors[i].SecondaryID
+	}
+	return ids
+}
+
+func TestSearchRecall(t *testing.T) {
+	vecs := getRandomVecs(500, 8)
+	graph := getTestGraph(t, vecs)
+	var hits, total int
+	for _, query := range getRandomVecs(20, 8) {
+		exact := make(map[uint64]bool)
+		for _, id := range getExactNeighbors(vecs, query, 10) {
+			exact[id] = true
+		}
+		for _, neighbor := range graph.Search(query, 10, 64) {
+			if exact[neighbor.SecondaryID] {
+				hits++
+			}
+		}
+		total += 10
+	}
+	if recall := float64(hits) / float64(total); recall < 0.9 {
+		t.Fatalf("Recall is too low: %v", recall)
+	}
+	neighbors := graph.Search(vecs[0], 3, 1)
+	if len(neighbors) != 3 || neighbors[0].SecondaryID != 1 || neighbors[0].Dist != 0 {
+		t.Fatalf("The nearest neighbor of the indexed point must be the point itself: %v", neighbors)
+	}
+}
+
+func TestDeleteAndReplace(t *testing.T) {
+	vecs := getRandomVecs(100, 4)
+	graph := getTestGraph(t, vecs)
+	if !graph.Delete(1) || graph.Delete(1) {
+		t.Fatal("Only the alive node must be deleted")
+	}
+	for _, neighbor := range graph.Search(vecs[0], 10, 32) {
+		if neighbor.SecondaryID == 1 {
+			t.Fatal("Deleted node must not be returned")
+		}
+	}
+	changed, err := graph.Insert(1, vecs[1])
+	if err != nil || len(changed) == 0 {
+		t.Fatalf("Could not replace the node: %v", err)
+	}
+	neighbors := graph.Search(vecs[1], 2, 32)
+	if len(neighbors) != 2 || neighbors[0].Dist != 0 || neighbors[1].Dist != 0 {
+		t.Fatalf("Replaced node must be alive and have the new vector: %v", neighbors)
+	}
+	_, err = graph.Insert(1000, []float64{1.0})
+	if err == nil {
+		t.Fatal("Vector of the wrong size must be rejected")
+	}
+}
+
+func TestRestoreGraph(t *testing.T) {
+	vecs := getRandomVecs(200, 4)
+	graph := getTestGraph(t, vecs)
+	graph.Delete(5)
+	b, err := graph.Dump()
+	if err != nil {
+		t.Fatalf("Could not serialize graph: %v", err)
+	}
+	restored := hnsw.NewGraph(hnsw.Config{})
+	err = restored.Load(b)
+	if err != nil {
+		t.Fatalf("Could not deserialize graph: %v", err)
+	}
+	if restored.Config != graph.Config {
+		t.Fatal("Deserialized config differs from the initial one")
+	}
+	for _, node := range graph.GetNodes(graph.GetIDs()) {
+		restored.AddNode(node)
+	}
+	if restored.MaxLevel != graph.MaxLevel {
+		t.Fatal("Node with the highest level must become the entry point")
+	}
+	for i := 0; i < 10; i++ {
+		expected := graph.Search(vecs[i], 5, 32)
+		actual := restored.Search(vecs[i], 5, 32)
+		if len(expected) != len(actual) {
+			t.Fatal("Restored graph must give the same results")
+		}
+		for j := range expected {
+			if expected[j] != actual[j] {
+				t.Fatal("Restored graph must give the same results")
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package lsh
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"gonum.org/v1/gonum/blas/blas64"
+	cm "lsh-search-service/common"
+)
+
+// NOTE: number of random pairs of points tried before the node with duplicate points becomes the leaf
+const splitAttempts = 8
+
+func (q forestQueue) Len() int            { return len(q) }
+func (q forestQueue) Less(i, j int) bool  { return q[i].priority > q[j].priority }
+func (q forestQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *forestQueue) Push(x interface{}) { *q = append(*q, x.(forestItem)) }
+func (q *forestQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	it := old[n-1]
+	*q = old[:n-1]
+	return it
+}
+
+// isLeaf checks if the node has no children; the root can't be a child, so zero index means no child
+func (node *TreeNode) isLeaf() bool {
+	return node.Children[0] == 0
+}
+
+// getMargin returns the signed distance from the plane to the point and the side of the plane
+func (node *TreeNode) getMargin(vec blas64.Vector) (float64, int) {
+	margin := blas64.Dot(vec, node.Plane.Coefs) - node.Plane.D
+	if margin > 0 {
+		return margin, 1
+	}
+	return margin, 0
+}
+
+// NewForest returns the empty forest, trees are grown by Build or restored by Load
+func NewForest(config ForestConfig) *Forest {
+	return &Forest{Config: config}
+}
+
+// prepareVec converts the vector to the form used by the trees, vectors are normalized for the angular distance
+func (forest *Forest) prepareVec(vec []float64) blas64.Vector {
+	if forest.Config.IsAngularDistance != 1 {
+		return cm.NewVec(vec)
+	}
+	normalized := cm.NewVec(append([]float64(nil), vec...))
+	if norm := blas64.Nrm2(normalized); norm > 0 {
+		blas64.Scal(1.0/norm, normalized)
+	}
+	return normalized
+}
+
+// Build grows the trees over the sample of vectors: every inner node splits its points by the plane
+// equidistant from two random points, until the node holds at most LeafSize points
+func (forest *Forest) Build(vecs [][]float64) error {
+	if forest.Config.NTrees <= 0 || forest.Config.LeafSize <= 0 {
+		return errors.New("number of trees and leaf size must be positive integers")
+	}
+	if len(vecs) == 0 {
+		return errors.New("forest needs at least one training vector")
+	}
+	dims := len(vecs[0])
+	points := make([]blas64.Vector, len(vecs))
+	for i, vec := range vecs {
+		if len(vec) != dims {
+			return errors.New("training vectors must be of the same size")
+		}
+		points[i] = forest.prepareVec(vec)
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	forest.Config.Dims = dims
+	forest.Trees = make([][]TreeNode, forest.Config.NTrees)
+	forest.HashFieldsNames = make([]string, forest.Config.NTrees)
+	for i := range forest.Trees {
+		idxs := make([]int, len(points))
+		for j := range idxs {
+			idxs[j] = j
+		}
+		forest.Trees[i] = forest.growTree(nil, points, idxs, rnd)
+		forest.HashFieldsNames[i] = strconv.Itoa(i)
+	}
+	return nil
+}
+
+// growTree appends the node holding the specified points and its subtrees to the tree
+func (forest *Forest) growTree(tree []TreeNode, points []blas64.Vector, idxs []int, rnd *rand.Rand) []TreeNode {
+	pos := len(tree)
+	tree = append(tree, TreeNode{})
+	if len(idxs) <= forest.Config.LeafSize {
+		return tree
+	}
+	plane, ok := splitPlane(points, idxs, rnd)
+	if !ok {
+		return tree
+	}
+	var sides [2][]int
+	node := TreeNode{Plane: plane}
+	for _, idx := range idxs {
+		_, side := node.getMargin(points[idx])
+		sides[side] = append(sides[side], idx)
+	}
+	tree[pos].Plane = plane
+	for side := range sides {
+		tree[pos].Children[side] = len(tree)
+		tree = forest.growTree(tree, points, sides[side], rnd)
+	}
+	return tree
+}
+
+// splitPlane returns the plane equidistant from two random distinct points, so each side gets at least one point
+func splitPlane(points []blas64.Vector, idxs []int, rnd *rand.Rand) (Plane, bool) {
+	for attempt := 0; attempt < splitAttempts; attempt++ {
+		a := points[idxs[rnd.Intn(len(idxs))]]
+		b := points[idxs[rnd.Intn(len(idxs))]]
+		coefs := cm.NewVec(make([]float64, a.N))
+		blas64.Copy(a, coefs)
+		blas64.Axpy(-1.0, b, coefs)
+		if blas64.Nrm2(coefs) == 0 {
+			continue
+		}
+		middle := cm.NewVec(make([]float64, a.N))
+		blas64.Copy(a, middle)
+		blas64.Axpy(1.0, b, middle)
+		return Plane{Coefs: coefs, D: blas64.Dot(coefs, middle) / 2}, true
+	}
+	return Plane{}, false
+}
+
+// GetHashes returns the leaf of the vector in each tree
+func (forest *Forest) GetHashes(vec blas64.Vector) map[int]uint64 {
+	point := forest.prepareVec(vec.Data)
+	hashes := make(map[int]uint64, len(forest.Trees))
+	for i, tree := range forest.Trees {
+		node := 0
+		for !tree[node].isLeaf() {
+			_, side := tree[node].getMargin(point)
+			node = tree[node].Children[side]
+		}
+		hashes[i] = uint64(node)
+	}
+	return hashes
+}
+
+// Search visits leaves of all the trees, starting from the ones closest to the vector: the node
+// priority is the smallest margin on the path to it, so the leaves on the far side of the planes
+// which pass close to the vector come right after the leaves of the vector. Search stops when
+// visit returns false or there are no leaves left
+func (forest *Forest) Search(vec blas64.Vector, visit func(table int, hash uint64) bool) {
+	point := forest.prepareVec(vec.Data)
+	queue := make(forestQueue, 0, len(forest.Trees))
+	for i := range forest.Trees {
+		queue = append(queue, forestItem{tree: i, priority: math.Inf(1)})
+	}
+	heap.Init(&queue)
+	for queue.Len() > 0 {
+		it := heap.Pop(&queue).(forestItem)
+		node := &forest.Trees[it.tree][it.node]
+		if node.isLeaf() {
+			if !visit(it.tree, uint64(it.node)) {
+				return
+			}
+			continue
+		}
+		margin, _ := node.getMargin(point)
+		heap.Push(&queue, forestItem{tree: it.tree, node: node.Children[1], priority: math.Min(it.priority, margin)})
+		heap.Push(&queue, forestItem{tree: it.tree, node: node.Children[0], priority: math.Min(it.priority, -margin)})
+	}
+}
+
+// Dump encodes Forest object as a byte-array
+func (forest *Forest) Dump() ([]byte, error) {
+	if len(forest.Trees) == 0 {
+		return nil, errors.New("forest must contain at least one tree")
+	}
+	buf := &bytes.Buffer{}
+	enc := gob.NewEncoder(buf)
+	err := enc.Encode(forest)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Load loads Forest struct from the byte-array
+func (forest *Forest) Load(inp []byte) error {
+	return loadGob(inp, forest)
+}
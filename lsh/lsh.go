@@ -6,6 +6,7 @@ import (
 	"errors"
 	"math"
 	"math/rand"
+	"reflect"
 	"strconv"
 	"sync"
 	"time"
@@ -34,6 +35,21 @@ func (lshInstance *HasherInstance) GetHash(inpVec, meanVec blas64.Vector) uint64
 	return hash
 }
 
+// GetSketch calculates SimHash sketch: sign bits of the projections on the planes through the mean,
+// packed into bytes
+func (lshInstance *HasherInstance) GetSketch(inpVec, meanVec blas64.Vector) []byte {
+	sketch := make([]byte, (len(lshInstance.Planes)+7)/8)
+	shiftedVec := cm.NewVec(make([]float64, inpVec.N))
+	blas64.Copy(inpVec, shiftedVec)
+	blas64.Axpy(-1.0, meanVec, shiftedVec)
+	for i, plane := range lshInstance.Planes {
+		if !math.Signbit(blas64.Dot(shiftedVec, plane.Coefs)) {
+			sketch[i/8] |= 1 << (i % 8)
+		}
+	}
+	return sketch
+}
+
 // NewLSHIndex creates slice of LSHIndexInstances to hold several permutations results
 func NewLSHIndex(config Config) *Hasher {
 	lshIndex := &Hasher{
@@ -97,9 +113,28 @@ func (lshIndex *Hasher) Generate(convMean, convStd blas64.Vector) error {
 		lshIndex.Instances[i] = tmpLSHIndex
 		lshIndex.HashFieldsNames[i] = strconv.Itoa(i)
 	}
+
+	// NOTE: sketch planes go through the mean, so the sketch approximates the angle between vectors
+	lshIndex.Sketch = HasherInstance{}
+	for i := 0; i < lshIndex.Config.SketchBits; i++ {
+		coefs := lshIndex.getRandomPlane()
+		lshIndex.Sketch.Planes = append(lshIndex.Sketch.Planes, Plane{
+			Coefs: cm.NewVec(coefs.Data[:coefs.N-1]),
+		})
+	}
 	return nil
 }
 
+// GetSketch returns the long SimHash sketch of the vector, nil if sketches are disabled
+func (lshIndex *Hasher) GetSketch(vec blas64.Vector) []byte {
+	lshIndex.Lock()
+	defer lshIndex.Unlock()
+	if len(lshIndex.Sketch.Planes) == 0 {
+		return nil
+	}
+	return lshIndex.Sketch.GetSketch(vec, lshIndex.Config.MeanVec)
+}
+
 // GetHashes returns map of calculated lsh values
 func (lshIndex *Hasher) GetHashes(vec blas64.Vector) map[int]uint64 {
 	lshIndex.Lock()
@@ -107,14 +142,14 @@ func (lshIndex *Hasher) GetHashes(vec blas64.Vector) map[int]uint64 {
 
 	hashes := safeHashesHolder{v: make(map[int]uint64)}
 	var wg sync.WaitGroup
-	for i, lshInstance := range lshIndex.Instances {
+	for i := range lshIndex.Instances {
 		wg.Add(1)
 		go func(idx int, lsh *HasherInstance, hashesMap *safeHashesHolder) {
 			hashesMap.Lock()
 			hashesMap.v[idx] = lsh.GetHash(vec, lshIndex.Config.MeanVec)
 			hashesMap.Unlock()
 			wg.Done()
-		}(i, &lshInstance, &hashes)
+		}(i, &lshIndex.Instances[i], &hashes)
 	}
 	wg.Wait()
 	return hashes.v
@@ -153,6 +188,7 @@ func (lshIndex *Hasher) Dump() ([]byte, error) {
 		Instances:       &lshIndex.Instances,
 		HashFieldsNames: &lshIndex.HashFieldsNames,
 		Config:          &lshIndex.Config,
+		Sketch:          &lshIndex.Sketch,
 	}
 	err := enc.Encode(encodable)
 	if err != nil {
@@ -166,12 +202,22 @@ func (lshIndex *Hasher) Load(inp []byte) error {
 	lshIndex.Lock()
 	defer lshIndex.Unlock()
 
-	buf := &bytes.Buffer{}
-	buf.Write(inp)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&lshIndex)
+	loaded := &Hasher{}
+	err := loadGob(inp, loaded)
 	if err != nil {
 		return err
 	}
+	lshIndex.Config = loaded.Config
+	lshIndex.Instances = loaded.Instances
+	lshIndex.HashFieldsNames = loaded.HashFieldsNames
+	lshIndex.Sketch = loaded.Sketch
 	return nil
 }
+
+// loadGob resets the target to its zero value and decodes the serialized object into it:
+// gob skips zero values, so the fields of the previously loaded object would survive otherwise
+func loadGob(inp []byte, target interface{}) error {
+	value := reflect.ValueOf(target).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	return gob.NewDecoder(bytes.NewReader(inp)).Decode(target)
+}
@@ -25,6 +25,7 @@ type Config struct {
 	BiasMultiplier    float64
 	DistanceThrsh     float64
 	Dims              int
+	SketchBits        int
 	Bias              float64
 	MeanVec           blas64.Vector
 }
@@ -35,6 +36,7 @@ type Hasher struct {
 	Config          Config
 	Instances       []HasherInstance
 	HashFieldsNames []string
+	Sketch          HasherInstance
 }
 
 // HasherEncode using for encoding/decoding the Hasher structure
@@ -42,6 +44,7 @@ type HasherEncode struct {
 	Instances       *[]HasherInstance
 	HashFieldsNames *[]string
 	Config          *Config
+	Sketch          *HasherInstance
 }
 
 // SafeHashesHolder allows to lock map while write values in it
@@ -49,3 +52,35 @@ type safeHashesHolder struct {
 	sync.Mutex
 	v map[int]uint64
 }
+
+// ForestConfig holds the parameters of the random projection trees forest
+type ForestConfig struct {
+	IsAngularDistance int
+	NTrees            int
+	LeafSize          int
+	Dims              int
+}
+
+// TreeNode is the single node of the random projection tree: the inner node splits its points
+// by the plane, the leaf has no children
+type TreeNode struct {
+	Plane    Plane
+	Children [2]int
+}
+
+// Forest holds random projection trees, each tree is the hash table and its leaves are the hashes
+type Forest struct {
+	Config          ForestConfig
+	Trees           [][]TreeNode
+	HashFieldsNames []string
+}
+
+// forestItem is the tree node queued by the search with the smallest margin on the path to it
+type forestItem struct {
+	tree     int
+	node     int
+	priority float64
+}
+
+// forestQueue pops the node with the largest priority first
+type forestQueue []forestItem
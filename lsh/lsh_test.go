@@ -198,3 +198,123 @@ func TestDumpHasher(t *testing.T) {
 		t.Fatal("Seems like the deserialized hasher differs from the initial one")
 	}
 }
+
+func TestGetSketch(t *testing.T) {
+	config := hashing.Config{
+		IsAngularDistance: 1,
+		NPermutes:         2,
+		NPlanes:           1,
+		BiasMultiplier:    2.0,
+		DistanceThrsh:     0.8,
+		Dims:              3,
+		SketchBits:        20,
+	}
+	hasher, err := getNewHasher(config)
+	if err != nil {
+		t.Fatalf("Smth went wrong with planes generation: %v", err)
+	}
+	v1 := cm.NewVec([]float64{0.0, 1.0, 0.0})
+	v2 := cm.NewVec([]float64{0.0, -1.0, 0.0})
+	sketch := hasher.GetSketch(v1)
+	if len(sketch) != 3 {
+		t.Fatal("Sketch bits must be packed into bytes")
+	}
+	if cm.HammingDistance(sketch, hasher.GetSketch(cm.NewVec([]float64{0.0, 2.0, 0.0}))) != 0 {
+		t.Fatal("Sketches of the collinear vectors must be equal")
+	}
+	if cm.HammingDistance(sketch, hasher.GetSketch(v2)) != config.SketchBits {
+		t.Fatal("Sketches of the opposite vectors must differ in every bit")
+	}
+
+	b, err := hasher.Dump()
+	if err != nil {
+		t.Fatalf("Could not serialize hasher: %v", err)
+	}
+	loaded := hashing.NewLSHIndex(hashing.Config{})
+	err = loaded.Load(b)
+	if err != nil {
+		t.Fatalf("Could not deserialize hasher: %v", err)
+	}
+	if cm.HammingDistance(sketch, loaded.GetSketch(v1)) != 0 {
+		t.Fatal("Deserialized hasher must produce the same sketches")
+	}
+
+	config.SketchBits = 0
+	hasher, _ = getNewHasher(config)
+	if hasher.GetSketch(v1) != nil {
+		t.Fatal("Sketch must be empty when disabled")
+	}
+}
+
+func TestForest(t *testing.T) {
+	vecs := make([][]float64, 100)
+	for i := range vecs {
+		vecs[i] = []float64{math.Sin(float64(i)), math.Cos(float64(i * 7)), float64(i%10) / 10}
+	}
+	forest := hashing.NewForest(hashing.ForestConfig{NTrees: 3, LeafSize: 5})
+	err := forest.Build(vecs)
+	if err != nil {
+		t.Fatalf("Could not build forest: %v", err)
+	}
+	if forest.Config.Dims != 3 || len(forest.Trees) != 3 || len(forest.HashFieldsNames) != 3 {
+		t.Fatal("Forest must hold the requested number of trees")
+	}
+	leafSizes := make(map[[2]uint64]int)
+	for _, vec := range vecs {
+		for table, hash := range forest.GetHashes(cm.NewVec(vec)) {
+			leafSizes[[2]uint64{uint64(table), hash}]++
+		}
+	}
+	for leaf, size := range leafSizes {
+		if size > 5 {
+			t.Fatalf("Leaf %v holds more than leaf size points: %v", leaf, size)
+		}
+	}
+
+	query := cm.NewVec(vecs[0])
+	hashes := forest.GetHashes(query)
+	visited := 0
+	forest.Search(query, func(table int, hash uint64) bool {
+		if visited < len(forest.Trees) && hashes[table] != hash {
+			t.Fatal("Leaves of the query must be visited first")
+		}
+		visited++
+		return true
+	})
+	if visited < len(leafSizes) {
+		t.Fatal("Search must visit all the leaves")
+	}
+	visited = 0
+	forest.Search(query, func(table int, hash uint64) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Fatal("Search must stop when visit returns false")
+	}
+
+	b, err := forest.Dump()
+	if err != nil {
+		t.Fatalf("Could not serialize forest: %v", err)
+	}
+	restored := hashing.NewForest(hashing.ForestConfig{})
+	err = restored.Load(b)
+	if err != nil {
+		t.Fatalf("Could not deserialize forest: %v", err)
+	}
+	if restored.Config != forest.Config {
+		t.Fatal("Deserialized config differs from the initial one")
+	}
+	for _, vec := range vecs {
+		expected, actual := forest.GetHashes(cm.NewVec(vec)), restored.GetHashes(cm.NewVec(vec))
+		for table := range expected {
+			if expected[table] != actual[table] {
+				t.Fatal("Restored forest must give the same hashes")
+			}
+		}
+	}
+	_, err = hashing.NewForest(hashing.ForestConfig{NTrees: 1, LeafSize: 1}).Dump()
+	if err == nil {
+		t.Fatal("Empty forest must not be serialized")
+	}
+}
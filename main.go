@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"lsh-search-service/app"
 	cm "lsh-search-service/common"
 	"net/http"
+	"time"
 )
 
 func main() {
@@ -16,16 +18,32 @@ func main() {
 	if err != nil {
 		logger.Err.Fatal(err.Error())
 	}
-	defer annServer.Mongo.Disconnect()
+	defer annServer.Store.Disconnect()
+	if config.App.HelperPollInterval > 0 {
+		go annServer.WatchBuildState(context.Background(), time.Duration(config.App.HelperPollInterval)*time.Second)
+	}
+	if config.App.BuildLeaseTTL > 0 {
+		go annServer.MonitorBuildLease(time.Duration(config.App.BuildLeaseTTL) * time.Second)
+	}
+	if config.App.AutoRebuild == 1 {
+		go annServer.MonitorDrift(time.Duration(config.App.DriftCheckInterval) * time.Second)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", app.HealthCheck)
 	mux.HandleFunc("/build-index", annServer.BuildHasherHandler)
 	mux.HandleFunc("/check-build", annServer.CheckBuildHandler)
+	mux.HandleFunc("/cancel-build", annServer.CancelBuildHandler)
+	mux.HandleFunc("/compute-stats", annServer.ComputeStatsHandler)
+	mux.HandleFunc("/check-drift", annServer.CheckDriftHandler)
+	mux.HandleFunc("/buckets-stats", annServer.BucketsStatsHandler)
 	mux.HandleFunc("/get-nn", annServer.GetNeighborsHandler)
+	mux.HandleFunc("/get-range", annServer.GetRangeHandler)
 	mux.HandleFunc("/get-index-size", annServer.GetHashCollSizeHandler)
 	mux.HandleFunc("/pop-hash", annServer.PopHashRecordHandler)
 	mux.HandleFunc("/put-hash", annServer.PutHashRecordHandler)
+	mux.HandleFunc("/metrics", annServer.MetricsHandler)
+	mux.HandleFunc("/shards-health", annServer.ShardsHealthHandler)
 	http.Handle("/", cm.Decorate(mux, cm.Timer(logger)))
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		logger.Err.Fatalf("Error running the server: %v", err)
@@ -0,0 +1,629 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+)
+
+func getHelloMessage() []byte {
+	helloMessage := cm.ResponseData{
+		Message: `{
+		"methods": {
+			"GET/POST": {
+				"/build-index": "starts building the index on every shard",
+				"/check-build": "returns the build status and progress merged over the shards",
+				"/cancel-build": "stops the running build on every shard",
+				"/pop-hash": "removes the point from the shard owning it",
+				"/put-hash": "adds the points to the shards owning them",
+				"/get-index-size": "returns the total size of the index over the shards",
+				"/shards-health": "returns health and size of every replica of every shard",
+				"/check-drift": "returns the drift reports of the shards",
+				"/buckets-stats": "returns the buckets stats of the shards",
+				"/metrics": "returns the metrics of every replica of every shard"
+			},
+			"POST": {
+				"/get-nn": "returns db ids of the nearest data points of all the shards, merged by distance",
+				"/get-range": "returns the page of the data points within the radius of all the shards, merged by distance"
+			}
+	    },
+		"params": {
+			"index": "name of the index of the cluster, the default one is used if not set"
+		}
+	}`}
+	// NOTE: ugly, but it's more convinient to update the text message by hand and then serialize to json
+	out, err := json.Marshal(helloMessage)
+	if err != nil {
+		return []byte("")
+	}
+	return out
+}
+
+// ReadConfig reads the topology of the cluster from the JSON file
+func ReadConfig(path string) (Config, error) {
+	config := Config{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// New checks the topology and returns the router over it; the only index is the default one
+// unless another one is set
+func New(logger *cm.Logger, config Config) (*Router, error) {
+	if len(config.Indexes) == 0 {
+		return nil, errors.New("Router: no indexes are configured")
+	}
+	if len(config.DefaultIndex) == 0 && len(config.Indexes) == 1 {
+		for name := range config.Indexes {
+			config.DefaultIndex = name
+		}
+	}
+	if _, ok := config.Indexes[config.DefaultIndex]; len(config.DefaultIndex) != 0 && !ok {
+		return nil, fmt.Errorf("Router: default index %s is not configured", config.DefaultIndex)
+	}
+	if config.RangePageSize <= 0 {
+		config.RangePageSize = defaultRangePageSize
+	}
+	router := &Router{
+		Config:  config,
+		Logger:  logger,
+		Client:  http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond},
+		indexes: make(map[string]*routedIndex),
+	}
+	for name, indexConfig := range config.Indexes {
+		if len(indexConfig.Shards) == 0 {
+			return nil, fmt.Errorf("Router: index %s has no shards", name)
+		}
+		index := &routedIndex{name: name}
+		names := make([]string, len(indexConfig.Shards))
+		for i, shardConfig := range indexConfig.Shards {
+			names[i] = shardConfig.Name
+			if len(names[i]) == 0 {
+				names[i] = "shard" + strconv.Itoa(i)
+			}
+			for _, prev := range names[:i] {
+				if prev == names[i] {
+					return nil, fmt.Errorf("Router: index %s has duplicate shard %s", name, prev)
+				}
+			}
+			if len(shardConfig.Replicas) == 0 {
+				return nil, fmt.Errorf("Router: shard %s of index %s has no replicas", names[i], name)
+			}
+			replicas := make([]string, len(shardConfig.Replicas))
+			for j, replica := range shardConfig.Replicas {
+				replicas[j] = strings.TrimRight(replica, "/")
+			}
+			index.shards = append(index.shards, &routedShard{name: names[i], replicas: replicas})
+		}
+		// NOTE: the ring is built the same way as the one of the sharded store, so the shard is kept by its name
+		index.ring = db.NewHashRing(names, db.ShardRingPoints)
+		router.indexes[name] = index
+	}
+	return router, nil
+}
+
+// getIndex returns the index selected by the `index` query parameter, or the default one
+func (router *Router) getIndex(r *http.Request) (*routedIndex, error) {
+	name := r.URL.Query().Get("index")
+	if len(name) == 0 {
+		name = router.Config.DefaultIndex
+	}
+	index, ok := router.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown index %q", name)
+	}
+	return index, nil
+}
+
+// getIndexes returns the index selected by the `index` query parameter, or all of them sorted by name
+func (router *Router) getIndexes(r *http.Request) ([]*routedIndex, error) {
+	if len(r.URL.Query().Get("index")) != 0 {
+		index, err := router.getIndex(r)
+		if err != nil {
+			return nil, err
+		}
+		return []*routedIndex{index}, nil
+	}
+	indexes := make([]*routedIndex, 0, len(router.indexes))
+	for _, index := range router.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].name < indexes[j].name })
+	return indexes, nil
+}
+
+func (err *shardError) Error() string {
+	return fmt.Sprintf("shard %s: %s", err.shard, err.err.Error())
+}
+
+// isRetryable checks if the request failed with the status may succeed on another replica:
+// the query timeout is the same for all of them, so it isn't retried
+func isRetryable(status int) bool {
+	return status == 0 || status == http.StatusInternalServerError ||
+		status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// getErrorStatus returns the status of the router response to the failed shard request:
+// client errors and the query timeout are passed through, other failures are reported as the bad gateway
+func getErrorStatus(err error) int {
+	var failed *shardError
+	if !errors.As(err, &failed) {
+		return http.StatusBadGateway
+	}
+	if failed.status == http.StatusGatewayTimeout || (failed.status >= 400 && failed.status < 500) {
+		return failed.status
+	}
+	return http.StatusBadGateway
+}
+
+// openReplica sends the request to the single replica, returns the response with the body unread
+func (router *Router) openReplica(ctx context.Context, replica, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, replica+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-type", "application/json")
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	return router.Client.Do(request)
+}
+
+// requestReplica sends the request to the single replica, returns the status and the body of the response
+func (router *Router) requestReplica(ctx context.Context, replica, method, path string, header http.Header, body []byte) (int, []byte, error) {
+	resp, err := router.openReplica(ctx, replica, method, path, header, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// request sends the request to the replicas of the shard in turn, starting with the next one,
+// so the requests are spread between them; the failed request is retried with the following replica
+// up to Retries times. Returns the body of the successful response or the shardError
+func (router *Router) request(ctx context.Context, shard *routedShard, method, path string, header http.Header, body []byte) ([]byte, error) {
+	start := int(atomic.AddUint32(&shard.next, 1) - 1)
+	failed := &shardError{shard: shard.name}
+	for attempt := 0; attempt <= router.Config.Retries; attempt++ {
+		replica := shard.replicas[(start+attempt)%len(shard.replicas)]
+		status, data, err := router.requestReplica(ctx, replica, method, path, header, body)
+		if err == nil && (status == http.StatusOK || status == http.StatusAccepted) {
+			return data, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s has responded with status %d", replica, status)
+		}
+		failed.status, failed.err = status, err
+		if ctx.Err() != nil || !isRetryable(status) {
+			break
+		}
+		router.Logger.Warn.Printf("Router: shard %s: %s", shard.name, err.Error())
+	}
+	return nil, failed
+}
+
+// openStream sends the request to the replicas of the shard the same way as request does, but returns
+// the body of the successful response unread, so it's read while the replica streams it
+func (router *Router) openStream(ctx context.Context, shard *routedShard, method, path string, header http.Header, body []byte) (io.ReadCloser, error) {
+	start := int(atomic.AddUint32(&shard.next, 1) - 1)
+	failed := &shardError{shard: shard.name}
+	for attempt := 0; attempt <= router.Config.Retries; attempt++ {
+		replica := shard.replicas[(start+attempt)%len(shard.replicas)]
+		status := 0
+		resp, err := router.openReplica(ctx, replica, method, path, header, body)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			status = resp.StatusCode
+			err = fmt.Errorf("%s has responded with status %d", replica, status)
+		}
+		failed.status, failed.err = status, err
+		if ctx.Err() != nil || !isRetryable(status) {
+			break
+		}
+		router.Logger.Warn.Printf("Router: shard %s: %s", shard.name, err.Error())
+	}
+	return nil, failed
+}
+
+// fanOut runs fn for all the shards of the index concurrently, returns the errors of the shards
+func (index *routedIndex) fanOut(fn func(shard int) error) []error {
+	errs := make([]error, len(index.shards))
+	var wg sync.WaitGroup
+	for shard := range index.shards {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			errs[shard] = fn(shard)
+		}(shard)
+	}
+	wg.Wait()
+	return errs
+}
+
+// getFirstError returns the first error of the shards
+func getFirstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isStreamRequested checks if the client accepts the NDJSON stream
+func isStreamRequested(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), cm.ContentTypeNDJSON)
+}
+
+// decodeStream reads the NDJSON stream of the shard and passes every record to fn, up to the trailer
+func decodeStream(stream io.Reader, fn func(record cm.StreamRecord) error) error {
+	dec := json.NewDecoder(stream)
+	for {
+		var record cm.StreamRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			// NOTE: the stream always ends with the trailer
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if len(record.Error) != 0 {
+			return errors.New(record.Error)
+		}
+		err = fn(record)
+		if err != nil || record.Neighbor == nil {
+			return err
+		}
+	}
+}
+
+// decodeNeighbors reads the neighbors streamed by the shard, followed by the trailer
+func decodeNeighbors(data []byte) (shardNeighbors, error) {
+	result := shardNeighbors{}
+	err := decodeStream(bytes.NewReader(data), func(record cm.StreamRecord) error {
+		if record.Neighbor == nil {
+			result.trailer = record
+		} else {
+			result.neighbors = append(result.neighbors, *record.Neighbor)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// getNeighbors queries all the shards of the index and merges their neighbors by distance, keeping MaxNN
+// of them; the neighbors are partial if some shards have failed. Returns the error if all of them have failed,
+// or the request is rejected by any of them
+func (router *Router) getNeighbors(ctx context.Context, index *routedIndex, body []byte) (*shardNeighbors, error) {
+	// NOTE: shards stream the neighbors along with their distances, so they can be merged
+	header := http.Header{"Accept": []string{cm.ContentTypeNDJSON}}
+	results := make([]shardNeighbors, len(index.shards))
+	errs := index.fanOut(func(shard int) error {
+		data, err := router.request(ctx, index.shards[shard], "POST", "/get-nn", header, body)
+		if err != nil {
+			return err
+		}
+		results[shard], err = decodeNeighbors(data)
+		if err != nil {
+			return &shardError{shard: index.shards[shard].name, err: err}
+		}
+		return nil
+	})
+	merged := &shardNeighbors{}
+	failed := 0
+	seen := make(map[uint64]bool)
+	for shard, err := range errs {
+		if err != nil {
+			if status := getErrorStatus(err); status >= 400 && status < 500 {
+				return nil, err
+			}
+			router.Logger.Warn.Println("Get NN: " + err.Error())
+			failed++
+			continue
+		}
+		result := results[shard]
+		for _, neighbor := range result.neighbors {
+			if !seen[neighbor.SecondaryID] {
+				seen[neighbor.SecondaryID] = true
+				merged.neighbors = append(merged.neighbors, neighbor)
+			}
+		}
+		if len(merged.trailer.Strategy) == 0 {
+			merged.trailer.Strategy = result.trailer.Strategy
+		}
+		if result.trailer.Partial && !merged.trailer.Partial {
+			merged.trailer.Partial, merged.trailer.StopReason = true, result.trailer.StopReason
+		}
+	}
+	if failed == len(index.shards) {
+		return nil, getFirstError(errs)
+	}
+	if failed > 0 {
+		merged.trailer.Partial, merged.trailer.StopReason = true, cm.StopReasonShardUnavailable
+	}
+	sort.SliceStable(merged.neighbors, func(i, j int) bool { return merged.neighbors[i].Dist < merged.neighbors[j].Dist })
+	if router.Config.MaxNN > 0 && len(merged.neighbors) > router.Config.MaxNN {
+		merged.neighbors = merged.neighbors[:router.Config.MaxNN]
+	}
+	return merged, nil
+}
+
+// streamNeighbors writes the merged neighbors as the NDJSON stream, followed by the trailer
+func (router *Router) streamNeighbors(w http.ResponseWriter, result *shardNeighbors) {
+	w.Header().Set("Content-Type", cm.ContentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for i := range result.neighbors {
+		if err := enc.Encode(cm.StreamRecord{Neighbor: &result.neighbors[i]}); err != nil {
+			router.Logger.Err.Println("Get NN: streaming: " + err.Error())
+			return
+		}
+	}
+	enc.Encode(result.trailer)
+}
+
+// groupByShard splits the points by the shards owning them
+func (index *routedIndex) groupByShard(records []cm.RequestData) [][]cm.RequestData {
+	groups := make([][]cm.RequestData, len(index.shards))
+	for _, record := range records {
+		shard := index.ring.GetShard(record.SecondaryID)
+		groups[shard] = append(groups[shard], record)
+	}
+	return groups
+}
+
+// getIndexSize returns the total size of the index over the shards
+func (router *Router) getIndexSize(ctx context.Context, index *routedIndex) (int64, error) {
+	sizes := make([]int64, len(index.shards))
+	errs := index.fanOut(func(shard int) error {
+		data, err := router.request(ctx, index.shards[shard], "GET", "/get-index-size", nil, nil)
+		if err != nil {
+			return err
+		}
+		resp := struct {
+			Results int64 `json:"neighbors"`
+		}{}
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			return &shardError{shard: index.shards[shard].name, err: err}
+		}
+		sizes[shard] = resp.Results
+		return nil
+	})
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total, getFirstError(errs)
+}
+
+// getBuildStatusRank orders the build statuses of the shards: the failed build of any shard
+// fails the whole index, the running one keeps it in progress, and it's done once all the shards are done
+func getBuildStatusRank(status int) int {
+	switch status {
+	case cm.BuildStatusError:
+		return 3
+	case cm.BuildStatusInProgress:
+		return 2
+	case cm.BuildStatusUnknown:
+		return 1
+	}
+	return 0
+}
+
+// checkBuild merges the build statuses of the shards; the progress is summed over them
+func (router *Router) checkBuild(ctx context.Context, index *routedIndex) cm.ResponseData {
+	statuses := make([]shardBuildStatus, len(index.shards))
+	errs := index.fanOut(func(shard int) error {
+		data, err := router.request(ctx, index.shards[shard], "GET", "/check-build", nil, nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &statuses[shard])
+		if err != nil {
+			return &shardError{shard: index.shards[shard].name, err: err}
+		}
+		return nil
+	})
+	status := cm.BuildStatusDone
+	progress := cm.BuildProgress{}
+	var messages []string
+	for shard, err := range errs {
+		shardStatus := statuses[shard]
+		if err != nil {
+			shardStatus = shardBuildStatus{Results: cm.BuildStatusError, Message: err.Error()}
+		}
+		if getBuildStatusRank(shardStatus.Results) > getBuildStatusRank(status) {
+			status = shardStatus.Results
+		}
+		if len(shardStatus.Message) != 0 {
+			messages = append(messages, index.shards[shard].name+": "+shardStatus.Message)
+		}
+		if shardStatus.Progress == nil {
+			continue
+		}
+		if len(progress.Phase) == 0 || shardStatus.Results == cm.BuildStatusInProgress {
+			progress.Phase = shardStatus.Progress.Phase
+		}
+		progress.Processed += shardStatus.Progress.Processed
+		progress.Total += shardStatus.Progress.Total
+		progress.Throughput += shardStatus.Progress.Throughput
+		if shardStatus.Progress.ETA > progress.ETA {
+			progress.ETA = shardStatus.Progress.ETA
+		}
+		if shardStatus.Progress.Elapsed > progress.Elapsed {
+			progress.Elapsed = shardStatus.Progress.Elapsed
+		}
+	}
+	return cm.ResponseData{
+		Results:  status,
+		Message:  strings.Join(messages, "; "),
+		Progress: &progress,
+	}
+}
+
+// cancelBuild asks every replica of every shard to stop the build, since it runs only on one of them;
+// the replica which isn't the owner passes the request through the build lease. Returns false if no build has been found
+func (router *Router) cancelBuild(ctx context.Context, index *routedIndex) bool {
+	var cancelled int32
+	index.fanOut(func(shard int) error {
+		var wg sync.WaitGroup
+		for _, replica := range index.shards[shard].replicas {
+			wg.Add(1)
+			go func(replica string) {
+				defer wg.Done()
+				status, _, err := router.requestReplica(ctx, replica, "POST", "/cancel-build", nil, nil)
+				if err == nil && (status == http.StatusOK || status == http.StatusAccepted) {
+					atomic.StoreInt32(&cancelled, 1)
+				}
+			}(replica)
+		}
+		wg.Wait()
+		return nil
+	})
+	return atomic.LoadInt32(&cancelled) == 1
+}
+
+// getShardsHealth checks every replica of every shard of the indexes: the replica is healthy
+// if all the shards of its storage are; the size is the size of the index kept by the replica
+func (router *Router) getShardsHealth(ctx context.Context, indexes []*routedIndex) []cm.ShardHealth {
+	var health []cm.ShardHealth
+	var replicas []string
+	for _, index := range indexes {
+		for _, shard := range index.shards {
+			for _, replica := range shard.replicas {
+				health = append(health, cm.ShardHealth{Shard: index.name + "/" + shard.name + "@" + replica})
+				replicas = append(replicas, replica)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range health {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, data, err := router.requestReplica(ctx, replicas[i], "GET", "/shards-health", nil, nil)
+			resp := struct {
+				Results []cm.ShardHealth `json:"neighbors"`
+			}{}
+			if err == nil {
+				err = json.Unmarshal(data, &resp)
+			}
+			if err != nil {
+				health[i].Error = err.Error()
+				return
+			}
+			health[i].Healthy = status == http.StatusOK
+			for _, storeShard := range resp.Results {
+				health[i].Size += storeShard.Size
+				if !storeShard.Healthy {
+					health[i].Error = storeShard.Shard + ": " + storeShard.Error
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return health
+}
+
+// decodeResults returns the raw results of the server response
+func decodeResults(data []byte) (json.RawMessage, error) {
+	resp := struct {
+		Results json.RawMessage `json:"neighbors"`
+	}{}
+	err := json.Unmarshal(data, &resp)
+	return resp.Results, err
+}
+
+// getShardReports sends the request to every shard of the index, returns their results keyed by the shard name
+func (router *Router) getShardReports(ctx context.Context, index *routedIndex, path string) (map[string]json.RawMessage, error) {
+	reports := make([]json.RawMessage, len(index.shards))
+	errs := index.fanOut(func(shard int) error {
+		data, err := router.request(ctx, index.shards[shard], "GET", path, nil, nil)
+		if err != nil {
+			return err
+		}
+		reports[shard], err = decodeResults(data)
+		if err != nil {
+			return &shardError{shard: index.shards[shard].name, err: err}
+		}
+		return nil
+	})
+	if err := getFirstError(errs); err != nil {
+		return nil, err
+	}
+	results := make(map[string]json.RawMessage, len(index.shards))
+	for shard, report := range reports {
+		results[index.shards[shard].name] = report
+	}
+	return results, nil
+}
+
+// getReplicasMetrics requests the metrics of every replica of every shard of the indexes,
+// keyed the same way as the shards health
+func (router *Router) getReplicasMetrics(ctx context.Context, indexes []*routedIndex) (map[string]json.RawMessage, error) {
+	var names, replicas []string
+	for _, index := range indexes {
+		for _, shard := range index.shards {
+			for _, replica := range shard.replicas {
+				names = append(names, index.name+"/"+shard.name+"@"+replica)
+				replicas = append(replicas, replica)
+			}
+		}
+	}
+	metrics := make([]json.RawMessage, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i := range replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, data, err := router.requestReplica(ctx, replicas[i], "GET", "/metrics", nil, nil)
+			if err == nil && status != http.StatusOK {
+				err = fmt.Errorf("%s has responded with status %d", replicas[i], status)
+			}
+			if err == nil {
+				metrics[i], err = decodeResults(data)
+			}
+			if err != nil {
+				errs[i] = &shardError{shard: names[i], status: status, err: err}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := getFirstError(errs); err != nil {
+		return nil, err
+	}
+	results := make(map[string]json.RawMessage, len(replicas))
+	for i, name := range names {
+		results[name] = metrics[i]
+	}
+	return results, nil
+}
@@ -0,0 +1,211 @@
+package router
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	cm "lsh-search-service/common"
+)
+
+// NOTE: the same as the default RANGE_PAGE_SIZE of the servers
+const defaultRangePageSize = 1000
+
+// encodeRangeToken serializes the positions of the range search on the shards, keyed by the shard name
+func encodeRangeToken(states map[string]rangeShardState) (string, error) {
+	b, err := json.Marshal(states)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeRangeToken restores the positions of the range search on the shards
+func decodeRangeToken(token string) (map[string]rangeShardState, error) {
+	states := make(map[string]rangeShardState)
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &states)
+	return states, err
+}
+
+// getRange returns the page of the neighbors within the radius merged over the shards by the distance, with
+// the token of the next page if there are more neighbors. Every shard is asked for the page of the same size
+// after its position, which is the token of its page and the number of its neighbors already returned;
+// only the nearest neighbors of all the pages make the router page, so the rest are asked again for the next one.
+// NOTE: the page must hold all the nearest neighbors, so it fails if any shard fails
+func (router *Router) getRange(ctx context.Context, index *routedIndex, input cm.RequestData, states map[string]rangeShardState) (*cm.ResponseData, error) {
+	pageSize := input.PageSize
+	if pageSize <= 0 {
+		pageSize = router.Config.RangePageSize
+	}
+	pages := make([]shardRangePage, len(index.shards))
+	errs := index.fanOut(func(shard int) error {
+		state := states[index.shards[shard].name]
+		if state.Done {
+			return nil
+		}
+		request := input
+		request.Token, request.PageSize = state.Token, state.Skip+pageSize
+		body, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		data, err := router.request(ctx, index.shards[shard], "POST", "/get-range", nil, body)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &pages[shard])
+		if err != nil {
+			return &shardError{shard: index.shards[shard].name, err: err}
+		}
+		if len(pages[shard].Results) < state.Skip {
+			state.Skip = len(pages[shard].Results)
+		}
+		pages[shard].Results = pages[shard].Results[state.Skip:]
+		return nil
+	})
+	if err := getFirstError(errs); err != nil {
+		return nil, err
+	}
+
+	type shardNeighbor struct {
+		neighbor cm.NeighborsRecord
+		shard    int
+	}
+	result := &cm.ResponseData{}
+	var merged []shardNeighbor
+	for shard, page := range pages {
+		for _, neighbor := range page.Results {
+			merged = append(merged, shardNeighbor{neighbor: neighbor, shard: shard})
+		}
+		if len(result.Strategy) == 0 {
+			result.Strategy = page.Strategy
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].neighbor.Dist != merged[j].neighbor.Dist {
+			return merged[i].neighbor.Dist < merged[j].neighbor.Dist
+		}
+		return merged[i].neighbor.SecondaryID < merged[j].neighbor.SecondaryID
+	})
+	if len(merged) > pageSize {
+		merged = merged[:pageSize]
+	}
+	neighbors := make([]cm.NeighborsRecord, len(merged))
+	taken := make([]int, len(index.shards))
+	for i, item := range merged {
+		neighbors[i] = item.neighbor
+		taken[item.shard]++
+	}
+	result.Results = neighbors
+
+	next := make(map[string]rangeShardState, len(index.shards))
+	hasMore := false
+	for shard, page := range pages {
+		name := index.shards[shard].name
+		state := states[name]
+		switch {
+		case state.Done:
+		case taken[shard] < len(page.Results):
+			state.Skip += taken[shard]
+		case len(page.Token) != 0:
+			state = rangeShardState{Token: page.Token}
+		default:
+			state = rangeShardState{Done: true}
+		}
+		next[name] = state
+		hasMore = hasMore || !state.Done
+	}
+	if !hasMore {
+		return result, nil
+	}
+	token, err := encodeRangeToken(next)
+	if err != nil {
+		return nil, err
+	}
+	result.Token = token
+	return result, nil
+}
+
+// streamRange streams the neighbors within the radius of all the shards as soon as they are streamed
+// by the shards, so they aren't sorted, followed by the trailer; the response status is sent with the first line,
+// so the failure of the shard which happens later is sent as the last line. The range stream isn't partial,
+// so the first failed shard stops the others
+func (router *Router) streamRange(ctx context.Context, w http.ResponseWriter, index *routedIndex, body []byte) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	header := http.Header{"Accept": []string{cm.ContentTypeNDJSON}}
+	var mutex sync.Mutex
+	var enc *json.Encoder
+	flusher, _ := w.(http.Flusher)
+	write := func(record cm.StreamRecord) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if enc == nil {
+			w.Header().Set("Content-Type", cm.ContentTypeNDJSON)
+			w.WriteHeader(http.StatusOK)
+			enc = json.NewEncoder(w)
+		}
+		err := enc.Encode(record)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	// NOTE: the failed shard cancels the others, so their cancelled requests don't hide its error
+	var failed error
+	fail := func(err error) error {
+		mutex.Lock()
+		if failed == nil {
+			failed = err
+		}
+		mutex.Unlock()
+		cancel()
+		return err
+	}
+	strategies := make([]string, len(index.shards))
+	index.fanOut(func(shard int) error {
+		stream, err := router.openStream(ctx, index.shards[shard], "POST", "/get-range", header, body)
+		if err != nil {
+			return fail(err)
+		}
+		defer stream.Close()
+		err = decodeStream(stream, func(record cm.StreamRecord) error {
+			if record.Neighbor == nil {
+				strategies[shard] = record.Strategy
+				return nil
+			}
+			return write(record)
+		})
+		if err != nil {
+			return fail(&shardError{shard: index.shards[shard].name, err: err})
+		}
+		return nil
+	})
+	mutex.Lock()
+	err, isStarted := failed, enc != nil
+	mutex.Unlock()
+	if err != nil {
+		router.Logger.Err.Println("Get range: " + err.Error())
+		if !isStarted {
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		write(cm.StreamRecord{Error: err.Error()})
+		return
+	}
+	trailer := cm.StreamRecord{}
+	for _, strategy := range strategies {
+		if len(trailer.Strategy) == 0 {
+			trailer.Strategy = strategy
+		}
+	}
+	write(trailer)
+}
@@ -0,0 +1,435 @@
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	cm "lsh-search-service/common"
+)
+
+var (
+	helloMessage = getHelloMessage()
+)
+
+// HealthCheck just checks that router is up and running;
+// also gives back list of available methods
+func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(helloMessage)
+}
+
+// BuildIndexHandler starts the build on every shard of the index with the same input
+// curl -v -X POST -H "Content-Type: application/json" -d '{"mean":[...],"std":[...]}' http://localhost:8090/build-index?index=main
+func (router *Router) BuildIndexHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println("Build index: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			router.Logger.Err.Println("Build index: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input cm.DatasetStats
+		err = json.Unmarshal(body, &input)
+		if err != nil {
+			router.Logger.Err.Println("Build index: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		errs := index.fanOut(func(shard int) error {
+			_, err := router.request(r.Context(), index.shards[shard], "POST", "/build-index", nil, body)
+			return err
+		})
+		if err := getFirstError(errs); err != nil {
+			router.Logger.Err.Println("Build index: " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// CheckBuildHandler returns the build status of the index merged over the shards
+func (router *Router) CheckBuildHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	index, err := router.getIndex(r)
+	if err != nil {
+		router.Logger.Err.Println("Checking build status: " + err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	jsonResp, _ := json.Marshal(router.checkBuild(r.Context(), index))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResp)
+}
+
+// CancelBuildHandler stops the build of the index on every shard
+func (router *Router) CancelBuildHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET", "POST":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println("Cancel build: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !router.cancelBuild(r.Context(), index) {
+			router.Logger.Warn.Println("Cancel build: no running build found on the shards")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// GetIndexSizeHandler returns the total size of the index over the shards
+func (router *Router) GetIndexSizeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	index, err := router.getIndex(r)
+	if err != nil {
+		router.Logger.Err.Println("Checking index size: " + err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	size, err := router.getIndexSize(r.Context(), index)
+	if err != nil {
+		router.Logger.Err.Println("Checking index size: " + err.Error())
+		w.WriteHeader(getErrorStatus(err))
+		return
+	}
+	jsonResp, _ := json.Marshal(cm.ResponseData{Results: size})
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResp)
+}
+
+// ShardsHealthHandler returns the health of every replica of every shard, of all the indexes unless
+// the index is selected; unhealthy replicas make the status 503
+func (router *Router) ShardsHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		indexes, err := router.getIndexes(r)
+		if err != nil {
+			router.Logger.Err.Println("Shards health: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		health := router.getShardsHealth(r.Context(), indexes)
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: health})
+		if err != nil {
+			router.Logger.Err.Println("Shards health: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		status := http.StatusOK
+		for _, replica := range health {
+			if !replica.Healthy {
+				router.Logger.Warn.Printf("Shards health: %s: %s", replica.Shard, replica.Error)
+				status = http.StatusServiceUnavailable
+			}
+		}
+		w.WriteHeader(status)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// PopHashHandler drops the point from the shard owning it
+// curl -v http://localhost:8090/pop-hash?id=42&index=main
+func (router *Router) PopHashHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println("Pop hash record: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ids, ok := r.URL.Query()["id"]
+		if !ok || len(ids) == 0 {
+			router.Logger.Err.Println("Pop hash record: object id must be specified")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseUint(ids[0], 10, 64)
+		if err != nil {
+			router.Logger.Err.Println("Pop hash record: cannot convert id to uint64 type")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		shard := index.shards[index.ring.GetShard(id)]
+		_, err = router.request(r.Context(), shard, "GET", "/pop-hash?id="+ids[0], nil, nil)
+		if err != nil {
+			router.Logger.Err.Println("Pop hash record: " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// PutHashHandler puts the points to the shards owning them
+// curl -v -X POST -H "Content-Type: application/json" -d '[{"secondaryId":42, "vec":[...]}]' http://localhost:8090/put-hash?index=main
+func (router *Router) PutHashHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println("Put hash record: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			router.Logger.Err.Println("Put hash record: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input []cm.RequestData
+		err = json.Unmarshal(body, &input)
+		if err != nil || len(input) == 0 {
+			router.Logger.Err.Println("Put hash record: points must be specified")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		groups := index.groupByShard(input)
+		errs := index.fanOut(func(shard int) error {
+			if len(groups[shard]) == 0 {
+				return nil
+			}
+			body, err := json.Marshal(groups[shard])
+			if err != nil {
+				return err
+			}
+			_, err = router.request(r.Context(), index.shards[shard], "POST", "/put-hash", nil, body)
+			return err
+		})
+		if err := getFirstError(errs); err != nil {
+			router.Logger.Err.Println("Put hash record: " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// GetNeighborsHandler queries all the shards of the index and returns their neighbors merged by distance;
+// neighbors are streamed as NDJSON if the client accepts it
+func (router *Router) GetNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println("Get NN: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			router.Logger.Err.Println("Get NN: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input cm.RequestData
+		err = json.Unmarshal(body, &input)
+		if err != nil {
+			router.Logger.Err.Println("Get NN: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result, err := router.getNeighbors(r.Context(), index, body)
+		if err != nil {
+			router.Logger.Err.Println("Get NN: " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		if isStreamRequested(r) {
+			router.streamNeighbors(w, result)
+			return
+		}
+
+		neighborsIDs := make([]uint64, len(result.neighbors))
+		for i, neighbor := range result.neighbors {
+			neighborsIDs[i] = neighbor.SecondaryID
+		}
+		jsonResp, err := json.Marshal(cm.ResponseData{
+			Results:    neighborsIDs,
+			Strategy:   result.trailer.Strategy,
+			Partial:    result.trailer.Partial,
+			StopReason: result.trailer.StopReason,
+		})
+		if err != nil {
+			router.Logger.Err.Println("Get NN: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// GetRangeHandler returns the page of all the neighbors within the radius of the request of all the shards,
+// merged by distance, or streams all of them as NDJSON if the client accepts it
+// curl -v -X POST -H "Content-Type: application/json" -d '{"vec":[...],"radius":0.5}' http://localhost:8090/get-range?index=main
+func (router *Router) GetRangeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			router.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input cm.RequestData
+		err = json.Unmarshal(body, &input)
+		if err != nil {
+			router.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if isStreamRequested(r) {
+			router.streamRange(r.Context(), w, index, body)
+			return
+		}
+		states := make(map[string]rangeShardState)
+		if len(input.Token) != 0 {
+			states, err = decodeRangeToken(input.Token)
+			if err != nil {
+				router.Logger.Err.Println("Get range: wrong token: " + err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		result, err := router.getRange(r.Context(), index, input, states)
+		if err != nil {
+			router.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		jsonResp, err := json.Marshal(result)
+		if err != nil {
+			router.Logger.Err.Println("Get range: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// CheckDriftHandler returns the drift reports of the shards of the index, keyed by the shard name
+// curl -v http://localhost:8090/check-drift?imbalance=1&index=main
+func (router *Router) CheckDriftHandler(w http.ResponseWriter, r *http.Request) {
+	router.serveShardReports(w, r, "Check drift", "/check-drift")
+}
+
+// BucketsStatsHandler returns the buckets stats of the shards of the index, keyed by the shard name
+// curl -v http://localhost:8090/buckets-stats?top=10&index=main
+func (router *Router) BucketsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	router.serveShardReports(w, r, "Buckets stats", "/buckets-stats")
+}
+
+// serveShardReports passes the request with its query to every shard of the index
+// and returns their results keyed by the shard name
+func (router *Router) serveShardReports(w http.ResponseWriter, r *http.Request, name, path string) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		index, err := router.getIndex(r)
+		if err != nil {
+			router.Logger.Err.Println(name + ": " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reports, err := router.getShardReports(r.Context(), index, path+"?"+r.URL.RawQuery)
+		if err != nil {
+			router.Logger.Err.Println(name + ": " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: reports})
+		if err != nil {
+			router.Logger.Err.Println(name + ": " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+// MetricsHandler returns the metrics of every replica of every shard, of all the indexes unless
+// the index is selected, keyed by the replica; the metrics are counted by every server on its own
+func (router *Router) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		indexes, err := router.getIndexes(r)
+		if err != nil {
+			router.Logger.Err.Println("Metrics: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		metrics, err := router.getReplicasMetrics(r.Context(), indexes)
+		if err != nil {
+			router.Logger.Err.Println("Metrics: " + err.Error())
+			w.WriteHeader(getErrorStatus(err))
+			return
+		}
+		jsonResp, err := json.Marshal(cm.ResponseData{Results: metrics})
+		if err != nil {
+			router.Logger.Err.Println("Metrics: " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResp)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"net/http"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+)
+
+// Config holds the topology of the cluster: the named indexes, each one split into the shards,
+// and the addresses of the ANN servers serving every shard
+type Config struct {
+	Address       string                 `json:"address"`
+	Timeout       int                    `json:"timeout"`       // timeout of the single shard request in milliseconds, 0 means no timeout
+	Retries       int                    `json:"retries"`       // number of the other replicas tried after the failed request
+	MaxNN         int                    `json:"maxNN"`         // number of the merged neighbors returned, 0 keeps all of them
+	RangePageSize int                    `json:"rangePageSize"` // number of the merged range neighbors per page, 1000 if not set
+	DefaultIndex  string                 `json:"defaultIndex"`
+	Indexes       map[string]IndexConfig `json:"indexes"`
+}
+
+// IndexConfig lists the shards of the index; points are split between the shards by the hash ring
+type IndexConfig struct {
+	Shards []ShardConfig `json:"shards"`
+}
+
+// ShardConfig lists the addresses of the servers which share the storage of the shard
+type ShardConfig struct {
+	Name     string   `json:"name"`
+	Replicas []string `json:"replicas"`
+}
+
+// Router fronts the ANN servers of the cluster with the same HTTP API: writes go to the shards
+// owning the points, queries are fanned out to all the shards of the index and their results are merged
+type Router struct {
+	Config  Config
+	Logger  *cm.Logger
+	Client  http.Client
+	indexes map[string]*routedIndex
+}
+
+// routedIndex holds the shards of the index and the ring mapping the points to them
+type routedIndex struct {
+	name   string
+	shards []*routedShard
+	ring   db.HashRing
+}
+
+// routedShard holds the replicas of the shard; requests are spread between them round-robin
+type routedShard struct {
+	name     string
+	replicas []string
+	next     uint32
+}
+
+// shardError is the failed request to the shard: the status is zero if no replica has answered
+type shardError struct {
+	shard  string
+	status int
+	err    error
+}
+
+// shardNeighbors holds the neighbors streamed by the shard along with the trailer
+type shardNeighbors struct {
+	neighbors []cm.NeighborsRecord
+	trailer   cm.StreamRecord
+}
+
+// shardRangePage is the page of the range search results of the shard
+type shardRangePage struct {
+	Results  []cm.NeighborsRecord `json:"neighbors"`
+	Token    string               `json:"token"`
+	Strategy string               `json:"strategy"`
+}
+
+// rangeShardState is the position of the range search on the shard, kept in the token of the router page:
+// the token of the shard page and the number of its neighbors already returned by the router
+type rangeShardState struct {
+	Token string `json:"token,omitempty"`
+	Skip  int    `json:"skip,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+}
+
+// shardBuildStatus is the build status reported by the shard
+type shardBuildStatus struct {
+	Results  int               `json:"neighbors"`
+	Message  string            `json:"message"`
+	Progress *cm.BuildProgress `json:"progress"`
+}
@@ -0,0 +1,401 @@
+package router_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"lsh-search-service/app"
+	"lsh-search-service/app/apptest"
+	cl "lsh-search-service/client"
+	cm "lsh-search-service/common"
+	"lsh-search-service/db"
+	"lsh-search-service/router"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	testVecs = append(apptest.GetVecs(),
+		cm.RequestData{SecondaryID: 5, Vec: []float64{-1.0, 0.0, 0.0}},
+		cm.RequestData{SecondaryID: 6, Vec: []float64{0.0, -1.0, 0.0}},
+		cm.RequestData{SecondaryID: 7, Vec: []float64{0.0, 0.0, -1.0}},
+		cm.RequestData{SecondaryID: 8, Vec: []float64{-1.0, -1.0, -1.0}},
+	)
+	testStats = apptest.GetStats()
+)
+
+// testShard is the shard of the cluster: the in-memory store shared by the replicas of the ANN server
+type testShard struct {
+	store    db.VectorStore
+	replicas []*httptest.Server
+}
+
+// newTestShard starts the replicas of the shard, the index is built before unless it's built by the router
+func newTestShard(t *testing.T, replicas int, isBuilt bool) *testShard {
+	config := apptest.GetConfig()
+	shard := &testShard{store: db.NewMemoryStore(config.Db)}
+	for i := 0; i < replicas; i++ {
+		annServer, err := app.NewANNServerWithStore(apptest.GetLogger(), config, shard.store)
+		if err != nil {
+			t.Fatalf("Could not create server: %v", err)
+		}
+		if isBuilt && i == 0 {
+			err = annServer.BuildIndex(context.Background(), testStats)
+			if err != nil {
+				t.Fatalf("Could not build index: %v", err)
+			}
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", app.HealthCheck)
+		mux.HandleFunc("/build-index", annServer.BuildHasherHandler)
+		mux.HandleFunc("/check-build", annServer.CheckBuildHandler)
+		mux.HandleFunc("/cancel-build", annServer.CancelBuildHandler)
+		mux.HandleFunc("/get-nn", annServer.GetNeighborsHandler)
+		mux.HandleFunc("/get-range", annServer.GetRangeHandler)
+		mux.HandleFunc("/check-drift", annServer.CheckDriftHandler)
+		mux.HandleFunc("/buckets-stats", annServer.BucketsStatsHandler)
+		mux.HandleFunc("/metrics", annServer.MetricsHandler)
+		mux.HandleFunc("/get-index-size", annServer.GetHashCollSizeHandler)
+		mux.HandleFunc("/pop-hash", annServer.PopHashRecordHandler)
+		mux.HandleFunc("/put-hash", annServer.PutHashRecordHandler)
+		mux.HandleFunc("/shards-health", annServer.ShardsHealthHandler)
+		shard.replicas = append(shard.replicas, httptest.NewServer(mux))
+	}
+	return shard
+}
+
+func (shard *testShard) close() {
+	for _, replica := range shard.replicas {
+		replica.Close()
+	}
+}
+
+func (shard *testShard) getConfig(name string) router.ShardConfig {
+	config := router.ShardConfig{Name: name}
+	for _, replica := range shard.replicas {
+		config.Replicas = append(config.Replicas, replica.URL)
+	}
+	return config
+}
+
+func (shard *testShard) getSize(t *testing.T) int64 {
+	helperRecord, err := shard.store.GetHelperRecord(false)
+	if err != nil {
+		t.Fatalf("Could not read helper record: %v", err)
+	}
+	size, err := shard.store.GetCollSize(helperRecord.HashCollName)
+	if err != nil {
+		t.Fatalf("Could not get index size: %v", err)
+	}
+	return size
+}
+
+// getDeadReplica returns the address of the stopped server
+func getDeadReplica() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func newTestRouter(t *testing.T, config router.Config) *httptest.Server {
+	annRouter, err := router.New(apptest.GetLogger(), config)
+	if err != nil {
+		t.Fatalf("Could not create router: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", router.HealthCheck)
+	mux.HandleFunc("/build-index", annRouter.BuildIndexHandler)
+	mux.HandleFunc("/check-build", annRouter.CheckBuildHandler)
+	mux.HandleFunc("/cancel-build", annRouter.CancelBuildHandler)
+	mux.HandleFunc("/get-nn", annRouter.GetNeighborsHandler)
+	mux.HandleFunc("/get-range", annRouter.GetRangeHandler)
+	mux.HandleFunc("/check-drift", annRouter.CheckDriftHandler)
+	mux.HandleFunc("/buckets-stats", annRouter.BucketsStatsHandler)
+	mux.HandleFunc("/metrics", annRouter.MetricsHandler)
+	mux.HandleFunc("/get-index-size", annRouter.GetIndexSizeHandler)
+	mux.HandleFunc("/pop-hash", annRouter.PopHashHandler)
+	mux.HandleFunc("/put-hash", annRouter.PutHashHandler)
+	mux.HandleFunc("/shards-health", annRouter.ShardsHealthHandler)
+	return httptest.NewServer(mux)
+}
+
+func doTestRequest(t *testing.T, method, url string, request, target interface{}) int {
+	var body []byte
+	if request != nil {
+		body, _ = json.Marshal(request)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request to %s has failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if target != nil && resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(target)
+		if err != nil {
+			t.Fatalf("Could not decode response of %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitTestBuild waits until the build of all the shards is done
+func waitTestBuild(t *testing.T, url string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var resp struct {
+			Results int    `json:"neighbors"`
+			Message string `json:"message"`
+		}
+		doTestRequest(t, "GET", url+"/check-build", nil, &resp)
+		if resp.Results == cm.BuildStatusDone {
+			return
+		}
+		if resp.Results == cm.BuildStatusError {
+			t.Fatalf("Build has failed: %s", resp.Message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Build of all the shards must finish")
+}
+
+type testNeighborsResponse struct {
+	Results    []uint64 `json:"neighbors"`
+	Partial    bool     `json:"partial"`
+	StopReason string   `json:"stopReason"`
+}
+
+func getTestNeighbors(t *testing.T, url string, request cm.RequestData) (testNeighborsResponse, int) {
+	var resp testNeighborsResponse
+	status := doTestRequest(t, "POST", url+"/get-nn", request, &resp)
+	return resp, status
+}
+
+func getTestIndexSize(t *testing.T, url string) int64 {
+	var resp struct {
+		Results int64 `json:"neighbors"`
+	}
+	status := doTestRequest(t, "GET", url+"/get-index-size", nil, &resp)
+	if status != http.StatusOK {
+		t.Fatalf("Get index size returned status %v", status)
+	}
+	return resp.Results
+}
+
+func TestRouter(t *testing.T) {
+	shards := []*testShard{newTestShard(t, 2, true), newTestShard(t, 2, true)}
+	defer shards[0].close()
+	defer shards[1].close()
+	// NOTE: the dead replica of the first shard makes every other request to it retried
+	shardConfigs := []router.ShardConfig{shards[0].getConfig("shard0"), shards[1].getConfig("shard1")}
+	shardConfigs[0].Replicas = append(shardConfigs[0].Replicas, getDeadReplica())
+	server := newTestRouter(t, router.Config{
+		Retries: 2,
+		MaxNN:   apptest.GetConfig().App.MaxNN,
+		Indexes: map[string]router.IndexConfig{"main": {Shards: shardConfigs}},
+	})
+	defer server.Close()
+
+	if status := doTestRequest(t, "POST", server.URL+"/put-hash", testVecs, nil); status != http.StatusOK {
+		t.Fatalf("Put hash returned status %v", status)
+	}
+	size0, size1 := shards[0].getSize(t), shards[1].getSize(t)
+	if size0 == 0 || size1 == 0 || size0+size1 != int64(len(testVecs)) {
+		t.Fatalf("Points must be split between the shards: %v %v", size0, size1)
+	}
+	if size := getTestIndexSize(t, server.URL); size != int64(len(testVecs)) {
+		t.Fatalf("Index size must be summed over the shards: %v", size)
+	}
+
+	for _, vec := range testVecs {
+		resp, status := getTestNeighbors(t, server.URL, cm.RequestData{Vec: vec.Vec})
+		if status != http.StatusOK || len(resp.Results) == 0 || resp.Results[0] != vec.SecondaryID || resp.Partial {
+			t.Fatalf("Neighbors of all the shards must be merged by distance: %v %+v", status, resp)
+		}
+		resp, _ = getTestNeighbors(t, server.URL, cm.RequestData{Vec: vec.Vec, Exact: true})
+		if len(resp.Results) != len(testVecs) || resp.Results[0] != vec.SecondaryID {
+			t.Fatalf("Exact scan must cover all the shards: %+v", resp)
+		}
+	}
+
+	status := doTestRequest(t, "GET", server.URL+"/pop-hash?id="+strconv.FormatUint(testVecs[0].SecondaryID, 10), nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("Pop hash returned status %v", status)
+	}
+	if size := getTestIndexSize(t, server.URL); size != int64(len(testVecs)-1) {
+		t.Fatalf("Point must be dropped from its shard: %v", size)
+	}
+
+	var health struct {
+		Results []cm.ShardHealth `json:"neighbors"`
+	}
+	resp, err := http.Get(server.URL + "/shards-health")
+	if err != nil {
+		t.Fatalf("Shards health has failed: %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || len(health.Results) != 5 {
+		t.Fatalf("Every replica must report its health: %v %+v", resp.StatusCode, health.Results)
+	}
+	unhealthy := 0
+	for _, replica := range health.Results {
+		if !replica.Healthy {
+			unhealthy++
+		}
+	}
+	if unhealthy != 1 {
+		t.Fatalf("Only the dead replica must be unhealthy: %+v", health.Results)
+	}
+}
+
+func TestRouterShardUnavailable(t *testing.T) {
+	shard := newTestShard(t, 1, true)
+	defer shard.close()
+	server := newTestRouter(t, router.Config{
+		Retries: 1,
+		Indexes: map[string]router.IndexConfig{
+			"main": {Shards: []router.ShardConfig{
+				shard.getConfig("shard0"),
+				{Name: "shard1", Replicas: []string{getDeadReplica()}},
+			}},
+			"dead": {Shards: []router.ShardConfig{
+				{Name: "shard0", Replicas: []string{getDeadReplica()}},
+			}},
+		},
+		DefaultIndex: "main",
+	})
+	defer server.Close()
+
+	if status := doTestRequest(t, "POST", server.URL+"/build-index?index=dead", testStats, nil); status != http.StatusBadGateway {
+		t.Fatalf("Build must fail if the shard is unavailable: %v", status)
+	}
+	if status := doTestRequest(t, "POST", shard.replicas[0].URL+"/put-hash", testVecs, nil); status != http.StatusOK {
+		t.Fatalf("Put hash returned status %v", status)
+	}
+	resp, status := getTestNeighbors(t, server.URL, cm.RequestData{Vec: testVecs[0].Vec})
+	if status != http.StatusOK || len(resp.Results) == 0 || resp.Results[0] != testVecs[0].SecondaryID {
+		t.Fatalf("Neighbors of the available shards must be returned: %v %+v", status, resp)
+	}
+	if !resp.Partial || resp.StopReason != cm.StopReasonShardUnavailable {
+		t.Fatalf("Neighbors must be partial if the shard is unavailable: %+v", resp)
+	}
+
+	status = doTestRequest(t, "POST", server.URL+"/get-nn?index=dead", cm.RequestData{Vec: testVecs[0].Vec}, nil)
+	if status != http.StatusBadGateway {
+		t.Fatalf("Query must fail if all the shards are unavailable: %v", status)
+	}
+	status = doTestRequest(t, "POST", server.URL+"/get-nn?index=unknown", cm.RequestData{Vec: testVecs[0].Vec}, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Unknown index must be rejected: %v", status)
+	}
+}
+
+func TestRouterBuild(t *testing.T) {
+	shards := []*testShard{newTestShard(t, 2, false), newTestShard(t, 1, false)}
+	defer shards[0].close()
+	defer shards[1].close()
+	server := newTestRouter(t, router.Config{
+		Indexes: map[string]router.IndexConfig{
+			"main": {Shards: []router.ShardConfig{shards[0].getConfig("shard0"), shards[1].getConfig("shard1")}},
+		},
+	})
+	defer server.Close()
+
+	if status := doTestRequest(t, "POST", server.URL+"/build-index", testStats, nil); status != http.StatusOK {
+		t.Fatalf("Build index returned status %v", status)
+	}
+	waitTestBuild(t, server.URL)
+	for _, shard := range shards {
+		helperRecord, _ := shard.store.GetHelperRecord(false)
+		if !helperRecord.IsBuildDone || len(helperRecord.HashCollName) == 0 {
+			t.Fatalf("Build must be started on every shard: %+v", helperRecord)
+		}
+	}
+	if status := doTestRequest(t, "POST", server.URL+"/cancel-build", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("Cancel must find no running build: %v", status)
+	}
+}
+
+type testRangeResponse struct {
+	Results []cm.NeighborsRecord `json:"neighbors"`
+	Token   string               `json:"token"`
+}
+
+func TestRouterRange(t *testing.T) {
+	shards := []*testShard{newTestShard(t, 2, true), newTestShard(t, 1, true)}
+	defer shards[0].close()
+	defer shards[1].close()
+	server := newTestRouter(t, router.Config{
+		Indexes: map[string]router.IndexConfig{
+			"main": {Shards: []router.ShardConfig{shards[0].getConfig("shard0"), shards[1].getConfig("shard1")}},
+		},
+	})
+	defer server.Close()
+	if status := doTestRequest(t, "POST", server.URL+"/put-hash", testVecs, nil); status != http.StatusOK {
+		t.Fatalf("Put hash returned status %v", status)
+	}
+
+	// NOTE: pages are smaller than the shards, so the neighbors left out of the page are asked again
+	request := cm.RequestData{Vec: testVecs[0].Vec, Radius: 10, PageSize: 3, Exact: true}
+	var neighbors []cm.NeighborsRecord
+	for pages := 0; pages == 0 || len(request.Token) != 0; pages++ {
+		if pages > len(testVecs) {
+			t.Fatal("Range pages must end")
+		}
+		var resp testRangeResponse
+		status := doTestRequest(t, "POST", server.URL+"/get-range", request, &resp)
+		if status != http.StatusOK || len(resp.Results) > request.PageSize {
+			t.Fatalf("Get range returned status %v: %+v", status, resp)
+		}
+		neighbors = append(neighbors, resp.Results...)
+		request.Token = resp.Token
+	}
+	seen := make(map[uint64]bool)
+	for i, neighbor := range neighbors {
+		if seen[neighbor.SecondaryID] || (i > 0 && neighbor.Dist < neighbors[i-1].Dist) {
+			t.Fatalf("Pages of all the shards must be merged by distance without repeats: %v", neighbors)
+		}
+		seen[neighbor.SecondaryID] = true
+	}
+	if len(neighbors) != len(testVecs) || neighbors[0].SecondaryID != testVecs[0].SecondaryID {
+		t.Fatalf("Pages must hold the neighbors of all the shards: %v", neighbors)
+	}
+	request.Token = "wrong"
+	if status := doTestRequest(t, "POST", server.URL+"/get-range", request, nil); status != http.StatusBadRequest {
+		t.Fatalf("Wrong token must be rejected: %v", status)
+	}
+
+	client := cl.New(cl.Config{ServerAddress: server.URL})
+	request.Token = ""
+	it, err := client.StreamRange(request)
+	if err != nil {
+		t.Fatalf("Could not stream range: %v", err)
+	}
+	streamed := 0
+	for it.Next() {
+		if !seen[it.Neighbor().SecondaryID] {
+			t.Fatalf("Streamed neighbor must be within the radius: %+v", it.Neighbor())
+		}
+		streamed++
+	}
+	if it.Err() != nil || streamed != len(testVecs) || len(it.Strategy()) == 0 {
+		t.Fatalf("Stream must hold the neighbors of all the shards: %v %v", streamed, it.Err())
+	}
+
+	var reports struct {
+		Results map[string]json.RawMessage `json:"neighbors"`
+	}
+	for _, path := range []string{"/check-drift", "/buckets-stats", "/metrics"} {
+		reports.Results = nil
+		if status := doTestRequest(t, "GET", server.URL+path, nil, &reports); status != http.StatusOK {
+			t.Fatalf("%s returned status %v", path, status)
+		}
+		if (path == "/metrics" && len(reports.Results) != 3) || (path != "/metrics" && len(reports.Results) != 2) {
+			t.Fatalf("%s must report every shard: %v", path, reports.Results)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	cm "lsh-search-service/common"
+	"lsh-search-service/router"
+)
+
+var (
+	routerConfig = os.Getenv("ROUTER_CONFIG")
+)
+
+func main() {
+	logger := cm.GetNewLogger()
+	if len(routerConfig) == 0 {
+		routerConfig = "router.json"
+	}
+	config, err := router.ReadConfig(routerConfig)
+	if err != nil {
+		logger.Err.Fatal(err.Error())
+	}
+	if len(config.Address) == 0 {
+		config.Address = ":8090"
+	}
+	annRouter, err := router.New(logger, config)
+	if err != nil {
+		logger.Err.Fatal(err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", router.HealthCheck)
+	mux.HandleFunc("/build-index", annRouter.BuildIndexHandler)
+	mux.HandleFunc("/check-build", annRouter.CheckBuildHandler)
+	mux.HandleFunc("/cancel-build", annRouter.CancelBuildHandler)
+	mux.HandleFunc("/get-nn", annRouter.GetNeighborsHandler)
+	mux.HandleFunc("/get-range", annRouter.GetRangeHandler)
+	mux.HandleFunc("/check-drift", annRouter.CheckDriftHandler)
+	mux.HandleFunc("/buckets-stats", annRouter.BucketsStatsHandler)
+	mux.HandleFunc("/metrics", annRouter.MetricsHandler)
+	mux.HandleFunc("/get-index-size", annRouter.GetIndexSizeHandler)
+	mux.HandleFunc("/pop-hash", annRouter.PopHashHandler)
+	mux.HandleFunc("/put-hash", annRouter.PutHashHandler)
+	mux.HandleFunc("/shards-health", annRouter.ShardsHealthHandler)
+	http.Handle("/", cm.Decorate(mux, cm.Timer(logger)))
+	if err := http.ListenAndServe(config.Address, nil); err != nil {
+		logger.Err.Fatalf("Error running the router: %v", err)
+	}
+}